@@ -0,0 +1,916 @@
+package rediqueue
+
+// Append-only file. Every change to a database is written to the file as a
+// Redis command (in RESP) with the same effect. On start the file is replayed.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FsyncPolicy says how often the append-only file is fsync()ed.
+type FsyncPolicy int
+
+const (
+	// FsyncEverySec fsyncs once a second. This is the default.
+	FsyncEverySec FsyncPolicy = iota
+	// FsyncAlways fsyncs after every change.
+	FsyncAlways
+	// FsyncNo leaves it to the OS.
+	FsyncNo
+)
+
+// String gives the name as used in the config file.
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncNo:
+		return "no"
+	default:
+		return "everysec"
+	}
+}
+
+// ParseFsyncPolicy parses "always", "everysec", or "no".
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	default:
+		return 0, fmt.Errorf("invalid fsync policy: %q", s)
+	}
+}
+
+var (
+	// ErrBadAOF is returned when the append-only file can't be parsed.
+	ErrBadAOF = errors.New("invalid append-only file")
+	// ErrAOFDisabled is returned by RewriteAOF without an append-only file.
+	ErrAOFDisabled = errors.New("ERR append only file is not enabled")
+	// ErrAOFRewriteInProgress is returned by RewriteAOF when a rewrite is
+	// already running.
+	ErrAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+)
+
+// appendOnly is the open append-only file. All methods need the RediQueue
+// lock.
+type appendOnly struct {
+	m          *RediQueue
+	filename   string
+	f          *os.File
+	policy     FsyncPolicy
+	db         int  // last SELECTed db, -1 if unknown
+	dirty      bool // written but not fsync()ed
+	err        error
+	stop       chan struct{}
+	size       int64         // current file size
+	baseSize   int64         // file size after the last rewrite
+	rewritePct int           // auto rewrite after this much growth. 0 disables
+	rewriteMin int64         // but not when smaller than this
+	rewriting  bool          // rewrite started or scheduled
+	rewriteBuf *bytes.Buffer // changes during a rewrite. Or nil.
+}
+
+// SetAppendOnly enables the append-only file. It has to be called before the
+// server is started; the file is replayed (or, if it doesn't exist yet,
+// created from the current content) on start. An empty filename disables it.
+// A relative filename is in the data directory, see SetDir().
+func (m *RediQueue) SetAppendOnly(filename string, policy FsyncPolicy) {
+	m.Lock()
+	defer m.Unlock()
+	m.aofFile = filename
+	m.aofPolicy = policy
+}
+
+// SetAutoAOFRewrite configures when the append-only file is rewritten
+// automatically: when it's at least minSize bytes, and has grown percentage
+// percent since the last rewrite. A percentage of 0 disables automatic
+// rewrites. The default is 100% and 64MB.
+func (m *RediQueue) SetAutoAOFRewrite(percentage int, minSize int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.aofRewritePct = percentage
+	m.aofRewriteMin = minSize
+	if m.aof != nil {
+		m.aof.rewritePct = percentage
+		m.aof.rewriteMin = minSize
+	}
+}
+
+// RewriteAOF replaces the append-only file with the smallest set of commands
+// which recreate the current content. Other commands keep running while the
+// new file is written; their changes are added to the new file before it
+// replaces the old one.
+func (m *RediQueue) RewriteAOF() error {
+	m.Lock()
+	a := m.aof
+	if a == nil {
+		m.Unlock()
+		return ErrAOFDisabled
+	}
+	if a.rewriting {
+		m.Unlock()
+		return ErrAOFRewriteInProgress
+	}
+	a.rewriting = true
+	return m.rewriteAOF(a)
+}
+
+// rewriteAOF does the work for RewriteAOF. It's called with the lock held,
+// and a.rewriting set, and it unlocks while writing.
+func (m *RediQueue) rewriteAOF(a *appendOnly) error {
+	var (
+		filename = a.filename
+		dbs      = m.copyDBs()
+	)
+	a.rewriteBuf = &bytes.Buffer{}
+	a.db = -1 // the new file won't have the same db SELECTed
+	m.Unlock()
+
+	tmp, err := writeTempAOF(filename, dbs)
+
+	m.Lock()
+	defer m.Unlock()
+	buf := a.rewriteBuf
+	a.rewriteBuf = nil
+	a.rewriting = false
+	if err != nil {
+		return err
+	}
+	if m.aof != a {
+		// closed while we were busy.
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.New("append only file closed during rewrite")
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	a.f.Close()
+	a.f = tmp
+	a.size = size
+	a.baseSize = size
+	a.dirty = false
+	if a.err != nil {
+		log.Printf("rediqueue append-only file %s: rewritten, logging changes again", filename)
+		a.err = nil
+	}
+	return nil
+}
+
+// writeTempAOF writes the commands to recreate dbs to a new temporary file
+// next to filename. The file is returned open, positioned at the end.
+func writeTempAOF(filename string, dbs map[int]*RedisDB) (*os.File, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".rewrite-")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(tmp)
+	writeAOFState(w, dbs)
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// startAOF replays and opens the append-only file, if configured.
+func (m *RediQueue) startAOF() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.aofFile == "" || m.aof != nil {
+		return nil
+	}
+
+	filename := m.path(m.aofFile)
+	if !m.aofLoaded {
+		if err := m.replayAOF(filename); err != nil {
+			return err
+		}
+		m.aofLoaded = true
+		m.dirty = 0
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a := &appendOnly{
+		m:          m,
+		filename:   filename,
+		f:          f,
+		policy:     m.aofPolicy,
+		db:         -1,
+		stop:       make(chan struct{}),
+		size:       fi.Size(),
+		baseSize:   fi.Size(),
+		rewritePct: m.aofRewritePct,
+		rewriteMin: m.aofRewriteMin,
+	}
+	if a.policy == FsyncEverySec {
+		m.every(time.Second, a.stop, func(time.Time) {
+			if m.aof == a {
+				a.sync()
+			}
+		})
+	}
+	m.setAOF(a)
+	return nil
+}
+
+// stopAOF fsyncs and closes the append-only file. Needs the lock.
+func (m *RediQueue) stopAOF() error {
+	a := m.aof
+	if a == nil {
+		return nil
+	}
+	m.setAOF(nil)
+	close(a.stop)
+	err := a.err
+	if err == nil {
+		err = a.f.Sync()
+	}
+	if e := a.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// setAOF makes all databases log to a, count their changes, and use our
+// time. Needs the lock.
+func (m *RediQueue) setAOF(a *appendOnly) {
+	m.aof = a
+	for _, db := range m.dbs {
+		db.aof = a
+		db.dirty = &m.dirty
+		db.now = m.effectiveNow
+	}
+}
+
+// replayAOF loads the append-only file. If the file doesn't exist it's
+// created with the current content. Needs the lock.
+func (m *RediQueue) replayAOF(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		return m.createAOF(filename)
+	}
+	defer f.Close()
+
+	m.flushAll()
+	n, err := m.readAOF(f)
+	if err == nil {
+		return nil
+	}
+	ce, ok := err.(*CorruptError)
+	if !ok {
+		return err
+	}
+	ce.File = filename
+	if m.recovery == RecoverNone {
+		return err
+	}
+	log.Printf("rediqueue: %v. Loaded the %d commands before it", err, n)
+	f.Close()
+	if m.recovery == RecoverTruncate {
+		log.Printf("rediqueue: truncating %s to %d bytes", filename, ce.Offset)
+		return os.Truncate(filename, ce.Offset)
+	}
+	if err := moveAside(filename); err != nil {
+		return err
+	}
+	return m.createAOF(filename)
+}
+
+// createAOF writes a new append-only file with the current content. Needs the
+// lock.
+func (m *RediQueue) createAOF(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	writeAOFState(w, m.dbs)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeAOFState writes the commands to recreate all databases. Needs the lock.
+func writeAOFState(w *bufio.Writer, dbs map[int]*RedisDB) {
+	for _, id := range sortedDBs(dbs) {
+		db := dbs[id]
+		w.Write(respCommand("SELECT", strconv.Itoa(id)))
+		for _, k := range db.allKeys() {
+			switch db.t(k) {
+			case "string":
+				w.Write(respCommand("SET", k, db.stringKeys[k]))
+			case "hash":
+				w.Write(respCommand(append([]string{"HSET", k}, db.hashPairs(k)...)...))
+			case "list":
+				w.Write(respCommand(append([]string{"RPUSH", k}, db.listKeys[k]...)...))
+			case "set":
+				w.Write(respCommand(append([]string{"SADD", k}, db.setMembers(k)...)...))
+				ttls := db.memberExpire[k]
+				for _, e := range sortedMembers(ttls) {
+					w.Write(respCommand("PSADDEXAT", k, strconv.FormatInt(unixMilli(ttls[e]), 10), e))
+				}
+			case "zset":
+				w.Write(respCommand(append([]string{"ZADD", k}, zsetPairs(db.zsetKeys[k].elems())...)...))
+			case "stream":
+				for _, args := range streamCommands(k, db.streamKeys[k]) {
+					w.Write(respCommand(args...))
+				}
+			}
+			if d, ok := db.expire[k]; ok {
+				w.Write(respCommand("PEXPIREAT", k, strconv.FormatInt(unixMilli(d), 10)))
+			}
+		}
+	}
+}
+
+// log writes a change to the file.
+func (a *appendOnly) log(db int, args []string) {
+	var b []byte
+	if a.db != db {
+		b = respCommand("SELECT", strconv.Itoa(db))
+		a.db = db
+	}
+	b = append(b, respCommand(args...)...)
+	if a.rewriteBuf != nil {
+		// even when the file is broken: the rewrite will fix that.
+		a.rewriteBuf.Write(b)
+	}
+	if a.err != nil {
+		return
+	}
+	if _, err := a.f.Write(b); err != nil {
+		a.fail(err)
+		return
+	}
+	a.size += int64(len(b))
+	a.dirty = true
+	if a.policy == FsyncAlways {
+		a.sync()
+	}
+	if a.needsRewrite() {
+		a.scheduleRewrite()
+	}
+}
+
+// scheduleRewrite starts a rewrite in the background. Since we have the lock
+// it'll only really start once the current command is done.
+func (a *appendOnly) scheduleRewrite() {
+	a.rewriting = true
+	go func() {
+		m := a.m
+		m.Lock()
+		if m.aof != a {
+			// closed in the meantime.
+			a.rewriting = false
+			m.Unlock()
+			return
+		}
+		if err := m.rewriteAOF(a); err != nil {
+			log.Printf("rediqueue append-only file rewrite: %v", err)
+		}
+	}()
+}
+
+// needsRewrite is true if the file has grown enough for an automatic rewrite.
+func (a *appendOnly) needsRewrite() bool {
+	if a.rewriting || a.rewritePct <= 0 || a.size < a.rewriteMin {
+		return false
+	}
+	return a.size >= a.baseSize+a.baseSize*int64(a.rewritePct)/100
+}
+
+func (a *appendOnly) sync() {
+	if !a.dirty || a.err != nil || a.policy == FsyncNo {
+		return
+	}
+	if err := a.f.Sync(); err != nil {
+		a.fail(err)
+		return
+	}
+	a.dirty = false
+}
+
+// fail stops all further writes, until a rewrite replaces the file. A partial
+// log is worse than none.
+func (a *appendOnly) fail(err error) {
+	log.Printf("rediqueue append-only file %s: %v", a.f.Name(), err)
+	a.err = err
+}
+
+// respCommand encodes a command as a RESP array of bulk strings.
+func respCommand(args ...string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return b.Bytes()
+}
+
+// readAOFCommand reads a single RESP array of bulk strings. Returns the
+// command and the number of bytes read. io.EOF means there was nothing left.
+func readAOFCommand(r *bufio.Reader) ([]string, int64, error) {
+	var n int64
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		n += int64(len(line))
+		if err != nil {
+			if err == io.EOF {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if len(line) < 3 || line[len(line)-2] != '\r' {
+			return "", ErrBadAOF
+		}
+		return line[:len(line)-2], nil
+	}
+
+	if _, err := r.Peek(1); err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	line, err := readLine()
+	if err != nil {
+		return nil, n, err
+	}
+	if line[0] != '*' {
+		return nil, n, ErrBadAOF
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 1 {
+		return nil, n, ErrBadAOF
+	}
+	args := make([]string, 0, minUint(uint64(count), 1024))
+	for ; count > 0; count-- {
+		line, err := readLine()
+		if err != nil {
+			return nil, n, err
+		}
+		if line[0] != '$' {
+			return nil, n, ErrBadAOF
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxSnapshotString {
+			return nil, n, ErrBadAOF
+		}
+		buf := make([]byte, length+2)
+		read, err := io.ReadFull(r, buf)
+		n += int64(read)
+		if err != nil {
+			return nil, n, io.ErrUnexpectedEOF
+		}
+		if buf[length] != '\r' || buf[length+1] != '\n' {
+			return nil, n, ErrBadAOF
+		}
+		args = append(args, string(buf[:length]))
+	}
+	return args, n, nil
+}
+
+// applyAOF executes a single command from the append-only file. Returns the
+// db following commands apply to. Needs the lock.
+func (m *RediQueue) applyAOF(db *RedisDB, args []string) (*RedisDB, error) {
+	cmd, args := strings.ToUpper(args[0]), args[1:]
+	argErr := func() error {
+		return fmt.Errorf("%s: %s", ErrBadAOF, errWrongNumber(cmd))
+	}
+	atoi := func(s string) (int, error) {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", ErrBadAOF, msgInvalidInt)
+		}
+		return i, nil
+	}
+	isType := func(k, t string) error {
+		if db.exists(k) && db.t(k) != t {
+			return fmt.Errorf("%s: %s", ErrBadAOF, msgWrongType)
+		}
+		return nil
+	}
+	parseID := func(s string) (streamID, error) {
+		id, err := parseStreamID(s, 0)
+		if err != nil {
+			return id, fmt.Errorf("%s: %s", ErrBadAOF, msgInvalidStreamID)
+		}
+		return id, nil
+	}
+	// group gives the consumer group, or nil.
+	group := func(k, g string) *streamGroup {
+		if s, ok := db.streamKeys[k]; ok {
+			return s.groups[g]
+		}
+		return nil
+	}
+
+	switch cmd {
+	case "SELECT":
+		if len(args) != 1 {
+			return db, argErr()
+		}
+		id, err := atoi(args[0])
+		if err != nil {
+			return db, err
+		}
+		return m.db(id), nil
+	case "FLUSHDB":
+		db.flush()
+	case "FLUSHALL":
+		m.flushAll()
+	case "DEL":
+		for _, k := range args {
+			db.del(k)
+		}
+	case "RENAME":
+		if len(args) != 2 {
+			return db, argErr()
+		}
+		if db.exists(args[0]) {
+			db.rename(args[0], args[1])
+		}
+	case "MOVE":
+		if len(args) != 2 {
+			return db, argErr()
+		}
+		id, err := atoi(args[1])
+		if err != nil {
+			return db, err
+		}
+		db.move(args[0], m.db(id))
+	case "SET":
+		if len(args) != 2 && !(len(args) == 3 && strings.ToUpper(args[2]) == "KEEPTTL") {
+			return db, argErr()
+		}
+		if len(args) == 3 {
+			if err := isType(args[0], "string"); err != nil {
+				return db, err
+			}
+			db.stringUpdate(args[0], args[1])
+		} else {
+			db.stringSet(args[0], args[1])
+		}
+	case "HSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "hash"); err != nil {
+			return db, err
+		}
+		db.hashSet(args[0], args[1:]...)
+	case "HDEL":
+		if len(args) < 2 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "hash"); err != nil {
+			return db, err
+		}
+		db.hashDel(args[0], args[1:]...)
+	case "ZADD":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "zset"); err != nil {
+			return db, err
+		}
+		for i := 1; i < len(args); i += 2 {
+			score, err := parseScore(args[i])
+			if err != nil {
+				return db, fmt.Errorf("%s: %s", ErrBadAOF, msgInvalidFloat)
+			}
+			db.zsetAdd(args[0], score, args[i+1])
+		}
+	case "ZREM":
+		if len(args) < 2 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "zset"); err != nil {
+			return db, err
+		}
+		db.zsetRem(args[0], args[1:]...)
+	case "XADD":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "stream"); err != nil {
+			return db, err
+		}
+		id, err := parseStreamID(args[1], 0)
+		if err != nil {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, msgInvalidStreamID)
+		}
+		if s, ok := db.streamKeys[args[0]]; ok && !s.lastID.less(id) {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, msgStreamIDTooSmall)
+		}
+		db.streamAdd(args[0], id, args[2:])
+	case "XDEL", "XSETID":
+		if len(args) < 2 || (cmd == "XSETID" && len(args) != 2) {
+			return db, argErr()
+		}
+		if err := isType(args[0], "stream"); err != nil {
+			return db, err
+		}
+		var ids []streamID
+		for _, a := range args[1:] {
+			id, err := parseStreamID(a, 0)
+			if err != nil {
+				return db, fmt.Errorf("%s: %s", ErrBadAOF, msgInvalidStreamID)
+			}
+			ids = append(ids, id)
+		}
+		if cmd == "XDEL" {
+			db.streamDel(args[0], ids...)
+		} else {
+			db.streamSetID(args[0], ids[0])
+		}
+	case "XTRIM":
+		if len(args) < 3 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "stream"); err != nil {
+			return db, err
+		}
+		trim, used, msg := parseStreamTrim(args[1:])
+		if msg == "" && used != len(args)-1 {
+			msg = msgSyntaxError
+		}
+		if msg != "" {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, msg)
+		}
+		db.streamTrim(args[0], trim)
+	case "XGROUP":
+		if len(args) < 3 {
+			return db, argErr()
+		}
+		sub, k, g := strings.ToUpper(args[0]), args[1], args[2]
+		if err := isType(k, "stream"); err != nil {
+			return db, err
+		}
+		if _, ok := db.streamKeys[k]; !ok {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, msgKeyNotFound)
+		}
+		if sub != "DESTROY" && len(args) != 4 || sub == "DESTROY" && len(args) != 3 {
+			return db, argErr()
+		}
+		if sub != "CREATE" && sub != "DESTROY" && group(k, g) == nil {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, errNoGroup(k, g))
+		}
+		switch sub {
+		case "CREATE", "SETID":
+			id, err := parseID(args[3])
+			if err != nil {
+				return db, err
+			}
+			if sub == "CREATE" {
+				db.streamGroupCreate(k, g, id)
+			} else {
+				db.streamGroupSetID(k, g, id)
+			}
+		case "DESTROY":
+			db.streamGroupDestroy(k, g)
+		case "CREATECONSUMER":
+			db.streamConsumerCreate(k, g, args[3], m.effectiveNow())
+		case "DELCONSUMER":
+			db.streamConsumerDelete(k, g, args[3])
+		default:
+			return db, fmt.Errorf("%s: unknown XGROUP subcommand '%s'", ErrBadAOF, args[0])
+		}
+	case "XCLAIM":
+		// only the form from xclaimCommand()
+		if len(args) != 11 {
+			return db, argErr()
+		}
+		k, g := args[0], args[1]
+		if err := isType(k, "stream"); err != nil {
+			return db, err
+		}
+		if group(k, g) == nil {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, errNoGroup(k, g))
+		}
+		id, err := parseID(args[4])
+		if err != nil {
+			return db, err
+		}
+		ms, err := strconv.ParseInt(args[6], 10, 64)
+		if err != nil {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, msgInvalidInt)
+		}
+		count, err := atoi(args[8])
+		if err != nil {
+			return db, err
+		}
+		db.streamPendingSet(k, g, streamPending{
+			id:        id,
+			consumer:  args[2],
+			delivered: fromUnixMilli(ms),
+			count:     count,
+		})
+	case "XACK":
+		if len(args) < 3 {
+			return db, argErr()
+		}
+		k, g := args[0], args[1]
+		if err := isType(k, "stream"); err != nil {
+			return db, err
+		}
+		if group(k, g) == nil {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, errNoGroup(k, g))
+		}
+		var ids []streamID
+		for _, a := range args[2:] {
+			id, err := parseID(a)
+			if err != nil {
+				return db, err
+			}
+			ids = append(ids, id)
+		}
+		db.streamAck(k, g, ids...)
+	case "PEXPIREAT":
+		if len(args) != 2 {
+			return db, argErr()
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, msgInvalidInt)
+		}
+		if db.exists(args[0]) {
+			db.setTTL(args[0], fromUnixMilli(ms))
+		}
+	case "PERSIST":
+		if len(args) != 1 {
+			return db, argErr()
+		}
+		db.persist(args[0])
+	case "LPUSH", "RPUSH":
+		if len(args) < 2 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "list"); err != nil {
+			return db, err
+		}
+		for _, v := range args[1:] {
+			if cmd == "LPUSH" {
+				db.listLpush(args[0], v)
+			} else {
+				db.listPush(args[0], v)
+			}
+		}
+	case "LPOP", "RPOP":
+		if len(args) != 1 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "list"); err != nil {
+			return db, err
+		}
+		if !db.exists(args[0]) {
+			break
+		}
+		if cmd == "LPOP" {
+			db.listLpop(args[0])
+		} else {
+			db.listPop(args[0])
+		}
+	case "LINSERT":
+		if len(args) != 4 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "list"); err != nil {
+			return db, err
+		}
+		where := -1
+		if strings.ToUpper(args[1]) == "AFTER" {
+			where = 1
+		}
+		db.listInsert(args[0], where, args[2], args[3])
+	case "LSET":
+		if len(args) != 3 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "list"); err != nil {
+			return db, err
+		}
+		i, err := atoi(args[1])
+		if err != nil {
+			return db, err
+		}
+		if i < 0 || i >= len(db.listKeys[args[0]]) {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, msgOutOfRange)
+		}
+		db.listSet(args[0], i, args[2])
+	case "LREM":
+		if len(args) != 3 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "list"); err != nil {
+			return db, err
+		}
+		count, err := atoi(args[1])
+		if err != nil {
+			return db, err
+		}
+		if db.exists(args[0]) {
+			db.listRem(args[0], count, args[2])
+		}
+	case "LTRIM":
+		if len(args) != 3 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "list"); err != nil {
+			return db, err
+		}
+		start, err := atoi(args[1])
+		if err != nil {
+			return db, err
+		}
+		end, err := atoi(args[2])
+		if err != nil {
+			return db, err
+		}
+		if db.exists(args[0]) {
+			db.listTrim(args[0], start, end)
+		}
+	case "PSADDEXAT":
+		if len(args) < 3 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "set"); err != nil {
+			return db, err
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return db, fmt.Errorf("%s: %s", ErrBadAOF, msgInvalidInt)
+		}
+		db.setAddTTL(args[0], fromUnixMilli(ms), args[2:]...)
+	case "SPERSIST":
+		if len(args) != 2 {
+			return db, argErr()
+		}
+		db.setPersist(args[0], args[1])
+	case "SADD", "SREM":
+		if len(args) < 2 {
+			return db, argErr()
+		}
+		if err := isType(args[0], "set"); err != nil {
+			return db, err
+		}
+		if cmd == "SADD" {
+			db.setAdd(args[0], args[1:]...)
+		} else {
+			db.setRem(args[0], args[1:]...)
+		}
+	default:
+		return db, fmt.Errorf("%s: unknown command '%s'", ErrBadAOF, strings.ToLower(cmd))
+	}
+	return db, nil
+}
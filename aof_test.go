@@ -0,0 +1,324 @@
+package rediqueue
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestAOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "appendonly.aof")
+
+	s := NewRediQueue()
+	s.Push("existing", "before")
+	s.SetAppendOnly(filename, FsyncAlways)
+	ok(t, s.Start())
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	_, err = c.Do("RPUSH", "queue", "a", "b", "c", "d")
+	ok(t, err)
+	_, err = c.Do("LPOP", "queue")
+	ok(t, err)
+	v, err := redis.Strings(c.Do("BLPOP", "queue", 1))
+	ok(t, err)
+	equals(t, []string{"queue", "b"}, v)
+	_, err = c.Do("LSET", "queue", -1, "D")
+	ok(t, err)
+	_, err = c.Do("LINSERT", "queue", "BEFORE", "D", "c2")
+	ok(t, err)
+	_, err = c.Do("SADD", "seen", "x", "y", "z")
+	ok(t, err)
+	_, err = c.Do("SPOP", "seen")
+	ok(t, err)
+	_, err = c.Do("SELECT", 2)
+	ok(t, err)
+	_, err = c.Do("RPUSH", "other", "1")
+	ok(t, err)
+	_, err = c.Do("MULTI")
+	ok(t, err)
+	_, err = c.Do("RPOPLPUSH", "other", "moved")
+	ok(t, err)
+	_, err = c.Do("RENAME", "moved", "renamed")
+	ok(t, err)
+	_, err = c.Do("EXEC")
+	ok(t, err)
+	_, err = c.Do("RPUSH", "gone", "1")
+	ok(t, err)
+	_, err = c.Do("MOVE", "gone", 3)
+	ok(t, err)
+	c.Close()
+
+	members, err := s.Members("seen")
+	ok(t, err)
+	s.Close()
+
+	s2 := NewRediQueue()
+	s2.SetAppendOnly(filename, FsyncEverySec)
+	ok(t, s2.Start())
+	defer s2.Close()
+	s2.CheckList(t, "existing", "before")
+	s2.CheckList(t, "queue", "c", "c2", "D")
+	s2.CheckSet(t, "seen", members...)
+	equals(t, []string{"renamed"}, s2.DB(2).Keys())
+	l, err := s2.DB(2).List("renamed")
+	ok(t, err)
+	equals(t, []string{"1"}, l)
+	equals(t, []string{"gone"}, s2.DB(3).Keys())
+
+	// Direct changes are logged as well.
+	s2.Lpop("queue")
+	s2.Close()
+	ok(t, s2.Start())
+	s2.CheckList(t, "queue", "c2", "D")
+}
+
+func TestAOFReplay(t *testing.T) {
+	s := NewRediQueue()
+	s.SetTime(time.Date(2020, 1, 1, 11, 59, 0, 0, time.UTC))
+
+	var buf bytes.Buffer
+	buf.Write(respCommand("RPUSH", "l", "a", "b"))
+	buf.Write(respCommand("SET", "str", "a"))
+	buf.Write(respCommand("PEXPIREAT", "str", "1577880000000"))
+	buf.Write(respCommand("SET", "str", "b", "KEEPTTL"))
+	buf.Write(respCommand("RENAME", "str", "str"))
+	buf.Write(respCommand("HSET", "h", "a", "1", "b", "2"))
+	buf.Write(respCommand("HDEL", "h", "a"))
+	buf.Write(respCommand("ZADD", "z", "1", "a", "2.5", "b", "-inf", "c"))
+	buf.Write(respCommand("ZREM", "z", "a"))
+	buf.Write(respCommand("XADD", "x", "1-0", "a", "1"))
+	buf.Write(respCommand("XADD", "x", "2-0", "b", "2"))
+	buf.Write(respCommand("XADD", "x", "3-0", "c", "3"))
+	buf.Write(respCommand("XDEL", "x", "2-0"))
+	buf.Write(respCommand("XTRIM", "x", "MAXLEN", "1"))
+	buf.Write(respCommand("XSETID", "x", "8-0"))
+	buf.Write(respCommand("XGROUP", "CREATE", "x", "g", "0-0"))
+	buf.Write(respCommand("XGROUP", "CREATE", "x", "gone", "0-0"))
+	buf.Write(respCommand("XGROUP", "DESTROY", "x", "gone"))
+	buf.Write(respCommand("XGROUP", "SETID", "x", "g", "3-0"))
+	buf.Write(respCommand("XGROUP", "CREATECONSUMER", "x", "g", "alice"))
+	buf.Write(respCommand("XGROUP", "CREATECONSUMER", "x", "g", "bob"))
+	buf.Write(respCommand(xclaimCommand("x", "g", streamPending{id: streamID{3, 0}, consumer: "bob", delivered: time.Unix(100, 0), count: 2})...))
+	buf.Write(respCommand(xclaimCommand("x", "g", streamPending{id: streamID{1, 0}, consumer: "bob", delivered: time.Unix(100, 0), count: 1})...))
+	buf.Write(respCommand("XACK", "x", "g", "1-0"))
+	buf.Write(respCommand("XGROUP", "DELCONSUMER", "x", "g", "alice"))
+	buf.Write(respCommand("SELECT", "1"))
+	buf.Write(respCommand("SADD", "s", "a"))
+	buf.Write(respCommand("PEXPIREAT", "s", "1577880000000"))
+	buf.Write(respCommand("SADD", "p", "a"))
+	buf.Write(respCommand("PEXPIREAT", "p", "1577880000000"))
+	buf.Write(respCommand("PERSIST", "p"))
+	r := bufio.NewReader(&buf)
+	db := s.db(0)
+	for {
+		args, _, err := readAOFCommand(r)
+		if err != nil {
+			break
+		}
+		db, err = s.applyAOF(db, args)
+		ok(t, err)
+	}
+	s.CheckList(t, "l", "a", "b")
+	s.CheckGet(t, "str", "b")
+	s.CheckHash(t, "h", map[string]string{"b": "2"})
+	z, err := s.SortedSet("z")
+	ok(t, err)
+	equals(t, map[string]float64{"b": 2.5, "c": math.Inf(-1)}, z)
+	entries, err := s.Stream("x")
+	ok(t, err)
+	equals(t, []StreamEntry{{ID: "3-0", Values: []string{"c", "3"}}}, entries)
+	equals(t, streamID{8, 0}, s.dbs[0].streamKeys["x"].lastID)
+	g := s.dbs[0].streamKeys["x"].groups
+	equals(t, 1, len(g))
+	equals(t, streamID{3, 0}, g["g"].lastID)
+	equals(t, []string{"bob"}, g["g"].consumerNames())
+	equals(t, []streamPending{{id: streamID{3, 0}, consumer: "bob", delivered: time.Unix(100, 0), count: 2}}, g["g"].pending)
+	equals(t, time.Minute, s.TTL("str"))
+	equals(t, []string{"p", "s"}, s.DB(1).Keys())
+	equals(t, time.Minute, s.DB(1).TTL("s"))
+	equals(t, time.Duration(0), s.DB(1).TTL("p"))
+
+	// Broken input
+	for _, cmd := range [][]string{
+		{"NOSUCH"},
+		{"LPUSH", "l"},
+		{"SADD", "l", "a"},
+		{"SET", "l", "a", "KEEPTTL"},
+		{"SET", "str"},
+		{"HSET", "h", "a"},
+		{"HDEL", "l", "a"},
+		{"ZADD", "z", "1"},
+		{"ZADD", "z", "nofloat", "a"},
+		{"ZADD", "l", "1", "a"},
+		{"ZREM", "l", "a"},
+		{"XADD", "x", "1-0", "a"},
+		{"XADD", "x", "3-0", "a", "1"},
+		{"XADD", "l", "9-0", "a", "1"},
+		{"XDEL", "x", "foo"},
+		{"XSETID", "x", "foo"},
+		{"XTRIM", "x", "MAXLEN", "foo"},
+		{"XGROUP", "CREATE", "nosuch", "g", "0-0"},
+		{"XGROUP", "CREATE", "x", "g", "foo"},
+		{"XGROUP", "SETID", "x", "nosuch", "0-0"},
+		{"XGROUP", "FOO", "x", "g", "0-0"},
+		{"XGROUP", "DESTROY", "x"},
+		{"XCLAIM", "x", "g", "bob", "0", "1-0"},
+		{"XCLAIM", "x", "nosuch", "bob", "0", "1-0", "TIME", "0", "RETRYCOUNT", "1", "FORCE", "JUSTID"},
+		{"XCLAIM", "x", "g", "bob", "0", "1-0", "TIME", "foo", "RETRYCOUNT", "1", "FORCE", "JUSTID"},
+		{"XACK", "x", "nosuch", "1-0"},
+		{"XACK", "x", "g", "foo"},
+		{"SELECT", "foo"},
+	} {
+		_, err := s.applyAOF(s.db(0), cmd)
+		assert(t, err != nil, "no error for %v", cmd)
+	}
+	_, _, err = readAOFCommand(bufio.NewReader(bytes.NewBufferString("*1\r\n$4\r\nPI")))
+	assert(t, err != nil, "no error")
+	// a huge count in a truncated file doesn't allocate it all up front
+	_, _, err = readAOFCommand(bufio.NewReader(bytes.NewBufferString("*4000000000\r\n$4\r\nPING\r\n")))
+	equals(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestAOFRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "appendonly.aof")
+
+	s := NewRediQueue()
+	equals(t, ErrAOFDisabled, s.RewriteAOF())
+	s.SetAppendOnly(filename, FsyncNo)
+	s.SetAutoAOFRewrite(0, 0)
+	ok(t, s.Start())
+	for i := 0; i < 100; i++ {
+		s.Push("queue", "job")
+		s.Pop("queue")
+	}
+	s.Push("queue", "last")
+	s.Set("name", "value")
+	s.HSet("job", "state", "done")
+	s.ZAdd("ranked", 3, "job")
+	s.XAdd("log", "1-0", "job", "done")
+	s.dbs[0].streamGroupCreate("log", "workers", streamID{1, 0})
+	s.dbs[0].streamPendingSet("log", "workers", streamPending{id: streamID{1, 0}, consumer: "w1", delivered: time.Unix(100, 0), count: 1})
+	before, err := os.Stat(filename)
+	ok(t, err)
+
+	// Changes during the rewrite end up in the new file.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			s.SetAdd("seen", "job")
+		}
+		close(done)
+	}()
+	ok(t, s.RewriteAOF())
+	<-done
+	after, err := os.Stat(filename)
+	ok(t, err)
+	assert(t, after.Size() < before.Size(), "file didn't shrink")
+
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+	v, err := redis.String(c.Do("BGREWRITEAOF"))
+	ok(t, err)
+	equals(t, "Background append only file rewriting started", v)
+	c.Close()
+	waitAOFRewrite(s)
+	s.Close()
+
+	s2 := NewRediQueue()
+	s2.SetAppendOnly(filename, FsyncNo)
+	ok(t, s2.Start())
+	s2.CheckList(t, "queue", "last")
+	s2.CheckSet(t, "seen", "job")
+	s2.CheckGet(t, "name", "value")
+	s2.CheckHash(t, "job", map[string]string{"state": "done"})
+	z, err := s2.SortedSet("ranked")
+	ok(t, err)
+	equals(t, map[string]float64{"job": 3}, z)
+	entries, err := s2.Stream("log")
+	ok(t, err)
+	equals(t, []StreamEntry{{ID: "1-0", Values: []string{"job", "done"}}}, entries)
+	g := s2.dbs[0].streamKeys["log"].groups["workers"]
+	equals(t, streamID{1, 0}, g.lastID)
+	equals(t, []streamPending{{id: streamID{1, 0}, consumer: "w1", delivered: time.Unix(100, 0), count: 1}}, g.pending)
+
+	// Automatic rewrites.
+	s2.SetAutoAOFRewrite(100, 0)
+	for i := 0; i < 100; i++ {
+		s2.Push("queue", "job")
+		s2.Pop("queue")
+	}
+	waitAOFRewrite(s2)
+	after2, err := os.Stat(filename)
+	ok(t, err)
+	assert(t, after2.Size() <= 2*after.Size(), "file didn't shrink")
+	s2.Close()
+}
+
+func waitAOFRewrite(s *RediQueue) {
+	for {
+		s.Lock()
+		busy := s.aof.rewriting
+		s.Unlock()
+		if !busy {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAOFWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "appendonly.aof")
+
+	s := NewRediQueue()
+	s.SetAppendOnly(filename, FsyncNo)
+	s.SetAutoAOFRewrite(0, 0)
+	ok(t, s.Start())
+	s.Push("queue", "one")
+
+	// Writes to a closed file fail.
+	s.Lock()
+	s.aof.f.Close()
+	s.Unlock()
+	s.Push("queue", "two")
+	s.Lock()
+	assert(t, s.aof.err != nil, "no write error")
+	s.Unlock()
+	s.Push("queue", "three")
+
+	// A rewrite writes a fresh file, and logging resumes.
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+	_, err = c.Do("BGREWRITEAOF")
+	ok(t, err)
+	c.Close()
+	waitAOFRewrite(s)
+	s.Lock()
+	equals(t, nil, s.aof.err)
+	s.Unlock()
+	s.Push("queue", "four")
+	s.Close()
+
+	s2 := NewRediQueue()
+	s2.SetAppendOnly(filename, FsyncNo)
+	ok(t, s2.Start())
+	defer s2.Close()
+	s2.CheckList(t, "queue", "one", "two", "three", "four")
+}
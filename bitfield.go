@@ -0,0 +1,195 @@
+package rediqueue
+
+// Bits in strings, as SETBIT, BITCOUNT, BITFIELD, &c. use them. Bit 0 is the
+// most significant bit of the first byte.
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// bitfield overflow behaviours
+const (
+	overflowWrap = "WRAP"
+	overflowSat  = "SAT"
+	overflowFail = "FAIL"
+)
+
+// bitfieldType is a BITFIELD type such as "i5" or "u8".
+type bitfieldType struct {
+	signed bool
+	bits   uint
+}
+
+// parseBitfieldType parses a type. i1 to i64, and u1 to u63.
+func parseBitfieldType(s string) (bitfieldType, bool) {
+	if len(s) < 2 {
+		return bitfieldType{}, false
+	}
+	var t bitfieldType
+	switch s[0] {
+	case 'i', 'I':
+		t.signed = true
+	case 'u', 'U':
+	default:
+		return bitfieldType{}, false
+	}
+	n, err := strconv.Atoi(s[1:])
+	if err != nil || n < 1 || n > 64 || (!t.signed && n == 64) {
+		return bitfieldType{}, false
+	}
+	t.bits = uint(n)
+	return t, true
+}
+
+// parseBitOffset parses a bit offset. With hash set "#3" is 3 times width.
+func parseBitOffset(s string, hash bool, width uint) (uint64, bool) {
+	mul := uint64(1)
+	if hash && strings.HasPrefix(s, "#") {
+		s, mul = s[1:], uint64(width)
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > math.MaxUint64/mul {
+		return 0, false
+	}
+	n *= mul
+	if n > maxStringLen*8-uint64(width) {
+		return 0, false
+	}
+	return n, true
+}
+
+// growBits makes sure bits up to offset+width are in the string.
+func growBits(v []byte, offset uint64, width uint) []byte {
+	if n := int((offset + uint64(width) + 7) / 8); len(v) < n {
+		v = append(v, make([]byte, n-len(v))...)
+	}
+	return v
+}
+
+// getBit gives a single bit. Bits past the end are 0.
+func getBit(v []byte, offset uint64) uint8 {
+	i := offset / 8
+	if i >= uint64(len(v)) {
+		return 0
+	}
+	return (v[i] >> (7 - offset%8)) & 1
+}
+
+// setBit sets a single bit. The bit needs to be in v.
+func setBit(v []byte, offset uint64, b uint8) {
+	mask := byte(1) << (7 - offset%8)
+	if b == 0 {
+		v[offset/8] &^= mask
+	} else {
+		v[offset/8] |= mask
+	}
+}
+
+// get gives the value at offset. Bits past the end are 0.
+func (t bitfieldType) get(v []byte, offset uint64) int64 {
+	var u uint64
+	for i := uint64(0); i < uint64(t.bits); i++ {
+		u = u<<1 | uint64(getBit(v, offset+i))
+	}
+	if t.signed && t.bits < 64 && u&(1<<(t.bits-1)) != 0 {
+		u |= math.MaxUint64 << t.bits
+	}
+	return int64(u)
+}
+
+// set writes n at offset. The bits need to be in v.
+func (t bitfieldType) set(v []byte, offset uint64, n int64) {
+	u := uint64(n)
+	for i := uint64(0); i < uint64(t.bits); i++ {
+		setBit(v, offset+i, uint8(u>>(uint64(t.bits)-1-i)&1))
+	}
+}
+
+// add gives v + incr, with the overflow behaviour applied. ok is false if
+// it overflows with FAIL.
+func (t bitfieldType) add(v, incr int64, overflow string) (int64, bool) {
+	if t.signed {
+		max := int64(math.MaxInt64)
+		if t.bits < 64 {
+			max = 1<<(t.bits-1) - 1
+		}
+		min := -max - 1
+		res := v + incr
+		over := (incr > 0 && (res < v || res > max)) || v > max
+		under := (incr < 0 && (res > v || res < min)) || v < min
+		switch {
+		case !over && !under:
+			return res, true
+		case overflow == overflowFail:
+			return 0, false
+		case overflow == overflowSat && over:
+			return max, true
+		case overflow == overflowSat:
+			return min, true
+		}
+		// wrap: sign extend what fits
+		u := uint64(v) + uint64(incr)
+		if t.bits < 64 {
+			if u&(1<<(t.bits-1)) != 0 {
+				u |= math.MaxUint64 << t.bits
+			} else {
+				u &^= math.MaxUint64 << t.bits
+			}
+		}
+		return int64(u), true
+	}
+
+	max := uint64(1)<<t.bits - 1
+	u := uint64(v)
+	res := u + uint64(incr)
+	over := u > max || (incr > 0 && uint64(incr) > max-u)
+	under := !over && incr < 0 && uint64(-incr) > u
+	switch {
+	case !over && !under:
+		return int64(res), true
+	case overflow == overflowFail:
+		return 0, false
+	case overflow == overflowSat && over:
+		return int64(max), true
+	case overflow == overflowSat:
+		return 0, true
+	}
+	return int64(res & max), true
+}
+
+// countBits counts the set bits in [start, end).
+func countBits(v []byte, start, end uint64) int {
+	n := 0
+	for i := start; i < end; {
+		if i%8 == 0 && i+8 <= end {
+			n += bits.OnesCount8(v[i/8])
+			i += 8
+			continue
+		}
+		n += int(getBit(v, i))
+		i++
+	}
+	return n
+}
+
+// findBit gives the first bit with value b in [start, end), or -1.
+func findBit(v []byte, b uint8, start, end uint64) int64 {
+	skip := byte(0x00)
+	if b == 0 {
+		skip = 0xFF
+	}
+	for i := start; i < end; {
+		if i%8 == 0 && i+8 <= end && v[i/8] == skip {
+			i += 8
+			continue
+		}
+		if getBit(v, i) == b {
+			return int64(i)
+		}
+		i++
+	}
+	return -1
+}
@@ -0,0 +1,81 @@
+package rediqueue
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBitfieldAdd(t *testing.T) {
+	i8 := bitfieldType{signed: true, bits: 8}
+	u8 := bitfieldType{bits: 8}
+	i64 := bitfieldType{signed: true, bits: 64}
+	u63 := bitfieldType{bits: 63}
+	for _, c := range []struct {
+		typ      bitfieldType
+		v, incr  int64
+		overflow string
+		want     int64
+		ok       bool
+	}{
+		{i8, 100, 27, overflowWrap, 127, true},
+		{i8, 100, 28, overflowWrap, -128, true},
+		{i8, 100, 28, overflowSat, 127, true},
+		{i8, 100, 28, overflowFail, 0, false},
+		{i8, -100, -29, overflowWrap, 127, true},
+		{i8, -100, -29, overflowSat, -128, true},
+		{i8, 1, math.MaxInt64, overflowSat, 127, true},
+		{i8, -1, math.MinInt64, overflowSat, -128, true},
+		{i8, 200, 0, overflowWrap, -56, true},
+		{i64, math.MaxInt64, 1, overflowWrap, math.MinInt64, true},
+		{i64, math.MaxInt64, 1, overflowSat, math.MaxInt64, true},
+		{i64, math.MinInt64, -1, overflowFail, 0, false},
+		{u8, 250, 5, overflowWrap, 255, true},
+		{u8, 250, 10, overflowWrap, 4, true},
+		{u8, 250, 10, overflowSat, 255, true},
+		{u8, 5, -10, overflowWrap, 251, true},
+		{u8, 5, -10, overflowSat, 0, true},
+		{u8, 5, -10, overflowFail, 0, false},
+		{u8, -1, 0, overflowSat, 255, true},
+		{u8, 5, math.MinInt64, overflowSat, 0, true},
+		{u63, 1, math.MaxInt64, overflowSat, math.MaxInt64, true},
+	} {
+		got, ok := c.typ.add(c.v, c.incr, c.overflow)
+		equals(t, c.ok, ok)
+		equals(t, c.want, got)
+	}
+}
+
+func TestBitfieldGetSet(t *testing.T) {
+	v := make([]byte, 9)
+	for _, c := range []struct {
+		typ    bitfieldType
+		offset uint64
+		n      int64
+	}{
+		{bitfieldType{signed: true, bits: 5}, 3, -7},
+		{bitfieldType{bits: 13}, 11, 8000},
+		{bitfieldType{signed: true, bits: 64}, 7, math.MinInt64 + 5},
+		{bitfieldType{bits: 1}, 71, 1},
+	} {
+		c.typ.set(v, c.offset, c.n)
+		equals(t, c.n, c.typ.get(v, c.offset))
+	}
+
+	typ, ok := parseBitfieldType("i64")
+	equals(t, true, ok)
+	equals(t, bitfieldType{signed: true, bits: 64}, typ)
+	_, ok = parseBitfieldType("u64")
+	equals(t, false, ok)
+	_, ok = parseBitfieldType("i0")
+	equals(t, false, ok)
+
+	off, ok := parseBitOffset("#3", true, 8)
+	equals(t, true, ok)
+	equals(t, uint64(24), off)
+	_, ok = parseBitOffset("#3", false, 8)
+	equals(t, false, ok)
+	_, ok = parseBitOffset("4294967295", false, 1)
+	equals(t, true, ok)
+	_, ok = parseBitOffset("4294967296", false, 1)
+	equals(t, false, ok)
+}
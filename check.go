@@ -15,6 +15,35 @@ type T interface {
 	Fail()
 }
 
+// CheckGet does not call Errorf() iff there is a string key with the
+// expected value. Normal use case is `m.CheckGet(t, "username", "theking")`.
+func (m *RediQueue) CheckGet(t T, key, expected string) {
+	found, err := m.Get(key)
+	if err != nil {
+		lError(t, "GET error, key %#v: %v", key, err)
+		return
+	}
+	if found != expected {
+		lError(t, "GET error, key %#v: Expected %#v, got %#v", key, expected, found)
+		return
+	}
+}
+
+// CheckHash does not call Errorf() iff there is a hash key with exactly the
+// expected fields.
+// Normal use case is `m.CheckHash(t, "job:1", map[string]string{"state": "done"})`.
+func (m *RediQueue) CheckHash(t T, key string, expected map[string]string) {
+	found, err := m.Hash(key)
+	if err != nil {
+		lError(t, "Hash error, key %#v: %v", key, err)
+		return
+	}
+	if !reflect.DeepEqual(expected, found) {
+		lError(t, "Hash error, key %#v: Expected %#v, got %#v", key, expected, found)
+		return
+	}
+}
+
 // CheckList does not call Errorf() iff there is a list key with the
 // expected values.
 // Normal use case is `m.CheckGet(t, "favorite_colors", "red", "green", "infrared")`.
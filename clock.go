@@ -0,0 +1,160 @@
+package rediqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where the time comes from: for TTLs, the save rules, and the
+// timeouts of blocking commands. The default is the real time. See
+// SetClock().
+type Clock interface {
+	Now() time.Time
+	// NewTimer is like time.NewTimer().
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is what Clock.NewTimer() returns.
+type Timer interface {
+	// C is like the C field of a time.Timer.
+	C() <-chan time.Time
+	// Stop is like time.Timer.Stop().
+	Stop() bool
+}
+
+// SetClock replaces the clock. Call it before Start(): what's already running
+// keeps using the old one. The time of the last save is reset to the new
+// clock's time, so the save rules start counting from there.
+func (m *RediQueue) SetClock(c Clock) {
+	m.Lock()
+	defer m.Unlock()
+	m.clock = c
+	m.lastSave = c.Now()
+}
+
+// every calls f with the lock held, every d, until stop is closed. The next
+// timer is set before the lock is released, so once a test sees what f did,
+// advancing a FakeClock fires f again. Needs the lock.
+func (m *RediQueue) every(d time.Duration, stop <-chan struct{}, f func(now time.Time)) {
+	c := m.clock
+	t := c.NewTimer(d)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				t.Stop()
+				return
+			case now := <-t.C():
+				m.Lock()
+				f(now)
+				t = c.NewTimer(d)
+				m.Unlock()
+			}
+		}
+	}()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// FakeClock is a Clock which only moves when told to, for tests.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock makes a FakeClock which starts at t.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+// Now gives the current fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer makes a timer which fires once Advance() gets past now + d.
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{
+		clock: c,
+		at:    c.now.Add(d),
+		c:     make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the time forward by d, and fires the timers which are due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// Timers gives the number of timers which haven't fired or been stopped yet.
+// Tests can use this to see whether a blocking command is waiting.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, o := range c.timers {
+		if o == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
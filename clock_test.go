@@ -0,0 +1,112 @@
+package rediqueue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// waitTimers waits until n timers are set on c.
+func waitTimers(c *FakeClock, n int) {
+	for c.Timers() < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	t1 := c.NewTimer(time.Second)
+	t2 := c.NewTimer(time.Minute)
+	t3 := c.NewTimer(time.Minute)
+	equals(t, 3, c.Timers())
+
+	c.Advance(time.Second)
+	equals(t, start.Add(time.Second), <-t1.C())
+	equals(t, false, t1.Stop())
+	equals(t, true, t3.Stop())
+	equals(t, 1, c.Timers())
+
+	c.Advance(time.Hour)
+	equals(t, start.Add(time.Hour+time.Second), <-t2.C())
+	equals(t, 0, c.Timers())
+	select {
+	case <-t3.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+}
+
+func TestClockBlocking(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	s := NewRediQueue()
+	s.SetClock(clock)
+	ok(t, s.Start())
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	// The saver and the sweeper always have one.
+	waitTimers(clock, 2)
+
+	done := make(chan error, 1)
+	go func() {
+		v, err := c.Do("BLPOP", "queue", 10)
+		if err == nil && v != nil {
+			err = ErrKeyNotFound
+		}
+		done <- err
+	}()
+	waitTimers(clock, 3)
+	clock.Advance(9 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("BLPOP returned too soon")
+	default:
+	}
+	clock.Advance(time.Second)
+	ok(t, <-done)
+}
+
+func TestClockExpire(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	s := NewRediQueue()
+	s.SetClock(clock)
+	s.Push("queue", "one")
+	ok(t, s.SetTTL("queue", time.Minute))
+
+	clock.Advance(10 * time.Second)
+	equals(t, 50*time.Second, s.TTL("queue"))
+	clock.Advance(time.Minute)
+	assert(t, !s.Exists("queue"), "queue didn't expire")
+}
+
+func TestClockSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	s := NewRediQueue()
+	s.SetDir(dir)
+	s.SetClock(clock)
+	s.SetSaveRules(SaveRule{Seconds: 60, Changes: 1})
+	ok(t, s.Start())
+	defer s.Close()
+	waitTimers(clock, 2)
+
+	s.Push("queue", "one")
+	clock.Advance(30 * time.Second)
+	waitTimers(clock, 2)
+	equals(t, 1, s.Dirty())
+	clock.Advance(30 * time.Second)
+	for s.Dirty() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waitBGSave(s)
+	equals(t, start.Add(time.Minute), s.LastSave())
+}
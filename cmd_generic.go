@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chinahdkj/rediqueue/server"
 )
@@ -13,21 +14,135 @@ import (
 // commandsGeneric handles EXPIRE, TTL, PERSIST, &c.
 func commandsGeneric(m *RediQueue) {
 	m.srv.Register("DEL", m.cmdDel)
-	// DUMP
+	m.srv.Register("DUMP", m.cmdDump)
 	m.srv.Register("EXISTS", m.cmdExists)
+	m.srv.Register("EXPIRE", makeCmdExpire(m, false, time.Second))
+	m.srv.Register("EXPIREAT", makeCmdExpire(m, true, time.Second))
 	m.srv.Register("KEYS", m.cmdKeys)
 	// MIGRATE
 	m.srv.Register("MOVE", m.cmdMove)
 	// OBJECT
+	m.srv.Register("PERSIST", m.cmdPersist)
+	m.srv.Register("PEXPIRE", makeCmdExpire(m, false, time.Millisecond))
+	m.srv.Register("PEXPIREAT", makeCmdExpire(m, true, time.Millisecond))
+	m.srv.Register("PTTL", m.cmdTTL)
 	m.srv.Register("RANDOMKEY", m.cmdRandomkey)
 	m.srv.Register("RENAME", m.cmdRename)
 	m.srv.Register("RENAMENX", m.cmdRenamenx)
-	// RESTORE
+	m.srv.Register("RESTORE", m.cmdRestore)
 	// SORT
+	m.srv.Register("TTL", m.cmdTTL)
 	m.srv.Register("TYPE", m.cmdType)
 	m.srv.Register("SCAN", m.cmdScan)
 }
 
+// generic expire command for EXPIRE, PEXPIRE, EXPIREAT, PEXPIREAT
+// d is the time unit. If unix is set it'll be seen as a unixtimestamp.
+func makeCmdExpire(m *RediQueue, unix bool, d time.Duration) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) != 2 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		key := args[0]
+		i, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			base := m.effectiveNow()
+			if unix {
+				base = time.Unix(0, 0)
+			}
+			at, ok := expireAt(base, i, d)
+			if !ok {
+				c.WriteError(errInvalidExpire(cmd))
+				return
+			}
+			if !db.exists(key) {
+				c.WriteInt(0)
+				return
+			}
+			if !at.After(m.effectiveNow()) {
+				db.del(key)
+			} else {
+				db.setTTL(key, at)
+			}
+			c.WriteInt(1)
+		})
+	}
+}
+
+// TTL and PTTL
+func (m *RediQueue) cmdTTL(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			// No such key
+			c.WriteInt(-2)
+			return
+		}
+		at, ok := db.ttl(key)
+		if !ok {
+			// No expire value
+			c.WriteInt(-1)
+			return
+		}
+		left := at.Sub(m.effectiveNow())
+		if strings.ToUpper(cmd) == "PTTL" {
+			c.WriteInt(int((left + time.Millisecond/2) / time.Millisecond))
+			return
+		}
+		c.WriteInt(int((left + time.Second/2) / time.Second))
+	})
+}
+
+// PERSIST
+func (m *RediQueue) cmdPersist(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.persist(key) {
+			c.WriteInt(0)
+			return
+		}
+		c.WriteInt(1)
+	})
+}
+
 // DEL
 func (m *RediQueue) cmdDel(c *server.Peer, cmd string, args []string) {
 	if !m.handleAuth(c) {
@@ -48,6 +163,109 @@ func (m *RediQueue) cmdDel(c *server.Peer, cmd string, args []string) {
 	})
 }
 
+// DUMP
+func (m *RediQueue) cmdDump(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteNull()
+			return
+		}
+		if hasMemberTTLs(db, key) {
+			c.WriteError(msgDumpMemberTTL)
+			return
+		}
+		c.WriteBulk(dumpKey(db, key))
+	})
+}
+
+// RESTORE
+func (m *RediQueue) cmdRestore(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, payload := args[0], args[2]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+	if ttl < 0 {
+		setDirty(c)
+		c.WriteError("ERR Invalid TTL value, must be >= 0")
+		return
+	}
+	replace, absTTL := false, false
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(arg) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		default:
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && !replace {
+			c.WriteError("BUSYKEY Target key name already exists.")
+			return
+		}
+		src, err := restoreKey(payload, key)
+		if err != nil {
+			c.WriteError("ERR DUMP payload version or checksum are wrong")
+			return
+		}
+		var at time.Time
+		if ttl > 0 {
+			base := m.effectiveNow()
+			if absTTL {
+				base = time.Unix(0, 0)
+			}
+			var ok bool
+			if at, ok = expireAt(base, ttl, time.Millisecond); !ok {
+				c.WriteError(errInvalidExpire(cmd))
+				return
+			}
+		}
+		db.del(key)
+		if ttl > 0 {
+			if !at.After(m.effectiveNow()) {
+				// Already expired, so it's gone right away.
+				c.WriteOK()
+				return
+			}
+			src.expire[key] = at
+		}
+		db.copyFrom(src)
+		c.WriteOK()
+	})
+}
+
 // TYPE
 func (m *RediQueue) cmdType(c *server.Peer, cmd string, args []string) {
 	if len(args) != 1 {
@@ -64,8 +282,8 @@ func (m *RediQueue) cmdType(c *server.Peer, cmd string, args []string) {
 	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
 		db := m.db(ctx.selectedDB)
 
-		t, ok := db.keys[key]
-		if !ok {
+		t := db.t(key)
+		if t == "" {
 			c.WriteInline("none")
 			return
 		}
@@ -169,18 +387,12 @@ func (m *RediQueue) cmdRandomkey(c *server.Peer, cmd string, args []string) {
 	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
 		db := m.db(ctx.selectedDB)
 
-		if len(db.keys) == 0 {
+		keys := db.allKeys()
+		if len(keys) == 0 {
 			c.WriteNull()
 			return
 		}
-		nr := rand.Intn(len(db.keys))
-		for k := range db.keys {
-			if nr == 0 {
-				c.WriteBulk(k)
-				return
-			}
-			nr--
-		}
+		c.WriteBulk(keys[rand.Intn(len(keys))])
 	})
 }
 
@@ -1,7 +1,9 @@
 package rediqueue
 
 import (
+	"math"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -418,3 +420,275 @@ func TestRenamenx(t *testing.T) {
 		assert(t, err != nil, "do RENAMENX error")
 	}
 }
+
+func TestDumpRestore(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.Push("queue", "one", "two", "three")
+	s.SetAdd("ints", "1", "2", "3")
+	s.SetAdd("seen", "a", "b")
+
+	for _, key := range []string{"queue", "ints", "seen"} {
+		payload, err := redis.Bytes(c.Do("DUMP", key))
+		ok(t, err)
+		_, err = c.Do("SELECT", 3)
+		ok(t, err)
+		v, err := redis.String(c.Do("RESTORE", key, 0, payload))
+		ok(t, err)
+		equals(t, "OK", v)
+		_, err = c.Do("SELECT", 0)
+		ok(t, err)
+	}
+	l, err := s.DB(3).List("queue")
+	ok(t, err)
+	equals(t, []string{"one", "two", "three"}, l)
+	members, err := s.DB(3).Members("ints")
+	ok(t, err)
+	equals(t, []string{"1", "2", "3"}, members)
+	members, err = s.DB(3).Members("seen")
+	ok(t, err)
+	equals(t, []string{"a", "b"}, members)
+
+	// Existing key
+	payload, err := redis.Bytes(c.Do("DUMP", "seen"))
+	ok(t, err)
+	_, err = c.Do("RESTORE", "queue", 0, payload)
+	assert(t, err != nil, "no BUSYKEY error")
+	v, err := redis.String(c.Do("RESTORE", "queue", 0, payload, "REPLACE"))
+	ok(t, err)
+	equals(t, "OK", v)
+	s.CheckSet(t, "queue", "a", "b")
+
+	// Missing key
+	nv, err := c.Do("DUMP", "nosuch")
+	ok(t, err)
+	equals(t, nil, nv)
+
+	// Errors
+	broken := append([]byte{}, payload...)
+	broken[1] ^= 0xFF
+	_, err = c.Do("RESTORE", "new", 0, broken)
+	assert(t, err != nil, "no checksum error")
+	_, err = c.Do("RESTORE", "new", 0, "foo")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("RESTORE", "new", -1, payload)
+	assert(t, err != nil, "no error")
+	_, err = c.Do("RESTORE", "new", "foo", payload)
+	assert(t, err != nil, "no error")
+	_, err = c.Do("RESTORE", "new", 0, payload, "FOO")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("RESTORE", "new", 0)
+	assert(t, err != nil, "no error")
+	_, err = c.Do("DUMP")
+	assert(t, err != nil, "no error")
+	assert(t, !s.Exists("new"), "new key")
+
+	// TTLs
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.SetTime(now)
+	v, err = redis.String(c.Do("RESTORE", "ttl", 2500, payload))
+	ok(t, err)
+	equals(t, "OK", v)
+	equals(t, 2500*time.Millisecond, s.TTL("ttl"))
+	v, err = redis.String(c.Do("RESTORE", "abs", now.Unix()*1000+3000, payload, "ABSTTL"))
+	ok(t, err)
+	equals(t, "OK", v)
+	equals(t, 3*time.Second, s.TTL("abs"))
+	v, err = redis.String(c.Do("RESTORE", "gone", now.Unix()*1000, payload, "ABSTTL"))
+	ok(t, err)
+	equals(t, "OK", v)
+	assert(t, !s.Exists("gone"), "expired key restored")
+
+	// TTLs which don't fit
+	_, err = c.Do("RESTORE", "queue", int64(math.MaxInt64), payload, "REPLACE")
+	equals(t, "ERR invalid expire time in 'restore' command", err.(redis.Error).Error())
+	s.CheckSet(t, "queue", "a", "b")
+	equals(t, time.Duration(0), s.TTL("queue"))
+}
+
+func TestExpire(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.SetTime(now)
+	s.Push("queue", "one")
+	s.SetAdd("seen", "a")
+
+	// No TTL yet
+	{
+		v, err := redis.Int(c.Do("TTL", "queue"))
+		ok(t, err)
+		equals(t, -1, v)
+		v, err = redis.Int(c.Do("PTTL", "nosuch"))
+		ok(t, err)
+		equals(t, -2, v)
+		v, err = redis.Int(c.Do("PERSIST", "queue"))
+		ok(t, err)
+		equals(t, 0, v)
+	}
+
+	// Set one
+	{
+		v, err := redis.Int(c.Do("EXPIRE", "queue", 10))
+		ok(t, err)
+		equals(t, 1, v)
+		v, err = redis.Int(c.Do("TTL", "queue"))
+		ok(t, err)
+		equals(t, 10, v)
+		v, err = redis.Int(c.Do("PTTL", "queue"))
+		ok(t, err)
+		equals(t, 10000, v)
+		equals(t, 10*time.Second, s.TTL("queue"))
+
+		v, err = redis.Int(c.Do("PEXPIRE", "seen", 1500))
+		ok(t, err)
+		equals(t, 1, v)
+		v, err = redis.Int(c.Do("TTL", "seen"))
+		ok(t, err)
+		equals(t, 2, v)
+
+		v, err = redis.Int(c.Do("EXPIREAT", "seen", now.Unix()+100))
+		ok(t, err)
+		equals(t, 1, v)
+		equals(t, 100*time.Second, s.TTL("seen"))
+
+		v, err = redis.Int(c.Do("PEXPIREAT", "seen", now.Unix()*1000+200))
+		ok(t, err)
+		equals(t, 1, v)
+		equals(t, 200*time.Millisecond, s.TTL("seen"))
+
+		v, err = redis.Int(c.Do("EXPIRE", "nosuch", 10))
+		ok(t, err)
+		equals(t, 0, v)
+	}
+
+	// Remove it
+	{
+		v, err := redis.Int(c.Do("PERSIST", "queue"))
+		ok(t, err)
+		equals(t, 1, v)
+		equals(t, time.Duration(0), s.TTL("queue"))
+		v, err = redis.Int(c.Do("TTL", "queue"))
+		ok(t, err)
+		equals(t, -1, v)
+	}
+
+	// Expired keys are gone
+	{
+		s.SetTime(now.Add(time.Second))
+		equals(t, []string{"queue"}, s.Keys())
+		assert(t, !s.Exists("seen"), "seen still exists")
+		v, err := redis.String(c.Do("TYPE", "seen"))
+		ok(t, err)
+		equals(t, "none", v)
+		n, err := redis.Int(c.Do("SADD", "seen", "b"))
+		ok(t, err)
+		equals(t, 1, n)
+		s.CheckSet(t, "seen", "b")
+		equals(t, time.Duration(0), s.TTL("seen"))
+	}
+
+	// A TTL in the past deletes the key
+	{
+		v, err := redis.Int(c.Do("EXPIRE", "seen", -1))
+		ok(t, err)
+		equals(t, 1, v)
+		assert(t, !s.Exists("seen"), "seen still exists")
+		v, err = redis.Int(c.Do("EXPIREAT", "queue", now.Unix()))
+		ok(t, err)
+		equals(t, 1, v)
+		assert(t, !s.Exists("queue"), "queue still exists")
+	}
+
+	// RENAME and MOVE carry the TTL, DEL and overwrites clear it
+	{
+		s.Push("a", "x")
+		ok(t, s.SetTTL("a", time.Minute))
+		_, err := c.Do("RENAME", "a", "b")
+		ok(t, err)
+		equals(t, time.Minute, s.TTL("b"))
+		_, err = c.Do("MOVE", "b", 2)
+		ok(t, err)
+		equals(t, time.Minute, s.DB(2).TTL("b"))
+
+		s.Push("b", "y")
+		ok(t, s.SetTTL("b", time.Minute))
+		_, err = c.Do("DEL", "b")
+		ok(t, err)
+		s.Push("b", "z")
+		equals(t, time.Duration(0), s.TTL("b"))
+
+		s.Push("c", "x")
+		ok(t, s.SetTTL("c", time.Minute))
+		_, err = c.Do("RENAME", "b", "c")
+		ok(t, err)
+		equals(t, time.Duration(0), s.TTL("c"))
+
+		ok(t, s.SetTTL("c", 0))
+		equals(t, ErrKeyNotFound, s.SetTTL("nosuch", time.Minute))
+
+		// to itself
+		ok(t, s.SetTTL("c", time.Minute))
+		str, err := redis.String(c.Do("RENAME", "c", "c"))
+		ok(t, err)
+		equals(t, "OK", str)
+		s.CheckList(t, "c", "z")
+		equals(t, time.Minute, s.TTL("c"))
+		n, err := redis.Int(c.Do("RENAMENX", "c", "c"))
+		ok(t, err)
+		equals(t, 0, n)
+		s.CheckList(t, "c", "z")
+	}
+
+	// TTLs which don't fit
+	{
+		s.Push("big", "x")
+		_, err := c.Do("EXPIRE", "big", 9300000000)
+		equals(t, "ERR invalid expire time in 'expire' command", err.(redis.Error).Error())
+		_, err = c.Do("EXPIRE", "big", 99999999999999)
+		equals(t, "ERR invalid expire time in 'expire' command", err.(redis.Error).Error())
+		// fits in a time.Duration, but not when added to now
+		_, err = c.Do("EXPIRE", "big", 9223372036)
+		equals(t, "ERR invalid expire time in 'expire' command", err.(redis.Error).Error())
+		_, err = c.Do("PEXPIRE", "big", int64(math.MaxInt64))
+		equals(t, "ERR invalid expire time in 'pexpire' command", err.(redis.Error).Error())
+		_, err = c.Do("PEXPIRE", "big", int64(math.MinInt64))
+		equals(t, "ERR invalid expire time in 'pexpire' command", err.(redis.Error).Error())
+		_, err = c.Do("EXPIREAT", "big", 9300000000)
+		equals(t, "ERR invalid expire time in 'expireat' command", err.(redis.Error).Error())
+		_, err = c.Do("EXPIRE", "nosuch", 9300000000)
+		equals(t, "ERR invalid expire time in 'expire' command", err.(redis.Error).Error())
+		assert(t, s.Exists("big"), "big is gone")
+		equals(t, time.Duration(0), s.TTL("big"))
+
+		v, err := redis.Int(c.Do("EXPIREAT", "big", 9223372036))
+		ok(t, err)
+		equals(t, 1, v)
+		assert(t, s.Exists("big"), "big is gone")
+		equals(t, time.Unix(9223372036, 0).Sub(now.Add(time.Second)), s.TTL("big"))
+	}
+
+	// Errors
+	{
+		_, err := c.Do("EXPIRE", "queue")
+		assert(t, err != nil, "no error")
+		_, err = c.Do("EXPIRE", "queue", "foo")
+		assert(t, err != nil, "no error")
+		_, err = c.Do("PEXPIREAT", "queue", 1, 2)
+		assert(t, err != nil, "no error")
+		_, err = c.Do("TTL")
+		assert(t, err != nil, "no error")
+		_, err = c.Do("PTTL", "a", "b")
+		assert(t, err != nil, "no error")
+		_, err = c.Do("PERSIST")
+		assert(t, err != nil, "no error")
+	}
+}
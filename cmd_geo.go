@@ -0,0 +1,567 @@
+// Commands from http://redis.io/commands#geo
+
+package rediqueue
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chinahdkj/rediqueue/server"
+)
+
+// commandsGeo handles all geo operations. Geo keys are sorted sets.
+func commandsGeo(m *RediQueue) {
+	m.srv.Register("GEOADD", m.cmdGeoadd)
+	m.srv.Register("GEODIST", m.cmdGeodist)
+	m.srv.Register("GEOHASH", m.cmdGeohash)
+	m.srv.Register("GEOPOS", m.cmdGeopos)
+	m.srv.Register("GEORADIUS", makeCmdGeoradius(m, false, false))
+	m.srv.Register("GEORADIUS_RO", makeCmdGeoradius(m, false, true))
+	m.srv.Register("GEORADIUSBYMEMBER", makeCmdGeoradius(m, true, false))
+	m.srv.Register("GEORADIUSBYMEMBER_RO", makeCmdGeoradius(m, true, true))
+	m.srv.Register("GEOSEARCH", makeCmdGeosearch(m, false))
+	m.srv.Register("GEOSEARCHSTORE", makeCmdGeosearch(m, true))
+}
+
+// GEOADD
+func (m *RediQueue) cmdGeoadd(c *server.Peer, cmd string, args []string) {
+	if len(args) < 4 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, args := args[0], args[1:]
+	var nx, xx, ch bool
+loop:
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break loop
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args)%3 != 0 || (nx && xx) {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+	var elems []ssElem
+	for ; len(args) > 0; args = args[3:] {
+		lon, lat, msg := parseLonLat(args[0], args[1])
+		if msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+		elems = append(elems, ssElem{
+			member: args[2],
+			score:  float64(geoEncode(lon, lat, geoLatMin, geoLatMax)),
+		})
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		res := 0
+		for _, e := range elems {
+			old, exists := db.zsetScore(key, e.member)
+			if (nx && exists) || (xx && !exists) {
+				continue
+			}
+			switch {
+			case !exists:
+				res++
+			case old == e.score:
+				continue
+			case ch:
+				res++
+			}
+			db.zsetAdd(key, e.score, e.member)
+		}
+		c.WriteInt(res)
+	})
+}
+
+// GEOPOS
+func (m *RediQueue) cmdGeopos(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, members := args[0], args[1:]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteLen(len(members))
+		for _, member := range members {
+			score, ok := db.zsetScore(key, member)
+			if !ok {
+				c.WriteNull()
+				continue
+			}
+			lon, lat := geoDecode(score)
+			c.WriteLen(2)
+			c.WriteBulk(formatGeoCoord(lon))
+			c.WriteBulk(formatGeoCoord(lat))
+		}
+	})
+}
+
+// GEODIST
+func (m *RediQueue) cmdGeodist(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, from, to := args[0], args[1], args[2]
+	unit := 1.0
+	switch len(args) {
+	case 3:
+	case 4:
+		var ok bool
+		if unit, ok = parseGeoUnit(args[3]); !ok {
+			setDirty(c)
+			c.WriteError(msgGeoUnit)
+			return
+		}
+	default:
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		fromScore, ok := db.zsetScore(key, from)
+		if !ok {
+			c.WriteNull()
+			return
+		}
+		toScore, ok := db.zsetScore(key, to)
+		if !ok {
+			c.WriteNull()
+			return
+		}
+		fromLon, fromLat := geoDecode(fromScore)
+		toLon, toLat := geoDecode(toScore)
+		c.WriteBulk(formatGeoDist(geoDistance(fromLon, fromLat, toLon, toLat) / unit))
+	})
+}
+
+// GEOHASH
+func (m *RediQueue) cmdGeohash(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, members := args[0], args[1:]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteLen(len(members))
+		for _, member := range members {
+			score, ok := db.zsetScore(key, member)
+			if !ok {
+				c.WriteNull()
+				continue
+			}
+			c.WriteBulk(geoHashString(score))
+		}
+	})
+}
+
+// GEORADIUS, GEORADIUSBYMEMBER, and their _RO versions
+func makeCmdGeoradius(m *RediQueue, byMember, readonly bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		n := 5
+		if byMember {
+			n = 4
+		}
+		if len(args) < n {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		var q geoQuery
+		key, args := args[0], args[1:]
+		if byMember {
+			q.member, args = args[0], args[1:]
+		} else {
+			var msg string
+			q.lon, q.lat, msg = parseLonLat(args[0], args[1])
+			if msg != "" {
+				setDirty(c)
+				c.WriteError(msg)
+				return
+			}
+			args = args[2:]
+		}
+		if msg := q.parseRadius(args[0], args[1]); msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+		if msg := q.parseOptions(args[2:], false, !readonly); msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+		if q.store != "" && (q.withCoord || q.withDist || q.withHash) {
+			setDirty(c)
+			c.WriteError(errGeoStore("STORE option in GEORADIUS"))
+			return
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			m.geoSearch(c, m.db(ctx.selectedDB), key, q)
+		})
+	}
+}
+
+// GEOSEARCH and GEOSEARCHSTORE
+func makeCmdGeosearch(m *RediQueue, store bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		n := 6
+		if store {
+			n = 7
+		}
+		if len(args) < n {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		var q geoQuery
+		if store {
+			q.store, args = args[0], args[1:]
+		}
+		key, args := args[0], args[1:]
+		if msg := q.parseOptions(args, true, store); msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+		if store && (q.withCoord || q.withDist || q.withHash) {
+			setDirty(c)
+			c.WriteError(errGeoStore("GEOSEARCHSTORE"))
+			return
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			m.geoSearch(c, m.db(ctx.selectedDB), key, q)
+		})
+	}
+}
+
+// geoSearch runs a query on key, and writes or stores the results.
+func (m *RediQueue) geoSearch(c *server.Peer, db *RedisDB, key string, q geoQuery) {
+	if db.exists(key) && db.t(key) != "zset" {
+		c.WriteError(msgWrongType)
+		return
+	}
+
+	s, ok := db.zsetKeys[key]
+	if !ok {
+		s = newSortedSet()
+	}
+	if q.member != "" && ok {
+		score, found := s.score(q.member)
+		if !found {
+			c.WriteError(msgGeoMember)
+			return
+		}
+		q.lon, q.lat = geoDecode(score)
+	}
+	res := q.run(s)
+
+	if q.store != "" {
+		stored := newSortedSet()
+		for _, r := range res {
+			if q.storeDist {
+				stored.set(r.member, r.dist/q.unit)
+			} else {
+				stored.set(r.member, r.score)
+			}
+		}
+		db.zsetSet(q.store, stored)
+		c.WriteInt(len(res))
+		return
+	}
+
+	c.WriteLen(len(res))
+	for _, r := range res {
+		if !q.withCoord && !q.withDist && !q.withHash {
+			c.WriteBulk(r.member)
+			continue
+		}
+		n := 1
+		for _, with := range []bool{q.withCoord, q.withDist, q.withHash} {
+			if with {
+				n++
+			}
+		}
+		c.WriteLen(n)
+		c.WriteBulk(r.member)
+		if q.withDist {
+			c.WriteBulk(formatGeoDist(r.dist / q.unit))
+		}
+		if q.withHash {
+			c.WriteInt(int(r.score))
+		}
+		if q.withCoord {
+			c.WriteLen(2)
+			c.WriteBulk(formatGeoCoord(r.lon))
+			c.WriteBulk(formatGeoCoord(r.lat))
+		}
+	}
+}
+
+// geoQuery is a parsed GEORADIUS, GEOSEARCH, &c. Distances are in meters.
+type geoQuery struct {
+	member        string // from this member, else from lon/lat
+	lon, lat      float64
+	byBox         bool
+	radius        float64
+	width, height float64
+	unit          float64 // of the query, which results use as well
+	withCoord     bool
+	withDist      bool
+	withHash      bool
+	count         int // 0 is no limit
+	any           bool
+	sort          int // 1 is ASC, -1 is DESC
+	store         string
+	storeDist     bool
+}
+
+// geoResult is a member found by a geoQuery.
+type geoResult struct {
+	member   string
+	score    float64
+	lon, lat float64
+	dist     float64
+}
+
+// parseRadius parses the "radius unit" of BYRADIUS and GEORADIUS.
+func (q *geoQuery) parseRadius(radius, unit string) string {
+	r, err := strconv.ParseFloat(radius, 64)
+	if err != nil {
+		return msgInvalidFloat
+	}
+	if r < 0 {
+		return msgGeoRadiusNeg
+	}
+	u, ok := parseGeoUnit(unit)
+	if !ok {
+		return msgGeoUnit
+	}
+	q.radius, q.unit = r*u, u
+	return ""
+}
+
+// parseOptions parses the options of GEORADIUS and GEOSEARCH. With search
+// set it's GEOSEARCH, which has the FROM and BY options, and GEOSEARCHSTORE
+// when store is set as well. Without search store allows STORE and STOREDIST.
+func (q *geoQuery) parseOptions(args []string, search, store bool) string {
+	var from, by int
+	for len(args) > 0 {
+		switch arg := strings.ToUpper(args[0]); {
+		case arg == "WITHCOORD":
+			q.withCoord = true
+			args = args[1:]
+		case arg == "WITHDIST":
+			q.withDist = true
+			args = args[1:]
+		case arg == "WITHHASH":
+			q.withHash = true
+			args = args[1:]
+		case arg == "ANY":
+			q.any = true
+			args = args[1:]
+		case arg == "ASC":
+			q.sort = 1
+			args = args[1:]
+		case arg == "DESC":
+			q.sort = -1
+			args = args[1:]
+		case arg == "COUNT" && len(args) > 1:
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return msgInvalidInt
+			}
+			if n <= 0 {
+				return msgCountPositive
+			}
+			q.count = n
+			args = args[2:]
+		case !search && store && (arg == "STORE" || arg == "STOREDIST") && len(args) > 1:
+			q.store, q.storeDist = args[1], arg == "STOREDIST"
+			args = args[2:]
+		case search && store && arg == "STOREDIST":
+			q.storeDist = true
+			args = args[1:]
+		case search && arg == "FROMMEMBER" && len(args) > 1:
+			q.member = args[1]
+			from++
+			args = args[2:]
+		case search && arg == "FROMLONLAT" && len(args) > 2:
+			var msg string
+			if q.lon, q.lat, msg = parseLonLat(args[1], args[2]); msg != "" {
+				return msg
+			}
+			from++
+			args = args[3:]
+		case search && arg == "BYRADIUS" && len(args) > 2:
+			if msg := q.parseRadius(args[1], args[2]); msg != "" {
+				return msg
+			}
+			by++
+			args = args[3:]
+		case search && arg == "BYBOX" && len(args) > 3:
+			w, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				return msgInvalidFloat
+			}
+			h, err := strconv.ParseFloat(args[2], 64)
+			if err != nil {
+				return msgInvalidFloat
+			}
+			if w < 0 || h < 0 {
+				return msgGeoBoxNeg
+			}
+			u, ok := parseGeoUnit(args[3])
+			if !ok {
+				return msgGeoUnit
+			}
+			q.byBox, q.width, q.height, q.unit = true, w*u, h*u, u
+			by++
+			args = args[4:]
+		default:
+			return msgSyntaxError
+		}
+	}
+	if search && from != 1 {
+		return msgGeoFrom
+	}
+	if search && by != 1 {
+		return msgGeoBy
+	}
+	if q.any && q.count == 0 {
+		return msgGeoAny
+	}
+	return ""
+}
+
+// run gives the members of s in the query area. With a COUNT, but no ANY,
+// the closest ones.
+func (q geoQuery) run(s *sortedSet) []geoResult {
+	var res []geoResult
+	for _, e := range s.elems() {
+		lon, lat := geoDecode(e.score)
+		dist := geoDistance(q.lon, q.lat, lon, lat)
+		if q.byBox {
+			if !geoInBox(lon, lat, q.lon, q.lat, q.width, q.height) {
+				continue
+			}
+		} else if dist > q.radius {
+			continue
+		}
+		res = append(res, geoResult{
+			member: e.member,
+			score:  e.score,
+			lon:    lon,
+			lat:    lat,
+			dist:   dist,
+		})
+		if q.any && len(res) == q.count {
+			break
+		}
+	}
+
+	order := q.sort
+	if order == 0 && q.count > 0 && !q.any {
+		order = 1
+	}
+	switch order {
+	case 1:
+		sort.SliceStable(res, func(i, j int) bool { return res[i].dist < res[j].dist })
+	case -1:
+		sort.SliceStable(res, func(i, j int) bool { return res[i].dist > res[j].dist })
+	}
+	if q.count > 0 && len(res) > q.count {
+		res = res[:q.count]
+	}
+	return res
+}
+
+// parseLonLat parses and checks a position.
+func parseLonLat(lonArg, latArg string) (float64, float64, string) {
+	lon, err := strconv.ParseFloat(lonArg, 64)
+	if err != nil {
+		return 0, 0, msgInvalidFloat
+	}
+	lat, err := strconv.ParseFloat(latArg, 64)
+	if err != nil {
+		return 0, 0, msgInvalidFloat
+	}
+	if !geoValid(lon, lat) {
+		return 0, 0, errInvalidLonLat(lon, lat)
+	}
+	return lon, lat, ""
+}
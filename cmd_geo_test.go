@@ -0,0 +1,353 @@
+package rediqueue
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Test GEOADD, GEOPOS, GEODIST, and GEOHASH.
+func TestGeoadd(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		n, err := redis.Int(c.Do("GEOADD", "Sicily", 13.361389, 38.115556, "Palermo", 15.087269, 37.502669, "Catania"))
+		ok(t, err)
+		equals(t, 2, n)
+
+		// a sorted set, with the geohash as score
+		typ, err := redis.String(c.Do("TYPE", "Sicily"))
+		ok(t, err)
+		equals(t, "zset", typ)
+		members, err := redis.Strings(c.Do("ZRANGE", "Sicily", 0, -1, "WITHSCORES"))
+		ok(t, err)
+		equals(t, []string{"Palermo", "3479099956230698", "Catania", "3479447370796909"}, members)
+
+		n, err = redis.Int(c.Do("GEOADD", "Sicily", 13.361389, 38.115556, "Palermo"))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	// NX, XX, CH
+	{
+		n, err := redis.Int(c.Do("GEOADD", "Sicily", "NX", 13, 38, "Palermo", 13.583333, 37.316667, "Agrigento"))
+		ok(t, err)
+		equals(t, 1, n)
+
+		n, err = redis.Int(c.Do("GEOADD", "Sicily", "XX", "CH", 13.583333, 37.316667, "Agrigento", 1, 1, "Nowhere"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		n, err = redis.Int(c.Do("GEOADD", "Sicily", "XX", "CH", 13.5, 37.3, "Agrigento"))
+		ok(t, err)
+		equals(t, 1, n)
+		_, err = c.Do("GEOADD", "Sicily", 13.583333, 37.316667, "Agrigento")
+		ok(t, err)
+	}
+
+	{
+		res, err := redis.Values(c.Do("GEOPOS", "Sicily", "Palermo", "Catania", "NonExisting"))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]interface{}{[]byte("13.36138933897018433"), []byte("38.11555639549629859")},
+			[]interface{}{[]byte("15.08726745843887329"), []byte("37.50266842333162032")},
+			nil,
+		}, res)
+
+		res, err = redis.Values(c.Do("GEOPOS", "nosuch", "Palermo"))
+		ok(t, err)
+		equals(t, []interface{}{nil}, res)
+	}
+
+	{
+		for unit, want := range map[string]string{
+			"":   "166274.1516",
+			"km": "166.2742",
+			"MI": "103.3182",
+			"ft": "545518.8700",
+		} {
+			args := []interface{}{"Sicily", "Palermo", "Catania"}
+			if unit != "" {
+				args = append(args, unit)
+			}
+			d, err := redis.String(c.Do("GEODIST", args...))
+			ok(t, err)
+			equals(t, want, d)
+		}
+
+		d, err := c.Do("GEODIST", "Sicily", "Palermo", "Foo")
+		ok(t, err)
+		equals(t, nil, d)
+	}
+
+	{
+		res, err := c.Do("GEOHASH", "Sicily", "Palermo", "Catania", "Foo")
+		ok(t, err)
+		equals(t, []interface{}{[]byte("sqc8b49rny0"), []byte("sqdtr74hyu0"), nil}, res)
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("GEOADD", "Sicily", 13.361389, 86, "North")
+		equals(t, "ERR invalid longitude,latitude pair 13.361389,86.000000", err.(redis.Error).Error())
+		_, err = c.Do("GEOADD", "Sicily", "foo", 38, "Foo")
+		equals(t, msgInvalidFloat, err.(redis.Error).Error())
+		_, err = c.Do("GEOADD", "Sicily", 13, 38, "Foo", 14)
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("GEOADD", "Sicily", "NX", "XX", 13, 38, "Foo")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("GEODIST", "Sicily", "Palermo", "Catania", "yards")
+		equals(t, msgGeoUnit, err.(redis.Error).Error())
+		_, err = c.Do("GEODIST", "Sicily", "Palermo", "Catania", "m", "m")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+
+		s.Set("str", "value")
+		_, err = c.Do("GEOADD", "str", 13, 38, "Foo")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("GEOPOS", "str", "Foo")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("GEODIST", "str", "Foo", "Bar")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("GEOHASH", "str", "Foo")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("GEOADD", "Sicily", 13, 38)
+		assert(t, err != nil, "GEOADD error")
+		_, err = c.Do("GEODIST", "Sicily", "Palermo")
+		assert(t, err != nil, "GEODIST error")
+	}
+
+	// In a transaction
+	{
+		_, err := c.Do("MULTI")
+		ok(t, err)
+		_, err = c.Do("GEOADD", "tx", 13.361389, 38.115556, "Palermo")
+		ok(t, err)
+		_, err = c.Do("GEOHASH", "tx", "Palermo")
+		ok(t, err)
+		res, err := redis.Values(c.Do("EXEC"))
+		ok(t, err)
+		equals(t, []interface{}{int64(1), []interface{}{[]byte("sqc8b49rny0")}}, res)
+	}
+}
+
+// Test GEORADIUS and GEORADIUSBYMEMBER.
+func TestGeoradius(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	_, err = c.Do("GEOADD", "Sicily", 13.361389, 38.115556, "Palermo", 15.087269, 37.502669, "Catania")
+	ok(t, err)
+
+	{
+		res, err := redis.Strings(c.Do("GEORADIUS", "Sicily", 15, 37, 100, "km"))
+		ok(t, err)
+		equals(t, []string{"Catania"}, res)
+
+		res, err = redis.Strings(c.Do("GEORADIUS", "Sicily", 15, 37, 200, "km", "ASC"))
+		ok(t, err)
+		equals(t, []string{"Catania", "Palermo"}, res)
+
+		res, err = redis.Strings(c.Do("GEORADIUS", "Sicily", 15, 37, 200, "km", "DESC"))
+		ok(t, err)
+		equals(t, []string{"Palermo", "Catania"}, res)
+
+		// COUNT sorts, unless there is ANY.
+		res, err = redis.Strings(c.Do("GEORADIUS", "Sicily", 15, 37, 200, "km", "COUNT", 1))
+		ok(t, err)
+		equals(t, []string{"Catania"}, res)
+		res, err = redis.Strings(c.Do("GEORADIUS", "Sicily", 15, 37, 200, "km", "COUNT", 1, "ANY"))
+		ok(t, err)
+		equals(t, []string{"Palermo"}, res)
+
+		res, err = redis.Strings(c.Do("GEORADIUS", "nosuch", 15, 37, 200, "km"))
+		ok(t, err)
+		equals(t, []string{}, res)
+	}
+
+	{
+		res, err := redis.Values(c.Do("GEORADIUS", "Sicily", 15, 37, 200, "km", "WITHDIST", "ASC"))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]interface{}{[]byte("Catania"), []byte("56.4413")},
+			[]interface{}{[]byte("Palermo"), []byte("190.4424")},
+		}, res)
+
+		res, err = redis.Values(c.Do("GEORADIUS", "Sicily", 15, 37, 200, "km", "WITHCOORD", "WITHHASH", "WITHDIST", "ASC"))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]interface{}{
+				[]byte("Catania"),
+				[]byte("56.4413"),
+				int64(3479447370796909),
+				[]interface{}{[]byte("15.08726745843887329"), []byte("37.50266842333162032")},
+			},
+			[]interface{}{
+				[]byte("Palermo"),
+				[]byte("190.4424"),
+				int64(3479099956230698),
+				[]interface{}{[]byte("13.36138933897018433"), []byte("38.11555639549629859")},
+			},
+		}, res)
+	}
+
+	{
+		_, err := c.Do("GEOADD", "Sicily", 13.583333, 37.316667, "Agrigento")
+		ok(t, err)
+		res, err := redis.Strings(c.Do("GEORADIUSBYMEMBER", "Sicily", "Agrigento", 100, "km", "ASC"))
+		ok(t, err)
+		equals(t, []string{"Agrigento", "Palermo"}, res)
+
+		res, err = redis.Strings(c.Do("GEORADIUSBYMEMBER_RO", "Sicily", "Agrigento", 100, "km", "DESC"))
+		ok(t, err)
+		equals(t, []string{"Palermo", "Agrigento"}, res)
+	}
+
+	// STORE and STOREDIST
+	{
+		n, err := redis.Int(c.Do("GEORADIUS", "Sicily", 15, 37, 100, "km", "STORE", "near"))
+		ok(t, err)
+		equals(t, 1, n)
+		members, err := redis.Strings(c.Do("ZRANGE", "near", 0, -1, "WITHSCORES"))
+		ok(t, err)
+		equals(t, []string{"Catania", "3479447370796909"}, members)
+
+		n, err = redis.Int(c.Do("GEORADIUSBYMEMBER", "Sicily", "Catania", 200, "km", "STOREDIST", "dist"))
+		ok(t, err)
+		equals(t, 3, n)
+		d, err := redis.String(c.Do("ZSCORE", "dist", "Catania"))
+		ok(t, err)
+		equals(t, "0", d)
+
+		n, err = redis.Int(c.Do("GEORADIUS", "Sicily", 0, 0, 1, "km", "STORE", "near"))
+		ok(t, err)
+		equals(t, 0, n)
+		equals(t, false, s.Exists("near"))
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("GEORADIUS", "Sicily", 15, 37, -1, "km")
+		equals(t, msgGeoRadiusNeg, err.(redis.Error).Error())
+		_, err = c.Do("GEORADIUS", "Sicily", 15, 37, 1, "parsec")
+		equals(t, msgGeoUnit, err.(redis.Error).Error())
+		_, err = c.Do("GEORADIUS", "Sicily", 15, 37, 1, "km", "ANY")
+		equals(t, msgGeoAny, err.(redis.Error).Error())
+		_, err = c.Do("GEORADIUS", "Sicily", 15, 37, 1, "km", "COUNT", 0)
+		equals(t, msgCountPositive, err.(redis.Error).Error())
+		_, err = c.Do("GEORADIUS", "Sicily", 15, 37, 1, "km", "STORE", "x", "WITHDIST")
+		equals(t, "ERR STORE option in GEORADIUS is not compatible with WITHDIST, WITHHASH and WITHCOORD options", err.(redis.Error).Error())
+		_, err = c.Do("GEORADIUS_RO", "Sicily", 15, 37, 1, "km", "STORE", "x")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("GEORADIUS", "Sicily", 15, 37, 1, "km", "FROMMEMBER", "Palermo")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("GEORADIUSBYMEMBER", "Sicily", "Nowhere", 1, "km")
+		equals(t, msgGeoMember, err.(redis.Error).Error())
+		s.Set("str", "value")
+		_, err = c.Do("GEORADIUS", "str", 15, 37, 1, "km")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("GEORADIUS", "Sicily", 15, 37, 1)
+		assert(t, err != nil, "GEORADIUS error")
+	}
+}
+
+// Test GEOSEARCH and GEOSEARCHSTORE.
+func TestGeosearch(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	_, err = c.Do("GEOADD", "Sicily",
+		13.361389, 38.115556, "Palermo",
+		15.087269, 37.502669, "Catania",
+		12.758489, 38.788135, "edge1",
+		17.241510, 38.788135, "edge2",
+	)
+	ok(t, err)
+
+	{
+		res, err := redis.Strings(c.Do("GEOSEARCH", "Sicily", "FROMLONLAT", 15, 37, "BYRADIUS", 200, "km", "ASC"))
+		ok(t, err)
+		equals(t, []string{"Catania", "Palermo"}, res)
+
+		res2, err := redis.Values(c.Do("GEOSEARCH", "Sicily", "FROMLONLAT", 15, 37, "BYBOX", 400, 400, "km", "ASC", "WITHDIST"))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]interface{}{[]byte("Catania"), []byte("56.4413")},
+			[]interface{}{[]byte("Palermo"), []byte("190.4424")},
+			[]interface{}{[]byte("edge2"), []byte("279.7403")},
+			[]interface{}{[]byte("edge1"), []byte("279.7405")},
+		}, res2)
+
+		res, err = redis.Strings(c.Do("GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYRADIUS", 100, "km"))
+		ok(t, err)
+		equals(t, []string{"Palermo", "edge1"}, res)
+
+		res, err = redis.Strings(c.Do("GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYBOX", 10, 10, "km"))
+		ok(t, err)
+		equals(t, []string{"Palermo"}, res)
+	}
+
+	{
+		n, err := redis.Int(c.Do("GEOSEARCHSTORE", "dest", "Sicily", "FROMLONLAT", 15, 37, "BYBOX", 400, 400, "km", "ASC", "COUNT", 3))
+		ok(t, err)
+		equals(t, 3, n)
+		members, err := redis.Strings(c.Do("ZRANGE", "dest", 0, -1))
+		ok(t, err)
+		equals(t, []string{"Palermo", "Catania", "edge2"}, members)
+
+		n, err = redis.Int(c.Do("GEOSEARCHSTORE", "dest", "Sicily", "FROMLONLAT", 15, 37, "BYRADIUS", 200, "km", "STOREDIST"))
+		ok(t, err)
+		equals(t, 2, n)
+		members, err = redis.Strings(c.Do("ZRANGE", "dest", 0, -1, "WITHSCORES"))
+		ok(t, err)
+		equals(t, "Catania", members[0])
+		assert(t, members[1] > "56.44" && members[1] < "56.45", "STOREDIST %s", members[1])
+
+		n, err = redis.Int(c.Do("GEOSEARCHSTORE", "dest", "nosuch", "FROMLONLAT", 15, 37, "BYRADIUS", 200, "km"))
+		ok(t, err)
+		equals(t, 0, n)
+		equals(t, false, s.Exists("dest"))
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("GEOSEARCH", "Sicily", "BYRADIUS", 200, "km", "ASC", "WITHDIST")
+		equals(t, msgGeoFrom, err.(redis.Error).Error())
+		_, err = c.Do("GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "FROMLONLAT", 15, 37, "BYRADIUS", 200, "km")
+		equals(t, msgGeoFrom, err.(redis.Error).Error())
+		_, err = c.Do("GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "WITHDIST", "COUNT", 1)
+		equals(t, msgGeoBy, err.(redis.Error).Error())
+		_, err = c.Do("GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYBOX", -1, 1, "km")
+		equals(t, msgGeoBoxNeg, err.(redis.Error).Error())
+		_, err = c.Do("GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYRADIUS", 1, "km", "STORE", "x")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("GEOSEARCH", "Sicily", "FROMMEMBER", "Nowhere", "BYRADIUS", 1, "km")
+		equals(t, msgGeoMember, err.(redis.Error).Error())
+		_, err = c.Do("GEOSEARCH", "Sicily", "FROMLONLAT", 200, 37, "BYRADIUS", 1, "km")
+		equals(t, "ERR invalid longitude,latitude pair 200.000000,37.000000", err.(redis.Error).Error())
+		_, err = c.Do("GEOSEARCHSTORE", "dest", "Sicily", "FROMMEMBER", "Palermo", "BYRADIUS", 1, "km", "WITHHASH")
+		equals(t, "ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options", err.(redis.Error).Error())
+		_, err = c.Do("GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYRADIUS")
+		assert(t, err != nil, "GEOSEARCH error")
+	}
+
+	// In a transaction
+	{
+		_, err := c.Do("MULTI")
+		ok(t, err)
+		_, err = c.Do("GEOSEARCHSTORE", "tx", "Sicily", "FROMMEMBER", "Palermo", "BYRADIUS", 100, "km")
+		ok(t, err)
+		res, err := redis.Values(c.Do("EXEC"))
+		ok(t, err)
+		equals(t, []interface{}{int64(2)}, res)
+	}
+}
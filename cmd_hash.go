@@ -0,0 +1,536 @@
+// Commands from http://redis.io/commands#hash
+
+package rediqueue
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/chinahdkj/rediqueue/server"
+)
+
+// commandsHash handles all hash value operations.
+func commandsHash(m *RediQueue) {
+	m.srv.Register("HDEL", m.cmdHdel)
+	m.srv.Register("HEXISTS", m.cmdHexists)
+	m.srv.Register("HGET", m.cmdHget)
+	m.srv.Register("HGETALL", m.cmdHgetall)
+	m.srv.Register("HINCRBY", m.cmdHincrby)
+	m.srv.Register("HINCRBYFLOAT", m.cmdHincrbyfloat)
+	m.srv.Register("HKEYS", m.cmdHkeys)
+	m.srv.Register("HLEN", m.cmdHlen)
+	m.srv.Register("HMGET", m.cmdHmget)
+	m.srv.Register("HSET", m.cmdHset)
+	m.srv.Register("HSETNX", m.cmdHsetnx)
+	m.srv.Register("HSTRLEN", m.cmdHstrlen)
+	m.srv.Register("HVALS", m.cmdHvals)
+	m.srv.Register("HSCAN", m.cmdHscan)
+}
+
+// HSET
+func (m *RediQueue) cmdHset(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, pairs := args[0], args[1:]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(db.hashSet(key, pairs...))
+	})
+}
+
+// HSETNX
+func (m *RediQueue) cmdHsetnx(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, field, value := args[0], args[1], args[2]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		if _, ok := db.hashKeys[key][field]; ok {
+			c.WriteInt(0)
+			return
+		}
+		db.hashSet(key, field, value)
+		c.WriteInt(1)
+	})
+}
+
+// HGET
+func (m *RediQueue) cmdHget(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, field := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteNull()
+			return
+		}
+		if db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		value, ok := db.hashKeys[key][field]
+		if !ok {
+			c.WriteNull()
+			return
+		}
+		c.WriteBulk(value)
+	})
+}
+
+// HMGET
+func (m *RediQueue) cmdHmget(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, fields := args[0], args[1:]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		h := db.hashKeys[key]
+		c.WriteLen(len(fields))
+		for _, f := range fields {
+			value, ok := h[f]
+			if !ok {
+				c.WriteNull()
+				continue
+			}
+			c.WriteBulk(value)
+		}
+	})
+}
+
+// HDEL
+func (m *RediQueue) cmdHdel(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, fields := args[0], args[1:]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(db.hashDel(key, fields...))
+	})
+}
+
+// HEXISTS
+func (m *RediQueue) cmdHexists(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, field := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		if _, ok := db.hashKeys[key][field]; !ok {
+			c.WriteInt(0)
+			return
+		}
+		c.WriteInt(1)
+	})
+}
+
+// HGETALL
+func (m *RediQueue) cmdHgetall(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteLen(0)
+			return
+		}
+		if db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		pairs := db.hashPairs(key)
+		c.WriteLen(len(pairs))
+		for _, v := range pairs {
+			c.WriteBulk(v)
+		}
+	})
+}
+
+// HKEYS
+func (m *RediQueue) cmdHkeys(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteLen(0)
+			return
+		}
+		if db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		fields := db.hashFields(key)
+		c.WriteLen(len(fields))
+		for _, f := range fields {
+			c.WriteBulk(f)
+		}
+	})
+}
+
+// HVALS
+func (m *RediQueue) cmdHvals(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteLen(0)
+			return
+		}
+		if db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		fields := db.hashFields(key)
+		c.WriteLen(len(fields))
+		for _, f := range fields {
+			c.WriteBulk(db.hashKeys[key][f])
+		}
+	})
+}
+
+// HLEN
+func (m *RediQueue) cmdHlen(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(len(db.hashKeys[key]))
+	})
+}
+
+// HSTRLEN
+func (m *RediQueue) cmdHstrlen(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, field := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(len(db.hashKeys[key][field]))
+	})
+}
+
+// HINCRBY
+func (m *RediQueue) cmdHincrby(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, field := args[0], args[1]
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v, err := db.hashIncr(key, field, delta)
+		if err != nil {
+			if err == ErrIntValueError {
+				c.WriteError(msgHashNotInt)
+				return
+			}
+			c.WriteError(err.Error())
+			return
+		}
+		c.WriteInt(int(v))
+	})
+}
+
+// HINCRBYFLOAT
+func (m *RediQueue) cmdHincrbyfloat(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, field := args[0], args[1]
+	delta, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidFloat)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v, err := db.hashIncrfloat(key, field, delta)
+		if err != nil {
+			if err == ErrFloatValueError {
+				c.WriteError(msgHashNotFloat)
+				return
+			}
+			c.WriteError(err.Error())
+			return
+		}
+		c.WriteBulk(formatFloat(v))
+	})
+}
+
+// HSCAN
+func (m *RediQueue) cmdHscan(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	cursor, err := strconv.Atoi(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidCursor)
+		return
+	}
+	args = args[2:]
+	// MATCH and COUNT options
+	var withMatch bool
+	var match string
+	for len(args) > 0 {
+		if strings.ToLower(args[0]) == "count" {
+			if len(args) < 2 {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			_, err := strconv.Atoi(args[1])
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			// We do nothing with count.
+			args = args[2:]
+			continue
+		}
+		if strings.ToLower(args[0]) == "match" {
+			if len(args) < 2 {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			withMatch = true
+			match = args[1]
+			args = args[2:]
+			continue
+		}
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+		// return _all_ (matched) fields every time
+
+		if cursor != 0 {
+			// invalid cursor
+			c.WriteLen(2)
+			c.WriteBulk("0") // no next cursor
+			c.WriteLen(0)    // no elements
+			return
+		}
+		if db.exists(key) && db.t(key) != "hash" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		fields := db.hashFields(key)
+		if withMatch {
+			fields = matchKeys(fields, match)
+		}
+
+		c.WriteLen(2)
+		c.WriteBulk("0") // no next cursor
+		c.WriteLen(len(fields) * 2)
+		for _, f := range fields {
+			c.WriteBulk(f)
+			c.WriteBulk(db.hashKeys[key][f])
+		}
+	})
+}
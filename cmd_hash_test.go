@@ -0,0 +1,380 @@
+package rediqueue
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Test HSET / HGET / HMGET / HDEL.
+func TestHash(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		n, err := redis.Int(c.Do("HSET", "job:1", "state", "new", "queue", "q1"))
+		ok(t, err)
+		equals(t, 2, n) // New fields.
+		n, err = redis.Int(c.Do("HSET", "job:1", "state", "running", "worker", "w1"))
+		ok(t, err)
+		equals(t, 1, n)
+		s.CheckHash(t, "job:1", map[string]string{
+			"state":  "running",
+			"queue":  "q1",
+			"worker": "w1",
+		})
+
+		v, err := redis.String(c.Do("HGET", "job:1", "state"))
+		ok(t, err)
+		equals(t, "running", v)
+
+		v, err = redis.String(c.Do("TYPE", "job:1"))
+		ok(t, err)
+		equals(t, "hash", v)
+	}
+
+	// Nonexisting keys and fields
+	{
+		v, err := c.Do("HGET", "job:1", "nosuch")
+		ok(t, err)
+		equals(t, nil, v)
+		v, err = c.Do("HGET", "nosuch", "state")
+		ok(t, err)
+		equals(t, nil, v)
+	}
+
+	{
+		v, err := redis.Values(c.Do("HMGET", "job:1", "queue", "nosuch", "state"))
+		ok(t, err)
+		equals(t, []interface{}{[]byte("q1"), nil, []byte("running")}, v)
+		v, err = redis.Values(c.Do("HMGET", "nosuch", "a"))
+		ok(t, err)
+		equals(t, []interface{}{nil}, v)
+	}
+
+	{
+		n, err := redis.Int(c.Do("HSETNX", "job:1", "state", "new"))
+		ok(t, err)
+		equals(t, 0, n)
+		n, err = redis.Int(c.Do("HSETNX", "job:1", "retries", "0"))
+		ok(t, err)
+		equals(t, 1, n)
+	}
+
+	{
+		n, err := redis.Int(c.Do("HDEL", "job:1", "retries", "worker", "nosuch"))
+		ok(t, err)
+		equals(t, 2, n)
+		n, err = redis.Int(c.Do("HDEL", "nosuch", "a"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		// The last field deletes the key.
+		n, err = redis.Int(c.Do("HDEL", "job:1", "state", "queue"))
+		ok(t, err)
+		equals(t, 2, n)
+		equals(t, false, s.Exists("job:1"))
+	}
+
+	// Direct usage
+	{
+		isNew, err := s.HSet("direct", "aap", "noot")
+		ok(t, err)
+		equals(t, true, isNew)
+		isNew, err = s.HSet("direct", "aap", "mies")
+		ok(t, err)
+		equals(t, false, isNew)
+		v, err := s.HGet("direct", "aap")
+		ok(t, err)
+		equals(t, "mies", v)
+		_, err = s.HGet("direct", "nosuch")
+		equals(t, ErrKeyNotFound, err)
+		fields, err := s.HKeys("direct")
+		ok(t, err)
+		equals(t, []string{"aap"}, fields)
+		n, err := s.HDel("direct", "aap")
+		ok(t, err)
+		equals(t, 1, n)
+		_, err = s.Hash("direct")
+		equals(t, ErrKeyNotFound, err)
+	}
+
+	// Wrong usage
+	{
+		s.Push("list", "aap")
+		_, err := c.Do("HSET", "list", "a", "b")
+		assert(t, err != nil, "HSET error")
+		_, err = c.Do("HGET", "list", "a")
+		assert(t, err != nil, "HGET error")
+		_, err = c.Do("HMGET", "list", "a")
+		assert(t, err != nil, "HMGET error")
+		_, err = c.Do("HDEL", "list", "a")
+		assert(t, err != nil, "HDEL error")
+		_, err = c.Do("HSETNX", "list", "a", "b")
+		assert(t, err != nil, "HSETNX error")
+		_, err = s.HSet("list", "a", "b")
+		equals(t, ErrWrongType, err)
+
+		_, err = c.Do("HSET", "h", "a")
+		assert(t, err != nil, "HSET error")
+		_, err = c.Do("HSET", "h", "a", "b", "c")
+		assert(t, err != nil, "HSET error")
+		_, err = c.Do("HGET", "h")
+		assert(t, err != nil, "HGET error")
+		_, err = c.Do("HMGET", "h")
+		assert(t, err != nil, "HMGET error")
+		_, err = c.Do("HDEL", "h")
+		assert(t, err != nil, "HDEL error")
+	}
+}
+
+// Test HEXISTS, HGETALL, HKEYS, HVALS, HLEN and HSTRLEN.
+func TestHashRead(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.HSet("h", "b", "noot")
+	s.HSet("h", "a", "aap")
+	s.HSet("h", "c", "")
+
+	{
+		n, err := redis.Int(c.Do("HEXISTS", "h", "a"))
+		ok(t, err)
+		equals(t, 1, n)
+		n, err = redis.Int(c.Do("HEXISTS", "h", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+		n, err = redis.Int(c.Do("HEXISTS", "nosuch", "a"))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	{
+		v, err := redis.Strings(c.Do("HGETALL", "h"))
+		ok(t, err)
+		equals(t, []string{"a", "aap", "b", "noot", "c", ""}, v)
+		m, err := redis.StringMap(c.Do("HGETALL", "h"))
+		ok(t, err)
+		equals(t, map[string]string{"a": "aap", "b": "noot", "c": ""}, m)
+
+		v, err = redis.Strings(c.Do("HKEYS", "h"))
+		ok(t, err)
+		equals(t, []string{"a", "b", "c"}, v)
+
+		v, err = redis.Strings(c.Do("HVALS", "h"))
+		ok(t, err)
+		equals(t, []string{"aap", "noot", ""}, v)
+
+		for _, cmd := range []string{"HGETALL", "HKEYS", "HVALS"} {
+			v, err = redis.Strings(c.Do(cmd, "nosuch"))
+			ok(t, err)
+			equals(t, []string{}, v)
+		}
+	}
+
+	{
+		n, err := redis.Int(c.Do("HLEN", "h"))
+		ok(t, err)
+		equals(t, 3, n)
+		n, err = redis.Int(c.Do("HLEN", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		n, err = redis.Int(c.Do("HSTRLEN", "h", "b"))
+		ok(t, err)
+		equals(t, 4, n)
+		n, err = redis.Int(c.Do("HSTRLEN", "h", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	// Wrong usage
+	{
+		s.Push("list", "aap")
+		for _, args := range [][]interface{}{
+			{"HEXISTS", "list", "a"},
+			{"HGETALL", "list"},
+			{"HKEYS", "list"},
+			{"HVALS", "list"},
+			{"HLEN", "list"},
+			{"HSTRLEN", "list", "a"},
+			{"HEXISTS", "h"},
+			{"HGETALL"},
+			{"HKEYS", "h", "h"},
+			{"HLEN"},
+			{"HSTRLEN", "h"},
+		} {
+			_, err := c.Do(args[0].(string), args[1:]...)
+			assert(t, err != nil, "no error for %v", args)
+		}
+	}
+}
+
+// Test HINCRBY and HINCRBYFLOAT.
+func TestHincrby(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		n, err := redis.Int(c.Do("HINCRBY", "job:1", "retries", 1))
+		ok(t, err)
+		equals(t, 1, n)
+		n, err = redis.Int(c.Do("HINCRBY", "job:1", "retries", -3))
+		ok(t, err)
+		equals(t, -2, n)
+
+		f, err := redis.Float64(c.Do("HINCRBYFLOAT", "job:1", "progress", "0.5"))
+		ok(t, err)
+		equals(t, 0.5, f)
+		f, err = redis.Float64(c.Do("HINCRBYFLOAT", "job:1", "progress", "0.25"))
+		ok(t, err)
+		equals(t, 0.75, f)
+
+		s.CheckHash(t, "job:1", map[string]string{"retries": "-2", "progress": "0.75"})
+	}
+
+	// Direct usage
+	{
+		n, err := s.HIncr("direct", "n", 5)
+		ok(t, err)
+		equals(t, int64(5), n)
+		f, err := s.HIncrfloat("direct", "n", 1.5)
+		ok(t, err)
+		equals(t, 6.5, f)
+		_, err = s.HIncr("direct", "n", 1)
+		equals(t, ErrIntValueError, err)
+	}
+
+	// Wrong usage
+	{
+		s.HSet("h", "str", "aap")
+		_, err := c.Do("HINCRBY", "h", "str", 1)
+		equals(t, msgHashNotInt, err.(redis.Error).Error())
+		_, err = c.Do("HINCRBYFLOAT", "h", "str", "1")
+		equals(t, msgHashNotFloat, err.(redis.Error).Error())
+		s.HSet("h", "big", "9223372036854775807")
+		_, err = c.Do("HINCRBY", "h", "big", 1)
+		assert(t, err != nil, "HINCRBY error")
+		_, err = c.Do("HINCRBY", "h", "n", "noint")
+		assert(t, err != nil, "HINCRBY error")
+		_, err = c.Do("HINCRBYFLOAT", "h", "n", "nofloat")
+		assert(t, err != nil, "HINCRBYFLOAT error")
+		s.Push("list", "aap")
+		_, err = c.Do("HINCRBY", "list", "n", 1)
+		assert(t, err != nil, "HINCRBY error")
+		_, err = c.Do("HINCRBYFLOAT", "list", "n", "1")
+		assert(t, err != nil, "HINCRBYFLOAT error")
+		_, err = c.Do("HINCRBY", "h", "n")
+		assert(t, err != nil, "HINCRBY error")
+	}
+}
+
+// Test HSCAN.
+func TestHscan(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.HSet("h", "field1", "value1")
+	s.HSet("h", "field2", "value2")
+	s.HSet("h", "other", "value3")
+
+	{
+		res, err := redis.Values(c.Do("HSCAN", "h", 0))
+		ok(t, err)
+		equals(t, 2, len(res))
+		equals(t, "0", string(res[0].([]byte)))
+		fields, err := redis.Strings(res[1], nil)
+		ok(t, err)
+		equals(t, []string{"field1", "value1", "field2", "value2", "other", "value3"}, fields)
+	}
+
+	{
+		res, err := redis.Values(c.Do("HSCAN", "h", 0, "MATCH", "field*", "COUNT", 10))
+		ok(t, err)
+		fields, err := redis.Strings(res[1], nil)
+		ok(t, err)
+		equals(t, []string{"field1", "value1", "field2", "value2"}, fields)
+	}
+
+	// An invalid cursor gives nothing.
+	{
+		res, err := redis.Values(c.Do("HSCAN", "h", 42))
+		ok(t, err)
+		fields, err := redis.Strings(res[1], nil)
+		ok(t, err)
+		equals(t, []string{}, fields)
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("HSCAN", "h")
+		assert(t, err != nil, "HSCAN error")
+		_, err = c.Do("HSCAN", "h", "noint")
+		assert(t, err != nil, "HSCAN error")
+		_, err = c.Do("HSCAN", "h", 0, "COUNT")
+		assert(t, err != nil, "HSCAN error")
+		_, err = c.Do("HSCAN", "h", 0, "COUNT", "noint")
+		assert(t, err != nil, "HSCAN error")
+		_, err = c.Do("HSCAN", "h", 0, "MATCH")
+		assert(t, err != nil, "HSCAN error")
+		_, err = c.Do("HSCAN", "h", 0, "NOSUCH")
+		assert(t, err != nil, "HSCAN error")
+		s.Push("list", "aap")
+		_, err = c.Do("HSCAN", "list", 0)
+		assert(t, err != nil, "HSCAN error")
+	}
+}
+
+// Test that hash keys move around like the other types.
+func TestHashKeys(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.HSet("h", "a", "b")
+	{
+		_, err := c.Do("RENAME", "h", "h2")
+		ok(t, err)
+		s.CheckHash(t, "h2", map[string]string{"a": "b"})
+		equals(t, false, s.Exists("h"))
+	}
+
+	{
+		n, err := redis.Int(c.Do("MOVE", "h2", 1))
+		ok(t, err)
+		equals(t, 1, n)
+		s.Select(1)
+		s.CheckHash(t, "h2", map[string]string{"a": "b"})
+		s.Select(0)
+	}
+
+	{
+		s.HSet("restore", "f", "v")
+		payload, err := redis.String(c.Do("DUMP", "restore"))
+		ok(t, err)
+		_, err = c.Do("RESTORE", "restored", 0, payload)
+		ok(t, err)
+		s.CheckHash(t, "restored", map[string]string{"f": "v"})
+		s.Del("restore")
+		s.Del("restored")
+	}
+
+	{
+		s.HSet("dump", "f", "value")
+		equals(t, "- dump\n   f: \"value\"\n", s.Dump())
+	}
+}
@@ -0,0 +1,136 @@
+// Commands from http://redis.io/commands#hyperloglog
+
+package rediqueue
+
+import (
+	"github.com/chinahdkj/rediqueue/server"
+)
+
+// commandsHLL handles all HyperLogLog operations.
+func commandsHLL(m *RediQueue) {
+	m.srv.Register("PFADD", m.cmdPfadd)
+	m.srv.Register("PFCOUNT", m.cmdPfcount)
+	m.srv.Register("PFMERGE", m.cmdPfmerge)
+}
+
+// PFADD
+func (m *RediQueue) cmdPfadd(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, elems := args[0], args[1:]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		h, msg := db.hllGet(key)
+		if msg != "" {
+			c.WriteError(msg)
+			return
+		}
+		changed := h == nil
+		if h == nil {
+			h = &hll{cardValid: true}
+		}
+		for _, e := range elems {
+			if h.add(e) {
+				changed = true
+			}
+		}
+		if !changed {
+			c.WriteInt(0)
+			return
+		}
+		db.stringUpdate(key, h.String())
+		c.WriteInt(1)
+	})
+}
+
+// PFCOUNT
+func (m *RediQueue) cmdPfcount(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	keys := args
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if len(keys) == 1 {
+			h, msg := db.hllGet(keys[0])
+			if msg != "" {
+				c.WriteError(msg)
+				return
+			}
+			if h == nil {
+				c.WriteInt(0)
+				return
+			}
+			if !h.cardValid {
+				// Redis stores the count, so we do too.
+				h.card, h.cardValid = h.count(), true
+				db.stringUpdate(keys[0], h.String())
+			}
+			c.WriteInt(int(h.card))
+			return
+		}
+
+		merged := &hll{}
+		for _, k := range keys {
+			h, msg := db.hllGet(k)
+			if msg != "" {
+				c.WriteError(msg)
+				return
+			}
+			if h != nil {
+				merged.merge(h)
+			}
+		}
+		c.WriteInt(int(merged.count()))
+	})
+}
+
+// PFMERGE
+func (m *RediQueue) cmdPfmerge(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	dest, keys := args[0], args
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		// dest is merged as well
+		merged := &hll{}
+		for _, k := range keys {
+			h, msg := db.hllGet(k)
+			if msg != "" {
+				c.WriteError(msg)
+				return
+			}
+			if h != nil {
+				merged.merge(h)
+			}
+		}
+		db.stringUpdate(dest, merged.String())
+		c.WriteOK()
+	})
+}
@@ -0,0 +1,203 @@
+package rediqueue
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Test PFADD and PFCOUNT.
+func TestPfadd(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	s.SetTime(time.Now())
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		v, err := redis.Int(c.Do("PFADD", "h", "a", "b", "c", "d", "e", "f", "g"))
+		ok(t, err)
+		equals(t, 1, v)
+
+		v, err = redis.Int(c.Do("PFADD", "h", "a", "b"))
+		ok(t, err)
+		equals(t, 0, v)
+
+		n, err := redis.Int(c.Do("PFCOUNT", "h"))
+		ok(t, err)
+		equals(t, 7, n)
+
+		typ, err := redis.String(c.Do("TYPE", "h"))
+		ok(t, err)
+		equals(t, "string", typ)
+	}
+
+	// Without elements only creates the key, which is an empty sparse one,
+	// byte for byte as Redis makes it.
+	{
+		v, err := redis.Int(c.Do("PFADD", "empty"))
+		ok(t, err)
+		equals(t, 1, v)
+		s.CheckGet(t, "empty", "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff")
+
+		v, err = redis.Int(c.Do("PFADD", "empty"))
+		ok(t, err)
+		equals(t, 0, v)
+
+		n, err := redis.Int(c.Do("PFCOUNT", "empty"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		n, err = redis.Int(c.Do("PFCOUNT", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	// Within the standard error, which is 0.81%.
+	{
+		for i := 0; i < 100000; i += 1000 {
+			args := []interface{}{"big"}
+			for j := i; j < i+1000; j++ {
+				args = append(args, "producer-"+strconv.Itoa(j))
+			}
+			_, err := c.Do("PFADD", args...)
+			ok(t, err)
+		}
+		n, err := redis.Int(c.Do("PFCOUNT", "big"))
+		ok(t, err)
+		assert(t, n > 98000 && n < 102000, "PFCOUNT %d", n)
+
+		v, err := s.Get("big")
+		ok(t, err)
+		equals(t, hllDenseSize, len(v))
+	}
+
+	// The count is cached in the value
+	{
+		_, err := c.Do("PFADD", "cache", "a", "b")
+		ok(t, err)
+		v, err := s.Get("cache")
+		ok(t, err)
+		equals(t, byte(0x80), v[15])
+
+		_, err = c.Do("PFCOUNT", "cache")
+		ok(t, err)
+		v, err = s.Get("cache")
+		ok(t, err)
+		equals(t, "\x02\x00\x00\x00\x00\x00\x00\x00", v[8:16])
+	}
+
+	// TTLs are kept
+	{
+		_, err := c.Do("PFADD", "ttl", "a")
+		ok(t, err)
+		s.SetTTL("ttl", 10*time.Second)
+		_, err = c.Do("PFADD", "ttl", "b")
+		ok(t, err)
+		_, err = c.Do("PFCOUNT", "ttl")
+		ok(t, err)
+		equals(t, 10*time.Second, s.TTL("ttl"))
+	}
+
+	// Wrong type of key
+	{
+		s.Push("list", "aap")
+		_, err := c.Do("PFADD", "list", "a")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("PFCOUNT", "list")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+
+		s.Set("str", "foo")
+		_, err = c.Do("PFADD", "str", "a")
+		equals(t, msgNotHLL, err.(redis.Error).Error())
+		_, err = c.Do("PFCOUNT", "str", "h")
+		equals(t, msgNotHLL, err.(redis.Error).Error())
+
+		s.Set("broken", "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f")
+		_, err = c.Do("PFCOUNT", "broken")
+		equals(t, msgInvalidHLL, err.(redis.Error).Error())
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("PFADD")
+		assert(t, err != nil, "PFADD error")
+		_, err = c.Do("PFCOUNT")
+		assert(t, err != nil, "PFCOUNT error")
+	}
+}
+
+// Test PFCOUNT with more keys, and PFMERGE.
+func TestPfmerge(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	_, err = c.Do("PFADD", "h1", "a", "b", "c")
+	ok(t, err)
+	_, err = c.Do("PFADD", "h2", "c", "d")
+	ok(t, err)
+
+	{
+		n, err := redis.Int(c.Do("PFCOUNT", "h1", "h2", "nosuch"))
+		ok(t, err)
+		equals(t, 4, n)
+	}
+
+	{
+		v, err := redis.String(c.Do("PFMERGE", "dest", "h1", "h2", "nosuch"))
+		ok(t, err)
+		equals(t, "OK", v)
+
+		n, err := redis.Int(c.Do("PFCOUNT", "dest"))
+		ok(t, err)
+		equals(t, 4, n)
+
+		// dest is merged as well
+		_, err = c.Do("PFADD", "h3", "e")
+		ok(t, err)
+		_, err = c.Do("PFMERGE", "dest", "h3")
+		ok(t, err)
+		n, err = redis.Int(c.Do("PFCOUNT", "dest"))
+		ok(t, err)
+		equals(t, 5, n)
+
+		// only dest
+		_, err = c.Do("PFMERGE", "new")
+		ok(t, err)
+		n, err = redis.Int(c.Do("PFCOUNT", "new"))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	// Wrong type of key
+	{
+		s.Set("str", "foo")
+		_, err := c.Do("PFMERGE", "dest", "str")
+		equals(t, msgNotHLL, err.(redis.Error).Error())
+		_, err = c.Do("PFMERGE", "str", "h1")
+		equals(t, msgNotHLL, err.(redis.Error).Error())
+		_, err = c.Do("PFMERGE")
+		assert(t, err != nil, "PFMERGE error")
+	}
+
+	// In a transaction
+	{
+		_, err := c.Do("MULTI")
+		ok(t, err)
+		v, err := redis.String(c.Do("PFADD", "tx", "a"))
+		ok(t, err)
+		equals(t, "QUEUED", v)
+		v, err = redis.String(c.Do("PFCOUNT", "tx"))
+		ok(t, err)
+		equals(t, "QUEUED", v)
+		res, err := redis.Values(c.Do("EXEC"))
+		ok(t, err)
+		equals(t, []interface{}{int64(1), int64(1)}, res)
+	}
+}
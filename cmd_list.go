@@ -19,13 +19,18 @@ const (
 
 // commandsList handles list commands (mostly L*)
 func commandsList(m *RediQueue) {
+	m.srv.Register("BLMOVE", m.cmdBlmove)
+	m.srv.Register("BLMPOP", m.cmdBlmpop)
 	m.srv.Register("BLPOP", m.cmdBlpop)
 	m.srv.Register("BRPOP", m.cmdBrpop)
 	m.srv.Register("BRPOPLPUSH", m.cmdBrpoplpush)
 	m.srv.Register("LINDEX", m.cmdLindex)
 	m.srv.Register("LINSERT", m.cmdLinsert)
 	m.srv.Register("LLEN", m.cmdLlen)
+	m.srv.Register("LMOVE", m.cmdLmove)
+	m.srv.Register("LMPOP", m.cmdLmpop)
 	m.srv.Register("LPOP", m.cmdLpop)
+	m.srv.Register("LPOS", m.cmdLpos)
 	m.srv.Register("LPUSH", m.cmdLpush)
 	m.srv.Register("LPUSHX", m.cmdLpushx)
 	m.srv.Register("LRANGE", m.cmdLrange)
@@ -134,13 +139,12 @@ func (m *RediQueue) cmdLindex(c *server.Peer, cmd string, args []string) {
 	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
 		db := m.db(ctx.selectedDB)
 
-		t, ok := db.keys[key]
-		if !ok {
+		if !db.exists(key) {
 			// No such key
 			c.WriteNull()
 			return
 		}
-		if t != "list" {
+		if db.t(key) != "list" {
 			c.WriteError(msgWrongType)
 			return
 		}
@@ -186,38 +190,17 @@ func (m *RediQueue) cmdLinsert(c *server.Peer, cmd string, args []string) {
 	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
 		db := m.db(ctx.selectedDB)
 
-		t, ok := db.keys[key]
-		if !ok {
+		if !db.exists(key) {
 			// No such key
 			c.WriteInt(0)
 			return
 		}
-		if t != "list" {
+		if db.t(key) != "list" {
 			c.WriteError(msgWrongType)
 			return
 		}
 
-		l := db.listKeys[key]
-		for i, el := range l {
-			if el != pivot {
-				continue
-			}
-
-			if where < 0 {
-				l = append(l[:i], append(listKey{value}, l[i:]...)...)
-			} else {
-				if i == len(l)-1 {
-					l = append(l, value)
-				} else {
-					l = append(l[:i+1], append(listKey{value}, l[i+1:]...)...)
-				}
-			}
-			db.listKeys[key] = l
-			db.keyVersion[key]++
-			c.WriteInt(len(l))
-			return
-		}
-		c.WriteInt(-1)
+		c.WriteInt(db.listInsert(key, where, pivot, value))
 	})
 }
 
@@ -237,13 +220,12 @@ func (m *RediQueue) cmdLlen(c *server.Peer, cmd string, args []string) {
 	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
 		db := m.db(ctx.selectedDB)
 
-		t, ok := db.keys[key]
-		if !ok {
+		if !db.exists(key) {
 			// No such key. That's zero length.
 			c.WriteInt(0)
 			return
 		}
-		if t != "list" {
+		if db.t(key) != "list" {
 			c.WriteError(msgWrongType)
 			return
 		}
@@ -263,7 +245,7 @@ func (m *RediQueue) cmdRpop(c *server.Peer, cmd string, args []string) {
 }
 
 func (m *RediQueue) cmdXpop(c *server.Peer, cmd string, args []string, lr leftright) {
-	if len(args) != 1 {
+	if len(args) < 1 || len(args) > 2 {
 		setDirty(c)
 		c.WriteError(errWrongNumber(cmd))
 		return
@@ -273,12 +255,32 @@ func (m *RediQueue) cmdXpop(c *server.Peer, cmd string, args []string, lr leftri
 	}
 
 	key := args[0]
+	withCount := len(args) == 2
+	count := 1
+	if withCount {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+		if n < 0 {
+			setDirty(c)
+			c.WriteError(msgMustBePositive)
+			return
+		}
+		count = n
+	}
 
 	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
 		db := m.db(ctx.selectedDB)
 
 		if !db.exists(key) {
 			// non-existing key is fine
+			if withCount {
+				c.WriteNullArray()
+				return
+			}
 			c.WriteNull()
 			return
 		}
@@ -287,14 +289,15 @@ func (m *RediQueue) cmdXpop(c *server.Peer, cmd string, args []string, lr leftri
 			return
 		}
 
-		var elem string
-		switch lr {
-		case left:
-			elem = db.listLpop(key)
-		case right:
-			elem = db.listPop(key)
+		elems := db.listPopN(key, count, lr)
+		if !withCount {
+			c.WriteBulk(elems[0])
+			return
+		}
+		c.WriteLen(len(elems))
+		for _, e := range elems {
+			c.WriteBulk(e)
 		}
-		c.WriteBulk(elem)
 	})
 }
 
@@ -416,7 +419,7 @@ func (m *RediQueue) cmdLrange(c *server.Peer, cmd string, args []string) {
 	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
 		db := m.db(ctx.selectedDB)
 
-		if t, ok := db.keys[key]; ok && t != "list" {
+		if db.exists(key) && db.t(key) != "list" {
 			c.WriteError(msgWrongType)
 			return
 		}
@@ -467,40 +470,7 @@ func (m *RediQueue) cmdLrem(c *server.Peer, cmd string, args []string) {
 			return
 		}
 
-		l := db.listKeys[key]
-		if count < 0 {
-			reverseSlice(l)
-		}
-		deleted := 0
-		newL := []string{}
-		toDelete := len(l)
-		if count < 0 {
-			toDelete = -count
-		}
-		if count > 0 {
-			toDelete = count
-		}
-		for _, el := range l {
-			if el == value {
-				if toDelete > 0 {
-					deleted++
-					toDelete--
-					continue
-				}
-			}
-			newL = append(newL, el)
-		}
-		if count < 0 {
-			reverseSlice(newL)
-		}
-		if len(newL) == 0 {
-			db.del(key)
-		} else {
-			db.listKeys[key] = newL
-			db.keyVersion[key]++
-		}
-
-		c.WriteInt(deleted)
+		c.WriteInt(db.listRem(key, count, value))
 	})
 }
 
@@ -544,9 +514,7 @@ func (m *RediQueue) cmdLset(c *server.Peer, cmd string, args []string) {
 			c.WriteError(msgOutOfRange)
 			return
 		}
-		l[index] = value
-		db.keyVersion[key]++
-
+		db.listSet(key, index, value)
 		c.WriteOK()
 	})
 }
@@ -579,25 +547,16 @@ func (m *RediQueue) cmdLtrim(c *server.Peer, cmd string, args []string) {
 	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
 		db := m.db(ctx.selectedDB)
 
-		t, ok := db.keys[key]
-		if !ok {
+		if !db.exists(key) {
 			c.WriteOK()
 			return
 		}
-		if t != "list" {
+		if db.t(key) != "list" {
 			c.WriteError(msgWrongType)
 			return
 		}
 
-		l := db.listKeys[key]
-		rs, re := redisRange(len(l), start, end, false)
-		l = l[rs:re]
-		if len(l) == 0 {
-			db.del(key)
-		} else {
-			db.listKeys[key] = l
-			db.keyVersion[key]++
-		}
+		db.listTrim(key, start, end)
 		c.WriteOK()
 	})
 }
@@ -626,9 +585,7 @@ func (m *RediQueue) cmdRpoplpush(c *server.Peer, cmd string, args []string) {
 			c.WriteError(msgWrongType)
 			return
 		}
-		elem := db.listPop(src)
-		db.listLpush(dst, elem)
-		c.WriteBulk(elem)
+		c.WriteBulk(db.listMove(src, dst, right, left))
 	})
 }
 
@@ -674,9 +631,213 @@ func (m *RediQueue) cmdBrpoplpush(c *server.Peer, cmd string, args []string) {
 			if len(db.listKeys[src]) == 0 {
 				return false
 			}
-			elem := db.listPop(src)
-			db.listLpush(dst, elem)
-			c.WriteBulk(elem)
+			c.WriteBulk(db.listMove(src, dst, right, left))
+			return true
+		},
+		func(c *server.Peer) {
+			// timeout
+			c.WriteNull()
+		},
+	)
+}
+
+// LPOS
+func (m *RediQueue) cmdLpos(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, elem, args := args[0], args[1], args[2:]
+	var (
+		rank      = 1
+		count     = 1
+		withCount = false
+		maxlen    = 0 // 0 is no limit
+	)
+	for len(args) > 0 {
+		opt := strings.ToUpper(args[0])
+		if len(args) < 2 || (opt != "RANK" && opt != "COUNT" && opt != "MAXLEN") {
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+		switch opt {
+		case "RANK":
+			if n == 0 {
+				setDirty(c)
+				c.WriteError(msgRankZero)
+				return
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				setDirty(c)
+				c.WriteError(msgCountNegative)
+				return
+			}
+			count, withCount = n, true
+		case "MAXLEN":
+			if n < 0 {
+				setDirty(c)
+				c.WriteError(msgMaxlenNegative)
+				return
+			}
+			maxlen = n
+		}
+		args = args[2:]
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "list" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		// A negative rank searches from the tail. Either way the n-th match
+		// is the first one we want.
+		l := db.listKeys[key]
+		skip := rank - 1
+		if rank < 0 {
+			skip = -rank - 1
+		}
+		var res []int
+		for i := 0; i < len(l) && (maxlen == 0 || i < maxlen); i++ {
+			idx := i
+			if rank < 0 {
+				idx = len(l) - 1 - i
+			}
+			if l[idx] != elem {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			res = append(res, idx)
+			if count != 0 && len(res) == count {
+				break
+			}
+		}
+
+		if !withCount {
+			if len(res) == 0 {
+				c.WriteNull()
+				return
+			}
+			c.WriteInt(res[0])
+			return
+		}
+		c.WriteLen(len(res))
+		for _, idx := range res {
+			c.WriteInt(idx)
+		}
+	})
+}
+
+// LMOVE
+func (m *RediQueue) cmdLmove(c *server.Peer, cmd string, args []string) {
+	if len(args) != 4 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	src, dst := args[0], args[1]
+	from, ok := parseLeftRight(args[2])
+	if !ok {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+	to, ok := parseLeftRight(args[3])
+	if !ok {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(src) {
+			c.WriteNull()
+			return
+		}
+		if db.t(src) != "list" || (db.exists(dst) && db.t(dst) != "list") {
+			c.WriteError(msgWrongType)
+			return
+		}
+		c.WriteBulk(db.listMove(src, dst, from, to))
+	})
+}
+
+// BLMOVE
+func (m *RediQueue) cmdBlmove(c *server.Peer, cmd string, args []string) {
+	if len(args) != 5 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	src, dst := args[0], args[1]
+	from, ok := parseLeftRight(args[2])
+	if !ok {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+	to, ok := parseLeftRight(args[3])
+	if !ok {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+	timeout, err := strconv.Atoi(args[4])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidTimeout)
+		return
+	}
+	if timeout < 0 {
+		setDirty(c)
+		c.WriteError(msgNegTimeout)
+		return
+	}
+
+	blocking(
+		m,
+		c,
+		time.Duration(timeout)*time.Second,
+		func(c *server.Peer, ctx *connCtx) bool {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(src) {
+				return false
+			}
+			if db.t(src) != "list" || (db.exists(dst) && db.t(dst) != "list") {
+				c.WriteError(msgWrongType)
+				return true
+			}
+			c.WriteBulk(db.listMove(src, dst, from, to))
 			return true
 		},
 		func(c *server.Peer) {
@@ -685,3 +846,134 @@ func (m *RediQueue) cmdBrpoplpush(c *server.Peer, cmd string, args []string) {
 		},
 	)
 }
+
+// LMPOP
+func (m *RediQueue) cmdLmpop(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	keys, lr, count, msg := parseLmpop(args)
+	if msg != "" {
+		setDirty(c)
+		c.WriteError(msg)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		if !lmpop(c, m.db(ctx.selectedDB), keys, lr, count) {
+			c.WriteNullArray()
+		}
+	})
+}
+
+// BLMPOP
+func (m *RediQueue) cmdBlmpop(c *server.Peer, cmd string, args []string) {
+	if len(args) < 4 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	timeout, err := strconv.Atoi(args[0])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidTimeout)
+		return
+	}
+	if timeout < 0 {
+		setDirty(c)
+		c.WriteError(msgNegTimeout)
+		return
+	}
+	keys, lr, count, msg := parseLmpop(args[1:])
+	if msg != "" {
+		setDirty(c)
+		c.WriteError(msg)
+		return
+	}
+
+	blocking(
+		m,
+		c,
+		time.Duration(timeout)*time.Second,
+		func(c *server.Peer, ctx *connCtx) bool {
+			return lmpop(c, m.db(ctx.selectedDB), keys, lr, count)
+		},
+		func(c *server.Peer) {
+			// timeout
+			c.WriteNullArray()
+		},
+	)
+}
+
+// parseLmpop parses "numkeys key [key ...] LEFT|RIGHT [COUNT count]".
+func parseLmpop(args []string) ([]string, leftright, int, string) {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return nil, left, 0, msgNumkeys
+	}
+	if n > len(args)-2 {
+		return nil, left, 0, msgSyntaxError
+	}
+	keys, args := args[1:1+n], args[1+n:]
+	lr, ok := parseLeftRight(args[0])
+	if !ok {
+		return nil, left, 0, msgSyntaxError
+	}
+	count := 1
+	switch args = args[1:]; {
+	case len(args) == 0:
+	case len(args) == 2 && strings.ToUpper(args[0]) == "COUNT":
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count <= 0 {
+			return nil, left, 0, msgCountZero
+		}
+	default:
+		return nil, left, 0, msgSyntaxError
+	}
+	return keys, lr, count, ""
+}
+
+// lmpop pops from the first list of keys which has something, and writes
+// the key and the elements. Returns false if all lists are empty.
+func lmpop(c *server.Peer, db *RedisDB, keys []string, lr leftright, count int) bool {
+	for _, key := range keys {
+		if !db.exists(key) {
+			continue
+		}
+		if db.t(key) != "list" {
+			c.WriteError(msgWrongType)
+			return true
+		}
+		elems := db.listPopN(key, count, lr)
+		c.WriteLen(2)
+		c.WriteBulk(key)
+		c.WriteLen(len(elems))
+		for _, e := range elems {
+			c.WriteBulk(e)
+		}
+		return true
+	}
+	return false
+}
+
+// parseLeftRight parses LEFT or RIGHT.
+func parseLeftRight(s string) (leftright, bool) {
+	switch strings.ToUpper(s) {
+	case "LEFT":
+		return left, true
+	case "RIGHT":
+		return right, true
+	default:
+		return left, false
+	}
+}
@@ -1,6 +1,8 @@
 package rediqueue
 
 import (
+	"bufio"
+	"net"
 	"testing"
 	"time"
 
@@ -25,6 +27,19 @@ func setup2(t *testing.T) (*RediQueue, redis.Conn, redis.Conn, func()) {
 	return s, c1, c2, func() { s.Close() }
 }
 
+// rawDo runs a command on a new connection, and gives the first line of the
+// reply. Unlike redigo, that tells a null bulk string from a null array.
+func rawDo(t *testing.T, s *RediQueue, args ...string) string {
+	conn, err := net.Dial("tcp", s.Addr())
+	ok(t, err)
+	defer conn.Close()
+	_, err = conn.Write(respCommand(args...))
+	ok(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	ok(t, err)
+	return line
+}
+
 func TestLpush(t *testing.T) {
 	s, c, done := setup(t)
 	defer done()
@@ -959,6 +974,36 @@ func TestBrpopTx(t *testing.T) {
 	}
 }
 
+func TestBlpopFair(t *testing.T) {
+	s, c1, c2, done := setup2(t)
+	defer done()
+	c3, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	// The client which blocked first gets the first element.
+	got2 := goStrings(t, c2, "BLPOP", "l", 2)
+	time.Sleep(30 * time.Millisecond)
+	got3 := goStrings(t, c3, "BLPOP", "l", 2)
+	time.Sleep(30 * time.Millisecond)
+	_, err = c1.Do("RPUSH", "l", "first", "second")
+	ok(t, err)
+
+	for _, tc := range []struct {
+		got  <-chan []string
+		want []string
+	}{
+		{got2, []string{"l", "first"}},
+		{got3, []string{"l", "second"}},
+	} {
+		select {
+		case have := <-tc.got:
+			equals(t, tc.want, have)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("BLPOP took too long")
+		}
+	}
+}
+
 func TestBlpop(t *testing.T) {
 	s, err := Run()
 	ok(t, err)
@@ -1067,3 +1112,275 @@ func TestBrpoplpushTimeout(t *testing.T) {
 		t.Error("BRPOPLPUSH took too long")
 	}
 }
+
+func TestLpopCount(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	s.Push("l", "aap", "noot", "mies", "vuur")
+	{
+		v, err := redis.Strings(c.Do("LPOP", "l", 2))
+		ok(t, err)
+		equals(t, []string{"aap", "noot"}, v)
+
+		v, err = redis.Strings(c.Do("RPOP", "l", 1))
+		ok(t, err)
+		equals(t, []string{"vuur"}, v)
+
+		v, err = redis.Strings(c.Do("LPOP", "l", 0))
+		ok(t, err)
+		equals(t, []string{}, v)
+
+		v, err = redis.Strings(c.Do("RPOP", "l", 10))
+		ok(t, err)
+		equals(t, []string{"mies"}, v)
+		equals(t, false, s.Exists("l"))
+
+		res, err := c.Do("LPOP", "l", 2)
+		ok(t, err)
+		equals(t, nil, res)
+		equals(t, "*-1\r\n", rawDo(t, s, "LPOP", "l", "2"))
+		equals(t, "*-1\r\n", rawDo(t, s, "RPOP", "nosuch", "2"))
+		equals(t, "$-1\r\n", rawDo(t, s, "LPOP", "nosuch"))
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("LPOP", "l", -1)
+		equals(t, msgMustBePositive, err.(redis.Error).Error())
+		_, err = c.Do("RPOP", "l", "foo")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("LPOP", "l", 1, 2)
+		assert(t, err != nil, "LPOP error")
+	}
+}
+
+func TestLpos(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	s.Push("l", "a", "b", "c", "d", "1", "2", "3", "4", "3", "3", "3")
+	for _, c2 := range []struct {
+		args []interface{}
+		want interface{}
+	}{
+		{[]interface{}{"l", "3"}, int64(6)},
+		{[]interface{}{"l", "3", "RANK", 2}, int64(8)},
+		{[]interface{}{"l", "3", "RANK", -1}, int64(10)},
+		{[]interface{}{"l", "3", "RANK", -5}, nil},
+		{[]interface{}{"l", "3", "MAXLEN", 6}, nil},
+		{[]interface{}{"l", "3", "COUNT", 0, "RANK", 2}, []interface{}{int64(8), int64(9), int64(10)}},
+		{[]interface{}{"l", "3", "COUNT", 2}, []interface{}{int64(6), int64(8)}},
+		{[]interface{}{"l", "3", "COUNT", 0, "RANK", -1, "MAXLEN", 3}, []interface{}{int64(10), int64(9), int64(8)}},
+		{[]interface{}{"l", "z", "COUNT", 1}, []interface{}{}},
+		{[]interface{}{"nosuch", "a"}, nil},
+		{[]interface{}{"nosuch", "a", "COUNT", 0}, []interface{}{}},
+	} {
+		v, err := c.Do("LPOS", c2.args...)
+		ok(t, err)
+		equals(t, c2.want, v)
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("LPOS", "l", "3", "RANK", 0)
+		equals(t, msgRankZero, err.(redis.Error).Error())
+		_, err = c.Do("LPOS", "l", "3", "COUNT", -1)
+		equals(t, msgCountNegative, err.(redis.Error).Error())
+		_, err = c.Do("LPOS", "l", "3", "MAXLEN", -1)
+		equals(t, msgMaxlenNegative, err.(redis.Error).Error())
+		_, err = c.Do("LPOS", "l", "3", "RANK", "foo")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("LPOS", "l", "3", "RANK")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("LPOS", "l", "3", "FOO", 1)
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		s.Set("str", "value")
+		_, err = c.Do("LPOS", "str", "3")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("LPOS", "l")
+		assert(t, err != nil, "LPOS error")
+	}
+}
+
+func TestLmove(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	s.Push("l", "one", "two", "three")
+	{
+		v, err := redis.String(c.Do("LMOVE", "l", "other", "RIGHT", "LEFT"))
+		ok(t, err)
+		equals(t, "three", v)
+		v, err = redis.String(c.Do("LMOVE", "l", "other", "left", "right"))
+		ok(t, err)
+		equals(t, "one", v)
+
+		lv, err := s.List("l")
+		ok(t, err)
+		equals(t, []string{"two"}, lv)
+		lv, err = s.List("other")
+		ok(t, err)
+		equals(t, []string{"three", "one"}, lv)
+
+		// the same list
+		v, err = redis.String(c.Do("LMOVE", "other", "other", "LEFT", "RIGHT"))
+		ok(t, err)
+		equals(t, "three", v)
+		lv, err = s.List("other")
+		ok(t, err)
+		equals(t, []string{"one", "three"}, lv)
+
+		res, err := c.Do("LMOVE", "nosuch", "other", "LEFT", "LEFT")
+		ok(t, err)
+		equals(t, nil, res)
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("LMOVE", "l", "other", "UP", "LEFT")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("LMOVE", "l", "other", "LEFT", "DOWN")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		s.Set("str", "value")
+		_, err = c.Do("LMOVE", "l", "str", "LEFT", "LEFT")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("LMOVE", "str", "l", "LEFT", "LEFT")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("LMOVE", "l", "other", "LEFT")
+		assert(t, err != nil, "LMOVE error")
+		_, err = c.Do("BLMOVE", "l", "other", "LEFT", "LEFT", -1)
+		equals(t, msgNegTimeout, err.(redis.Error).Error())
+		_, err = c.Do("BLMOVE", "l", "other", "LEFT", "LEFT", "foo")
+		equals(t, msgInvalidTimeout, err.(redis.Error).Error())
+		_, err = c.Do("BLMOVE", "l", "other", "UP", "LEFT", 1)
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+	}
+}
+
+func TestBlmove(t *testing.T) {
+	s, c1, c2, done := setup2(t)
+	defer done()
+
+	got := make(chan string, 1)
+	go func() {
+		v, err := redis.String(c2.Do("BLMOVE", "from", "to", "LEFT", "RIGHT", 1))
+		ok(t, err)
+		got <- v
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	_, err := c1.Do("RPUSH", "from", "e1", "e2")
+	ok(t, err)
+
+	select {
+	case have := <-got:
+		equals(t, "e1", have)
+	case <-time.After(500 * time.Millisecond):
+		t.Error("BLMOVE took too long")
+	}
+	lv, err := s.List("to")
+	ok(t, err)
+	equals(t, []string{"e1"}, lv)
+
+	// timeout
+	timeout := goStrings(t, c2, "BLMOVE", "nosuch", "to", "LEFT", "RIGHT", 1)
+	select {
+	case have := <-timeout:
+		equals(t, []string(nil), have)
+	case <-time.After(1500 * time.Millisecond):
+		t.Error("BLMOVE took too long")
+	}
+}
+
+func TestLmpop(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	s.Push("l1", "a", "b", "c")
+	s.Push("l2", "d")
+	{
+		res, err := redis.Values(c.Do("LMPOP", 2, "nosuch", "l1", "LEFT"))
+		ok(t, err)
+		equals(t, []interface{}{[]byte("l1"), []interface{}{[]byte("a")}}, res)
+
+		res, err = redis.Values(c.Do("LMPOP", 2, "l1", "l2", "RIGHT", "COUNT", 5))
+		ok(t, err)
+		equals(t, []interface{}{[]byte("l1"), []interface{}{[]byte("c"), []byte("b")}}, res)
+		equals(t, false, s.Exists("l1"))
+
+		v, err := c.Do("LMPOP", 1, "nosuch", "LEFT")
+		ok(t, err)
+		equals(t, nil, v)
+		equals(t, "*-1\r\n", rawDo(t, s, "LMPOP", "1", "nosuch", "LEFT"))
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("LMPOP", 0, "l2", "LEFT")
+		equals(t, msgNumkeys, err.(redis.Error).Error())
+		_, err = c.Do("LMPOP", "foo", "l2", "LEFT")
+		equals(t, msgNumkeys, err.(redis.Error).Error())
+		_, err = c.Do("LMPOP", 2, "l2", "LEFT")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("LMPOP", 1, "l2", "UP")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("LMPOP", 1, "l2", "LEFT", "COUNT", 0)
+		equals(t, msgCountZero, err.(redis.Error).Error())
+		_, err = c.Do("LMPOP", 1, "l2", "LEFT", "COUNT")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		s.Set("str", "value")
+		_, err = c.Do("LMPOP", 2, "str", "l2", "LEFT")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("BLMPOP", -1, 1, "l2", "LEFT")
+		equals(t, msgNegTimeout, err.(redis.Error).Error())
+		_, err = c.Do("BLMPOP", 1, 0, "l2", "LEFT")
+		equals(t, msgNumkeys, err.(redis.Error).Error())
+		_, err = c.Do("LMPOP", 1, "l2")
+		assert(t, err != nil, "LMPOP error")
+	}
+}
+
+func TestBlmpop(t *testing.T) {
+	s, c1, c2, done := setup2(t)
+	defer done()
+
+	got := make(chan []interface{}, 1)
+	go func() {
+		res, err := redis.Values(c2.Do("BLMPOP", 1, 2, "l1", "l2", "RIGHT", "COUNT", 2))
+		ok(t, err)
+		got <- res
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	_, err := c1.Do("RPUSH", "l2", "e1", "e2", "e3")
+	ok(t, err)
+
+	select {
+	case have := <-got:
+		equals(t, []interface{}{[]byte("l2"), []interface{}{[]byte("e3"), []byte("e2")}}, have)
+	case <-time.After(500 * time.Millisecond):
+		t.Error("BLMPOP took too long")
+	}
+
+	// In a transaction it doesn't block.
+	{
+		_, err := c1.Do("MULTI")
+		ok(t, err)
+		_, err = c1.Do("BLMPOP", 0, 1, "nosuch", "LEFT")
+		ok(t, err)
+		_, err = c1.Do("BLMPOP", 0, 1, "l2", "LEFT")
+		ok(t, err)
+		res, err := redis.Values(c1.Do("EXEC"))
+		ok(t, err)
+		equals(t, []interface{}{nil, []interface{}{[]byte("l2"), []interface{}{[]byte("e1")}}}, res)
+	}
+
+	// timeout
+	{
+		v, err := c1.Do("BLMPOP", 1, 1, "nosuch", "LEFT")
+		ok(t, err)
+		equals(t, nil, v)
+		equals(t, "*-1\r\n", rawDo(t, s, "BLMPOP", "1", "1", "nosuch", "LEFT"))
+	}
+}
@@ -3,15 +3,24 @@
 package rediqueue
 
 import (
+	"fmt"
+	"log"
+	"os"
 	"strings"
 
 	"github.com/chinahdkj/rediqueue/server"
 )
 
 func commandsServer(m *RediQueue) {
+	m.srv.Register("BGREWRITEAOF", m.cmdBgrewriteaof)
+	m.srv.Register("BGSAVE", m.cmdBgsave)
+	m.srv.Register("CONFIG", m.cmdConfig)
 	m.srv.Register("DBSIZE", m.cmdDbsize)
 	m.srv.Register("FLUSHALL", m.cmdFlushall)
 	m.srv.Register("FLUSHDB", m.cmdFlushdb)
+	m.srv.Register("LASTSAVE", m.cmdLastsave)
+	m.srv.Register("SAVE", m.cmdSave)
+	m.srv.Register("SHUTDOWN", m.cmdShutdown)
 }
 
 // DBSIZE
@@ -73,3 +82,204 @@ func (m *RediQueue) cmdFlushdb(c *server.Peer, cmd string, args []string) {
 		c.WriteOK()
 	})
 }
+
+// BGREWRITEAOF
+func (m *RediQueue) cmdBgrewriteaof(c *server.Peer, cmd string, args []string) {
+	if len(args) > 0 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		a := m.aof
+		if a == nil {
+			c.WriteError(ErrAOFDisabled.Error())
+			return
+		}
+		if a.rewriting {
+			c.WriteError(ErrAOFRewriteInProgress.Error())
+			return
+		}
+		a.scheduleRewrite()
+		c.WriteInline("Background append only file rewriting started")
+	})
+}
+
+// SAVE
+func (m *RediQueue) cmdSave(c *server.Peer, cmd string, args []string) {
+	if len(args) > 0 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		if m.saving {
+			c.WriteError(ErrSaveInProgress.Error())
+			return
+		}
+		if err := m.save(); err != nil {
+			c.WriteError("ERR " + err.Error())
+			return
+		}
+		c.WriteOK()
+	})
+}
+
+// BGSAVE
+func (m *RediQueue) cmdBgsave(c *server.Peer, cmd string, args []string) {
+	if len(args) > 0 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		if m.saving {
+			c.WriteError(ErrSaveInProgress.Error())
+			return
+		}
+		m.bgsave()
+		c.WriteInline("Background saving started")
+	})
+}
+
+// LASTSAVE
+func (m *RediQueue) cmdLastsave(c *server.Peer, cmd string, args []string) {
+	if len(args) > 0 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		c.WriteInt(int(m.lastSave.Unix()))
+	})
+}
+
+// CONFIG
+func (m *RediQueue) cmdConfig(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	sub := args[0]
+	args = args[1:]
+	switch strings.ToLower(sub) {
+	case "get":
+		if len(args) < 1 {
+			setDirty(c)
+			c.WriteError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try CONFIG HELP.", sub))
+			return
+		}
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			params := map[string]string{
+				"dir":        m.dir,
+				"dbfilename": m.dbFilename,
+			}
+			if params["dir"] == "" {
+				params["dir"], _ = os.Getwd()
+			}
+			var names []string
+			for _, pattern := range args {
+				names = append(names, matchKeys([]string{"dbfilename", "dir"}, strings.ToLower(pattern))...)
+			}
+			seen := map[string]bool{}
+			var res []string
+			for _, n := range names {
+				if seen[n] {
+					continue
+				}
+				seen[n] = true
+				res = append(res, n, params[n])
+			}
+			c.WriteLen(len(res))
+			for _, v := range res {
+				c.WriteBulk(v)
+			}
+		})
+	case "set":
+		if len(args) != 2 {
+			setDirty(c)
+			c.WriteError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try CONFIG HELP.", sub))
+			return
+		}
+		param, value := strings.ToLower(args[0]), args[1]
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			switch param {
+			case "dir":
+				if err := checkDir(value); err != nil {
+					c.WriteError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", param, err))
+					return
+				}
+				m.dir = value
+			case "dbfilename":
+				if err := checkDBFilename(value); err != nil {
+					c.WriteError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", param, err))
+					return
+				}
+				m.dbFilename = value
+			default:
+				c.WriteError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[0]))
+				return
+			}
+			c.WriteOK()
+		})
+	default:
+		setDirty(c)
+		c.WriteError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try CONFIG HELP.", sub))
+	}
+}
+
+// SHUTDOWN
+func (m *RediQueue) cmdShutdown(c *server.Peer, cmd string, args []string) {
+	if len(args) > 1 {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+	mode := ShutdownDefault
+	if len(args) == 1 {
+		switch strings.ToUpper(args[0]) {
+		case "SAVE":
+			mode = ShutdownSave
+		case "NOSAVE":
+			mode = ShutdownNoSave
+		default:
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		// There is no reply, the connection is closed.
+		c.Close()
+		go func() {
+			if err := m.Shutdown(mode); err != nil {
+				log.Printf("rediqueue shutdown: %v", err)
+			}
+		}()
+	})
+}
@@ -1,7 +1,10 @@
 package rediqueue
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -88,3 +91,71 @@ func TestCmdServer(t *testing.T) {
 		assert(t, err != nil, "no FLUSHALL error")
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewRediQueue()
+	s.SetDir(dir)
+	s.SetAppendOnly("appendonly.aof", FsyncNo)
+	ok(t, s.Start())
+	addr := s.Addr()
+
+	blocked, err := redis.Dial("tcp", addr)
+	ok(t, err)
+	c, err := redis.Dial("tcp", addr)
+	ok(t, err)
+
+	res := make(chan interface{}, 1)
+	go func() {
+		v, err := blocked.Do("BLPOP", "nosuch", 0)
+		if err != nil {
+			v = err
+		}
+		res <- v
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	_, err = c.Do("RPUSH", "queue", "job")
+	ok(t, err)
+	_, err = c.Do("SHUTDOWN", "SAVE")
+	assert(t, err != nil, "SHUTDOWN replied")
+	equals(t, nil, <-res)
+	ok(t, s.Wait())
+	_, err = redis.Dial("tcp", addr)
+	assert(t, err != nil, "still accepting connections")
+	s.Close() // no-op
+
+	// Both the snapshot and the append-only file are complete.
+	s2 := NewRediQueue()
+	s2.SetDir(dir)
+	ok(t, s2.Load())
+	s2.CheckList(t, "queue", "job")
+	s3 := NewRediQueue()
+	s3.SetDir(dir)
+	s3.SetAppendOnly("appendonly.aof", FsyncNo)
+	ok(t, s3.Start())
+	s3.CheckList(t, "queue", "job")
+
+	// Direct use.
+	s3.Push("queue", "other")
+	ok(t, s3.Shutdown(ShutdownNoSave))
+	ok(t, s3.Shutdown(ShutdownNoSave))
+	ok(t, s2.Load())
+	s2.CheckList(t, "queue", "job")
+
+	// Errors
+	s4, err := Run()
+	ok(t, err)
+	defer s4.Close()
+	c4, err := redis.Dial("tcp", s4.Addr())
+	ok(t, err)
+	_, err = c4.Do("SHUTDOWN", "FOO")
+	assert(t, err != nil, "no error")
+	_, err = c4.Do("SHUTDOWN", "SAVE", "NOW")
+	assert(t, err != nil, "no error")
+	_, err = c4.Do("PING")
+	ok(t, err)
+}
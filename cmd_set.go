@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chinahdkj/rediqueue/server"
 )
@@ -13,6 +14,9 @@ import (
 // commandsSet handles all set value operations.
 func commandsSet(m *RediQueue) {
 	m.srv.Register("SADD", m.cmdSadd)
+	m.srv.Register("SADDEX", makeCmdSaddex(m, false, time.Second))
+	m.srv.Register("PSADDEX", makeCmdSaddex(m, false, time.Millisecond))
+	m.srv.Register("PSADDEXAT", makeCmdSaddex(m, true, time.Millisecond))
 	m.srv.Register("SCARD", m.cmdScard)
 	m.srv.Register("SDIFF", m.cmdSdiff)
 	m.srv.Register("SDIFFSTORE", m.cmdSdiffstore)
@@ -21,12 +25,15 @@ func commandsSet(m *RediQueue) {
 	m.srv.Register("SISMEMBER", m.cmdSismember)
 	m.srv.Register("SMEMBERS", m.cmdSmembers)
 	m.srv.Register("SMOVE", m.cmdSmove)
+	m.srv.Register("SPERSIST", m.cmdSpersist)
 	m.srv.Register("SPOP", m.cmdSpop)
 	m.srv.Register("SRANDMEMBER", m.cmdSrandmember)
 	m.srv.Register("SREM", m.cmdSrem)
 	m.srv.Register("SUNION", m.cmdSunion)
 	m.srv.Register("SUNIONSTORE", m.cmdSunionstore)
 	m.srv.Register("SSCAN", m.cmdSscan)
+	m.srv.Register("STTL", m.cmdSttl)
+	m.srv.Register("PSTTL", m.cmdSttl)
 }
 
 // SADD
@@ -55,6 +62,124 @@ func (m *RediQueue) cmdSadd(c *server.Peer, cmd string, args []string) {
 	})
 }
 
+// generic command for SADDEX, PSADDEX, and PSADDEXAT. These are not in Redis:
+// they add members which expire on their own, and update the TTL of members
+// which are already there. d is the time unit. If unix is set it'll be seen
+// as a unixtimestamp.
+func makeCmdSaddex(m *RediQueue, unix bool, d time.Duration) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) < 3 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		key, elems := args[0], args[2:]
+		i, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+		if i <= 0 {
+			setDirty(c)
+			c.WriteError(errInvalidExpire(cmd))
+			return
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			base := m.effectiveNow()
+			if unix {
+				base = time.Unix(0, 0)
+			}
+			at, ok := expireAt(base, i, d)
+			if !ok {
+				c.WriteError(errInvalidExpire(cmd))
+				return
+			}
+			if db.exists(key) && db.t(key) != "set" {
+				c.WriteError(ErrWrongType.Error())
+				return
+			}
+
+			c.WriteInt(db.setAddTTL(key, at, elems...))
+		})
+	}
+}
+
+// STTL and PSTTL. Not in Redis: the TTL of a set member.
+func (m *RediQueue) cmdSttl(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, member := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "set" {
+			c.WriteError(ErrWrongType.Error())
+			return
+		}
+		if !db.setIsMember(key, member) {
+			// No such member
+			c.WriteInt(-2)
+			return
+		}
+		at, ok := db.memberTTL(key, member)
+		if !ok {
+			// No expire value
+			c.WriteInt(-1)
+			return
+		}
+		left := at.Sub(m.effectiveNow())
+		if strings.ToUpper(cmd) == "PSTTL" {
+			c.WriteInt(int((left + time.Millisecond/2) / time.Millisecond))
+			return
+		}
+		c.WriteInt(int((left + time.Second/2) / time.Second))
+	})
+}
+
+// SPERSIST. Not in Redis: removes the TTL of a set member.
+func (m *RediQueue) cmdSpersist(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, member := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "set" {
+			c.WriteError(ErrWrongType.Error())
+			return
+		}
+		if !db.setPersist(key, member) {
+			c.WriteInt(0)
+			return
+		}
+		c.WriteInt(1)
+	})
+}
+
 // SCARD
 func (m *RediQueue) cmdScard(c *server.Peer, cmd string, args []string) {
 	if len(args) != 1 {
@@ -304,8 +429,13 @@ func (m *RediQueue) cmdSmove(c *server.Peer, cmd string, args []string) {
 			c.WriteInt(0)
 			return
 		}
+		at, ttl := db.memberTTL(src, member)
 		db.setRem(src, member)
-		db.setAdd(dst, member)
+		if ttl {
+			db.setAddTTL(dst, at, member)
+		} else {
+			db.setAdd(dst, member)
+		}
 		c.WriteInt(1)
 	})
 }
@@ -1,8 +1,12 @@
 package rediqueue
 
 import (
+	"bufio"
+	"bytes"
+	"math"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -733,3 +737,186 @@ func TestSscan(t *testing.T) {
 		assert(t, err != nil, "do SSCAN error")
 	}
 }
+
+// Test SADDEX / STTL / SPERSIST.
+func TestSaddex(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.SetTime(now)
+	s.SetAdd("seen", "forever")
+
+	{
+		v, err := redis.Int(c.Do("SADDEX", "seen", 10, "a", "b"))
+		ok(t, err)
+		equals(t, 2, v)
+		v, err = redis.Int(c.Do("PSADDEX", "seen", 20000, "b", "c"))
+		ok(t, err)
+		equals(t, 1, v)
+		v, err = redis.Int(c.Do("PSADDEXAT", "seen", now.Unix()*1000+30000, "d"))
+		ok(t, err)
+		equals(t, 1, v)
+		s.CheckSet(t, "seen", "a", "b", "c", "d", "forever")
+
+		v, err = redis.Int(c.Do("STTL", "seen", "a"))
+		ok(t, err)
+		equals(t, 10, v)
+		v, err = redis.Int(c.Do("PSTTL", "seen", "b"))
+		ok(t, err)
+		equals(t, 20000, v)
+		equals(t, 30*time.Second, s.MemberTTL("seen", "d"))
+		v, err = redis.Int(c.Do("STTL", "seen", "forever"))
+		ok(t, err)
+		equals(t, -1, v)
+		v, err = redis.Int(c.Do("STTL", "seen", "nosuch"))
+		ok(t, err)
+		equals(t, -2, v)
+		v, err = redis.Int(c.Do("STTL", "nosuch", "a"))
+		ok(t, err)
+		equals(t, -2, v)
+	}
+
+	// Expired members are gone
+	{
+		s.FastForward(10 * time.Second)
+		members, err := redis.Strings(c.Do("SMEMBERS", "seen"))
+		ok(t, err)
+		equals(t, []string{"b", "c", "d", "forever"}, members)
+		v, err := redis.Int(c.Do("SISMEMBER", "seen", "a"))
+		ok(t, err)
+		equals(t, 0, v)
+
+		s.SetTime(now.Add(20 * time.Second))
+		v, err = redis.Int(c.Do("SCARD", "seen"))
+		ok(t, err)
+		equals(t, 2, v)
+		res, err := redis.Values(c.Do("SSCAN", "seen", 0))
+		ok(t, err)
+		keys, err := redis.Strings(res[1], nil)
+		ok(t, err)
+		equals(t, []string{"d", "forever"}, keys)
+	}
+
+	// SPERSIST, and SADD doesn't change the TTL
+	{
+		v, err := redis.Int(c.Do("SPERSIST", "seen", "d"))
+		ok(t, err)
+		equals(t, 1, v)
+		v, err = redis.Int(c.Do("SPERSIST", "seen", "d"))
+		ok(t, err)
+		equals(t, 0, v)
+		equals(t, time.Duration(0), s.MemberTTL("seen", "d"))
+
+		_, err = s.SetAddTTL("seen", time.Hour, "e")
+		ok(t, err)
+		v, err = redis.Int(c.Do("SADD", "seen", "e"))
+		ok(t, err)
+		equals(t, 0, v)
+		equals(t, time.Hour, s.MemberTTL("seen", "e"))
+	}
+
+	// The set goes when the last member expires, the key TTL still counts
+	{
+		_, err := s.SetAddTTL("dedup", time.Second, "x")
+		ok(t, err)
+		_, err = s.SetAddTTL("dedup", time.Minute, "y")
+		ok(t, err)
+		s.FastForward(time.Second)
+		s.CheckSet(t, "dedup", "y")
+		s.FastForward(time.Minute)
+		assert(t, !s.Exists("dedup"), "dedup still exists")
+	}
+
+	// SMOVE and RENAME keep member TTLs
+	{
+		_, err := c.Do("SMOVE", "seen", "other", "e")
+		ok(t, err)
+		equals(t, time.Hour-61*time.Second, s.MemberTTL("other", "e"))
+		_, err = c.Do("RENAME", "other", "renamed")
+		ok(t, err)
+		equals(t, time.Hour-61*time.Second, s.MemberTTL("renamed", "e"))
+	}
+
+	// Errors
+	{
+		_, err := c.Do("SADDEX", "seen", 10)
+		assert(t, err != nil, "no error")
+		_, err = c.Do("SADDEX", "seen", "foo", "a")
+		assert(t, err != nil, "no error")
+		_, err = c.Do("SADDEX", "seen", 0, "a")
+		assert(t, err != nil, "no error")
+		_, err = c.Do("SADDEX", "s", 9300000000, "m")
+		equals(t, "ERR invalid expire time in 'saddex' command", err.(redis.Error).Error())
+		_, err = c.Do("PSADDEX", "s", int64(math.MaxInt64), "m")
+		equals(t, "ERR invalid expire time in 'psaddex' command", err.(redis.Error).Error())
+		_, err = c.Do("PSADDEXAT", "s", int64(math.MaxInt64), "m")
+		equals(t, "ERR invalid expire time in 'psaddexat' command", err.(redis.Error).Error())
+		equals(t, false, s.Exists("s"))
+		_, err = c.Do("STTL", "seen")
+		assert(t, err != nil, "no error")
+		_, err = c.Do("SPERSIST", "seen")
+		assert(t, err != nil, "no error")
+		s.Push("list", "a")
+		_, err = c.Do("SADDEX", "list", 10, "a")
+		assert(t, err != nil, "no error")
+		_, err = c.Do("STTL", "list", "a")
+		assert(t, err != nil, "no error")
+	}
+}
+
+func TestSetMemberTTLPersistence(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := NewRediQueue()
+	s.SetTime(now)
+	s.SetAdd("seen", "forever")
+	s.SetAddTTL("seen", time.Minute, "a", "b")
+
+	var buf bytes.Buffer
+	ok(t, s.SnapshotTo(&buf))
+	s.FlushAll()
+	ok(t, s.RestoreFrom(&buf))
+	s.CheckSet(t, "seen", "a", "b", "forever")
+	equals(t, time.Minute, s.MemberTTL("seen", "a"))
+	equals(t, time.Duration(0), s.MemberTTL("seen", "forever"))
+
+	// The same, via the append-only file
+	var aof bytes.Buffer
+	w := bufio.NewWriter(&aof)
+	writeAOFState(w, s.dbs)
+	ok(t, w.Flush())
+	s2 := NewRediQueue()
+	s2.SetTime(now)
+	db := s2.db(0)
+	r := bufio.NewReader(&aof)
+	for {
+		args, _, err := readAOFCommand(r)
+		if err != nil {
+			break
+		}
+		db, err = s2.applyAOF(db, args)
+		ok(t, err)
+	}
+	s2.CheckSet(t, "seen", "a", "b", "forever")
+	equals(t, time.Minute, s2.MemberTTL("seen", "b"))
+
+	// RDB files and DUMP payloads have no place for them, so those fail.
+	equals(t, ErrRDBMemberTTL, writeRDB(&bytes.Buffer{}, s.dbs))
+	ok(t, s.Start())
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+	_, err = c.Do("DUMP", "seen")
+	equals(t, msgDumpMemberTTL, err.(redis.Error).Error())
+
+	_, err = c.Do("SPERSIST", "seen", "a")
+	ok(t, err)
+	_, err = c.Do("SPERSIST", "seen", "b")
+	ok(t, err)
+	_, err = redis.Bytes(c.Do("DUMP", "seen"))
+	ok(t, err)
+	ok(t, writeRDB(&bytes.Buffer{}, s.dbs))
+}
@@ -0,0 +1,1085 @@
+// Commands from http://redis.io/commands#sorted_set
+
+package rediqueue
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chinahdkj/rediqueue/server"
+)
+
+// commandsSortedSet handles all sorted set operations.
+func commandsSortedSet(m *RediQueue) {
+	m.srv.Register("BZPOPMAX", makeCmdBzpop(m, true))
+	m.srv.Register("BZPOPMIN", makeCmdBzpop(m, false))
+	m.srv.Register("ZADD", m.cmdZadd)
+	m.srv.Register("ZCARD", m.cmdZcard)
+	m.srv.Register("ZCOUNT", m.cmdZcount)
+	m.srv.Register("ZINCRBY", m.cmdZincrby)
+	m.srv.Register("ZINTERSTORE", makeCmdZstore(m, false))
+	m.srv.Register("ZPOPMAX", makeCmdZpop(m, true))
+	m.srv.Register("ZPOPMIN", makeCmdZpop(m, false))
+	m.srv.Register("ZRANGE", makeCmdZrange(m, false))
+	m.srv.Register("ZRANGEBYLEX", makeCmdZrangebylex(m, false))
+	m.srv.Register("ZRANGEBYSCORE", makeCmdZrangebyscore(m, false))
+	m.srv.Register("ZRANK", makeCmdZrank(m, false))
+	m.srv.Register("ZREM", m.cmdZrem)
+	m.srv.Register("ZREMRANGEBYLEX", m.cmdZremrangebylex)
+	m.srv.Register("ZREMRANGEBYRANK", m.cmdZremrangebyrank)
+	m.srv.Register("ZREMRANGEBYSCORE", m.cmdZremrangebyscore)
+	m.srv.Register("ZREVRANGE", makeCmdZrange(m, true))
+	m.srv.Register("ZREVRANGEBYLEX", makeCmdZrangebylex(m, true))
+	m.srv.Register("ZREVRANGEBYSCORE", makeCmdZrangebyscore(m, true))
+	m.srv.Register("ZREVRANK", makeCmdZrank(m, true))
+	m.srv.Register("ZSCORE", m.cmdZscore)
+	m.srv.Register("ZUNIONSTORE", makeCmdZstore(m, true))
+	m.srv.Register("ZSCAN", m.cmdZscan)
+}
+
+// BZPOPMIN and BZPOPMAX
+func makeCmdBzpop(m *RediQueue, max bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) < 2 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+		timeoutS := args[len(args)-1]
+		keys := args[:len(args)-1]
+
+		timeout, err := strconv.Atoi(timeoutS)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidTimeout)
+			return
+		}
+		if timeout < 0 {
+			setDirty(c)
+			c.WriteError(msgNegTimeout)
+			return
+		}
+
+		blocking(
+			m,
+			c,
+			time.Duration(timeout)*time.Second,
+			func(c *server.Peer, ctx *connCtx) bool {
+				db := m.db(ctx.selectedDB)
+				for _, key := range keys {
+					if !db.exists(key) {
+						continue
+					}
+					if db.t(key) != "zset" {
+						c.WriteError(msgWrongType)
+						return true
+					}
+
+					e := db.zsetPop(key, 1, max)[0]
+					c.WriteLen(3)
+					c.WriteBulk(key)
+					c.WriteBulk(e.member)
+					c.WriteBulk(formatFloat(e.score))
+					return true
+				}
+				return false
+			},
+			func(c *server.Peer) {
+				// timeout
+				c.WriteNull()
+			},
+		)
+	}
+}
+
+// ZADD
+func (m *RediQueue) cmdZadd(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, args := args[0], args[1:]
+	var nx, xx, gt, lt, ch, incr bool
+loop:
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break loop
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+	if nx && xx {
+		setDirty(c)
+		c.WriteError(msgXXandNX)
+		return
+	}
+	if (gt && lt) || ((gt || lt) && nx) {
+		setDirty(c)
+		c.WriteError(msgGTLTandNX)
+		return
+	}
+	if incr && len(args) > 2 {
+		setDirty(c)
+		c.WriteError(msgSingleElementPair)
+		return
+	}
+	var elems []ssElem
+	for len(args) > 0 {
+		score, err := parseScore(args[0])
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidFloat)
+			return
+		}
+		elems = append(elems, ssElem{member: args[1], score: score})
+		args = args[2:]
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		// skip tells whether NX, XX, GT, or LT keep the new score out.
+		skip := func(score, old float64, exists bool) bool {
+			return (nx && exists) || (xx && !exists) ||
+				(exists && gt && score <= old) ||
+				(exists && lt && score >= old)
+		}
+
+		if incr {
+			e := elems[0]
+			old, exists := db.zsetScore(key, e.member)
+			score := old + e.score
+			if math.IsNaN(score) {
+				c.WriteError(msgScoreNaN)
+				return
+			}
+			if skip(score, old, exists) {
+				c.WriteNull()
+				return
+			}
+			db.zsetAdd(key, score, e.member)
+			c.WriteBulk(formatFloat(score))
+			return
+		}
+
+		res := 0
+		for _, e := range elems {
+			old, exists := db.zsetScore(key, e.member)
+			if skip(e.score, old, exists) {
+				continue
+			}
+			switch {
+			case !exists:
+				res++
+			case old == e.score:
+				continue
+			case ch:
+				res++
+			}
+			db.zsetAdd(key, e.score, e.member)
+		}
+		c.WriteInt(res)
+	})
+}
+
+// ZCARD
+func (m *RediQueue) cmdZcard(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(db.zsetKeys[key].card())
+	})
+}
+
+// ZCOUNT
+func (m *RediQueue) cmdZcount(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	min, err := parseScoreBound(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidMinMax)
+		return
+	}
+	max, err := parseScoreBound(args[2])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidMinMax)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(db.zsetKeys[key].count(min, max))
+	})
+}
+
+// ZINCRBY
+func (m *RediQueue) cmdZincrby(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, member := args[0], args[2]
+	delta, err := parseScore(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidFloat)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		old, _ := db.zsetScore(key, member)
+		score := old + delta
+		if math.IsNaN(score) {
+			c.WriteError(msgScoreNaN)
+			return
+		}
+		db.zsetAdd(key, score, member)
+		c.WriteBulk(formatFloat(score))
+	})
+}
+
+// ZRANGE and ZREVRANGE
+func makeCmdZrange(m *RediQueue, reverse bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) < 3 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		key := args[0]
+		start, err := strconv.Atoi(args[1])
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+		end, err := strconv.Atoi(args[2])
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+		withScores := false
+		for _, arg := range args[3:] {
+			if strings.ToUpper(arg) != "WITHSCORES" {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			withScores = true
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(key) {
+				c.WriteLen(0)
+				return
+			}
+			if db.t(key) != "zset" {
+				c.WriteError(msgWrongType)
+				return
+			}
+
+			s := db.zsetKeys[key]
+			rs, re := redisRange(s.card(), start, end, false)
+			writeElems(c, s.byRank(rs, re, reverse), withScores)
+		})
+	}
+}
+
+// ZRANGEBYSCORE and ZREVRANGEBYSCORE
+func makeCmdZrangebyscore(m *RediQueue, reverse bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) < 3 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		key, minArg, maxArg := args[0], args[1], args[2]
+		if reverse {
+			minArg, maxArg = maxArg, minArg
+		}
+		min, err := parseScoreBound(minArg)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidMinMax)
+			return
+		}
+		max, err := parseScoreBound(maxArg)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidMinMax)
+			return
+		}
+		withScores, offset, count, msg := parseRangeOptions(args[3:], true)
+		if msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(key) {
+				c.WriteLen(0)
+				return
+			}
+			if db.t(key) != "zset" {
+				c.WriteError(msgWrongType)
+				return
+			}
+
+			elems := db.zsetKeys[key].between(min, max, reverse, offset, count)
+			writeElems(c, elems, withScores)
+		})
+	}
+}
+
+// ZRANGEBYLEX and ZREVRANGEBYLEX
+func makeCmdZrangebylex(m *RediQueue, reverse bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) < 3 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		key, minArg, maxArg := args[0], args[1], args[2]
+		if reverse {
+			minArg, maxArg = maxArg, minArg
+		}
+		min, err := parseLexBound(minArg)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidRangeItem)
+			return
+		}
+		max, err := parseLexBound(maxArg)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidRangeItem)
+			return
+		}
+		_, offset, count, msg := parseRangeOptions(args[3:], false)
+		if msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(key) {
+				c.WriteLen(0)
+				return
+			}
+			if db.t(key) != "zset" {
+				c.WriteError(msgWrongType)
+				return
+			}
+
+			elems := db.zsetKeys[key].between(min, max, reverse, offset, count)
+			writeElems(c, elems, false)
+		})
+	}
+}
+
+// ZRANK and ZREVRANK
+func makeCmdZrank(m *RediQueue, reverse bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) != 2 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		key, member := args[0], args[1]
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(key) {
+				c.WriteNull()
+				return
+			}
+			if db.t(key) != "zset" {
+				c.WriteError(msgWrongType)
+				return
+			}
+
+			s := db.zsetKeys[key]
+			rank := s.rank(member)
+			if rank < 0 {
+				c.WriteNull()
+				return
+			}
+			if reverse {
+				rank = s.card() - 1 - rank
+			}
+			c.WriteInt(rank)
+		})
+	}
+}
+
+// ZREM
+func (m *RediQueue) cmdZrem(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, members := args[0], args[1:]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(db.zsetRem(key, members...))
+	})
+}
+
+// ZREMRANGEBYLEX
+func (m *RediQueue) cmdZremrangebylex(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	min, err := parseLexBound(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidRangeItem)
+		return
+	}
+	max, err := parseLexBound(args[2])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidRangeItem)
+		return
+	}
+
+	m.zremrange(c, key, func(s *sortedSet) []ssElem {
+		return s.between(min, max, false, 0, -1)
+	})
+}
+
+// ZREMRANGEBYRANK
+func (m *RediQueue) cmdZremrangebyrank(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	start, err := strconv.Atoi(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+	end, err := strconv.Atoi(args[2])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+
+	m.zremrange(c, key, func(s *sortedSet) []ssElem {
+		rs, re := redisRange(s.card(), start, end, false)
+		return s.byRank(rs, re, false)
+	})
+}
+
+// ZREMRANGEBYSCORE
+func (m *RediQueue) cmdZremrangebyscore(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	min, err := parseScoreBound(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidMinMax)
+		return
+	}
+	max, err := parseScoreBound(args[2])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidMinMax)
+		return
+	}
+
+	m.zremrange(c, key, func(s *sortedSet) []ssElem {
+		return s.between(min, max, false, 0, -1)
+	})
+}
+
+// zremrange implements the ZREMRANGEBY* commands: it removes what sel picks.
+func (m *RediQueue) zremrange(c *server.Peer, key string, sel func(*sortedSet) []ssElem) {
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		elems := sel(db.zsetKeys[key])
+		if len(elems) == 0 {
+			c.WriteInt(0)
+			return
+		}
+		members := make([]string, 0, len(elems))
+		for _, e := range elems {
+			members = append(members, e.member)
+		}
+		c.WriteInt(db.zsetRem(key, members...))
+	})
+}
+
+// ZPOPMIN and ZPOPMAX
+func makeCmdZpop(m *RediQueue, max bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) < 1 || len(args) > 2 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		key := args[0]
+		count := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			if n < 0 {
+				setDirty(c)
+				c.WriteError(msgMustBePositive)
+				return
+			}
+			count = n
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(key) {
+				c.WriteLen(0)
+				return
+			}
+			if db.t(key) != "zset" {
+				c.WriteError(msgWrongType)
+				return
+			}
+
+			writeElems(c, db.zsetPop(key, count, max), true)
+		})
+	}
+}
+
+// ZSCORE
+func (m *RediQueue) cmdZscore(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, member := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteNull()
+			return
+		}
+		if db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		score, ok := db.zsetScore(key, member)
+		if !ok {
+			c.WriteNull()
+			return
+		}
+		c.WriteBulk(formatFloat(score))
+	})
+}
+
+// ZUNIONSTORE and ZINTERSTORE
+func makeCmdZstore(m *RediQueue, union bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) < 3 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		dest := args[0]
+		numKeys, err := strconv.Atoi(args[1])
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+		if numKeys < 1 {
+			setDirty(c)
+			c.WriteError(fmt.Sprintf("ERR at least 1 input key is needed for %s", strings.ToLower(cmd)))
+			return
+		}
+		args = args[2:]
+		if len(args) < numKeys {
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+		keys, args := args[:numKeys], args[numKeys:]
+		var weights []float64
+		aggregate := "sum"
+		for len(args) > 0 {
+			switch strings.ToUpper(args[0]) {
+			case "WEIGHTS":
+				if len(args) < numKeys+1 {
+					setDirty(c)
+					c.WriteError(msgSyntaxError)
+					return
+				}
+				weights = weights[:0]
+				for _, w := range args[1 : numKeys+1] {
+					f, err := parseScore(w)
+					if err != nil {
+						setDirty(c)
+						c.WriteError(msgWeightNotFloat)
+						return
+					}
+					weights = append(weights, f)
+				}
+				args = args[numKeys+1:]
+			case "AGGREGATE":
+				if len(args) < 2 {
+					setDirty(c)
+					c.WriteError(msgSyntaxError)
+					return
+				}
+				aggregate = strings.ToLower(args[1])
+				switch aggregate {
+				case "sum", "min", "max":
+				default:
+					setDirty(c)
+					c.WriteError(msgSyntaxError)
+					return
+				}
+				args = args[2:]
+			default:
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			var (
+				scores = map[string]float64{}
+				seen   = map[string]int{} // in how many keys
+			)
+			for i, k := range keys {
+				if !db.exists(k) {
+					continue
+				}
+				// Plain sets count as all scores 1.
+				var elems []ssElem
+				switch db.t(k) {
+				case "zset":
+					elems = db.zsetKeys[k].elems()
+				case "set":
+					for _, e := range db.setMembers(k) {
+						elems = append(elems, ssElem{member: e, score: 1})
+					}
+				default:
+					c.WriteError(msgWrongType)
+					return
+				}
+				w := 1.0
+				if weights != nil {
+					w = weights[i]
+				}
+				for _, e := range elems {
+					score := e.score * w
+					if math.IsNaN(score) {
+						// 0 * inf, Redis makes that 0.
+						score = 0
+					}
+					old, ok := scores[e.member]
+					switch {
+					case !ok:
+						old = score
+					case aggregate == "min":
+						old = math.Min(old, score)
+					case aggregate == "max":
+						old = math.Max(old, score)
+					default:
+						old += score
+						if math.IsNaN(old) {
+							old = 0
+						}
+					}
+					scores[e.member] = old
+					seen[e.member]++
+				}
+			}
+
+			res := newSortedSet()
+			for member, score := range scores {
+				if !union && seen[member] != len(keys) {
+					continue
+				}
+				res.set(member, score)
+			}
+			db.zsetSet(dest, res)
+			c.WriteInt(res.card())
+		})
+	}
+}
+
+// ZSCAN
+func (m *RediQueue) cmdZscan(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	cursor, err := strconv.Atoi(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidCursor)
+		return
+	}
+	args = args[2:]
+	// MATCH and COUNT options
+	var withMatch bool
+	var match string
+	for len(args) > 0 {
+		if strings.ToLower(args[0]) == "count" {
+			if len(args) < 2 {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			_, err := strconv.Atoi(args[1])
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			// We do nothing with count.
+			args = args[2:]
+			continue
+		}
+		if strings.ToLower(args[0]) == "match" {
+			if len(args) < 2 {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			withMatch = true
+			match = args[1]
+			args = args[2:]
+			continue
+		}
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+		// return _all_ (matched) members every time
+
+		if cursor != 0 {
+			// invalid cursor
+			c.WriteLen(2)
+			c.WriteBulk("0") // no next cursor
+			c.WriteLen(0)    // no elements
+			return
+		}
+		if db.exists(key) && db.t(key) != "zset" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		var elems []ssElem
+		if s, ok := db.zsetKeys[key]; ok {
+			elems = s.elems()
+		}
+		if withMatch {
+			var members []string
+			for _, e := range elems {
+				members = append(members, e.member)
+			}
+			matched := map[string]bool{}
+			for _, e := range matchKeys(members, match) {
+				matched[e] = true
+			}
+			var res []ssElem
+			for _, e := range elems {
+				if matched[e.member] {
+					res = append(res, e)
+				}
+			}
+			elems = res
+		}
+
+		c.WriteLen(2)
+		c.WriteBulk("0") // no next cursor
+		writeElems(c, elems, true)
+	})
+}
+
+// writeElems writes members, with their scores if withScores is set.
+func writeElems(c *server.Peer, elems []ssElem, withScores bool) {
+	if withScores {
+		c.WriteLen(2 * len(elems))
+	} else {
+		c.WriteLen(len(elems))
+	}
+	for _, e := range elems {
+		c.WriteBulk(e.member)
+		if withScores {
+			c.WriteBulk(formatFloat(e.score))
+		}
+	}
+}
+
+// parseScore parses a score or a weight. NaN is not a valid score.
+func parseScore(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) {
+		return 0, ErrFloatValueError
+	}
+	return v, nil
+}
+
+// parseScoreBound parses a ZRANGEBYSCORE &c. min or max: a score, with a "("
+// prefix for an exclusive bound. -inf and +inf are scores as well.
+func parseScoreBound(s string) (scoreBound, error) {
+	var b scoreBound
+	if strings.HasPrefix(s, "(") {
+		b.excl = true
+		s = s[1:]
+	}
+	v, err := parseScore(s)
+	if err != nil {
+		return b, err
+	}
+	b.v = v
+	return b, nil
+}
+
+// parseLexBound parses a ZRANGEBYLEX &c. min or max: "-", "+", or a member
+// prefixed by "[" (inclusive) or "(" (exclusive).
+func parseLexBound(s string) (lexBound, error) {
+	switch {
+	case s == "-":
+		return lexBound{inf: -1}, nil
+	case s == "+":
+		return lexBound{inf: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return lexBound{v: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return lexBound{v: s[1:], excl: true}, nil
+	default:
+		return lexBound{}, ErrFloatValueError
+	}
+}
+
+// parseRangeOptions parses the [WITHSCORES] [LIMIT offset count] of
+// ZRANGEBYSCORE &c. A negative offset gives nothing, a negative count
+// everything. Returns an error message if something is wrong.
+func parseRangeOptions(args []string, scores bool) (withScores bool, offset, count int, msg string) {
+	count = -1
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "WITHSCORES":
+			if !scores {
+				return false, 0, 0, msgSyntaxError
+			}
+			withScores = true
+			args = args[1:]
+		case "LIMIT":
+			if len(args) < 3 {
+				return false, 0, 0, msgSyntaxError
+			}
+			var err error
+			if offset, err = strconv.Atoi(args[1]); err != nil {
+				return false, 0, 0, msgInvalidInt
+			}
+			if count, err = strconv.Atoi(args[2]); err != nil {
+				return false, 0, 0, msgInvalidInt
+			}
+			if offset < 0 {
+				count = 0
+			}
+			args = args[3:]
+		default:
+			return false, 0, 0, msgSyntaxError
+		}
+	}
+	return withScores, offset, count, ""
+}
@@ -0,0 +1,709 @@
+package rediqueue
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Test ZADD / ZSCORE / ZCARD / ZREM.
+func TestSortedSetAdd(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		n, err := redis.Int(c.Do("ZADD", "z", 1, "one", 2, "two", 3, "three"))
+		ok(t, err)
+		equals(t, 3, n)
+		n, err = redis.Int(c.Do("ZADD", "z", 1, "one", 4, "four"))
+		ok(t, err)
+		equals(t, 1, n)
+
+		members, err := s.ZMembers("z")
+		ok(t, err)
+		equals(t, []string{"one", "two", "three", "four"}, members)
+
+		v, err := redis.String(c.Do("ZSCORE", "z", "three"))
+		ok(t, err)
+		equals(t, "3", v)
+		null, err := c.Do("ZSCORE", "z", "nosuch")
+		ok(t, err)
+		equals(t, nil, null)
+
+		n, err = redis.Int(c.Do("ZCARD", "z"))
+		ok(t, err)
+		equals(t, 4, n)
+		n, err = redis.Int(c.Do("ZCARD", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		v, err = redis.String(c.Do("TYPE", "z"))
+		ok(t, err)
+		equals(t, "zset", v)
+	}
+
+	// NX, XX, GT, LT, CH
+	{
+		n, err := redis.Int(c.Do("ZADD", "z", "NX", 10, "one", 5, "five"))
+		ok(t, err)
+		equals(t, 1, n)
+		score, err := s.ZScore("z", "one")
+		ok(t, err)
+		equals(t, 1.0, score)
+
+		n, err = redis.Int(c.Do("ZADD", "z", "XX", "CH", 10, "one", 6, "six"))
+		ok(t, err)
+		equals(t, 1, n) // changed, not added
+		_, err = s.ZScore("z", "six")
+		equals(t, ErrKeyNotFound, err)
+
+		n, err = redis.Int(c.Do("ZADD", "z", "GT", "CH", 5, "one", 20, "two"))
+		ok(t, err)
+		equals(t, 1, n)
+		score, _ = s.ZScore("z", "one")
+		equals(t, 10.0, score)
+		score, _ = s.ZScore("z", "two")
+		equals(t, 20.0, score)
+
+		n, err = redis.Int(c.Do("ZADD", "z", "LT", "CH", 5, "one", 30, "two"))
+		ok(t, err)
+		equals(t, 1, n)
+		score, _ = s.ZScore("z", "one")
+		equals(t, 5.0, score)
+	}
+
+	// INCR and ZINCRBY
+	{
+		v, err := redis.String(c.Do("ZADD", "z", "INCR", 2.5, "one"))
+		ok(t, err)
+		equals(t, "7.5", v)
+		null, err := c.Do("ZADD", "z", "NX", "INCR", 1, "one")
+		ok(t, err)
+		equals(t, nil, null)
+
+		v, err = redis.String(c.Do("ZINCRBY", "z", -7.5, "one"))
+		ok(t, err)
+		equals(t, "0", v)
+		v, err = redis.String(c.Do("ZINCRBY", "new", "+inf", "a"))
+		ok(t, err)
+		equals(t, "inf", v)
+		_, err = c.Do("ZINCRBY", "new", "-inf", "a")
+		equals(t, msgScoreNaN, err.(redis.Error).Error())
+	}
+
+	{
+		n, err := redis.Int(c.Do("ZREM", "z", "one", "two", "nosuch"))
+		ok(t, err)
+		equals(t, 2, n)
+		n, err = redis.Int(c.Do("ZREM", "nosuch", "one"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		n, err = redis.Int(c.Do("ZREM", "z", "three", "four", "five"))
+		ok(t, err)
+		equals(t, 3, n)
+		equals(t, false, s.Exists("z"))
+	}
+
+	// Direct usage
+	{
+		added, err := s.ZAdd("direct", 1.5, "a")
+		ok(t, err)
+		equals(t, true, added)
+		added, err = s.ZAdd("direct", 2, "a")
+		ok(t, err)
+		equals(t, false, added)
+		z, err := s.SortedSet("direct")
+		ok(t, err)
+		equals(t, map[string]float64{"a": 2}, z)
+		removed, err := s.ZRem("direct", "a")
+		ok(t, err)
+		equals(t, true, removed)
+		_, err = s.ZMembers("direct")
+		equals(t, ErrKeyNotFound, err)
+	}
+
+	// Wrong usage
+	{
+		s.Set("str", "value")
+		for _, args := range [][]interface{}{
+			{"ZADD", "str", 1, "a"},
+			{"ZADD", "z", 1},
+			{"ZADD", "z", "nofloat", "a"},
+			{"ZADD", "z", "nan", "a"},
+			{"ZADD", "z", "NX", "XX", 1, "a"},
+			{"ZADD", "z", "GT", "LT", 1, "a"},
+			{"ZADD", "z", "GT", "NX", 1, "a"},
+			{"ZADD", "z", "INCR", 1, "a", 2, "b"},
+			{"ZSCORE", "str", "a"},
+			{"ZSCORE", "z"},
+			{"ZCARD", "str"},
+			{"ZREM", "str", "a"},
+			{"ZREM", "z"},
+			{"ZINCRBY", "str", 1, "a"},
+			{"ZINCRBY", "z", "nofloat", "a"},
+		} {
+			_, err := c.Do(args[0].(string), args[1:]...)
+			assert(t, err != nil, "no error for %v", args)
+		}
+		_, err := s.ZAdd("str", 1, "a")
+		equals(t, ErrWrongType, err)
+	}
+}
+
+// Test ZRANGE, ZREVRANGE, ZRANK, ZREVRANK, and ZCOUNT.
+func TestSortedSetRange(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.ZAdd("z", 1, "one")
+	s.ZAdd("z", 2, "two")
+	s.ZAdd("z", 2, "zwei")
+	s.ZAdd("z", 3, "three")
+	s.ZAdd("z", math.Inf(1), "inf")
+
+	{
+		v, err := redis.Strings(c.Do("ZRANGE", "z", 0, -1))
+		ok(t, err)
+		equals(t, []string{"one", "two", "zwei", "three", "inf"}, v)
+		v, err = redis.Strings(c.Do("ZRANGE", "z", 1, 2, "WITHSCORES"))
+		ok(t, err)
+		equals(t, []string{"two", "2", "zwei", "2"}, v)
+		v, err = redis.Strings(c.Do("ZREVRANGE", "z", 0, 1, "WITHSCORES"))
+		ok(t, err)
+		equals(t, []string{"inf", "inf", "three", "3"}, v)
+		v, err = redis.Strings(c.Do("ZREVRANGE", "z", -2, -1))
+		ok(t, err)
+		equals(t, []string{"two", "one"}, v)
+		v, err = redis.Strings(c.Do("ZRANGE", "z", 10, 20))
+		ok(t, err)
+		equals(t, []string{}, v)
+		v, err = redis.Strings(c.Do("ZRANGE", "z", 0, int64(math.MaxInt64)))
+		ok(t, err)
+		equals(t, []string{"one", "two", "zwei", "three", "inf"}, v)
+		v, err = redis.Strings(c.Do("ZREVRANGE", "z", 3, int64(math.MaxInt64)))
+		ok(t, err)
+		equals(t, []string{"two", "one"}, v)
+		v, err = redis.Strings(c.Do("ZRANGE", "nosuch", 0, -1))
+		ok(t, err)
+		equals(t, []string{}, v)
+	}
+
+	{
+		n, err := redis.Int(c.Do("ZRANK", "z", "three"))
+		ok(t, err)
+		equals(t, 3, n)
+		n, err = redis.Int(c.Do("ZREVRANK", "z", "three"))
+		ok(t, err)
+		equals(t, 1, n)
+		null, err := c.Do("ZRANK", "z", "nosuch")
+		ok(t, err)
+		equals(t, nil, null)
+		null, err = c.Do("ZREVRANK", "nosuch", "one")
+		ok(t, err)
+		equals(t, nil, null)
+	}
+
+	{
+		for _, tc := range []struct {
+			min, max string
+			want     int
+		}{
+			{"-inf", "+inf", 5},
+			{"2", "3", 3},
+			{"(2", "3", 1},
+			{"2", "(3", 2},
+			{"(1", "(2", 0},
+			{"5", "1", 0},
+			{"inf", "inf", 1},
+		} {
+			n, err := redis.Int(c.Do("ZCOUNT", "z", tc.min, tc.max))
+			ok(t, err)
+			equals(t, tc.want, n)
+		}
+	}
+
+	// Wrong usage
+	{
+		s.Set("str", "value")
+		for _, args := range [][]interface{}{
+			{"ZRANGE", "str", 0, -1},
+			{"ZRANGE", "z", "noint", -1},
+			{"ZRANGE", "z", 0, "noint"},
+			{"ZRANGE", "z", 0, -1, "NOSUCH"},
+			{"ZRANGE", "z", 0},
+			{"ZREVRANGE", "str", 0, -1},
+			{"ZRANK", "str", "a"},
+			{"ZRANK", "z"},
+			{"ZCOUNT", "str", 0, 1},
+			{"ZCOUNT", "z", "nofloat", 1},
+			{"ZCOUNT", "z", 0, "(nofloat"},
+		} {
+			_, err := c.Do(args[0].(string), args[1:]...)
+			assert(t, err != nil, "no error for %v", args)
+		}
+	}
+}
+
+// Test ZRANGEBYSCORE, ZREVRANGEBYSCORE, ZRANGEBYLEX and ZREVRANGEBYLEX.
+func TestSortedSetRangeBy(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.ZAdd("z", 1, "one")
+	s.ZAdd("z", 2, "two")
+	s.ZAdd("z", 3, "three")
+	s.ZAdd("z", 4, "four")
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		s.ZAdd("lex", 0, m)
+	}
+
+	{
+		v, err := redis.Strings(c.Do("ZRANGEBYSCORE", "z", "(1", 3))
+		ok(t, err)
+		equals(t, []string{"two", "three"}, v)
+		v, err = redis.Strings(c.Do("ZRANGEBYSCORE", "z", "-inf", "+inf", "WITHSCORES", "LIMIT", 1, 2))
+		ok(t, err)
+		equals(t, []string{"two", "2", "three", "3"}, v)
+		v, err = redis.Strings(c.Do("ZRANGEBYSCORE", "z", 0, 10, "LIMIT", 2, -1))
+		ok(t, err)
+		equals(t, []string{"three", "four"}, v)
+		v, err = redis.Strings(c.Do("ZRANGEBYSCORE", "z", 0, 10, "LIMIT", -1, 10))
+		ok(t, err)
+		equals(t, []string{}, v)
+
+		v, err = redis.Strings(c.Do("ZREVRANGEBYSCORE", "z", "+inf", "(2"))
+		ok(t, err)
+		equals(t, []string{"four", "three"}, v)
+		v, err = redis.Strings(c.Do("ZREVRANGEBYSCORE", "z", 3, 1, "WITHSCORES", "LIMIT", 1, 1))
+		ok(t, err)
+		equals(t, []string{"two", "2"}, v)
+	}
+
+	{
+		v, err := redis.Strings(c.Do("ZRANGEBYLEX", "lex", "-", "+"))
+		ok(t, err)
+		equals(t, []string{"a", "b", "c", "d", "e"}, v)
+		v, err = redis.Strings(c.Do("ZRANGEBYLEX", "lex", "[b", "(d"))
+		ok(t, err)
+		equals(t, []string{"b", "c"}, v)
+		v, err = redis.Strings(c.Do("ZRANGEBYLEX", "lex", "(b", "+", "LIMIT", 1, 2))
+		ok(t, err)
+		equals(t, []string{"d", "e"}, v)
+		v, err = redis.Strings(c.Do("ZREVRANGEBYLEX", "lex", "[c", "-"))
+		ok(t, err)
+		equals(t, []string{"c", "b", "a"}, v)
+		v, err = redis.Strings(c.Do("ZREVRANGEBYLEX", "lex", "+", "(d"))
+		ok(t, err)
+		equals(t, []string{"e"}, v)
+	}
+
+	// Wrong usage
+	{
+		for _, args := range [][]interface{}{
+			{"ZRANGEBYSCORE", "z", "nofloat", 1},
+			{"ZRANGEBYSCORE", "z", 0, 1, "LIMIT", 1},
+			{"ZRANGEBYSCORE", "z", 0, 1, "LIMIT", "noint", 1},
+			{"ZRANGEBYSCORE", "z", 0, 1, "NOSUCH"},
+			{"ZRANGEBYSCORE", "z", 0},
+			{"ZRANGEBYLEX", "lex", "a", "+"},
+			{"ZRANGEBYLEX", "lex", "-", "b"},
+			{"ZRANGEBYLEX", "lex", "-", "+", "WITHSCORES"},
+			{"ZREVRANGEBYLEX", "lex", "+"},
+		} {
+			_, err := c.Do(args[0].(string), args[1:]...)
+			assert(t, err != nil, "no error for %v", args)
+		}
+		_, err := c.Do("ZRANGEBYSCORE", "z", "nofloat", 1)
+		equals(t, msgInvalidMinMax, err.(redis.Error).Error())
+		_, err = c.Do("ZRANGEBYLEX", "lex", "a", "+")
+		equals(t, msgInvalidRangeItem, err.(redis.Error).Error())
+	}
+}
+
+// Test ZREMRANGEBYRANK, ZREMRANGEBYSCORE, ZREMRANGEBYLEX, ZPOPMIN and ZPOPMAX.
+func TestSortedSetRemove(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	fill := func() {
+		s.Del("z")
+		for i, m := range []string{"a", "b", "c", "d", "e"} {
+			s.ZAdd("z", float64(i), m)
+		}
+	}
+
+	{
+		fill()
+		n, err := redis.Int(c.Do("ZREMRANGEBYRANK", "z", 1, -2))
+		ok(t, err)
+		equals(t, 3, n)
+		members, _ := s.ZMembers("z")
+		equals(t, []string{"a", "e"}, members)
+
+		fill()
+		n, err = redis.Int(c.Do("ZREMRANGEBYSCORE", "z", "(0", 2))
+		ok(t, err)
+		equals(t, 2, n)
+		members, _ = s.ZMembers("z")
+		equals(t, []string{"a", "d", "e"}, members)
+
+		fill()
+		n, err = redis.Int(c.Do("ZREMRANGEBYLEX", "z", "-", "[b"))
+		ok(t, err)
+		equals(t, 2, n)
+
+		n, err = redis.Int(c.Do("ZREMRANGEBYRANK", "z", 0, -1))
+		ok(t, err)
+		equals(t, 3, n)
+		equals(t, false, s.Exists("z"))
+
+		n, err = redis.Int(c.Do("ZREMRANGEBYSCORE", "nosuch", 0, 1))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	{
+		fill()
+		v, err := redis.Strings(c.Do("ZPOPMIN", "z"))
+		ok(t, err)
+		equals(t, []string{"a", "0"}, v)
+		v, err = redis.Strings(c.Do("ZPOPMAX", "z", 2))
+		ok(t, err)
+		equals(t, []string{"e", "4", "d", "3"}, v)
+		v, err = redis.Strings(c.Do("ZPOPMIN", "z", 10))
+		ok(t, err)
+		equals(t, []string{"b", "1", "c", "2"}, v)
+		equals(t, false, s.Exists("z"))
+		v, err = redis.Strings(c.Do("ZPOPMIN", "z"))
+		ok(t, err)
+		equals(t, []string{}, v)
+	}
+
+	// Wrong usage
+	{
+		s.Set("str", "value")
+		for _, args := range [][]interface{}{
+			{"ZREMRANGEBYRANK", "str", 0, 1},
+			{"ZREMRANGEBYRANK", "z", "noint", 1},
+			{"ZREMRANGEBYSCORE", "z", 0, "nofloat"},
+			{"ZREMRANGEBYLEX", "z", "-", "nolex"},
+			{"ZREMRANGEBYLEX", "z", "-"},
+			{"ZPOPMIN", "str"},
+			{"ZPOPMIN", "z", "noint"},
+			{"ZPOPMIN", "z", -1},
+			{"ZPOPMAX"},
+			{"ZPOPMAX", "z", 1, 2},
+		} {
+			_, err := c.Do(args[0].(string), args[1:]...)
+			assert(t, err != nil, "no error for %v", args)
+		}
+	}
+}
+
+// Test ZUNIONSTORE and ZINTERSTORE.
+func TestSortedSetStore(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.ZAdd("z1", 1, "a")
+	s.ZAdd("z1", 2, "b")
+	s.ZAdd("z2", 10, "b")
+	s.ZAdd("z2", 20, "c")
+	s.SetAdd("set", "c", "d")
+
+	{
+		n, err := redis.Int(c.Do("ZUNIONSTORE", "dest", 2, "z1", "z2"))
+		ok(t, err)
+		equals(t, 3, n)
+		z, err := s.SortedSet("dest")
+		ok(t, err)
+		equals(t, map[string]float64{"a": 1, "b": 12, "c": 20}, z)
+
+		n, err = redis.Int(c.Do("ZUNIONSTORE", "dest", 3, "z1", "z2", "set", "WEIGHTS", 2, 1, 5, "AGGREGATE", "MAX"))
+		ok(t, err)
+		equals(t, 4, n)
+		z, _ = s.SortedSet("dest")
+		equals(t, map[string]float64{"a": 2, "b": 10, "c": 20, "d": 5}, z)
+
+		n, err = redis.Int(c.Do("ZINTERSTORE", "dest", 2, "z1", "z2", "AGGREGATE", "MIN"))
+		ok(t, err)
+		equals(t, 1, n)
+		z, _ = s.SortedSet("dest")
+		equals(t, map[string]float64{"b": 2}, z)
+
+		// The destination can be a source.
+		n, err = redis.Int(c.Do("ZINTERSTORE", "z2", 2, "z2", "set"))
+		ok(t, err)
+		equals(t, 1, n)
+		z, _ = s.SortedSet("z2")
+		equals(t, map[string]float64{"c": 21}, z)
+
+		// Empty results delete the destination.
+		n, err = redis.Int(c.Do("ZINTERSTORE", "dest", 2, "z1", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+		equals(t, false, s.Exists("dest"))
+	}
+
+	// Wrong usage
+	{
+		s.Set("str", "value")
+		for _, args := range [][]interface{}{
+			{"ZUNIONSTORE", "dest", 1, "str"},
+			{"ZUNIONSTORE", "dest", 0, "z1"},
+			{"ZUNIONSTORE", "dest", "noint", "z1"},
+			{"ZUNIONSTORE", "dest", 3, "z1", "z2"},
+			{"ZUNIONSTORE", "dest", 2, "z1", "z2", "WEIGHTS", 1},
+			{"ZUNIONSTORE", "dest", 1, "z1", "WEIGHTS", "nofloat"},
+			{"ZUNIONSTORE", "dest", 1, "z1", "AGGREGATE", "AVG"},
+			{"ZUNIONSTORE", "dest", 1, "z1", "AGGREGATE"},
+			{"ZINTERSTORE", "dest", 1, "z1", "NOSUCH"},
+			{"ZINTERSTORE", "dest", 1},
+		} {
+			_, err := c.Do(args[0].(string), args[1:]...)
+			assert(t, err != nil, "no error for %v", args)
+		}
+	}
+}
+
+// Test ZSCAN.
+func TestZscan(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.ZAdd("z", 2, "member2")
+	s.ZAdd("z", 1, "member1")
+	s.ZAdd("z", 3, "other")
+
+	{
+		res, err := redis.Values(c.Do("ZSCAN", "z", 0))
+		ok(t, err)
+		equals(t, "0", string(res[0].([]byte)))
+		v, err := redis.Strings(res[1], nil)
+		ok(t, err)
+		equals(t, []string{"member1", "1", "member2", "2", "other", "3"}, v)
+
+		res, err = redis.Values(c.Do("ZSCAN", "z", 0, "MATCH", "mem*", "COUNT", 1))
+		ok(t, err)
+		v, err = redis.Strings(res[1], nil)
+		ok(t, err)
+		equals(t, []string{"member1", "1", "member2", "2"}, v)
+
+		res, err = redis.Values(c.Do("ZSCAN", "nosuch", 0))
+		ok(t, err)
+		v, err = redis.Strings(res[1], nil)
+		ok(t, err)
+		equals(t, []string{}, v)
+	}
+
+	// Wrong usage
+	{
+		s.Set("str", "value")
+		for _, args := range [][]interface{}{
+			{"ZSCAN", "str", 0},
+			{"ZSCAN", "z"},
+			{"ZSCAN", "z", "noint"},
+			{"ZSCAN", "z", 0, "COUNT", "noint"},
+			{"ZSCAN", "z", 0, "MATCH"},
+			{"ZSCAN", "z", 0, "NOSUCH"},
+		} {
+			_, err := c.Do(args[0].(string), args[1:]...)
+			assert(t, err != nil, "no error for %v", args)
+		}
+	}
+}
+
+// Test that sorted set keys move around like the other types.
+func TestSortedSetKeys(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.ZAdd("z", 1, "a")
+	{
+		_, err := c.Do("RENAME", "z", "z2")
+		ok(t, err)
+		n, err := redis.Int(c.Do("MOVE", "z2", 1))
+		ok(t, err)
+		equals(t, 1, n)
+		s.Select(1)
+		score, err := s.ZScore("z2", "a")
+		ok(t, err)
+		equals(t, 1.0, score)
+		s.Select(0)
+	}
+
+	{
+		s.ZAdd("restore", 1.5, "a")
+		s.ZAdd("restore", math.Inf(-1), "b")
+		payload, err := redis.String(c.Do("DUMP", "restore"))
+		ok(t, err)
+		_, err = c.Do("RESTORE", "restored", 0, payload)
+		ok(t, err)
+		z, err := s.SortedSet("restored")
+		ok(t, err)
+		equals(t, map[string]float64{"a": 1.5, "b": math.Inf(-1)}, z)
+		s.Del("restore")
+		s.Del("restored")
+	}
+
+	{
+		s.ZAdd("dump", 2.5, "value")
+		equals(t, "- dump\n   2.5: \"value\"\n", s.Dump())
+	}
+}
+
+func TestBzpop(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	// Simple cases
+	{
+		s.ZAdd("z", 1, "one")
+		s.ZAdd("z", 2, "two")
+		s.ZAdd("z", 3, "three")
+		v, err := redis.Strings(c.Do("BZPOPMIN", "nosuch", "z", 1))
+		ok(t, err)
+		equals(t, []string{"z", "one", "1"}, v)
+		v, err = redis.Strings(c.Do("BZPOPMAX", "z", 1))
+		ok(t, err)
+		equals(t, []string{"z", "three", "3"}, v)
+		v, err = redis.Strings(c.Do("BZPOPMAX", "z", 1))
+		ok(t, err)
+		equals(t, []string{"z", "two", "2"}, v)
+		equals(t, false, s.Exists("z"))
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("BZPOPMIN", "str", 1)
+		assert(t, err != nil, "BZPOPMIN error")
+		_, err = c.Do("BZPOPMIN")
+		assert(t, err != nil, "BZPOPMIN error")
+		_, err = c.Do("BZPOPMIN", "key")
+		assert(t, err != nil, "BZPOPMIN error")
+		_, err = c.Do("BZPOPMIN", "key", -1)
+		assert(t, err != nil, "BZPOPMIN error")
+		_, err = c.Do("BZPOPMAX", "key", "inf")
+		assert(t, err != nil, "BZPOPMAX error")
+	}
+}
+
+func TestBzpopBlock(t *testing.T) {
+	_, c1, c2, done := setup2(t)
+	defer done()
+
+	got := goStrings(t, c2, "BZPOPMAX", "z1", "z2", 0)
+	time.Sleep(30 * time.Millisecond)
+
+	_, err := c1.Do("ZADD", "z0", 1, "a")
+	ok(t, err)
+	_, err = c1.Do("ZADD", "z2", 1, "b", 2, "c")
+	ok(t, err)
+
+	select {
+	case have := <-got:
+		equals(t, []string{"z2", "c", "2"}, have)
+	case <-time.After(500 * time.Millisecond):
+		t.Error("BZPOPMAX took too long")
+	}
+}
+
+func TestBzpopTimeout(t *testing.T) {
+	_, c, done := setup(t)
+	defer done()
+
+	got := goStrings(t, c, "BZPOPMIN", "z", 1)
+	select {
+	case have := <-got:
+		equals(t, []string(nil), have)
+	case <-time.After(1500 * time.Millisecond):
+		t.Error("BZPOPMIN took too long")
+	}
+}
+
+func TestBzpopTx(t *testing.T) {
+	// BZPOPMIN in a transaction behaves as if the timeout triggers right away
+	_, c, done := setup(t)
+	defer done()
+
+	_, err := c.Do("MULTI")
+	ok(t, err)
+	v, err := redis.String(c.Do("BZPOPMIN", "z", 3))
+	ok(t, err)
+	equals(t, "QUEUED", v)
+	_, err = c.Do("ZADD", "z", 1, "a")
+	ok(t, err)
+	_, err = c.Do("BZPOPMIN", "z", 3)
+	ok(t, err)
+
+	res, err := redis.Values(c.Do("EXEC"))
+	ok(t, err)
+	equals(t, 3, len(res))
+	equals(t, nil, res[0])
+	equals(t, int64(1), res[1])
+	popped, err := redis.Strings(res[2], nil)
+	ok(t, err)
+	equals(t, []string{"z", "a", "1"}, popped)
+}
+
+func TestBzpopFair(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+
+	// Clients get new members in the order they blocked.
+	var gots []<-chan []string
+	for i := 0; i < 3; i++ {
+		c, err := redis.Dial("tcp", s.Addr())
+		ok(t, err)
+		defer c.Close()
+		gots = append(gots, goStrings(t, c, "BZPOPMIN", "z", 2))
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	// The first two get the first ZADD, the last one waits for the next.
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+	_, err = c.Do("ZADD", "z", 1, "a", 2, "b")
+	ok(t, err)
+	time.Sleep(30 * time.Millisecond)
+	_, err = c.Do("ZADD", "z", 3, "c")
+	ok(t, err)
+	for i, want := range [][]string{
+		{"z", "a", "1"},
+		{"z", "b", "2"},
+		{"z", "c", "3"},
+	} {
+		select {
+		case have := <-gots[i]:
+			equals(t, want, have)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("BZPOPMIN took too long")
+		}
+	}
+}
@@ -0,0 +1,1420 @@
+// Commands from http://redis.io/commands#stream
+
+package rediqueue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chinahdkj/rediqueue/server"
+)
+
+// commandsStream handles all stream operations.
+func commandsStream(m *RediQueue) {
+	m.srv.Register("XACK", m.cmdXack)
+	m.srv.Register("XADD", m.cmdXadd)
+	m.srv.Register("XAUTOCLAIM", m.cmdXautoclaim)
+	m.srv.Register("XCLAIM", m.cmdXclaim)
+	m.srv.Register("XDEL", m.cmdXdel)
+	m.srv.Register("XGROUP", m.cmdXgroup)
+	m.srv.Register("XINFO", m.cmdXinfo)
+	m.srv.Register("XLEN", m.cmdXlen)
+	m.srv.Register("XPENDING", m.cmdXpending)
+	m.srv.Register("XRANGE", makeCmdXrange(m, false))
+	m.srv.Register("XREAD", m.cmdXread)
+	m.srv.Register("XREADGROUP", m.cmdXreadgroup)
+	m.srv.Register("XREVRANGE", makeCmdXrange(m, true))
+	m.srv.Register("XSETID", m.cmdXsetid)
+	m.srv.Register("XTRIM", m.cmdXtrim)
+}
+
+// XADD
+func (m *RediQueue) cmdXadd(c *server.Peer, cmd string, args []string) {
+	if len(args) < 4 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	var (
+		key       = args[0]
+		noMkS     = false
+		trim      *streamTrim
+		remaining = args[1:]
+	)
+loop:
+	for len(remaining) > 0 {
+		switch strings.ToUpper(remaining[0]) {
+		case "NOMKSTREAM":
+			noMkS = true
+			remaining = remaining[1:]
+		case "MAXLEN", "MINID":
+			if trim != nil {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			t, used, msg := parseStreamTrim(remaining)
+			if msg != "" {
+				setDirty(c)
+				c.WriteError(msg)
+				return
+			}
+			trim = &t
+			remaining = remaining[used:]
+		default:
+			break loop
+		}
+	}
+	if len(remaining) < 3 || len(remaining)%2 != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	idArg, values := remaining[0], remaining[1:]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+		s, ok := db.streamKeys[key]
+		if !ok && noMkS {
+			c.WriteNull()
+			return
+		}
+		last := streamID{}
+		if ok {
+			last = s.lastID
+		}
+		id, msg := nextStreamID(last, idArg, uint64(unixMilli(m.effectiveNow())))
+		if msg != "" {
+			c.WriteError(msg)
+			return
+		}
+		db.streamAdd(key, id, append([]string{}, values...))
+		if trim != nil {
+			db.streamTrim(key, *trim)
+		}
+		c.WriteBulk(id.String())
+	})
+}
+
+// XDEL
+func (m *RediQueue) cmdXdel(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	var ids []streamID
+	for _, a := range args[1:] {
+		id, err := parseStreamID(a, 0)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidStreamID)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(db.streamDel(key, ids...))
+	})
+}
+
+// XLEN
+func (m *RediQueue) cmdXlen(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(len(db.streamKeys[key].entries))
+	})
+}
+
+// XRANGE and XREVRANGE
+func makeCmdXrange(m *RediQueue, reverse bool) func(*server.Peer, string, []string) {
+	return func(c *server.Peer, cmd string, args []string) {
+		if len(args) != 3 && len(args) != 5 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd))
+			return
+		}
+		if !m.handleAuth(c) {
+			return
+		}
+
+		key, startArg, endArg := args[0], args[1], args[2]
+		if reverse {
+			startArg, endArg = endArg, startArg
+		}
+		start, msg := parseStreamRangeID(startArg, true)
+		if msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+		end, msg := parseStreamRangeID(endArg, false)
+		if msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+		count := -1
+		if len(args) == 5 {
+			if strings.ToUpper(args[3]) != "COUNT" {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			n, err := strconv.Atoi(args[4])
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			if n < 0 {
+				n = 0
+			}
+			count = n
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(key) {
+				c.WriteLen(0)
+				return
+			}
+			if db.t(key) != "stream" {
+				c.WriteError(msgWrongType)
+				return
+			}
+
+			writeStreamEntries(c, db.streamKeys[key].between(start, end, reverse, count))
+		})
+	}
+}
+
+// XREAD
+func (m *RediQueue) cmdXread(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	opts, msg := parseXread(cmd, args, false)
+	if msg != "" {
+		setDirty(c)
+		c.WriteError(msg)
+		return
+	}
+	var (
+		count, keys, idArgs = opts.count, opts.keys, opts.ids
+		ids                 = make([]streamID, len(keys))
+	)
+	for i, a := range idArgs {
+		switch a {
+		case "$":
+			continue
+		case ">":
+			setDirty(c)
+			c.WriteError(msgXreadGT)
+			return
+		}
+		id, err := parseStreamID(a, 0)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidStreamID)
+			return
+		}
+		ids[i] = id
+	}
+
+	resolved := false
+	read := func(c *server.Peer, ctx *connCtx) bool {
+		db := m.db(ctx.selectedDB)
+		for _, k := range keys {
+			if db.exists(k) && db.t(k) != "stream" {
+				c.WriteError(msgWrongType)
+				return true
+			}
+		}
+		if !resolved {
+			// "$" is whatever is the last ID when we start.
+			for i, a := range idArgs {
+				if a == "$" {
+					if s, ok := db.streamKeys[keys[i]]; ok {
+						ids[i] = s.lastID
+					}
+				}
+			}
+			resolved = true
+		}
+
+		var (
+			found   []string
+			entries [][]streamEntry
+		)
+		for i, k := range keys {
+			s, ok := db.streamKeys[k]
+			if !ok {
+				continue
+			}
+			if es := s.after(ids[i], count); len(es) > 0 {
+				found = append(found, k)
+				entries = append(entries, es)
+			}
+		}
+		if len(found) == 0 {
+			return false
+		}
+		c.WriteLen(len(found))
+		for i, k := range found {
+			c.WriteLen(2)
+			c.WriteBulk(k)
+			writeStreamEntries(c, entries[i])
+		}
+		return true
+	}
+
+	if !opts.block {
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			if !read(c, ctx) {
+				c.WriteNull()
+			}
+		})
+		return
+	}
+	blocking(
+		m,
+		c,
+		opts.timeout,
+		read,
+		func(c *server.Peer) {
+			// timeout
+			c.WriteNull()
+		},
+	)
+}
+
+// xreadOpts are the options of XREAD and XREADGROUP.
+type xreadOpts struct {
+	count   int // -1 for no limit
+	block   bool
+	timeout time.Duration
+	noAck   bool
+	keys    []string
+	ids     []string // as given
+}
+
+// parseXread parses "[COUNT n] [BLOCK ms] [NOACK] STREAMS key... id...".
+// NOACK is for XREADGROUP only.
+func parseXread(cmd string, args []string, group bool) (xreadOpts, string) {
+	opts := xreadOpts{count: -1}
+loop:
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "COUNT":
+			if len(args) < 2 {
+				return opts, msgSyntaxError
+			}
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return opts, msgInvalidInt
+			}
+			if n > 0 {
+				opts.count = n
+			}
+			args = args[2:]
+		case "BLOCK":
+			if len(args) < 2 {
+				return opts, msgSyntaxError
+			}
+			ms, err := strconv.Atoi(args[1])
+			if err != nil {
+				return opts, msgInvalidTimeout
+			}
+			if ms < 0 {
+				return opts, msgNegTimeout
+			}
+			opts.block = true
+			opts.timeout = time.Duration(ms) * time.Millisecond
+			args = args[2:]
+		case "NOACK":
+			if !group {
+				return opts, msgSyntaxError
+			}
+			opts.noAck = true
+			args = args[1:]
+		case "STREAMS":
+			args = args[1:]
+			break loop
+		default:
+			return opts, msgSyntaxError
+		}
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return opts, errXreadUnbalanced(cmd)
+	}
+	opts.keys, opts.ids = args[:len(args)/2], args[len(args)/2:]
+	return opts, ""
+}
+
+// XSETID
+func (m *RediQueue) cmdXsetid(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	id, err := parseStreamID(args[1], 0)
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidStreamID)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteError(msgKeyNotFound)
+			return
+		}
+		if db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+		s := db.streamKeys[key]
+		if n := len(s.entries); n > 0 && id.less(s.entries[n-1].id) {
+			c.WriteError(msgStreamSetIDTooSmall)
+			return
+		}
+
+		db.streamSetID(key, id)
+		c.WriteOK()
+	})
+}
+
+// XTRIM
+func (m *RediQueue) cmdXtrim(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	trim, used, msg := parseStreamTrim(args[1:])
+	if msg == "" && used != len(args)-1 {
+		msg = msgSyntaxError
+	}
+	if msg != "" {
+		setDirty(c)
+		c.WriteError(msg)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+		if db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(db.streamTrim(key, trim))
+	})
+}
+
+// XGROUP
+func (m *RediQueue) cmdXgroup(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	sub, args := args[0], args[1:]
+	subUpper := strings.ToUpper(sub)
+	wrongNumber := func() {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd + "|" + sub))
+	}
+	switch subUpper {
+	case "CREATE", "SETID":
+		if len(args) < 3 {
+			wrongNumber()
+			return
+		}
+		key, group, idArg := args[0], args[1], args[2]
+		mkStream := false
+		for opts := args[3:]; len(opts) > 0; {
+			switch {
+			case subUpper == "CREATE" && strings.ToUpper(opts[0]) == "MKSTREAM":
+				mkStream = true
+				opts = opts[1:]
+			case strings.ToUpper(opts[0]) == "ENTRIESREAD" && len(opts) > 1:
+				// we don't keep track of this
+				if _, err := strconv.Atoi(opts[1]); err != nil {
+					setDirty(c)
+					c.WriteError(msgInvalidInt)
+					return
+				}
+				opts = opts[2:]
+			default:
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+		}
+		var id streamID
+		if idArg != "$" {
+			var err error
+			if id, err = parseStreamID(idArg, 0); err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidStreamID)
+				return
+			}
+		}
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if db.exists(key) && db.t(key) != "stream" {
+				c.WriteError(msgWrongType)
+				return
+			}
+			if !db.exists(key) {
+				if !mkStream {
+					c.WriteError(msgXgroupKeyNotFound)
+					return
+				}
+				db.streamSetID(key, streamID{})
+			}
+			s := db.streamKeys[key]
+			if idArg == "$" {
+				id = s.lastID
+			}
+			if subUpper == "CREATE" {
+				if s.groups[group] != nil {
+					c.WriteError(msgXgroupBusy)
+					return
+				}
+				db.streamGroupCreate(key, group, id)
+			} else {
+				if s.groups[group] == nil {
+					c.WriteError(errNoGroupForKey(key, group))
+					return
+				}
+				db.streamGroupSetID(key, group, id)
+			}
+			c.WriteOK()
+		})
+	case "DESTROY":
+		if len(args) != 2 {
+			wrongNumber()
+			return
+		}
+		key, group := args[0], args[1]
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(key) {
+				c.WriteError(msgXgroupKeyNotFound)
+				return
+			}
+			if db.t(key) != "stream" {
+				c.WriteError(msgWrongType)
+				return
+			}
+
+			if db.streamGroupDestroy(key, group) {
+				c.WriteInt(1)
+			} else {
+				c.WriteInt(0)
+			}
+		})
+	case "CREATECONSUMER", "DELCONSUMER":
+		if len(args) != 3 {
+			wrongNumber()
+			return
+		}
+		key, group, consumer := args[0], args[1], args[2]
+
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			db := m.db(ctx.selectedDB)
+
+			if !db.exists(key) {
+				c.WriteError(msgXgroupKeyNotFound)
+				return
+			}
+			if db.t(key) != "stream" {
+				c.WriteError(msgWrongType)
+				return
+			}
+			if db.streamKeys[key].groups[group] == nil {
+				c.WriteError(errNoGroupForKey(key, group))
+				return
+			}
+
+			if subUpper == "DELCONSUMER" {
+				c.WriteInt(db.streamConsumerDelete(key, group, consumer))
+				return
+			}
+			if db.streamConsumerCreate(key, group, consumer, m.effectiveNow()) {
+				c.WriteInt(1)
+			} else {
+				c.WriteInt(0)
+			}
+		})
+	default:
+		setDirty(c)
+		c.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try XGROUP HELP.", sub))
+	}
+}
+
+// XREADGROUP
+func (m *RediQueue) cmdXreadgroup(c *server.Peer, cmd string, args []string) {
+	if len(args) < 6 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	if strings.ToUpper(args[0]) != "GROUP" {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+	group, consumer := args[1], args[2]
+	opts, msg := parseXread(cmd, args[3:], true)
+	if msg != "" {
+		setDirty(c)
+		c.WriteError(msg)
+		return
+	}
+	var (
+		keys = opts.keys
+		ids  = make([]streamID, len(keys))
+		news = make([]bool, len(keys)) // ">": entries never delivered to the group
+	)
+	for i, a := range opts.ids {
+		switch a {
+		case ">":
+			news[i] = true
+			continue
+		case "$":
+			setDirty(c)
+			c.WriteError(msgXreadgroupDollar)
+			return
+		}
+		id, err := parseStreamID(a, 0)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidStreamID)
+			return
+		}
+		ids[i] = id
+	}
+
+	read := func(c *server.Peer, ctx *connCtx) bool {
+		db := m.db(ctx.selectedDB)
+		now := m.effectiveNow()
+		for _, k := range keys {
+			if db.exists(k) && db.t(k) != "stream" {
+				c.WriteError(msgWrongType)
+				return true
+			}
+			if s, ok := db.streamKeys[k]; !ok || s.groups[group] == nil {
+				c.WriteError(errNoGroup(k, group) + " in XREADGROUP with GROUP option")
+				return true
+			}
+		}
+
+		var (
+			found   []string
+			entries [][]streamEntry
+		)
+		for i, k := range keys {
+			db.streamConsumerSeen(k, group, consumer, now)
+			s := db.streamKeys[k]
+			g := s.groups[group]
+			if !news[i] {
+				// the history of this consumer, which is always replied
+				var es []streamEntry
+				for _, p := range g.consumerPending(consumer) {
+					if len(es) == opts.count {
+						break
+					}
+					if !ids[i].less(p.id) {
+						continue
+					}
+					e, ok := s.get(p.id)
+					if !ok {
+						es = append(es, streamEntry{id: p.id})
+						continue
+					}
+					es = append(es, e)
+					p.delivered = now
+					p.count++
+					db.streamPendingSet(k, group, p)
+				}
+				found = append(found, k)
+				entries = append(entries, es)
+				continue
+			}
+			es := s.after(g.lastID, opts.count)
+			if len(es) == 0 {
+				continue
+			}
+			if !opts.noAck {
+				for _, e := range es {
+					db.streamPendingSet(k, group, streamPending{
+						id:        e.id,
+						consumer:  consumer,
+						delivered: now,
+						count:     1,
+					})
+				}
+			}
+			db.streamGroupSetID(k, group, es[len(es)-1].id)
+			found = append(found, k)
+			entries = append(entries, es)
+		}
+		if len(found) == 0 {
+			return false
+		}
+		c.WriteLen(len(found))
+		for i, k := range found {
+			c.WriteLen(2)
+			c.WriteBulk(k)
+			writeStreamEntries(c, entries[i])
+		}
+		return true
+	}
+
+	if !opts.block {
+		withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+			if !read(c, ctx) {
+				c.WriteNull()
+			}
+		})
+		return
+	}
+	blocking(
+		m,
+		c,
+		opts.timeout,
+		read,
+		func(c *server.Peer) {
+			// timeout
+			c.WriteNull()
+		},
+	)
+}
+
+// XACK
+func (m *RediQueue) cmdXack(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, group := args[0], args[1]
+	var ids []streamID
+	for _, a := range args[2:] {
+		id, err := parseStreamID(a, 0)
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidStreamID)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+		if s, ok := db.streamKeys[key]; !ok || s.groups[group] == nil {
+			c.WriteInt(0)
+			return
+		}
+
+		c.WriteInt(db.streamAck(key, group, ids...))
+	})
+}
+
+// XPENDING
+func (m *RediQueue) cmdXpending(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	var (
+		key, group = args[0], args[1]
+		summary    = len(args) == 2
+		minIdle    time.Duration
+		start, end streamID
+		count      int
+		consumer   string
+	)
+	if !summary {
+		opts := args[2:]
+		if strings.ToUpper(opts[0]) == "IDLE" {
+			if len(opts) < 2 {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			ms, err := strconv.Atoi(opts[1])
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			minIdle = time.Duration(ms) * time.Millisecond
+			opts = opts[2:]
+		}
+		if len(opts) != 3 && len(opts) != 4 {
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+		var msg string
+		if start, msg = parseStreamRangeID(opts[0], true); msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+		if end, msg = parseStreamRangeID(opts[1], false); msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+		n, err := strconv.Atoi(opts[2])
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+		if n > 0 {
+			count = n
+		}
+		if len(opts) == 4 {
+			consumer = opts[3]
+		}
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+		s, ok := db.streamKeys[key]
+		if !ok || s.groups[group] == nil {
+			c.WriteError(errNoGroup(key, group))
+			return
+		}
+		g := s.groups[group]
+
+		if summary {
+			c.WriteLen(4)
+			c.WriteInt(len(g.pending))
+			if len(g.pending) == 0 {
+				c.WriteNull()
+				c.WriteNull()
+				c.WriteNull()
+				return
+			}
+			c.WriteBulk(g.pending[0].id.String())
+			c.WriteBulk(g.pending[len(g.pending)-1].id.String())
+			var consumers []string
+			for _, name := range g.consumerNames() {
+				if len(g.consumerPending(name)) > 0 {
+					consumers = append(consumers, name)
+				}
+			}
+			c.WriteLen(len(consumers))
+			for _, name := range consumers {
+				c.WriteLen(2)
+				c.WriteBulk(name)
+				c.WriteBulk(strconv.Itoa(len(g.consumerPending(name))))
+			}
+			return
+		}
+
+		now := m.effectiveNow()
+		var res []streamPending
+		for _, p := range g.pending {
+			if len(res) == count {
+				break
+			}
+			if p.id.less(start) || end.less(p.id) {
+				continue
+			}
+			if consumer != "" && p.consumer != consumer {
+				continue
+			}
+			if now.Sub(p.delivered) < minIdle {
+				continue
+			}
+			res = append(res, p)
+		}
+		c.WriteLen(len(res))
+		for _, p := range res {
+			c.WriteLen(4)
+			c.WriteBulk(p.id.String())
+			c.WriteBulk(p.consumer)
+			c.WriteInt(idleMs(now, p.delivered))
+			c.WriteInt(p.count)
+		}
+	})
+}
+
+// XCLAIM
+func (m *RediQueue) cmdXclaim(c *server.Peer, cmd string, args []string) {
+	if len(args) < 5 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, group, consumer := args[0], args[1], args[2]
+	minIdle, msg := parseMinIdle(args[3])
+	if msg != "" {
+		setDirty(c)
+		c.WriteError(msg)
+		return
+	}
+	var (
+		ids        []streamID
+		opts       = args[4:]
+		idle       time.Duration
+		at         time.Time
+		retryCount = -1
+		force      = false
+		justID     = false
+		lastID     *streamID
+	)
+	for len(opts) > 0 {
+		id, err := parseStreamID(opts[0], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+		opts = opts[1:]
+	}
+	for len(opts) > 0 {
+		switch o := strings.ToUpper(opts[0]); {
+		case o == "FORCE":
+			force = true
+			opts = opts[1:]
+		case o == "JUSTID":
+			justID = true
+			opts = opts[1:]
+		case o == "LASTID" && len(opts) > 1:
+			id, err := parseStreamID(opts[1], 0)
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidStreamID)
+				return
+			}
+			lastID = &id
+			opts = opts[2:]
+		case (o == "IDLE" || o == "TIME" || o == "RETRYCOUNT") && len(opts) > 1:
+			n, err := strconv.ParseInt(opts[1], 10, 64)
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			switch o {
+			case "IDLE":
+				idle = time.Duration(n) * time.Millisecond
+			case "TIME":
+				at = fromUnixMilli(n)
+			default:
+				retryCount = int(n)
+			}
+			opts = opts[2:]
+		default:
+			setDirty(c)
+			c.WriteError(fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", opts[0]))
+			return
+		}
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+		s, ok := db.streamKeys[key]
+		if !ok || s.groups[group] == nil {
+			c.WriteError(errNoGroup(key, group))
+			return
+		}
+		g := s.groups[group]
+
+		now := m.effectiveNow()
+		delivered := now.Add(-idle)
+		if !at.IsZero() {
+			delivered = at
+		}
+		if delivered.After(now) {
+			delivered = now
+		}
+		if lastID != nil && g.lastID.less(*lastID) {
+			db.streamGroupSetID(key, group, *lastID)
+		}
+		db.streamConsumerSeen(key, group, consumer, now)
+
+		var claimed []streamEntry
+		for _, id := range ids {
+			e, exists := s.get(id)
+			var p streamPending
+			if old := g.getPending(id); old != nil {
+				if !exists {
+					// gone from the stream, so it can't be delivered anymore
+					db.streamAck(key, group, id)
+					continue
+				}
+				if now.Sub(old.delivered) < minIdle {
+					continue
+				}
+				p = *old
+			} else {
+				if !force || !exists {
+					continue
+				}
+				p = streamPending{id: id, count: 1}
+			}
+			p.consumer = consumer
+			p.delivered = delivered
+			if retryCount >= 0 {
+				p.count = retryCount
+			} else if !justID {
+				p.count++
+			}
+			db.streamPendingSet(key, group, p)
+			claimed = append(claimed, e)
+		}
+
+		if justID {
+			c.WriteLen(len(claimed))
+			for _, e := range claimed {
+				c.WriteBulk(e.id.String())
+			}
+			return
+		}
+		writeStreamEntries(c, claimed)
+	})
+}
+
+// XAUTOCLAIM
+func (m *RediQueue) cmdXautoclaim(c *server.Peer, cmd string, args []string) {
+	if len(args) < 5 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, group, consumer := args[0], args[1], args[2]
+	minIdle, msg := parseMinIdle(args[3])
+	if msg != "" {
+		setDirty(c)
+		c.WriteError(msg)
+		return
+	}
+	start, msg := parseStreamRangeID(args[4], true)
+	if msg != "" {
+		setDirty(c)
+		c.WriteError(msg)
+		return
+	}
+	var (
+		count  = 100
+		justID = false
+	)
+	for opts := args[5:]; len(opts) > 0; {
+		switch strings.ToUpper(opts[0]) {
+		case "JUSTID":
+			justID = true
+			opts = opts[1:]
+		case "COUNT":
+			if len(opts) < 2 {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			n, err := strconv.Atoi(opts[1])
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			if n < 1 {
+				setDirty(c)
+				c.WriteError(msgCountPositive)
+				return
+			}
+			count = n
+			opts = opts[2:]
+		default:
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+		s, ok := db.streamKeys[key]
+		if !ok || s.groups[group] == nil {
+			c.WriteError(errNoGroup(key, group))
+			return
+		}
+		g := s.groups[group]
+
+		now := m.effectiveNow()
+		db.streamConsumerSeen(key, group, consumer, now)
+		var (
+			claimed  []streamEntry
+			deleted  []streamID
+			n        = count
+			attempts = 10 * count
+			i        = g.searchPending(start)
+		)
+		for ; i < len(g.pending) && n > 0 && attempts > 0; attempts-- {
+			p := g.pending[i]
+			e, exists := s.get(p.id)
+			if !exists {
+				db.streamAck(key, group, p.id)
+				deleted = append(deleted, p.id)
+				n--
+				continue
+			}
+			i++
+			if now.Sub(p.delivered) < minIdle {
+				continue
+			}
+			p.consumer = consumer
+			p.delivered = now
+			if !justID {
+				p.count++
+			}
+			db.streamPendingSet(key, group, p)
+			claimed = append(claimed, e)
+			n--
+		}
+		next := streamID{}
+		if i < len(g.pending) {
+			next = g.pending[i].id
+		}
+
+		c.WriteLen(3)
+		c.WriteBulk(next.String())
+		if justID {
+			c.WriteLen(len(claimed))
+			for _, e := range claimed {
+				c.WriteBulk(e.id.String())
+			}
+		} else {
+			writeStreamEntries(c, claimed)
+		}
+		writeStreamIDs(c, deleted)
+	})
+}
+
+// XINFO
+func (m *RediQueue) cmdXinfo(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	sub, args := args[0], args[1:]
+	subUpper := strings.ToUpper(sub)
+	switch subUpper {
+	case "STREAM", "GROUPS":
+		if len(args) != 1 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd + "|" + sub))
+			return
+		}
+	case "CONSUMERS":
+		if len(args) != 2 {
+			setDirty(c)
+			c.WriteError(errWrongNumber(cmd + "|" + sub))
+			return
+		}
+	default:
+		setDirty(c)
+		c.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try XINFO HELP.", sub))
+		return
+	}
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteError(msgKeyNotFound)
+			return
+		}
+		if db.t(key) != "stream" {
+			c.WriteError(msgWrongType)
+			return
+		}
+		s := db.streamKeys[key]
+
+		switch subUpper {
+		case "STREAM":
+			c.WriteLen(10)
+			c.WriteBulk("length")
+			c.WriteInt(len(s.entries))
+			c.WriteBulk("last-generated-id")
+			c.WriteBulk(s.lastID.String())
+			c.WriteBulk("groups")
+			c.WriteInt(len(s.groups))
+			c.WriteBulk("first-entry")
+			if len(s.entries) == 0 {
+				c.WriteNull()
+			} else {
+				writeStreamEntry(c, s.entries[0])
+			}
+			c.WriteBulk("last-entry")
+			if len(s.entries) == 0 {
+				c.WriteNull()
+			} else {
+				writeStreamEntry(c, s.entries[len(s.entries)-1])
+			}
+		case "GROUPS":
+			c.WriteLen(len(s.groups))
+			for _, name := range s.groupNames() {
+				g := s.groups[name]
+				c.WriteLen(8)
+				c.WriteBulk("name")
+				c.WriteBulk(name)
+				c.WriteBulk("consumers")
+				c.WriteInt(len(g.consumers))
+				c.WriteBulk("pending")
+				c.WriteInt(len(g.pending))
+				c.WriteBulk("last-delivered-id")
+				c.WriteBulk(g.lastID.String())
+			}
+		case "CONSUMERS":
+			group := args[1]
+			g := s.groups[group]
+			if g == nil {
+				c.WriteError(errNoGroupForKey(key, group))
+				return
+			}
+			now := m.effectiveNow()
+			c.WriteLen(len(g.consumers))
+			for _, name := range g.consumerNames() {
+				c.WriteLen(6)
+				c.WriteBulk("name")
+				c.WriteBulk(name)
+				c.WriteBulk("pending")
+				c.WriteInt(len(g.consumerPending(name)))
+				c.WriteBulk("idle")
+				c.WriteInt(idleMs(now, g.consumers[name].seen))
+			}
+		}
+	})
+}
+
+// writeStreamEntries writes entries as an array of [id, [field, value, ...]].
+func writeStreamEntries(c *server.Peer, entries []streamEntry) {
+	c.WriteLen(len(entries))
+	for _, e := range entries {
+		writeStreamEntry(c, e)
+	}
+}
+
+// writeStreamEntry writes [id, [field, value, ...]]. Entries without values
+// are deleted ones, which XREADGROUP gives as [id, nil].
+func writeStreamEntry(c *server.Peer, e streamEntry) {
+	c.WriteLen(2)
+	c.WriteBulk(e.id.String())
+	if e.values == nil {
+		c.WriteNull()
+		return
+	}
+	c.WriteLen(len(e.values))
+	for _, v := range e.values {
+		c.WriteBulk(v)
+	}
+}
+
+// writeStreamIDs writes IDs as an array.
+func writeStreamIDs(c *server.Peer, ids []streamID) {
+	c.WriteLen(len(ids))
+	for _, id := range ids {
+		c.WriteBulk(id.String())
+	}
+}
+
+// parseStreamRangeID parses an XRANGE start or end: "-", "+", an ID, or an
+// ID prefixed with "(" to leave it out. An ID without a sequence number is
+// the first or the last ID of that millisecond.
+func parseStreamRangeID(s string, start bool) (streamID, string) {
+	switch s {
+	case "-":
+		return streamID{}, ""
+	case "+":
+		return maxStreamID, ""
+	}
+	excl := strings.HasPrefix(s, "(")
+	if excl {
+		s = s[1:]
+	}
+	var seq uint64
+	if !start {
+		seq = maxStreamID.seq
+	}
+	id, err := parseStreamID(s, seq)
+	if err != nil {
+		return id, msgInvalidStreamID
+	}
+	if !excl {
+		return id, ""
+	}
+	if start {
+		next, ok := id.next()
+		if !ok {
+			return id, msgInvalidStartID
+		}
+		return next, ""
+	}
+	prev, ok := id.prev()
+	if !ok {
+		return id, msgInvalidEndID
+	}
+	return prev, ""
+}
+
+// parseMinIdle parses the min-idle-time of XCLAIM and XAUTOCLAIM.
+func parseMinIdle(s string) (time.Duration, string) {
+	ms, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, msgXclaimMinIdle
+	}
+	if ms < 0 {
+		ms = 0
+	}
+	return time.Duration(ms) * time.Millisecond, ""
+}
+
+// idleMs gives the milliseconds since t, which is never negative.
+func idleMs(now, t time.Time) int {
+	if d := now.Sub(t); d > 0 {
+		return int(d / time.Millisecond)
+	}
+	return 0
+}
+
+func errXreadUnbalanced(cmd string) string {
+	return "ERR Unbalanced '" + strings.ToLower(cmd) + "' list of streams: for each stream key an ID or '$' must be specified."
+}
@@ -0,0 +1,974 @@
+package rediqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// streamEntries flattens an XRANGE reply to [id, field, value, ..., id, ...].
+func streamEntries(t *testing.T, res interface{}) []string {
+	entries, err := redis.Values(res, nil)
+	ok(t, err)
+	var flat []string
+	for _, e := range entries {
+		parts, err := redis.Values(e, nil)
+		ok(t, err)
+		equals(t, 2, len(parts))
+		id, err := redis.String(parts[0], nil)
+		ok(t, err)
+		values, err := redis.Strings(parts[1], nil)
+		ok(t, err)
+		flat = append(flat, id)
+		flat = append(flat, values...)
+	}
+	return flat
+}
+
+// Test XADD / XLEN / XRANGE.
+func TestStreamAdd(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+	s.SetTime(time.Unix(1000, 0))
+
+	{
+		id, err := redis.String(c.Do("XADD", "s", "1-1", "name", "aap"))
+		ok(t, err)
+		equals(t, "1-1", id)
+		id, err = redis.String(c.Do("XADD", "s", "1-*", "name", "noot"))
+		ok(t, err)
+		equals(t, "1-2", id)
+		id, err = redis.String(c.Do("XADD", "s", "5", "name", "mies", "age", "3"))
+		ok(t, err)
+		equals(t, "5-0", id)
+		id, err = redis.String(c.Do("XADD", "s", "*", "name", "vuur"))
+		ok(t, err)
+		equals(t, "1000000-0", id)
+		id, err = redis.String(c.Do("XADD", "s", "*", "name", "wim"))
+		ok(t, err)
+		equals(t, "1000000-1", id)
+
+		n, err := redis.Int(c.Do("XLEN", "s"))
+		ok(t, err)
+		equals(t, 5, n)
+		n, err = redis.Int(c.Do("XLEN", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		v, err := redis.String(c.Do("TYPE", "s"))
+		ok(t, err)
+		equals(t, "stream", v)
+
+		entries, err := s.Stream("s")
+		ok(t, err)
+		equals(t, 5, len(entries))
+		equals(t, StreamEntry{ID: "5-0", Values: []string{"name", "mies", "age", "3"}}, entries[2])
+	}
+
+	// IDs which are not above the last one
+	{
+		_, err := c.Do("XADD", "s", "1000000-1", "name", "zus")
+		equals(t, msgStreamIDTooSmall, err.(redis.Error).Error())
+		_, err = c.Do("XADD", "s", "999", "name", "zus")
+		equals(t, msgStreamIDTooSmall, err.(redis.Error).Error())
+		_, err = c.Do("XADD", "s", "999-*", "name", "zus")
+		equals(t, msgStreamIDTooSmall, err.(redis.Error).Error())
+		_, err = c.Do("XADD", "new", "0-0", "name", "zus")
+		equals(t, msgStreamIDZero, err.(redis.Error).Error())
+		_, err = c.Do("XADD", "new", "foo", "name", "zus")
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+		equals(t, false, s.Exists("new"))
+	}
+
+	// NOMKSTREAM, MAXLEN, and MINID
+	{
+		v, err := c.Do("XADD", "new", "NOMKSTREAM", "*", "name", "zus")
+		ok(t, err)
+		equals(t, nil, v)
+		equals(t, false, s.Exists("new"))
+
+		id, err := redis.String(c.Do("XADD", "s", "MAXLEN", "3", "*", "name", "jet"))
+		ok(t, err)
+		equals(t, "1000000-2", id)
+		n, err := redis.Int(c.Do("XLEN", "s"))
+		ok(t, err)
+		equals(t, 3, n)
+
+		_, err = c.Do("XADD", "s", "MINID", "~", "1000000-2", "LIMIT", "10", "*", "name", "teun")
+		ok(t, err)
+		n, err = redis.Int(c.Do("XLEN", "s"))
+		ok(t, err)
+		equals(t, 2, n)
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XADD", "str", "*", "name", "aap")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XADD", "s", "*", "name")
+		assert(t, err != nil, "XADD error")
+		_, err = c.Do("XADD", "s", "*")
+		assert(t, err != nil, "XADD error")
+		_, err = c.Do("XADD", "s", "MAXLEN", "-1", "*", "name", "aap")
+		equals(t, msgStreamMaxlenNeg, err.(redis.Error).Error())
+		_, err = c.Do("XADD", "s", "MAXLEN", "1", "LIMIT", "10", "*", "name", "aap")
+		equals(t, msgStreamLimitExact, err.(redis.Error).Error())
+		_, err = c.Do("XLEN", "str")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XLEN")
+		assert(t, err != nil, "XLEN error")
+	}
+}
+
+func TestStreamRange(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	for _, id := range []string{"1-0", "1-1", "2-0", "3-5"} {
+		_, err := s.XAdd("s", id, "id", id)
+		ok(t, err)
+	}
+
+	{
+		res, err := c.Do("XRANGE", "s", "-", "+")
+		ok(t, err)
+		equals(t, []string{"1-0", "id", "1-0", "1-1", "id", "1-1", "2-0", "id", "2-0", "3-5", "id", "3-5"}, streamEntries(t, res))
+
+		res, err = c.Do("XRANGE", "s", "1", "2")
+		ok(t, err)
+		equals(t, []string{"1-0", "id", "1-0", "1-1", "id", "1-1", "2-0", "id", "2-0"}, streamEntries(t, res))
+
+		res, err = c.Do("XRANGE", "s", "(1-0", "(3-5")
+		ok(t, err)
+		equals(t, []string{"1-1", "id", "1-1", "2-0", "id", "2-0"}, streamEntries(t, res))
+
+		res, err = c.Do("XRANGE", "s", "-", "+", "COUNT", 1)
+		ok(t, err)
+		equals(t, []string{"1-0", "id", "1-0"}, streamEntries(t, res))
+
+		res, err = c.Do("XRANGE", "s", "-", "+", "COUNT", -1)
+		ok(t, err)
+		equals(t, []string(nil), streamEntries(t, res))
+
+		res, err = c.Do("XRANGE", "s", "3", "1")
+		ok(t, err)
+		equals(t, []string(nil), streamEntries(t, res))
+
+		res, err = c.Do("XRANGE", "nosuch", "-", "+")
+		ok(t, err)
+		equals(t, []string(nil), streamEntries(t, res))
+	}
+
+	// XREVRANGE has end first
+	{
+		res, err := c.Do("XREVRANGE", "s", "+", "-", "COUNT", 2)
+		ok(t, err)
+		equals(t, []string{"3-5", "id", "3-5", "2-0", "id", "2-0"}, streamEntries(t, res))
+
+		res, err = c.Do("XREVRANGE", "s", "(2-0", "1-1")
+		ok(t, err)
+		equals(t, []string{"1-1", "id", "1-1"}, streamEntries(t, res))
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XRANGE", "str", "-", "+")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XRANGE", "s", "foo", "+")
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+		_, err = c.Do("XRANGE", "s", "-", "+", "COUNT")
+		assert(t, err != nil, "XRANGE error")
+		_, err = c.Do("XRANGE", "s", "-", "+", "COUNT", "foo")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("XRANGE", "s", "-", "+", "LIMIT", 1)
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XRANGE", "s", "(18446744073709551615-18446744073709551615", "+")
+		equals(t, msgInvalidStartID, err.(redis.Error).Error())
+		_, err = c.Do("XRANGE", "s", "-", "(0-0")
+		equals(t, msgInvalidEndID, err.(redis.Error).Error())
+	}
+}
+
+// Test XDEL / XTRIM / XSETID.
+func TestStreamDelete(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	for _, id := range []string{"1-0", "2-0", "3-0", "4-0", "5-0"} {
+		_, err := s.XAdd("s", id, "id", id)
+		ok(t, err)
+	}
+
+	{
+		n, err := redis.Int(c.Do("XDEL", "s", "2-0", "2-1", "4"))
+		ok(t, err)
+		equals(t, 2, n)
+		n, err = redis.Int(c.Do("XDEL", "nosuch", "1-0"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		n, err = redis.Int(c.Do("XTRIM", "s", "MAXLEN", "=", 2))
+		ok(t, err)
+		equals(t, 1, n)
+		res, err := c.Do("XRANGE", "s", "-", "+")
+		ok(t, err)
+		equals(t, []string{"3-0", "id", "3-0", "5-0", "id", "5-0"}, streamEntries(t, res))
+
+		n, err = redis.Int(c.Do("XTRIM", "s", "MINID", "6"))
+		ok(t, err)
+		equals(t, 2, n)
+		n, err = redis.Int(c.Do("XLEN", "s"))
+		ok(t, err)
+		equals(t, 0, n)
+		// empty streams stay, and keep their last ID
+		equals(t, true, s.Exists("s"))
+		_, err = c.Do("XADD", "s", "5-0", "id", "again")
+		equals(t, msgStreamIDTooSmall, err.(redis.Error).Error())
+	}
+
+	{
+		v, err := redis.String(c.Do("XSETID", "s", "10-0"))
+		ok(t, err)
+		equals(t, "OK", v)
+		id, err := redis.String(c.Do("XADD", "s", "10-*", "id", "next"))
+		ok(t, err)
+		equals(t, "10-1", id)
+		_, err = c.Do("XSETID", "s", "9-0")
+		equals(t, msgStreamSetIDTooSmall, err.(redis.Error).Error())
+		_, err = c.Do("XSETID", "nosuch", "9-0")
+		equals(t, msgKeyNotFound, err.(redis.Error).Error())
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XDEL", "str", "1-0")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XDEL", "s", "foo")
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+		_, err = c.Do("XDEL", "s")
+		assert(t, err != nil, "XDEL error")
+		_, err = c.Do("XTRIM", "str", "MAXLEN", 1)
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XTRIM", "s", "MAXLEN", 1, "foo")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XTRIM", "s", "SIZE", 1)
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XTRIM", "s", "MAXLEN", "foo")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("XSETID", "str", "1-0")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XSETID", "s", "foo")
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+	}
+}
+
+func TestStreamKeys(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	_, err := s.XAdd("s", "1-0", "name", "aap")
+	ok(t, err)
+	_, err = s.XAdd("s", "2-0", "name", "noot")
+	ok(t, err)
+
+	{
+		_, err := c.Do("RENAME", "s", "s2")
+		ok(t, err)
+		equals(t, false, s.Exists("s"))
+		entries, err := s.Stream("s2")
+		ok(t, err)
+		equals(t, []StreamEntry{
+			{ID: "1-0", Values: []string{"name", "aap"}},
+			{ID: "2-0", Values: []string{"name", "noot"}},
+		}, entries)
+	}
+
+	{
+		n, err := redis.Int(c.Do("MOVE", "s2", 1))
+		ok(t, err)
+		equals(t, 1, n)
+		entries, err := s.DB(1).Stream("s2")
+		ok(t, err)
+		equals(t, 2, len(entries))
+	}
+
+	{
+		_, err := c.Do("SELECT", 1)
+		ok(t, err)
+		payload, err := redis.String(c.Do("DUMP", "s2"))
+		ok(t, err)
+		_, err = c.Do("RESTORE", "s3", 0, payload)
+		ok(t, err)
+		res, err := c.Do("XRANGE", "s3", "-", "+")
+		ok(t, err)
+		equals(t, []string{"1-0", "name", "aap", "2-0", "name", "noot"}, streamEntries(t, res))
+		_, err = c.Do("XADD", "s3", "2-0", "name", "mies")
+		equals(t, msgStreamIDTooSmall, err.(redis.Error).Error())
+	}
+
+	{
+		_, err := s.Stream("nosuch")
+		equals(t, ErrKeyNotFound, err)
+		s.Set("str", "value")
+		_, err = s.Stream("str")
+		equals(t, ErrWrongType, err)
+		_, err = s.XAdd("str", "*", "name", "aap")
+		equals(t, ErrWrongType, err)
+		_, err = s.XAdd("s", "*", "name")
+		assert(t, err != nil, "XAdd error")
+	}
+}
+
+func TestXread(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		_, err := s.XAdd("s1", id, "id", id)
+		ok(t, err)
+	}
+	_, err := s.XAdd("s2", "5-0", "id", "5-0")
+	ok(t, err)
+
+	{
+		res, err := redis.Values(c.Do("XREAD", "COUNT", 2, "STREAMS", "s1", "s2", "nosuch", "1", "0", "0"))
+		ok(t, err)
+		equals(t, 2, len(res))
+		s1, err := redis.Values(res[0], nil)
+		ok(t, err)
+		equals(t, "s1", string(s1[0].([]byte)))
+		equals(t, []string{"2-0", "id", "2-0", "3-0", "id", "3-0"}, streamEntries(t, s1[1]))
+		s2, err := redis.Values(res[1], nil)
+		ok(t, err)
+		equals(t, "s2", string(s2[0].([]byte)))
+		equals(t, []string{"5-0", "id", "5-0"}, streamEntries(t, s2[1]))
+
+		v, err := c.Do("XREAD", "STREAMS", "s1", "$")
+		ok(t, err)
+		equals(t, nil, v)
+		v, err = c.Do("XREAD", "STREAMS", "s1", "3-0")
+		ok(t, err)
+		equals(t, nil, v)
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XREAD", "STREAMS", "str", "0")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XREAD", "STREAMS", "s1", "s2", "0")
+		equals(t, errXreadUnbalanced("XREAD"), err.(redis.Error).Error())
+		_, err = c.Do("XREAD", "STREAMS", "s1", "foo")
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+		_, err = c.Do("XREAD", "COUNT", "foo", "STREAMS", "s1", "0")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("XREAD", "BLOCK", -1, "STREAMS", "s1", "0")
+		equals(t, msgNegTimeout, err.(redis.Error).Error())
+		_, err = c.Do("XREAD", "FOO", "STREAMS", "s1", "0")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XREAD", "STREAMS")
+		assert(t, err != nil, "XREAD error")
+	}
+}
+
+// goXread runs a command in the background and gives its reply.
+func goXread(c redis.Conn, args ...interface{}) <-chan interface{} {
+	got := make(chan interface{}, 1)
+	go func() {
+		res, err := c.Do("XREAD", args...)
+		if err != nil {
+			got <- err
+			return
+		}
+		got <- res
+	}()
+	return got
+}
+
+func TestXreadBlock(t *testing.T) {
+	s, c1, c2, done := setup2(t)
+	defer done()
+
+	_, err := s.XAdd("s", "1-0", "id", "old")
+	ok(t, err)
+
+	got := goXread(c2, "BLOCK", 0, "STREAMS", "s", "$")
+	time.Sleep(30 * time.Millisecond)
+
+	_, err = c1.Do("XADD", "other", "*", "id", "other")
+	ok(t, err)
+	_, err = c1.Do("XADD", "s", "2-0", "id", "new")
+	ok(t, err)
+
+	select {
+	case have := <-got:
+		res, err := redis.Values(have, nil)
+		ok(t, err)
+		equals(t, 1, len(res))
+		stream, err := redis.Values(res[0], nil)
+		ok(t, err)
+		equals(t, "s", string(stream[0].([]byte)))
+		equals(t, []string{"2-0", "id", "new"}, streamEntries(t, stream[1]))
+	case <-time.After(500 * time.Millisecond):
+		t.Error("XREAD took too long")
+	}
+}
+
+func TestXreadTimeout(t *testing.T) {
+	_, c, done := setup(t)
+	defer done()
+
+	got := goXread(c, "BLOCK", 100, "STREAMS", "s", "0")
+	select {
+	case have := <-got:
+		equals(t, nil, have)
+	case <-time.After(500 * time.Millisecond):
+		t.Error("XREAD took too long")
+	}
+}
+
+func TestXreadTx(t *testing.T) {
+	// XREAD BLOCK in a transaction behaves as if the timeout triggers right
+	// away
+	_, c, done := setup(t)
+	defer done()
+
+	_, err := c.Do("MULTI")
+	ok(t, err)
+	v, err := redis.String(c.Do("XREAD", "BLOCK", 0, "STREAMS", "s", "0"))
+	ok(t, err)
+	equals(t, "QUEUED", v)
+	_, err = c.Do("XADD", "s", "1-0", "id", "aap")
+	ok(t, err)
+	_, err = c.Do("XREAD", "BLOCK", 0, "STREAMS", "s", "0")
+	ok(t, err)
+
+	res, err := redis.Values(c.Do("EXEC"))
+	ok(t, err)
+	equals(t, 3, len(res))
+	equals(t, nil, res[0])
+	equals(t, []byte("1-0"), res[1])
+	read, err := redis.Values(res[2], nil)
+	ok(t, err)
+	equals(t, 1, len(read))
+}
+
+// Test XGROUP.
+func TestStreamGroup(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	_, err := s.XAdd("s", "1-0", "id", "1")
+	ok(t, err)
+	_, err = s.XAdd("s", "2-0", "id", "2")
+	ok(t, err)
+
+	{
+		v, err := redis.String(c.Do("XGROUP", "CREATE", "s", "all", "0"))
+		ok(t, err)
+		equals(t, "OK", v)
+		_, err = c.Do("XGROUP", "CREATE", "s", "new", "$")
+		ok(t, err)
+		_, err = c.Do("XGROUP", "CREATE", "s", "all", "0")
+		equals(t, msgXgroupBusy, err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "CREATE", "nosuch", "all", "0")
+		equals(t, msgXgroupKeyNotFound, err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "CREATE", "made", "all", "$", "MKSTREAM")
+		ok(t, err)
+		n, err := redis.Int(c.Do("XLEN", "made"))
+		ok(t, err)
+		equals(t, 0, n)
+
+		res, err := c.Do("XREADGROUP", "GROUP", "new", "alice", "STREAMS", "s", ">")
+		ok(t, err)
+		equals(t, nil, res)
+	}
+
+	{
+		v, err := redis.String(c.Do("XGROUP", "SETID", "s", "new", "1-0"))
+		ok(t, err)
+		equals(t, "OK", v)
+		res, err := c.Do("XREADGROUP", "GROUP", "new", "alice", "STREAMS", "s", ">")
+		ok(t, err)
+		read, err := redis.Values(res, nil)
+		ok(t, err)
+		stream, err := redis.Values(read[0], nil)
+		ok(t, err)
+		equals(t, []string{"2-0", "id", "2"}, streamEntries(t, stream[1]))
+		_, err = c.Do("XGROUP", "SETID", "s", "nosuch", "1-0")
+		equals(t, errNoGroupForKey("s", "nosuch"), err.(redis.Error).Error())
+	}
+
+	{
+		n, err := redis.Int(c.Do("XGROUP", "CREATECONSUMER", "s", "new", "bob"))
+		ok(t, err)
+		equals(t, 1, n)
+		n, err = redis.Int(c.Do("XGROUP", "CREATECONSUMER", "s", "new", "bob"))
+		ok(t, err)
+		equals(t, 0, n)
+		n, err = redis.Int(c.Do("XGROUP", "DELCONSUMER", "s", "new", "alice"))
+		ok(t, err)
+		equals(t, 1, n) // it had 2-0 pending
+		n, err = redis.Int(c.Do("XGROUP", "DELCONSUMER", "s", "new", "alice"))
+		ok(t, err)
+		equals(t, 0, n)
+		equals(t, 0, len(s.dbs[0].streamKeys["s"].groups["new"].pending))
+
+		n, err = redis.Int(c.Do("XGROUP", "DESTROY", "s", "new"))
+		ok(t, err)
+		equals(t, 1, n)
+		n, err = redis.Int(c.Do("XGROUP", "DESTROY", "s", "new"))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XGROUP", "CREATE", "str", "g", "0")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "CREATE", "s", "g", "foo")
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "CREATE", "s", "g", "0", "FOO")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "SETID", "s", "all", "0", "MKSTREAM")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "CREATE", "s", "g")
+		equals(t, errWrongNumber("xgroup|create"), err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "DESTROY", "nosuch", "g")
+		equals(t, msgXgroupKeyNotFound, err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "CREATECONSUMER", "s", "nosuch", "bob")
+		equals(t, errNoGroupForKey("s", "nosuch"), err.(redis.Error).Error())
+		_, err = c.Do("XGROUP", "FOO")
+		assert(t, err != nil, "XGROUP error")
+		_, err = c.Do("XGROUP")
+		assert(t, err != nil, "XGROUP error")
+	}
+}
+
+// Test XREADGROUP / XACK.
+func TestXreadgroup(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		_, err := s.XAdd("s", id, "id", id)
+		ok(t, err)
+	}
+	_, err := c.Do("XGROUP", "CREATE", "s", "g", "0")
+	ok(t, err)
+	// readStream gives the entries of the only stream in an XREADGROUP reply.
+	readStream := func(res interface{}) []string {
+		read, err := redis.Values(res, nil)
+		ok(t, err)
+		equals(t, 1, len(read))
+		stream, err := redis.Values(read[0], nil)
+		ok(t, err)
+		equals(t, "s", string(stream[0].([]byte)))
+		return streamEntries(t, stream[1])
+	}
+
+	{
+		res, err := c.Do("XREADGROUP", "GROUP", "g", "alice", "COUNT", 2, "STREAMS", "s", ">")
+		ok(t, err)
+		equals(t, []string{"1-0", "id", "1-0", "2-0", "id", "2-0"}, readStream(res))
+		res, err = c.Do("XREADGROUP", "GROUP", "g", "bob", "NOACK", "STREAMS", "s", ">")
+		ok(t, err)
+		equals(t, []string{"3-0", "id", "3-0"}, readStream(res))
+		res, err = c.Do("XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">")
+		ok(t, err)
+		equals(t, nil, res)
+
+		// history
+		res, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "0")
+		ok(t, err)
+		equals(t, []string{"1-0", "id", "1-0", "2-0", "id", "2-0"}, readStream(res))
+		res, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "1-0")
+		ok(t, err)
+		equals(t, []string{"2-0", "id", "2-0"}, readStream(res))
+		res, err = c.Do("XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", "0")
+		ok(t, err)
+		equals(t, []string(nil), readStream(res))
+		g := s.dbs[0].streamKeys["s"].groups["g"]
+		equals(t, 3, g.getPending(streamID{2, 0}).count)
+		equals(t, streamID{3, 0}, g.lastID)
+
+		// deleted entries are nil in the history
+		_, err = c.Do("XDEL", "s", "1-0")
+		ok(t, err)
+		res, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "COUNT", 1, "STREAMS", "s", "0")
+		ok(t, err)
+		read, err := redis.Values(res, nil)
+		ok(t, err)
+		stream, err := redis.Values(read[0], nil)
+		ok(t, err)
+		entries, err := redis.Values(stream[1], nil)
+		ok(t, err)
+		equals(t, []interface{}{[]byte("1-0"), nil}, entries[0])
+	}
+
+	{
+		n, err := redis.Int(c.Do("XACK", "s", "g", "1-0", "2-0", "3-0"))
+		ok(t, err)
+		equals(t, 2, n)
+		n, err = redis.Int(c.Do("XACK", "s", "g", "1-0"))
+		ok(t, err)
+		equals(t, 0, n)
+		n, err = redis.Int(c.Do("XACK", "s", "nosuch", "1-0"))
+		ok(t, err)
+		equals(t, 0, n)
+		n, err = redis.Int(c.Do("XACK", "nosuch", "g", "1-0"))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "str", ">")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XREADGROUP", "GROUP", "nosuch", "alice", "STREAMS", "s", ">")
+		equals(t, errNoGroup("s", "nosuch")+" in XREADGROUP with GROUP option", err.(redis.Error).Error())
+		_, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "$")
+		equals(t, msgXreadgroupDollar, err.(redis.Error).Error())
+		_, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s")
+		assert(t, err != nil, "XREADGROUP error")
+		_, err = c.Do("XREADGROUP", "FOO", "g", "alice", "STREAMS", "s", ">")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XREAD", "STREAMS", "s", ">")
+		equals(t, msgXreadGT, err.(redis.Error).Error())
+		_, err = c.Do("XREAD", "NOACK", "STREAMS", "s", "0")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XACK", "str", "g", "1-0")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XACK", "s", "g", "foo")
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+		_, err = c.Do("XACK", "s", "g")
+		assert(t, err != nil, "XACK error")
+	}
+}
+
+func TestXreadgroupBlock(t *testing.T) {
+	s, c1, c2, done := setup2(t)
+	defer done()
+
+	_, err := c1.Do("XGROUP", "CREATE", "s", "g", "$", "MKSTREAM")
+	ok(t, err)
+
+	got := make(chan interface{}, 1)
+	go func() {
+		res, err := c2.Do("XREADGROUP", "GROUP", "g", "alice", "BLOCK", 0, "STREAMS", "s", ">")
+		if err != nil {
+			got <- err
+			return
+		}
+		got <- res
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	_, err = c1.Do("XADD", "s", "1-0", "id", "new")
+	ok(t, err)
+
+	select {
+	case have := <-got:
+		res, err := redis.Values(have, nil)
+		ok(t, err)
+		stream, err := redis.Values(res[0], nil)
+		ok(t, err)
+		equals(t, []string{"1-0", "id", "new"}, streamEntries(t, stream[1]))
+		equals(t, 1, len(s.dbs[0].streamKeys["s"].groups["g"].consumerPending("alice")))
+	case <-time.After(500 * time.Millisecond):
+		t.Error("XREADGROUP took too long")
+	}
+}
+
+func TestXpending(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	now := time.Unix(1000, 0)
+	s.SetTime(now)
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		_, err := s.XAdd("s", id, "id", id)
+		ok(t, err)
+	}
+	_, err := c.Do("XGROUP", "CREATE", "s", "g", "0")
+	ok(t, err)
+
+	{
+		res, err := redis.Values(c.Do("XPENDING", "s", "g"))
+		ok(t, err)
+		equals(t, []interface{}{int64(0), nil, nil, nil}, res)
+	}
+
+	_, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "COUNT", 2, "STREAMS", "s", ">")
+	ok(t, err)
+	s.SetTime(now.Add(time.Second))
+	_, err = c.Do("XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">")
+	ok(t, err)
+	s.SetTime(now.Add(3 * time.Second))
+
+	{
+		res, err := redis.Values(c.Do("XPENDING", "s", "g"))
+		ok(t, err)
+		equals(t, []interface{}{
+			int64(3),
+			[]byte("1-0"),
+			[]byte("3-0"),
+			[]interface{}{
+				[]interface{}{[]byte("alice"), []byte("2")},
+				[]interface{}{[]byte("bob"), []byte("1")},
+			},
+		}, res)
+
+		res, err = redis.Values(c.Do("XPENDING", "s", "g", "-", "+", 10))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]interface{}{[]byte("1-0"), []byte("alice"), int64(3000), int64(1)},
+			[]interface{}{[]byte("2-0"), []byte("alice"), int64(3000), int64(1)},
+			[]interface{}{[]byte("3-0"), []byte("bob"), int64(2000), int64(1)},
+		}, res)
+
+		res, err = redis.Values(c.Do("XPENDING", "s", "g", "IDLE", 2500, "-", "+", 10))
+		ok(t, err)
+		equals(t, 2, len(res))
+
+		res, err = redis.Values(c.Do("XPENDING", "s", "g", "(1-0", "+", 10, "alice"))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]interface{}{[]byte("2-0"), []byte("alice"), int64(3000), int64(1)},
+		}, res)
+
+		res, err = redis.Values(c.Do("XPENDING", "s", "g", "-", "+", 1))
+		ok(t, err)
+		equals(t, 1, len(res))
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XPENDING", "str", "g")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XPENDING", "s", "nosuch")
+		equals(t, errNoGroup("s", "nosuch"), err.(redis.Error).Error())
+		_, err = c.Do("XPENDING", "nosuch", "g")
+		equals(t, errNoGroup("nosuch", "g"), err.(redis.Error).Error())
+		_, err = c.Do("XPENDING", "s", "g", "-", "+")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XPENDING", "s", "g", "-", "+", "foo")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("XPENDING", "s", "g", "IDLE", "foo", "-", "+", 1)
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("XPENDING", "s", "g", "foo", "+", 1)
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+		_, err = c.Do("XPENDING", "s")
+		assert(t, err != nil, "XPENDING error")
+	}
+}
+
+func TestXclaim(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	now := time.Unix(1000, 0)
+	s.SetTime(now)
+	for _, id := range []string{"1-0", "2-0", "3-0", "4-0"} {
+		_, err := s.XAdd("s", id, "id", id)
+		ok(t, err)
+	}
+	_, err := c.Do("XGROUP", "CREATE", "s", "g", "0")
+	ok(t, err)
+	_, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "COUNT", 3, "STREAMS", "s", ">")
+	ok(t, err)
+	s.SetTime(now.Add(10 * time.Second))
+	g := s.dbs[0].streamKeys["s"].groups["g"]
+
+	{
+		// 2-0 is not idle long enough, 4-0 not pending
+		res, err := c.Do("XCLAIM", "s", "g", "bob", 5000, "1-0", "4-0")
+		ok(t, err)
+		equals(t, []string{"1-0", "id", "1-0"}, streamEntries(t, res))
+		p := g.getPending(streamID{1, 0})
+		equals(t, "bob", p.consumer)
+		equals(t, 2, p.count)
+		equals(t, now.Add(10*time.Second), p.delivered)
+
+		res, err = c.Do("XCLAIM", "s", "g", "bob", 5000, "1-0")
+		ok(t, err)
+		equals(t, []string(nil), streamEntries(t, res))
+
+		ids, err := redis.Strings(c.Do("XCLAIM", "s", "g", "bob", 0, "2-0", "JUSTID", "IDLE", 500))
+		ok(t, err)
+		equals(t, []string{"2-0"}, ids)
+		p = g.getPending(streamID{2, 0})
+		equals(t, 1, p.count)
+		equals(t, now.Add(9500*time.Millisecond), p.delivered)
+
+		ids, err = redis.Strings(c.Do("XCLAIM", "s", "g", "carol", 0, "4-0", "FORCE", "JUSTID", "RETRYCOUNT", 7, "TIME", 1000500, "LASTID", "4-0"))
+		ok(t, err)
+		equals(t, []string{"4-0"}, ids)
+		p = g.getPending(streamID{4, 0})
+		equals(t, "carol", p.consumer)
+		equals(t, 7, p.count)
+		equals(t, time.Unix(1000, 500*1000*1000), p.delivered)
+		equals(t, streamID{4, 0}, g.lastID)
+
+		// entries deleted from the stream are dropped
+		_, err = c.Do("XDEL", "s", "3-0")
+		ok(t, err)
+		res, err = c.Do("XCLAIM", "s", "g", "bob", 0, "3-0")
+		ok(t, err)
+		equals(t, []string(nil), streamEntries(t, res))
+		equals(t, (*streamPending)(nil), g.getPending(streamID{3, 0}))
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XCLAIM", "str", "g", "bob", 0, "1-0")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XCLAIM", "s", "nosuch", "bob", 0, "1-0")
+		equals(t, errNoGroup("s", "nosuch"), err.(redis.Error).Error())
+		_, err = c.Do("XCLAIM", "s", "g", "bob", "foo", "1-0")
+		equals(t, msgXclaimMinIdle, err.(redis.Error).Error())
+		_, err = c.Do("XCLAIM", "s", "g", "bob", 0, "1-0", "FOO")
+		equals(t, "ERR Unrecognized XCLAIM option 'FOO'", err.(redis.Error).Error())
+		_, err = c.Do("XCLAIM", "s", "g", "bob", 0, "1-0", "IDLE", "foo")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("XCLAIM", "s", "g", "bob", 0)
+		assert(t, err != nil, "XCLAIM error")
+	}
+}
+
+func TestXautoclaim(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	now := time.Unix(1000, 0)
+	s.SetTime(now)
+	for _, id := range []string{"1-0", "2-0", "3-0", "4-0"} {
+		_, err := s.XAdd("s", id, "id", id)
+		ok(t, err)
+	}
+	_, err := c.Do("XGROUP", "CREATE", "s", "g", "0")
+	ok(t, err)
+	_, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "COUNT", 2, "STREAMS", "s", ">")
+	ok(t, err)
+	s.SetTime(now.Add(10 * time.Second))
+	_, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", ">")
+	ok(t, err)
+	_, err = c.Do("XDEL", "s", "1-0")
+	ok(t, err)
+
+	{
+		res, err := redis.Values(c.Do("XAUTOCLAIM", "s", "g", "bob", 5000, "-", "COUNT", 2))
+		ok(t, err)
+		equals(t, 3, len(res))
+		equals(t, []byte("3-0"), res[0])
+		equals(t, []string{"2-0", "id", "2-0"}, streamEntries(t, res[1]))
+		deleted, err := redis.Strings(res[2], nil)
+		ok(t, err)
+		equals(t, []string{"1-0"}, deleted)
+
+		res, err = redis.Values(c.Do("XAUTOCLAIM", "s", "g", "bob", 5000, "3-0"))
+		ok(t, err)
+		equals(t, []byte("0-0"), res[0])
+		equals(t, []string(nil), streamEntries(t, res[1]))
+
+		res, err = redis.Values(c.Do("XAUTOCLAIM", "s", "g", "bob", 0, "0", "JUSTID"))
+		ok(t, err)
+		ids, err := redis.Strings(res[1], nil)
+		ok(t, err)
+		equals(t, []string{"2-0", "3-0", "4-0"}, ids)
+		g := s.dbs[0].streamKeys["s"].groups["g"]
+		equals(t, 2, g.getPending(streamID{2, 0}).count)
+		equals(t, 1, g.getPending(streamID{3, 0}).count)
+		equals(t, 3, len(g.consumerPending("bob")))
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XAUTOCLAIM", "str", "g", "bob", 0, "0")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XAUTOCLAIM", "s", "nosuch", "bob", 0, "0")
+		equals(t, errNoGroup("s", "nosuch"), err.(redis.Error).Error())
+		_, err = c.Do("XAUTOCLAIM", "s", "g", "bob", 0, "0", "COUNT", 0)
+		equals(t, msgCountPositive, err.(redis.Error).Error())
+		_, err = c.Do("XAUTOCLAIM", "s", "g", "bob", 0, "foo")
+		equals(t, msgInvalidStreamID, err.(redis.Error).Error())
+		_, err = c.Do("XAUTOCLAIM", "s", "g", "bob", 0, "0", "FOO")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("XAUTOCLAIM", "s", "g", "bob", 0)
+		assert(t, err != nil, "XAUTOCLAIM error")
+	}
+}
+
+func TestXinfo(t *testing.T) {
+	s, c, done := setup(t)
+	defer done()
+
+	now := time.Unix(1000, 0)
+	s.SetTime(now)
+	_, err := s.XAdd("s", "1-0", "id", "1")
+	ok(t, err)
+	_, err = s.XAdd("s", "2-0", "id", "2")
+	ok(t, err)
+	_, err = c.Do("XGROUP", "CREATE", "s", "g", "0")
+	ok(t, err)
+	_, err = c.Do("XREADGROUP", "GROUP", "g", "alice", "COUNT", 1, "STREAMS", "s", ">")
+	ok(t, err)
+	s.SetTime(now.Add(2 * time.Second))
+
+	{
+		res, err := redis.Values(c.Do("XINFO", "STREAM", "s"))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]byte("length"), int64(2),
+			[]byte("last-generated-id"), []byte("2-0"),
+			[]byte("groups"), int64(1),
+			[]byte("first-entry"), []interface{}{[]byte("1-0"), []interface{}{[]byte("id"), []byte("1")}},
+			[]byte("last-entry"), []interface{}{[]byte("2-0"), []interface{}{[]byte("id"), []byte("2")}},
+		}, res)
+
+		res, err = redis.Values(c.Do("XINFO", "GROUPS", "s"))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]interface{}{
+				[]byte("name"), []byte("g"),
+				[]byte("consumers"), int64(1),
+				[]byte("pending"), int64(1),
+				[]byte("last-delivered-id"), []byte("1-0"),
+			},
+		}, res)
+
+		res, err = redis.Values(c.Do("XINFO", "CONSUMERS", "s", "g"))
+		ok(t, err)
+		equals(t, []interface{}{
+			[]interface{}{
+				[]byte("name"), []byte("alice"),
+				[]byte("pending"), int64(1),
+				[]byte("idle"), int64(2000),
+			},
+		}, res)
+	}
+
+	// Error cases
+	{
+		s.Set("str", "value")
+		_, err := c.Do("XINFO", "STREAM", "str")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("XINFO", "STREAM", "nosuch")
+		equals(t, msgKeyNotFound, err.(redis.Error).Error())
+		_, err = c.Do("XINFO", "CONSUMERS", "s", "nosuch")
+		equals(t, errNoGroupForKey("s", "nosuch"), err.(redis.Error).Error())
+		_, err = c.Do("XINFO", "CONSUMERS", "s")
+		assert(t, err != nil, "XINFO error")
+		_, err = c.Do("XINFO", "FOO", "s")
+		assert(t, err != nil, "XINFO error")
+	}
+}
@@ -0,0 +1,1070 @@
+// Commands from http://redis.io/commands#string
+
+package rediqueue
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chinahdkj/rediqueue/server"
+)
+
+// maxStringLen is the longest string SETRANGE and SETBIT make, as in Redis.
+const maxStringLen = 512 << 20
+
+// commandsString handles all string value operations.
+func commandsString(m *RediQueue) {
+	m.srv.Register("APPEND", m.cmdAppend)
+	m.srv.Register("BITCOUNT", m.cmdBitcount)
+	m.srv.Register("BITFIELD", m.cmdBitfield)
+	m.srv.Register("BITFIELD_RO", m.cmdBitfield)
+	m.srv.Register("BITOP", m.cmdBitop)
+	m.srv.Register("BITPOS", m.cmdBitpos)
+	m.srv.Register("DECR", m.cmdDecr)
+	m.srv.Register("DECRBY", m.cmdDecrby)
+	m.srv.Register("GET", m.cmdGet)
+	m.srv.Register("GETBIT", m.cmdGetbit)
+	m.srv.Register("GETRANGE", m.cmdGetrange)
+	m.srv.Register("GETSET", m.cmdGetset)
+	m.srv.Register("INCR", m.cmdIncr)
+	m.srv.Register("INCRBY", m.cmdIncrby)
+	m.srv.Register("INCRBYFLOAT", m.cmdIncrbyfloat)
+	m.srv.Register("MGET", m.cmdMget)
+	m.srv.Register("MSET", m.cmdMset)
+	m.srv.Register("PSETEX", m.cmdPsetex)
+	m.srv.Register("SET", m.cmdSet)
+	m.srv.Register("SETBIT", m.cmdSetbit)
+	m.srv.Register("SETEX", m.cmdSetex)
+	m.srv.Register("SETNX", m.cmdSetnx)
+	m.srv.Register("SETRANGE", m.cmdSetrange)
+	m.srv.Register("STRLEN", m.cmdStrlen)
+}
+
+// SET
+func (m *RediQueue) cmdSet(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	var (
+		nx      = false // set iff not exists
+		xx      = false // set iff exists
+		get     = false // return the old value
+		keepTTL = false
+		expire  int64 // in units of unit, 0 for no TTL
+		unit    time.Duration
+	)
+
+	key, value, args := args[0], args[1], args[2:]
+	for len(args) > 0 {
+		timeUnit := time.Second
+		switch arg := strings.ToUpper(args[0]); arg {
+		case "NX":
+			nx = true
+			args = args[1:]
+			continue
+		case "XX":
+			xx = true
+			args = args[1:]
+			continue
+		case "GET":
+			get = true
+			args = args[1:]
+			continue
+		case "KEEPTTL":
+			keepTTL = true
+			args = args[1:]
+			continue
+		case "PX":
+			timeUnit = time.Millisecond
+			fallthrough
+		case "EX":
+			if len(args) < 2 || expire != 0 {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			if n <= 0 {
+				setDirty(c)
+				c.WriteError(msgInvalidSETime)
+				return
+			}
+			expire, unit = n, timeUnit
+			args = args[2:]
+			continue
+		default:
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+	}
+	if nx && xx {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+	if keepTTL && expire != 0 {
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		var ttlAt time.Time
+		if expire != 0 {
+			var ok bool
+			if ttlAt, ok = expireAt(m.effectiveNow(), expire, unit); !ok {
+				c.WriteError(msgInvalidSETime)
+				return
+			}
+		}
+		exists := db.exists(key)
+		if get && exists && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+		old, hadOld := db.stringKeys[key]
+		// reply is the reply for GET, or else what we say if we didn't set.
+		reply := func() {
+			if !get || !hadOld {
+				c.WriteNull()
+				return
+			}
+			c.WriteBulk(old)
+		}
+		if (nx && exists) || (xx && !exists) {
+			reply()
+			return
+		}
+
+		at, hadTTL := db.expire[key]
+		db.stringSet(key, value)
+		switch {
+		case expire != 0:
+			db.setTTL(key, ttlAt)
+		case keepTTL && hadTTL:
+			db.setTTL(key, at)
+		}
+		if get {
+			reply()
+			return
+		}
+		c.WriteOK()
+	})
+}
+
+// SETEX
+func (m *RediQueue) cmdSetex(c *server.Peer, cmd string, args []string) {
+	m.setex(c, cmd, args, time.Second, msgInvalidSETEXTime)
+}
+
+// PSETEX
+func (m *RediQueue) cmdPsetex(c *server.Peer, cmd string, args []string) {
+	m.setex(c, cmd, args, time.Millisecond, msgInvalidPSETEXTime)
+}
+
+// setex implements SETEX and PSETEX, which differ in the time unit.
+func (m *RediQueue) setex(c *server.Peer, cmd string, args []string, unit time.Duration, msgInvalid string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, value := args[0], args[2]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+	if ttl <= 0 {
+		setDirty(c)
+		c.WriteError(msgInvalid)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		at, ok := expireAt(m.effectiveNow(), ttl, unit)
+		if !ok {
+			c.WriteError(msgInvalid)
+			return
+		}
+		db.stringSet(key, value)
+		db.setTTL(key, at)
+		c.WriteOK()
+	})
+}
+
+// SETNX
+func (m *RediQueue) cmdSetnx(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, value := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) {
+			c.WriteInt(0)
+			return
+		}
+
+		db.stringSet(key, value)
+		c.WriteInt(1)
+	})
+}
+
+// MSET
+func (m *RediQueue) cmdMset(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 || len(args)%2 != 0 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		for i := 0; i < len(args); i += 2 {
+			db.stringSet(args[i], args[i+1])
+		}
+		c.WriteOK()
+	})
+}
+
+// GET
+func (m *RediQueue) cmdGet(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			c.WriteNull()
+			return
+		}
+		if db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteBulk(db.stringKeys[key])
+	})
+}
+
+// GETSET
+func (m *RediQueue) cmdGetset(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, value := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		old, ok := db.stringKeys[key]
+		db.stringSet(key, value)
+		if !ok {
+			c.WriteNull()
+			return
+		}
+		c.WriteBulk(old)
+	})
+}
+
+// MGET
+func (m *RediQueue) cmdMget(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		c.WriteLen(len(args))
+		for _, k := range args {
+			if db.t(k) != "string" {
+				// Wrong type and non-existing keys are both nil.
+				c.WriteNull()
+				continue
+			}
+			c.WriteBulk(db.stringKeys[k])
+		}
+	})
+}
+
+// INCR
+func (m *RediQueue) cmdIncr(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	m.incr(c, args[0], 1)
+}
+
+// INCRBY
+func (m *RediQueue) cmdIncrby(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+
+	m.incr(c, args[0], delta)
+}
+
+// DECR
+func (m *RediQueue) cmdDecr(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	m.incr(c, args[0], -1)
+}
+
+// DECRBY
+func (m *RediQueue) cmdDecrby(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || delta == -delta && delta != 0 {
+		// the second case is math.MinInt64, which can't be negated.
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+
+	m.incr(c, args[0], -delta)
+}
+
+// incr implements INCR, INCRBY, DECR, and DECRBY.
+func (m *RediQueue) incr(c *server.Peer, key string, delta int64) {
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v, err := db.stringIncr(key, delta)
+		if err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+		c.WriteInt(int(v))
+	})
+}
+
+// INCRBYFLOAT
+func (m *RediQueue) cmdIncrbyfloat(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	delta, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidFloat)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v, err := db.stringIncrfloat(key, delta)
+		if err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+		c.WriteBulk(formatFloat(v))
+	})
+}
+
+// APPEND
+func (m *RediQueue) cmdAppend(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, value := args[0], args[1]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		newValue := db.stringKeys[key] + value
+		db.stringUpdate(key, newValue)
+		c.WriteInt(len(newValue))
+	})
+}
+
+// STRLEN
+func (m *RediQueue) cmdStrlen(c *server.Peer, cmd string, args []string) {
+	if len(args) != 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(len(db.stringKeys[key]))
+	})
+}
+
+// GETRANGE
+func (m *RediQueue) cmdGetrange(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	start, err := strconv.Atoi(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+	end, err := strconv.Atoi(args[2])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v := db.stringKeys[key]
+		s, e := redisRange(len(v), start, end, true)
+		c.WriteBulk(v[s:e])
+	})
+}
+
+// SETRANGE
+func (m *RediQueue) cmdSetrange(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, subst := args[0], args[2]
+	pos, err := strconv.Atoi(args[1])
+	if err != nil {
+		setDirty(c)
+		c.WriteError(msgInvalidInt)
+		return
+	}
+	if pos < 0 || pos > maxStringLen-len(subst) {
+		setDirty(c)
+		c.WriteError(msgOffsetOutOfRange)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v := []byte(db.stringKeys[key])
+		if len(subst) == 0 {
+			// Nothing changes, and no key is made.
+			c.WriteInt(len(v))
+			return
+		}
+		if len(v) < pos+len(subst) {
+			v = append(v, make([]byte, pos+len(subst)-len(v))...)
+		}
+		copy(v[pos:], subst)
+		db.stringUpdate(key, string(v))
+		c.WriteInt(len(v))
+	})
+}
+
+// SETBIT
+func (m *RediQueue) cmdSetbit(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	offset, ok := parseBitOffset(args[1], false, 1)
+	if !ok {
+		setDirty(c)
+		c.WriteError(msgBitOffset)
+		return
+	}
+	if args[2] != "0" && args[2] != "1" {
+		setDirty(c)
+		c.WriteError(msgBitValue)
+		return
+	}
+	bit := args[2][0] - '0'
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v := growBits([]byte(db.stringKeys[key]), offset, 1)
+		old := getBit(v, offset)
+		setBit(v, offset, bit)
+		db.stringUpdate(key, string(v))
+		c.WriteInt(int(old))
+	})
+}
+
+// GETBIT
+func (m *RediQueue) cmdGetbit(c *server.Peer, cmd string, args []string) {
+	if len(args) != 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key := args[0]
+	offset, ok := parseBitOffset(args[1], false, 1)
+	if !ok {
+		setDirty(c)
+		c.WriteError(msgBitOffset)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		c.WriteInt(int(getBit([]byte(db.stringKeys[key]), offset)))
+	})
+}
+
+// BITCOUNT
+func (m *RediQueue) cmdBitcount(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, args := args[0], args[1:]
+	var (
+		start   = 0
+		end     = -1
+		bitMode = false
+	)
+	switch len(args) {
+	case 0:
+	case 2, 3:
+		var msg string
+		start, end, bitMode, msg = parseBitRange(args)
+		if msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+	default:
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v := db.stringKeys[key]
+		s, e := bitRange(len(v), start, end, bitMode)
+		c.WriteInt(countBits([]byte(v), s, e))
+	})
+}
+
+// BITPOS
+func (m *RediQueue) cmdBitpos(c *server.Peer, cmd string, args []string) {
+	if len(args) < 2 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	key, args := args[0], args[1:]
+	if args[0] != "0" && args[0] != "1" {
+		setDirty(c)
+		c.WriteError(msgBitposBit)
+		return
+	}
+	bit, args := args[0][0]-'0', args[1:]
+	var (
+		start    = 0
+		end      = -1
+		endGiven = len(args) > 1
+		bitMode  = false
+	)
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		start, err = strconv.Atoi(args[0])
+		if err != nil {
+			setDirty(c)
+			c.WriteError(msgInvalidInt)
+			return
+		}
+	case 2, 3:
+		var msg string
+		start, end, bitMode, msg = parseBitRange(args)
+		if msg != "" {
+			setDirty(c)
+			c.WriteError(msg)
+			return
+		}
+	default:
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if !db.exists(key) {
+			if bit == 1 {
+				c.WriteInt(-1)
+			} else {
+				c.WriteInt(0)
+			}
+			return
+		}
+		if db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v := db.stringKeys[key]
+		s, e := bitRange(len(v), start, end, bitMode)
+		if s >= e {
+			c.WriteInt(-1)
+			return
+		}
+		pos := findBit([]byte(v), bit, s, e)
+		if pos == -1 && bit == 0 && !endGiven {
+			// the string is taken to be padded with 0 bits
+			pos = int64(e)
+		}
+		c.WriteInt(int(pos))
+	})
+}
+
+// BITOP
+func (m *RediQueue) cmdBitop(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	op, dest, keys := strings.ToUpper(args[0]), args[1], args[2:]
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			setDirty(c)
+			c.WriteError(msgBitopNot)
+			return
+		}
+	default:
+		setDirty(c)
+		c.WriteError(msgSyntaxError)
+		return
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		var values [][]byte
+		l := 0
+		for _, k := range keys {
+			if db.exists(k) && db.t(k) != "string" {
+				c.WriteError(msgWrongType)
+				return
+			}
+			v := []byte(db.stringKeys[k])
+			values = append(values, v)
+			if len(v) > l {
+				l = len(v)
+			}
+		}
+
+		// Shorter strings are padded with 0 bytes.
+		res := make([]byte, l)
+		copy(res, values[0])
+		for i := range res {
+			if op == "NOT" {
+				res[i] = ^res[i]
+				continue
+			}
+			for _, v := range values[1:] {
+				var b byte
+				if i < len(v) {
+					b = v[i]
+				}
+				switch op {
+				case "AND":
+					res[i] &= b
+				case "OR":
+					res[i] |= b
+				case "XOR":
+					res[i] ^= b
+				}
+			}
+		}
+
+		if l == 0 {
+			db.del(dest)
+		} else {
+			db.stringSet(dest, string(res))
+		}
+		c.WriteInt(l)
+	})
+}
+
+// bitfieldOp is a single BITFIELD GET, SET, or INCRBY.
+type bitfieldOp struct {
+	op       string
+	typ      bitfieldType
+	offset   uint64
+	value    int64
+	overflow string
+}
+
+// BITFIELD and BITFIELD_RO
+func (m *RediQueue) cmdBitfield(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		setDirty(c)
+		c.WriteError(errWrongNumber(cmd))
+		return
+	}
+	if !m.handleAuth(c) {
+		return
+	}
+
+	readonly := strings.ToUpper(cmd) == "BITFIELD_RO"
+	key, args := args[0], args[1:]
+	var (
+		ops      []bitfieldOp
+		overflow = overflowWrap
+		write    = false
+	)
+	for len(args) > 0 {
+		op := strings.ToUpper(args[0])
+		switch op {
+		case "OVERFLOW":
+			if readonly {
+				setDirty(c)
+				c.WriteError(msgBitfieldRO)
+				return
+			}
+			if len(args) < 2 {
+				setDirty(c)
+				c.WriteError(msgSyntaxError)
+				return
+			}
+			switch o := strings.ToUpper(args[1]); o {
+			case overflowWrap, overflowSat, overflowFail:
+				overflow = o
+			default:
+				setDirty(c)
+				c.WriteError(msgBitfieldOverflow)
+				return
+			}
+			args = args[2:]
+			continue
+		case "GET":
+		case "SET", "INCRBY":
+			if readonly {
+				setDirty(c)
+				c.WriteError(msgBitfieldRO)
+				return
+			}
+			write = true
+		default:
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+
+		n := 3
+		if op == "GET" {
+			n = 2
+		}
+		if len(args) < n+1 {
+			setDirty(c)
+			c.WriteError(msgSyntaxError)
+			return
+		}
+		typ, ok := parseBitfieldType(args[1])
+		if !ok {
+			setDirty(c)
+			c.WriteError(msgBitfieldType)
+			return
+		}
+		offset, ok := parseBitOffset(args[2], true, typ.bits)
+		if !ok {
+			setDirty(c)
+			c.WriteError(msgBitOffset)
+			return
+		}
+		o := bitfieldOp{op: op, typ: typ, offset: offset, overflow: overflow}
+		if op != "GET" {
+			v, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil {
+				setDirty(c)
+				c.WriteError(msgInvalidInt)
+				return
+			}
+			o.value = v
+		}
+		ops = append(ops, o)
+		args = args[n+1:]
+	}
+
+	withTx(m, c, func(c *server.Peer, ctx *connCtx) {
+		db := m.db(ctx.selectedDB)
+
+		if db.exists(key) && db.t(key) != "string" {
+			c.WriteError(msgWrongType)
+			return
+		}
+
+		v := []byte(db.stringKeys[key])
+		if write {
+			// The string grows for every SET and INCRBY, even when they
+			// fail, as in Redis.
+			for _, o := range ops {
+				if o.op != "GET" {
+					v = growBits(v, o.offset, o.typ.bits)
+				}
+			}
+		}
+
+		c.WriteLen(len(ops))
+		for _, o := range ops {
+			old := o.typ.get(v, o.offset)
+			switch o.op {
+			case "GET":
+				c.WriteInt(int(old))
+			case "SET":
+				n, ok := o.typ.add(o.value, 0, o.overflow)
+				if !ok {
+					c.WriteNull()
+					continue
+				}
+				o.typ.set(v, o.offset, n)
+				c.WriteInt(int(old))
+			case "INCRBY":
+				n, ok := o.typ.add(old, o.value, o.overflow)
+				if !ok {
+					c.WriteNull()
+					continue
+				}
+				o.typ.set(v, o.offset, n)
+				c.WriteInt(int(n))
+			}
+		}
+		if write {
+			db.stringUpdate(key, string(v))
+		}
+	})
+}
+
+// parseBitRange parses "start end [BYTE|BIT]" for BITCOUNT and BITPOS.
+func parseBitRange(args []string) (int, int, bool, string) {
+	start, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, 0, false, msgInvalidInt
+	}
+	end, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, 0, false, msgInvalidInt
+	}
+	bitMode := false
+	if len(args) > 2 {
+		switch strings.ToUpper(args[2]) {
+		case "BYTE":
+		case "BIT":
+			bitMode = true
+		default:
+			return 0, 0, false, msgSyntaxError
+		}
+	}
+	return start, end, bitMode, ""
+}
+
+// bitRange gives the bits [start, end) of a BITCOUNT or BITPOS range, on a
+// string of l bytes. Without bitMode start and end are in bytes.
+func bitRange(l, start, end int, bitMode bool) (uint64, uint64) {
+	if bitMode {
+		s, e := redisRange(l*8, start, end, true)
+		return uint64(s), uint64(e)
+	}
+	s, e := redisRange(l, start, end, true)
+	return uint64(s) * 8, uint64(e) * 8
+}
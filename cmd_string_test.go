@@ -0,0 +1,758 @@
+package rediqueue
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Test SET / GET.
+func TestString(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	s.SetTime(time.Now())
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		v, err := redis.String(c.Do("SET", "foo", "bar"))
+		ok(t, err)
+		equals(t, "OK", v)
+		s.CheckGet(t, "foo", "bar")
+
+		v, err = redis.String(c.Do("GET", "foo"))
+		ok(t, err)
+		equals(t, "bar", v)
+
+		v, err = redis.String(c.Do("TYPE", "foo"))
+		ok(t, err)
+		equals(t, "string", v)
+	}
+
+	// GET on a nonexisting key
+	{
+		v, err := c.Do("GET", "nosuch")
+		ok(t, err)
+		equals(t, nil, v)
+	}
+
+	// SET overwrites keys of any type.
+	{
+		s.Push("list", "aap")
+		_, err := c.Do("GET", "list")
+		assert(t, err != nil, "GET on a list")
+		_, err = c.Do("SET", "list", "noot")
+		ok(t, err)
+		s.CheckGet(t, "list", "noot")
+	}
+
+	// NX, XX, GET
+	{
+		v, err := c.Do("SET", "foo", "baz", "NX")
+		ok(t, err)
+		equals(t, nil, v)
+		s.CheckGet(t, "foo", "bar")
+
+		v, err = c.Do("SET", "new", "baz", "XX")
+		ok(t, err)
+		equals(t, nil, v)
+		equals(t, false, s.Exists("new"))
+
+		old, err := redis.String(c.Do("SET", "foo", "baz", "XX", "GET"))
+		ok(t, err)
+		equals(t, "bar", old)
+		s.CheckGet(t, "foo", "baz")
+
+		v, err = c.Do("SET", "new", "mies", "GET")
+		ok(t, err)
+		equals(t, nil, v)
+		s.CheckGet(t, "new", "mies")
+	}
+
+	// EX, PX, KEEPTTL
+	{
+		_, err := c.Do("SET", "foo", "bar", "EX", 10)
+		ok(t, err)
+		equals(t, 10*time.Second, s.TTL("foo"))
+
+		_, err = c.Do("SET", "foo", "bar", "PX", 1500)
+		ok(t, err)
+		equals(t, 1500*time.Millisecond, s.TTL("foo"))
+
+		_, err = c.Do("SET", "foo", "baz", "KEEPTTL")
+		ok(t, err)
+		equals(t, 1500*time.Millisecond, s.TTL("foo"))
+
+		_, err = c.Do("SET", "foo", "bar")
+		ok(t, err)
+		equals(t, time.Duration(0), s.TTL("foo"))
+	}
+
+	// Direct usage
+	{
+		ok(t, s.Set("direct", "value"))
+		v, err := s.Get("direct")
+		ok(t, err)
+		equals(t, "value", v)
+		_, err = s.Get("nosuch")
+		equals(t, ErrKeyNotFound, err)
+		s.Push("l", "aap")
+		_, err = s.Get("l")
+		equals(t, ErrWrongType, err)
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("SET")
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "foo")
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "foo", "bar", "NX", "XX")
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "foo", "bar", "EX")
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "foo", "bar", "EX", "noint")
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "foo", "bar", "EX", 0)
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "foo", "bar", "EX", 10, "PX", 10)
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "foo", "bar", "EX", 10, "KEEPTTL")
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "foo", "bar", "NOSUCH")
+		assert(t, err != nil, "SET error")
+		_, err = c.Do("SET", "k2", "v", "EX", 9300000000)
+		equals(t, msgInvalidSETime, err.(redis.Error).Error())
+		_, err = c.Do("SET", "k2", "v", "PX", int64(math.MaxInt64))
+		equals(t, msgInvalidSETime, err.(redis.Error).Error())
+		equals(t, false, s.Exists("k2"))
+		_, err = c.Do("GET")
+		assert(t, err != nil, "GET error")
+		_, err = c.Do("GET", "too", "many")
+		assert(t, err != nil, "GET error")
+	}
+}
+
+// Test SETEX, PSETEX, SETNX, GETSET, MSET and MGET.
+func TestStringSetters(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	s.SetTime(time.Now())
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		_, err := c.Do("SETEX", "foo", 10, "bar")
+		ok(t, err)
+		s.CheckGet(t, "foo", "bar")
+		equals(t, 10*time.Second, s.TTL("foo"))
+
+		_, err = c.Do("PSETEX", "foo", 2500, "baz")
+		ok(t, err)
+		s.CheckGet(t, "foo", "baz")
+		equals(t, 2500*time.Millisecond, s.TTL("foo"))
+
+		_, err = c.Do("SETEX", "foo", 0, "bar")
+		assert(t, err != nil, "SETEX error")
+		_, err = c.Do("SETEX", "foo", "noint", "bar")
+		assert(t, err != nil, "SETEX error")
+		_, err = c.Do("PSETEX", "foo", -1, "bar")
+		assert(t, err != nil, "PSETEX error")
+		_, err = c.Do("SETEX", "foo", 9300000000, "bar")
+		equals(t, msgInvalidSETEXTime, err.(redis.Error).Error())
+		_, err = c.Do("PSETEX", "foo", int64(math.MaxInt64), "bar")
+		equals(t, msgInvalidPSETEXTime, err.(redis.Error).Error())
+		s.CheckGet(t, "foo", "baz")
+		equals(t, 2500*time.Millisecond, s.TTL("foo"))
+	}
+
+	{
+		n, err := redis.Int(c.Do("SETNX", "nx", "aap"))
+		ok(t, err)
+		equals(t, 1, n)
+		n, err = redis.Int(c.Do("SETNX", "nx", "noot"))
+		ok(t, err)
+		equals(t, 0, n)
+		s.CheckGet(t, "nx", "aap")
+	}
+
+	{
+		old, err := redis.String(c.Do("GETSET", "nx", "mies"))
+		ok(t, err)
+		equals(t, "aap", old)
+		s.CheckGet(t, "nx", "mies")
+
+		v, err := c.Do("GETSET", "new", "wim")
+		ok(t, err)
+		equals(t, nil, v)
+		s.CheckGet(t, "new", "wim")
+
+		// GETSET removes the TTL.
+		_, err = c.Do("GETSET", "foo", "zus")
+		ok(t, err)
+		equals(t, time.Duration(0), s.TTL("foo"))
+	}
+
+	{
+		_, err := c.Do("MSET", "a", "1", "b", "2", "a", "3")
+		ok(t, err)
+		s.Push("l", "aap")
+		v, err := redis.Values(c.Do("MGET", "a", "b", "nosuch", "l"))
+		ok(t, err)
+		equals(t, []interface{}{[]byte("3"), []byte("2"), nil, nil}, v)
+
+		_, err = c.Do("MSET", "a", "1", "b")
+		assert(t, err != nil, "MSET error")
+		_, err = c.Do("MGET")
+		assert(t, err != nil, "MGET error")
+	}
+}
+
+// Test INCR, INCRBY, DECR, DECRBY and INCRBYFLOAT.
+func TestIncr(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	s.SetTime(time.Now())
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		n, err := redis.Int(c.Do("INCR", "counter"))
+		ok(t, err)
+		equals(t, 1, n)
+		n, err = redis.Int(c.Do("INCRBY", "counter", 41))
+		ok(t, err)
+		equals(t, 42, n)
+		n, err = redis.Int(c.Do("DECR", "counter"))
+		ok(t, err)
+		equals(t, 41, n)
+		n, err = redis.Int(c.Do("DECRBY", "counter", 50))
+		ok(t, err)
+		equals(t, -9, n)
+		s.CheckGet(t, "counter", "-9")
+	}
+
+	// Counters keep their TTL.
+	{
+		_, err := c.Do("SETEX", "ttl", 10, "5")
+		ok(t, err)
+		n, err := redis.Int(c.Do("INCR", "ttl"))
+		ok(t, err)
+		equals(t, 6, n)
+		equals(t, 10*time.Second, s.TTL("ttl"))
+	}
+
+	{
+		f, err := redis.Float64(c.Do("INCRBYFLOAT", "float", "1.5"))
+		ok(t, err)
+		equals(t, 1.5, f)
+		f, err = redis.Float64(c.Do("INCRBYFLOAT", "float", "-0.25"))
+		ok(t, err)
+		equals(t, 1.25, f)
+		s.CheckGet(t, "float", "1.25")
+
+		_, err = c.Do("INCRBYFLOAT", "float", "inf")
+		assert(t, err != nil, "INCRBYFLOAT error")
+	}
+
+	// Direct usage
+	{
+		n, err := s.Incr("direct", 3)
+		ok(t, err)
+		equals(t, int64(3), n)
+		f, err := s.Incrfloat("direct", 0.5)
+		ok(t, err)
+		equals(t, 3.5, f)
+		_, err = s.Incr("direct", 1)
+		equals(t, ErrIntValueError, err)
+
+		s.Set("big", "9223372036854775807")
+		_, err = s.Incr("big", 1)
+		equals(t, ErrIncrOverflow, err)
+		_, err = s.Incr("big", math.MinInt64)
+		ok(t, err)
+	}
+
+	// Wrong usage
+	{
+		s.Set("str", "aap")
+		_, err := c.Do("INCR", "str")
+		assert(t, err != nil, "INCR error")
+		_, err = c.Do("INCRBYFLOAT", "str", "1")
+		assert(t, err != nil, "INCRBYFLOAT error")
+		s.Push("l", "aap")
+		_, err = c.Do("INCR", "l")
+		assert(t, err != nil, "INCR error")
+		_, err = c.Do("INCRBY", "counter", "noint")
+		assert(t, err != nil, "INCRBY error")
+		_, err = c.Do("DECRBY", "counter", "-9223372036854775808")
+		assert(t, err != nil, "DECRBY error")
+		_, err = c.Do("INCRBYFLOAT", "counter", "nofloat")
+		assert(t, err != nil, "INCRBYFLOAT error")
+		_, err = c.Do("INCR")
+		assert(t, err != nil, "INCR error")
+	}
+}
+
+// Test APPEND, STRLEN, GETRANGE and SETRANGE.
+func TestStringRange(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		n, err := redis.Int(c.Do("APPEND", "foo", "Hello"))
+		ok(t, err)
+		equals(t, 5, n)
+		n, err = redis.Int(c.Do("APPEND", "foo", " World"))
+		ok(t, err)
+		equals(t, 11, n)
+		n, err = redis.Int(c.Do("STRLEN", "foo"))
+		ok(t, err)
+		equals(t, 11, n)
+		n, err = redis.Int(c.Do("STRLEN", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	{
+		for _, tc := range []struct {
+			start, end int
+			want       string
+		}{
+			{0, 4, "Hello"},
+			{-5, -1, "World"},
+			{0, -1, "Hello World"},
+			{6, 100, "World"},
+			{5, 3, ""},
+			{100, 200, ""},
+		} {
+			v, err := redis.String(c.Do("GETRANGE", "foo", tc.start, tc.end))
+			ok(t, err)
+			equals(t, tc.want, v)
+		}
+	}
+
+	{
+		n, err := redis.Int(c.Do("SETRANGE", "foo", 6, "Redis"))
+		ok(t, err)
+		equals(t, 11, n)
+		s.CheckGet(t, "foo", "Hello Redis")
+
+		n, err = redis.Int(c.Do("SETRANGE", "pad", 3, "x"))
+		ok(t, err)
+		equals(t, 4, n)
+		s.CheckGet(t, "pad", "\x00\x00\x00x")
+
+		n, err = redis.Int(c.Do("SETRANGE", "empty", 3, ""))
+		ok(t, err)
+		equals(t, 0, n)
+		equals(t, false, s.Exists("empty"))
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("SETRANGE", "foo", -1, "x")
+		assert(t, err != nil, "SETRANGE error")
+		_, err = c.Do("SETRANGE", "foo", 1<<29, "x")
+		assert(t, err != nil, "SETRANGE error")
+		_, err = c.Do("SETRANGE", "k", int64(math.MaxInt64), "ab")
+		equals(t, msgOffsetOutOfRange, err.(redis.Error).Error())
+		equals(t, false, s.Exists("k"))
+		_, err = c.Do("GETRANGE", "foo", "noint", 1)
+		assert(t, err != nil, "GETRANGE error")
+		s.Push("l", "aap")
+		_, err = c.Do("APPEND", "l", "x")
+		assert(t, err != nil, "APPEND error")
+		_, err = c.Do("STRLEN", "l")
+		assert(t, err != nil, "STRLEN error")
+	}
+}
+
+// Test that string keys move around like the other types.
+func TestStringKeys(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.Set("foo", "bar")
+	{
+		_, err := c.Do("RENAME", "foo", "baz")
+		ok(t, err)
+		s.CheckGet(t, "baz", "bar")
+		equals(t, false, s.Exists("foo"))
+	}
+
+	{
+		n, err := redis.Int(c.Do("MOVE", "baz", 1))
+		ok(t, err)
+		equals(t, 1, n)
+		equals(t, false, s.Exists("baz"))
+		s.Select(1)
+		s.CheckGet(t, "baz", "bar")
+		s.Select(0)
+	}
+
+	{
+		s.Set("del", "me")
+		n, err := redis.Int(c.Do("DEL", "del"))
+		ok(t, err)
+		equals(t, 1, n)
+		equals(t, false, s.Exists("del"))
+	}
+
+	{
+		s.Set("restore", "me")
+		payload, err := redis.String(c.Do("DUMP", "restore"))
+		ok(t, err)
+		_, err = c.Do("RESTORE", "restored", 0, payload)
+		ok(t, err)
+		s.CheckGet(t, "restored", "me")
+		s.Del("restore")
+		s.Del("restored")
+	}
+
+	{
+		s.Set("dump", "value")
+		equals(t, "- dump\n   \"value\"\n", s.Dump())
+	}
+}
+
+// Test SETBIT, GETBIT, and BITCOUNT.
+func TestBit(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	s.SetTime(time.Now())
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		n, err := redis.Int(c.Do("SETBIT", "flags", 7, 1))
+		ok(t, err)
+		equals(t, 0, n)
+		s.CheckGet(t, "flags", "\x01")
+
+		n, err = redis.Int(c.Do("SETBIT", "flags", 7, 0))
+		ok(t, err)
+		equals(t, 1, n)
+
+		// grows with 0 bytes
+		_, err = c.Do("SETBIT", "flags", 17, 1)
+		ok(t, err)
+		s.CheckGet(t, "flags", "\x00\x00\x40")
+
+		n, err = redis.Int(c.Do("GETBIT", "flags", 17))
+		ok(t, err)
+		equals(t, 1, n)
+		n, err = redis.Int(c.Do("GETBIT", "flags", 1000))
+		ok(t, err)
+		equals(t, 0, n)
+		n, err = redis.Int(c.Do("GETBIT", "nosuch", 0))
+		ok(t, err)
+		equals(t, 0, n)
+	}
+
+	// TTLs are kept
+	{
+		s.Set("ttl", "a")
+		s.SetTTL("ttl", 10*time.Second)
+		_, err := c.Do("SETBIT", "ttl", 20, 1)
+		ok(t, err)
+		equals(t, 10*time.Second, s.TTL("ttl"))
+	}
+
+	{
+		s.Set("foo", "foobar")
+		for _, c2 := range []struct {
+			args []interface{}
+			want int
+		}{
+			{[]interface{}{"foo"}, 26},
+			{[]interface{}{"foo", 0, 0}, 4},
+			{[]interface{}{"foo", 1, 1}, 6},
+			{[]interface{}{"foo", 1, 1, "BYTE"}, 6},
+			{[]interface{}{"foo", 5, 30, "bit"}, 17},
+			{[]interface{}{"foo", -2, -1}, 7},
+			{[]interface{}{"foo", 4, 2}, 0},
+			{[]interface{}{"nosuch"}, 0},
+		} {
+			n, err := redis.Int(c.Do("BITCOUNT", c2.args...))
+			ok(t, err)
+			equals(t, c2.want, n)
+		}
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("SETBIT", "flags", -1, 1)
+		equals(t, msgBitOffset, err.(redis.Error).Error())
+		_, err = c.Do("SETBIT", "flags", 1<<32, 1)
+		equals(t, msgBitOffset, err.(redis.Error).Error())
+		_, err = c.Do("SETBIT", "flags", uint64(math.MaxUint64), 1)
+		equals(t, msgBitOffset, err.(redis.Error).Error())
+		_, err = c.Do("SETBIT", "flags", 1, 2)
+		equals(t, msgBitValue, err.(redis.Error).Error())
+		_, err = c.Do("GETBIT", "flags", "foo")
+		equals(t, msgBitOffset, err.(redis.Error).Error())
+		_, err = c.Do("BITCOUNT", "foo", 1)
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("BITCOUNT", "foo", 1, 2, "NIBBLE")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("BITCOUNT", "foo", "a", 2)
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+
+		s.Push("l", "aap")
+		_, err = c.Do("SETBIT", "l", 1, 1)
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("GETBIT", "l", 1)
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("BITCOUNT", "l")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("SETBIT", "l", 1)
+		assert(t, err != nil, "SETBIT error")
+		_, err = c.Do("BITCOUNT")
+		assert(t, err != nil, "BITCOUNT error")
+	}
+
+	// In a transaction
+	{
+		_, err := c.Do("MULTI")
+		ok(t, err)
+		_, err = c.Do("SETBIT", "tx", 3, 1)
+		ok(t, err)
+		_, err = c.Do("BITCOUNT", "tx")
+		ok(t, err)
+		res, err := redis.Values(c.Do("EXEC"))
+		ok(t, err)
+		equals(t, []interface{}{int64(0), int64(1)}, res)
+	}
+}
+
+// Test BITPOS.
+func TestBitpos(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.Set("ones", "\xff\xf0\x00")
+	s.Set("mid", "\x00\xff\xf0")
+	s.Set("zero", "\x00\x00\x00")
+	s.Set("full", "\xff\xff\xff")
+	for _, c2 := range []struct {
+		args []interface{}
+		want int
+	}{
+		{[]interface{}{"ones", 0}, 12},
+		{[]interface{}{"mid", 1, 0}, 8},
+		{[]interface{}{"mid", 1, 2}, 16},
+		{[]interface{}{"mid", 1, 2, -1, "BYTE"}, 16},
+		{[]interface{}{"mid", 1, 7, 15, "BIT"}, 8},
+		{[]interface{}{"mid", 0, 1, 1}, -1},
+		{[]interface{}{"zero", 1}, -1},
+		{[]interface{}{"zero", 1, 7, -3, "BIT"}, -1},
+		{[]interface{}{"full", 0}, 24},
+		{[]interface{}{"full", 0, 1}, 24},
+		{[]interface{}{"full", 0, 0, -1}, -1},
+		{[]interface{}{"full", 1, 2, 1}, -1},
+		{[]interface{}{"nosuch", 1}, -1},
+		{[]interface{}{"nosuch", 0}, 0},
+	} {
+		n, err := redis.Int(c.Do("BITPOS", c2.args...))
+		ok(t, err)
+		equals(t, c2.want, n)
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("BITPOS", "mid", 2)
+		equals(t, msgBitposBit, err.(redis.Error).Error())
+		_, err = c.Do("BITPOS", "mid", 1, "a")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("BITPOS", "mid", 1, 0, 1, "BIT", "x")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		s.Push("l", "aap")
+		_, err = c.Do("BITPOS", "l", 1)
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("BITPOS", "mid")
+		assert(t, err != nil, "BITPOS error")
+	}
+}
+
+// Test BITOP.
+func TestBitop(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.Set("key1", "foobar")
+	s.Set("key2", "abcdef")
+	s.Set("short", "\xff")
+	{
+		n, err := redis.Int(c.Do("BITOP", "AND", "dest", "key1", "key2"))
+		ok(t, err)
+		equals(t, 6, n)
+		s.CheckGet(t, "dest", "`bc`ab")
+
+		n, err = redis.Int(c.Do("BITOP", "or", "dest", "key1", "key2"))
+		ok(t, err)
+		equals(t, 6, n)
+		s.CheckGet(t, "dest", "goofev")
+
+		_, err = c.Do("BITOP", "XOR", "dest", "key1", "key2")
+		ok(t, err)
+		s.CheckGet(t, "dest", "\x07\x0d\x0c\x06\x04\x14")
+
+		_, err = c.Do("BITOP", "NOT", "dest", "short")
+		ok(t, err)
+		s.CheckGet(t, "dest", "\x00")
+	}
+
+	// Missing and shorter keys are padded with 0 bytes.
+	{
+		n, err := redis.Int(c.Do("BITOP", "AND", "dest", "short", "key1"))
+		ok(t, err)
+		equals(t, 6, n)
+		s.CheckGet(t, "dest", "f\x00\x00\x00\x00\x00")
+
+		n, err = redis.Int(c.Do("BITOP", "OR", "dest", "short", "nosuch"))
+		ok(t, err)
+		equals(t, 1, n)
+		s.CheckGet(t, "dest", "\xff")
+	}
+
+	// An empty result deletes dest.
+	{
+		n, err := redis.Int(c.Do("BITOP", "OR", "dest", "nosuch"))
+		ok(t, err)
+		equals(t, 0, n)
+		equals(t, false, s.Exists("dest"))
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("BITOP", "NOT", "dest", "key1", "key2")
+		equals(t, msgBitopNot, err.(redis.Error).Error())
+		_, err = c.Do("BITOP", "NAND", "dest", "key1")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		s.Push("l", "aap")
+		_, err = c.Do("BITOP", "AND", "dest", "key1", "l")
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("BITOP", "AND", "dest")
+		assert(t, err != nil, "BITOP error")
+	}
+}
+
+// Test BITFIELD and BITFIELD_RO.
+func TestBitfield(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	{
+		res, err := redis.Values(c.Do("BITFIELD", "bf", "INCRBY", "i5", 100, 1, "GET", "u4", 0))
+		ok(t, err)
+		equals(t, []interface{}{int64(1), int64(0)}, res)
+
+		res, err = redis.Values(c.Do("BITFIELD", "bf", "SET", "i8", "#1", -100, "GET", "i8", 8, "GET", "u8", "#1"))
+		ok(t, err)
+		equals(t, []interface{}{int64(0), int64(-100), int64(156)}, res)
+
+		res, err = redis.Values(c.Do("BITFIELD_RO", "bf", "GET", "u4", 100, "GET", "u8", 1000))
+		ok(t, err)
+		equals(t, []interface{}{int64(0), int64(0)}, res)
+
+		res, err = redis.Values(c.Do("BITFIELD", "nosuch", "GET", "i64", 0))
+		ok(t, err)
+		equals(t, []interface{}{int64(0)}, res)
+		equals(t, false, s.Exists("nosuch"))
+	}
+
+	// OVERFLOW applies to the operations after it.
+	{
+		var got [][]interface{}
+		for i := 0; i < 4; i++ {
+			res, err := redis.Values(c.Do("BITFIELD", "ov", "INCRBY", "u2", 100, 1, "OVERFLOW", "SAT", "INCRBY", "u2", 102, 1))
+			ok(t, err)
+			got = append(got, res)
+		}
+		equals(t, [][]interface{}{
+			{int64(1), int64(1)},
+			{int64(2), int64(2)},
+			{int64(3), int64(3)},
+			{int64(0), int64(3)},
+		}, got)
+
+		got = nil
+		for i := 0; i < 4; i++ {
+			res, err := redis.Values(c.Do("BITFIELD", "fail", "OVERFLOW", "FAIL", "INCRBY", "u2", 102, 1))
+			ok(t, err)
+			got = append(got, res)
+		}
+		equals(t, [][]interface{}{
+			{int64(1)},
+			{int64(2)},
+			{int64(3)},
+			{nil},
+		}, got)
+
+		res, err := redis.Values(c.Do("BITFIELD", "sat", "OVERFLOW", "SAT", "SET", "i8", 0, 200, "GET", "i8", 0))
+		ok(t, err)
+		equals(t, []interface{}{int64(0), int64(127)}, res)
+	}
+
+	// Wrong usage
+	{
+		_, err := c.Do("BITFIELD", "bf", "GET", "u64", 0)
+		equals(t, msgBitfieldType, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD", "bf", "GET", "x8", 0)
+		equals(t, msgBitfieldType, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD", "bf", "GET", "u8", -1)
+		equals(t, msgBitOffset, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD", "bf", "GET", "u8", "#x")
+		equals(t, msgBitOffset, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD", "bf", "SET", "u8", uint64(math.MaxUint64-4), 1)
+		equals(t, msgBitOffset, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD", "bf", "SET", "u8", 0, "x")
+		equals(t, msgInvalidInt, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD", "bf", "OVERFLOW", "NOPE")
+		equals(t, msgBitfieldOverflow, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD", "bf", "SET", "u8", 0)
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD", "bf", "FOO")
+		equals(t, msgSyntaxError, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD_RO", "bf", "SET", "u8", 0, 1)
+		equals(t, msgBitfieldRO, err.(redis.Error).Error())
+		s.Push("l", "aap")
+		_, err = c.Do("BITFIELD", "l", "GET", "u8", 0)
+		equals(t, msgWrongType, err.(redis.Error).Error())
+		_, err = c.Do("BITFIELD")
+		assert(t, err != nil, "BITFIELD error")
+	}
+
+	// In a transaction
+	{
+		_, err := c.Do("MULTI")
+		ok(t, err)
+		_, err = c.Do("BITFIELD", "tx", "SET", "u8", 0, 65)
+		ok(t, err)
+		_, err = c.Do("EXEC")
+		ok(t, err)
+		s.CheckGet(t, "tx", "A")
+	}
+}
@@ -78,7 +78,7 @@ func (m *RediQueue) cmdExec(c *server.Peer, cmd string, args []string) {
 		cb(c, ctx)
 	}
 	// wake up anyone who waits on anything.
-	m.signal.Broadcast()
+	m.wakeBlocked()
 
 	stopTx(ctx)
 }
@@ -1,16 +1,33 @@
 package rediqueue
 
 import (
+	"math"
 	"sort"
+	"strconv"
+	"time"
 )
 
+// propagate counts a change for the save rules, and records it to the
+// append-only file, if there is one. The arguments are a Redis command which
+// has the same effect as the change.
+func (db *RedisDB) propagate(args ...string) {
+	if db.dirty != nil {
+		*db.dirty++
+	}
+	if db.aof != nil {
+		db.aof.log(db.id, args)
+	}
+}
+
 func (db *RedisDB) exists(k string) bool {
+	db.checkTTL(k)
 	_, ok := db.keys[k]
 	return ok
 }
 
 // t gives the type of a key, or ""
 func (db *RedisDB) t(k string) string {
+	db.checkTTL(k)
 	return db.keys[k]
 }
 
@@ -18,76 +35,450 @@ func (db *RedisDB) t(k string) string {
 func (db *RedisDB) allKeys() []string {
 	res := make([]string, 0, len(db.keys))
 	for k := range db.keys {
+		if db.checkTTL(k) {
+			continue
+		}
 		res = append(res, k)
 	}
 	sort.Strings(res) // To make things deterministic.
 	return res
 }
 
+// typedKeys returns all keys of type t. Sorted.
+func (db *RedisDB) typedKeys(t string) []string {
+	var res []string
+	for _, k := range db.allKeys() {
+		if db.t(k) == t {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// expired tells whether k has a TTL which has passed.
+func (db *RedisDB) expired(k string) bool {
+	d, ok := db.expire[k]
+	return ok && db.now != nil && !d.After(db.now())
+}
+
+// checkTTL deletes k if it has expired, and the expired members if it's a
+// set. Returns whether the key is gone.
+func (db *RedisDB) checkTTL(k string) bool {
+	if !db.expired(k) {
+		db.expireMembers(k)
+		_, ok := db.keys[k]
+		return !ok
+	}
+	db.remove(k)
+	db.propagate("DEL", k)
+	return true
+}
+
+// ttl gives the expire time of k, if it has one.
+func (db *RedisDB) ttl(k string) (time.Time, bool) {
+	if !db.exists(k) {
+		return time.Time{}, false
+	}
+	d, ok := db.expire[k]
+	return d, ok
+}
+
+// setTTL makes an existing key expire at d.
+func (db *RedisDB) setTTL(k string, d time.Time) {
+	db.expire[k] = d
+	db.keyVersion[k]++
+	db.propagate("PEXPIREAT", k, strconv.FormatInt(unixMilli(d), 10))
+}
+
+// persist removes the TTL of k. Returns whether there was one.
+func (db *RedisDB) persist(k string) bool {
+	if _, ok := db.ttl(k); !ok {
+		return false
+	}
+	delete(db.expire, k)
+	db.keyVersion[k]++
+	db.propagate("PERSIST", k)
+	return true
+}
+
 // flush removes all keys and values.
 func (db *RedisDB) flush() {
 	db.keys = map[string]string{}
+	db.stringKeys = map[string]string{}
+	db.hashKeys = map[string]hashKey{}
+	db.expire = map[string]time.Time{}
+	db.memberExpire = map[string]map[string]time.Time{}
+	db.memberNext = map[string]time.Time{}
 	db.listKeys = map[string]listKey{}
 	db.setKeys = map[string]setKey{}
+	db.zsetKeys = map[string]*sortedSet{}
+	db.streamKeys = map[string]*streamKey{}
+	db.propagate("FLUSHDB")
+}
+
+// copy makes a deep copy of all keys and values. The copy can be used without
+// the lock; it expires keys as of the time of the copy.
+func (db *RedisDB) copy() *RedisDB {
+	c := newRedisDB(db.id, nil)
+	if db.now != nil {
+		now := db.now()
+		c.now = func() time.Time { return now }
+	}
+	for k, t := range db.keys {
+		c.keys[k] = t
+	}
+	for k, d := range db.expire {
+		c.expire[k] = d
+	}
+	for k, ttls := range db.memberExpire {
+		cttls := make(map[string]time.Time, len(ttls))
+		for e, d := range ttls {
+			cttls[e] = d
+		}
+		c.memberExpire[k] = cttls
+		c.memberNext[k] = db.memberNext[k]
+	}
+	for k, v := range db.stringKeys {
+		c.stringKeys[k] = v
+	}
+	for k, h := range db.hashKeys {
+		ch := make(hashKey, len(h))
+		for f, v := range h {
+			ch[f] = v
+		}
+		c.hashKeys[k] = ch
+	}
+	for k, l := range db.listKeys {
+		c.listKeys[k] = append(listKey{}, l...)
+	}
+	for k, s := range db.setKeys {
+		cs := make(setKey, len(s))
+		for e := range s {
+			cs[e] = struct{}{}
+		}
+		c.setKeys[k] = cs
+	}
+	for k, s := range db.zsetKeys {
+		c.zsetKeys[k] = s.copy()
+	}
+	for k, s := range db.streamKeys {
+		c.streamKeys[k] = s.copy()
+	}
+	return &c
+}
+
+// copyFrom adds all keys from src. It uses the normal mutators, so the
+// changes are propagated.
+func (db *RedisDB) copyFrom(src *RedisDB) {
+	for _, k := range src.allKeys() {
+		switch src.t(k) {
+		case "string":
+			db.stringSet(k, src.stringKeys[k])
+		case "hash":
+			db.hashSet(k, src.hashPairs(k)...)
+		case "list":
+			db.listPush(k, src.listKeys[k]...)
+		case "set":
+			db.setAdd(k, src.setMembers(k)...)
+			for _, e := range sortedMembers(src.memberExpire[k]) {
+				db.setAddTTL(k, src.memberExpire[k][e], e)
+			}
+		case "zset":
+			db.zsetSet(k, src.zsetKeys[k].copy())
+		case "stream":
+			db.streamSet(k, src.streamKeys[k].copy())
+		}
+		if d, ok := src.expire[k]; ok {
+			db.setTTL(k, d)
+		}
+	}
 }
 
 // move something to another db. Will return ok. Or not.
 func (db *RedisDB) move(key string, to *RedisDB) bool {
-	if _, ok := to.keys[key]; ok {
+	if to.exists(key) || !db.exists(key) {
 		return false
 	}
 
-	t, ok := db.keys[key]
-	if !ok {
-		return false
-	}
-	to.keys[key] = db.keys[key]
+	t := db.keys[key]
+	to.keys[key] = t
 	switch t {
+	case "string":
+		to.stringKeys[key] = db.stringKeys[key]
+	case "hash":
+		to.hashKeys[key] = db.hashKeys[key]
 	case "list":
 		to.listKeys[key] = db.listKeys[key]
 	case "set":
 		to.setKeys[key] = db.setKeys[key]
+		if ttls, ok := db.memberExpire[key]; ok {
+			to.memberExpire[key] = ttls
+			to.memberNext[key] = db.memberNext[key]
+		}
+	case "zset":
+		to.zsetKeys[key] = db.zsetKeys[key]
+	case "stream":
+		to.streamKeys[key] = db.streamKeys[key]
 	default:
 		panic("unhandled key type")
 	}
+	if d, ok := db.expire[key]; ok {
+		to.expire[key] = d
+	}
 	to.keyVersion[key]++
-	db.del(key)
+	db.remove(key)
+	db.propagate("MOVE", key, strconv.Itoa(to.id))
 	return true
 }
 
+// rename moves from to to, overwriting to. Renaming a key to itself changes
+// nothing.
 func (db *RedisDB) rename(from, to string) {
-	db.del(to)
+	if from == to {
+		return
+	}
+	if db.exists(to) {
+		db.remove(to)
+	}
 	switch db.t(from) {
+	case "string":
+		db.stringKeys[to] = db.stringKeys[from]
+	case "hash":
+		db.hashKeys[to] = db.hashKeys[from]
 	case "list":
 		db.listKeys[to] = db.listKeys[from]
 	case "set":
 		db.setKeys[to] = db.setKeys[from]
+		if ttls, ok := db.memberExpire[from]; ok {
+			db.memberExpire[to] = ttls
+			db.memberNext[to] = db.memberNext[from]
+		}
+	case "zset":
+		db.zsetKeys[to] = db.zsetKeys[from]
+	case "stream":
+		db.streamKeys[to] = db.streamKeys[from]
 	default:
 		panic("missing case")
 	}
 	db.keys[to] = db.keys[from]
+	if d, ok := db.expire[from]; ok {
+		db.expire[to] = d
+	}
 	db.keyVersion[to]++
 
-	db.del(from)
+	db.remove(from)
+	db.propagate("RENAME", from, to)
 }
 
+// del deletes a key. Non-existing keys are fine.
 func (db *RedisDB) del(k string) {
 	if !db.exists(k) {
 		return
 	}
-	t := db.t(k)
+	db.remove(k)
+	db.propagate("DEL", k)
+}
+
+// remove deletes an existing key, without propagating the change. Used when
+// the change is part of something else, such as popping the last element.
+func (db *RedisDB) remove(k string) {
+	t := db.keys[k]
 	delete(db.keys, k)
+	delete(db.expire, k)
 	db.keyVersion[k]++
 	switch t {
+	case "string":
+		delete(db.stringKeys, k)
+	case "hash":
+		delete(db.hashKeys, k)
 	case "list":
 		delete(db.listKeys, k)
 	case "set":
 		delete(db.setKeys, k)
+		delete(db.memberExpire, k)
+		delete(db.memberNext, k)
+	case "zset":
+		delete(db.zsetKeys, k)
+	case "stream":
+		delete(db.streamKeys, k)
 	default:
 		panic("Unknown key type: " + t)
 	}
 }
 
+// stringSet sets a string key, replacing whatever was there, TTL included.
+func (db *RedisDB) stringSet(k, v string) {
+	if _, ok := db.keys[k]; ok {
+		db.remove(k)
+	}
+	db.keys[k] = "string"
+	db.stringKeys[k] = v
+	db.keyVersion[k]++
+	db.propagate("SET", k, v)
+}
+
+// stringUpdate changes the value of a string key, and keeps its TTL. This is
+// APPEND, INCR, &c. The key doesn't need to exist.
+func (db *RedisDB) stringUpdate(k, v string) {
+	db.keys[k] = "string"
+	db.stringKeys[k] = v
+	db.keyVersion[k]++
+	db.propagate("SET", k, v, "KEEPTTL")
+}
+
+// stringIncr changes an int string value by delta.
+func (db *RedisDB) stringIncr(k string, delta int64) (int64, error) {
+	var v int64
+	if sv, ok := db.stringKeys[k]; ok {
+		var err error
+		v, err = strconv.ParseInt(sv, 10, 64)
+		if err != nil {
+			return 0, ErrIntValueError
+		}
+	}
+	if (delta > 0 && v > math.MaxInt64-delta) || (delta < 0 && v < math.MinInt64-delta) {
+		return 0, ErrIncrOverflow
+	}
+	v += delta
+	db.stringUpdate(k, strconv.FormatInt(v, 10))
+	return v, nil
+}
+
+// stringIncrfloat changes a float string value by delta.
+func (db *RedisDB) stringIncrfloat(k string, delta float64) (float64, error) {
+	v := 0.0
+	if sv, ok := db.stringKeys[k]; ok {
+		var err error
+		v, err = strconv.ParseFloat(sv, 64)
+		if err != nil {
+			return 0, ErrFloatValueError
+		}
+	}
+	v += delta
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, ErrIncrNaNOrInf
+	}
+	db.stringUpdate(k, formatFloat(v))
+	return v, nil
+}
+
+// hllGet gives the HyperLogLog in a key, or nil if there is no key. The
+// message is set if it's not a HyperLogLog.
+func (db *RedisDB) hllGet(k string) (*hll, string) {
+	if !db.exists(k) {
+		return nil, ""
+	}
+	if db.t(k) != "string" {
+		return nil, msgWrongType
+	}
+	h, err := parseHLL(db.stringKeys[k])
+	if err != nil {
+		return nil, err.Error()
+	}
+	return h, ""
+}
+
+// hashSet sets fields of a hash, from field/value pairs. Returns nr of new
+// fields.
+func (db *RedisDB) hashSet(k string, fv ...string) int {
+	h, ok := db.hashKeys[k]
+	if !ok {
+		h = hashKey{}
+		db.keys[k] = "hash"
+		db.hashKeys[k] = h
+	}
+	added := 0
+	for i := 0; i+1 < len(fv); i += 2 {
+		if _, ok := h[fv[i]]; !ok {
+			added++
+		}
+		h[fv[i]] = fv[i+1]
+	}
+	db.keyVersion[k]++
+	db.propagate(append([]string{"HSET", k}, fv...)...)
+	return added
+}
+
+// hashDel removes fields from a hash. Returns nr of deleted fields.
+func (db *RedisDB) hashDel(k string, fields ...string) int {
+	h, ok := db.hashKeys[k]
+	if !ok {
+		return 0
+	}
+	deleted := 0
+	for _, f := range fields {
+		if _, ok := h[f]; ok {
+			deleted++
+			delete(h, f)
+		}
+	}
+	if deleted == 0 {
+		return 0
+	}
+	if len(h) == 0 {
+		db.remove(k)
+	}
+	db.keyVersion[k]++
+	db.propagate(append([]string{"HDEL", k}, fields...)...)
+	return deleted
+}
+
+// hashFields gives all fields of a hash. Sorted.
+func (db *RedisDB) hashFields(k string) []string {
+	h := db.hashKeys[k]
+	fields := make([]string, 0, len(h))
+	for f := range h {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// hashPairs gives all field/value pairs of a hash, sorted by field.
+func (db *RedisDB) hashPairs(k string) []string {
+	var res []string
+	for _, f := range db.hashFields(k) {
+		res = append(res, f, db.hashKeys[k][f])
+	}
+	return res
+}
+
+// hashIncr changes an int field by delta.
+func (db *RedisDB) hashIncr(k, f string, delta int64) (int64, error) {
+	var v int64
+	if sv, ok := db.hashKeys[k][f]; ok {
+		var err error
+		v, err = strconv.ParseInt(sv, 10, 64)
+		if err != nil {
+			return 0, ErrIntValueError
+		}
+	}
+	if (delta > 0 && v > math.MaxInt64-delta) || (delta < 0 && v < math.MinInt64-delta) {
+		return 0, ErrIncrOverflow
+	}
+	v += delta
+	db.hashSet(k, f, strconv.FormatInt(v, 10))
+	return v, nil
+}
+
+// hashIncrfloat changes a float field by delta.
+func (db *RedisDB) hashIncrfloat(k, f string, delta float64) (float64, error) {
+	v := 0.0
+	if sv, ok := db.hashKeys[k][f]; ok {
+		var err error
+		v, err = strconv.ParseFloat(sv, 64)
+		if err != nil {
+			return 0, ErrFloatValueError
+		}
+	}
+	v += delta
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, ErrIncrNaNOrInf
+	}
+	db.hashSet(k, f, formatFloat(v))
+	return v, nil
+}
+
 // listLpush is 'left push', aka unshift. Returns the new length.
 func (db *RedisDB) listLpush(k, v string) int {
 	l, ok := db.listKeys[k]
@@ -97,6 +488,7 @@ func (db *RedisDB) listLpush(k, v string) int {
 	l = append([]string{v}, l...)
 	db.listKeys[k] = l
 	db.keyVersion[k]++
+	db.propagate("LPUSH", k, v)
 	return len(l)
 }
 
@@ -106,11 +498,12 @@ func (db *RedisDB) listLpop(k string) string {
 	el := l[0]
 	l = l[1:]
 	if len(l) == 0 {
-		db.del(k)
+		db.remove(k)
 	} else {
 		db.listKeys[k] = l
 	}
 	db.keyVersion[k]++
+	db.propagate("LPOP", k)
 	return el
 }
 
@@ -122,6 +515,7 @@ func (db *RedisDB) listPush(k string, v ...string) int {
 	l = append(l, v...)
 	db.listKeys[k] = l
 	db.keyVersion[k]++
+	db.propagate(append([]string{"RPUSH", k}, v...)...)
 	return len(l)
 }
 
@@ -130,19 +524,150 @@ func (db *RedisDB) listPop(k string) string {
 	el := l[len(l)-1]
 	l = l[:len(l)-1]
 	if len(l) == 0 {
-		db.del(k)
+		db.remove(k)
 	} else {
 		db.listKeys[k] = l
 		db.keyVersion[k]++
 	}
+	db.propagate("RPOP", k)
 	return el
 }
 
-// setset replaces a whole set.
+// listPopN pops up to count elements from one end of a list.
+func (db *RedisDB) listPopN(k string, count int, lr leftright) []string {
+	if n := len(db.listKeys[k]); count > n {
+		count = n
+	}
+	elems := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		switch lr {
+		case left:
+			elems = append(elems, db.listLpop(k))
+		case right:
+			elems = append(elems, db.listPop(k))
+		}
+	}
+	return elems
+}
+
+// listMove pops an element from one end of src, and pushes it on one end of
+// dst. LMOVE, RPOPLPUSH, &c.
+func (db *RedisDB) listMove(src, dst string, from, to leftright) string {
+	var elem string
+	switch from {
+	case left:
+		elem = db.listLpop(src)
+	case right:
+		elem = db.listPop(src)
+	}
+	switch to {
+	case left:
+		db.listLpush(dst, elem)
+	case right:
+		db.listPush(dst, elem)
+	}
+	return elem
+}
+
+// listInsert implements LINSERT. where is -1 for before, +1 for after the
+// pivot. Returns the new length, or -1 if the pivot isn't there.
+func (db *RedisDB) listInsert(k string, where int, pivot, v string) int {
+	l := db.listKeys[k]
+	for i, el := range l {
+		if el != pivot {
+			continue
+		}
+
+		if where < 0 {
+			l = append(l[:i], append(listKey{v}, l[i:]...)...)
+		} else {
+			if i == len(l)-1 {
+				l = append(l, v)
+			} else {
+				l = append(l[:i+1], append(listKey{v}, l[i+1:]...)...)
+			}
+		}
+		db.listKeys[k] = l
+		db.keyVersion[k]++
+		if where < 0 {
+			db.propagate("LINSERT", k, "BEFORE", pivot, v)
+		} else {
+			db.propagate("LINSERT", k, "AFTER", pivot, v)
+		}
+		return len(l)
+	}
+	return -1
+}
+
+// listSet implements LSET. The index must be valid and not negative.
+func (db *RedisDB) listSet(k string, index int, v string) {
+	db.listKeys[k][index] = v
+	db.keyVersion[k]++
+	db.propagate("LSET", k, strconv.Itoa(index), v)
+}
+
+// listRem implements LREM. Returns the number of removed elements.
+func (db *RedisDB) listRem(k string, count int, v string) int {
+	l := db.listKeys[k]
+	if count < 0 {
+		reverseSlice(l)
+	}
+	deleted := 0
+	newL := []string{}
+	toDelete := len(l)
+	if count < 0 {
+		toDelete = -count
+	}
+	if count > 0 {
+		toDelete = count
+	}
+	for _, el := range l {
+		if el == v {
+			if toDelete > 0 {
+				deleted++
+				toDelete--
+				continue
+			}
+		}
+		newL = append(newL, el)
+	}
+	if count < 0 {
+		reverseSlice(newL)
+	}
+	if len(newL) == 0 {
+		db.remove(k)
+	} else {
+		db.listKeys[k] = newL
+	}
+	db.keyVersion[k]++
+	db.propagate("LREM", k, strconv.Itoa(count), v)
+	return deleted
+}
+
+// listTrim implements LTRIM.
+func (db *RedisDB) listTrim(k string, start, end int) {
+	l := db.listKeys[k]
+	rs, re := redisRange(len(l), start, end, false)
+	l = l[rs:re]
+	if len(l) == 0 {
+		db.remove(k)
+	} else {
+		db.listKeys[k] = l
+	}
+	db.keyVersion[k]++
+	db.propagate("LTRIM", k, strconv.Itoa(start), strconv.Itoa(end))
+}
+
+// setset replaces a whole set. An empty set removes the key.
 func (db *RedisDB) setSet(k string, set setKey) {
+	db.del(k)
+	if len(set) == 0 {
+		return
+	}
 	db.keys[k] = "set"
 	db.setKeys[k] = set
 	db.keyVersion[k]++
+	db.propagate(append([]string{"SADD", k}, db.setMembers(k)...)...)
 }
 
 // setadd adds members to a set. Returns nr of new keys.
@@ -161,6 +686,7 @@ func (db *RedisDB) setAdd(k string, elems ...string) int {
 	}
 	db.setKeys[k] = s
 	db.keyVersion[k]++
+	db.propagate(append([]string{"SADD", k}, elems...)...)
 	return added
 }
 
@@ -175,17 +701,105 @@ func (db *RedisDB) setRem(k string, fields ...string) int {
 		if _, ok := s[f]; ok {
 			removed++
 			delete(s, f)
+			delete(db.memberExpire[k], f)
 		}
 	}
 	if len(s) == 0 {
-		db.del(k)
+		db.remove(k)
 	} else {
 		db.setKeys[k] = s
 	}
 	db.keyVersion[k]++
+	db.propagate(append([]string{"SREM", k}, fields...)...)
 	return removed
 }
 
+// setAddTTL adds members to a set, or updates them, and makes them expire at
+// d. Returns nr of new members.
+func (db *RedisDB) setAddTTL(k string, d time.Time, elems ...string) int {
+	s, ok := db.setKeys[k]
+	if !ok {
+		s = setKey{}
+		db.keys[k] = "set"
+	}
+	ttls, ok := db.memberExpire[k]
+	if !ok {
+		ttls = map[string]time.Time{}
+		db.memberExpire[k] = ttls
+	}
+	added := 0
+	for _, e := range elems {
+		if _, ok := s[e]; !ok {
+			added++
+		}
+		s[e] = struct{}{}
+		ttls[e] = d
+	}
+	if next, ok := db.memberNext[k]; !ok || d.Before(next) {
+		db.memberNext[k] = d
+	}
+	db.setKeys[k] = s
+	db.keyVersion[k]++
+	db.propagate(append([]string{"PSADDEXAT", k, strconv.FormatInt(unixMilli(d), 10)}, elems...)...)
+	return added
+}
+
+// memberTTL gives the expire time of a set member, if it has one.
+func (db *RedisDB) memberTTL(k, e string) (time.Time, bool) {
+	if !db.setIsMember(k, e) {
+		return time.Time{}, false
+	}
+	d, ok := db.memberExpire[k][e]
+	return d, ok
+}
+
+// setPersist removes the TTL of a set member. Returns whether there was one.
+func (db *RedisDB) setPersist(k, e string) bool {
+	if _, ok := db.memberTTL(k, e); !ok {
+		return false
+	}
+	delete(db.memberExpire[k], e)
+	db.keyVersion[k]++
+	db.propagate("SPERSIST", k, e)
+	return true
+}
+
+// expireMembers removes the expired members of set k. memberNext is the
+// earliest TTL, or earlier, so usually nothing needs to be looked at. Returns
+// nr of removed members.
+func (db *RedisDB) expireMembers(k string) int {
+	next, ok := db.memberNext[k]
+	if !ok || db.now == nil {
+		return 0
+	}
+	now := db.now()
+	if next.After(now) {
+		return 0
+	}
+	var (
+		gone    []string
+		newNext time.Time
+	)
+	for e, d := range db.memberExpire[k] {
+		if !d.After(now) {
+			gone = append(gone, e)
+		} else if newNext.IsZero() || d.Before(newNext) {
+			newNext = d
+		}
+	}
+	if newNext.IsZero() {
+		delete(db.memberExpire, k)
+		delete(db.memberNext, k)
+	} else {
+		db.memberNext[k] = newNext
+	}
+	if len(gone) > 0 {
+		sort.Strings(gone)
+		db.setRem(k, gone...)
+	}
+	return len(gone)
+}
+
 // All members of a set.
 func (db *RedisDB) setMembers(k string) []string {
 	set := db.setKeys[k]
@@ -288,9 +902,339 @@ func (db *RedisDB) setUnion(keys []string) (setKey, error) {
 	return s, nil
 }
 
+// zsetAdd adds a member to a sorted set, or changes its score. Returns
+// whether it's new.
+func (db *RedisDB) zsetAdd(k string, score float64, member string) bool {
+	s, ok := db.zsetKeys[k]
+	if !ok {
+		s = newSortedSet()
+		db.keys[k] = "zset"
+		db.zsetKeys[k] = s
+	}
+	added := s.set(member, score)
+	db.keyVersion[k]++
+	db.propagate("ZADD", k, formatScore(score), member)
+	return added
+}
+
+// zsetSet replaces a whole sorted set. An empty set removes the key.
+func (db *RedisDB) zsetSet(k string, s *sortedSet) {
+	db.del(k)
+	if s.card() == 0 {
+		return
+	}
+	db.keys[k] = "zset"
+	db.zsetKeys[k] = s
+	db.keyVersion[k]++
+	db.propagate(append([]string{"ZADD", k}, zsetPairs(s.elems())...)...)
+}
+
+// zsetRem removes members from a sorted set. Returns nr of removed members.
+func (db *RedisDB) zsetRem(k string, members ...string) int {
+	s, ok := db.zsetKeys[k]
+	if !ok {
+		return 0
+	}
+	removed := 0
+	for _, e := range members {
+		if s.remove(e) {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+	if s.card() == 0 {
+		db.remove(k)
+	}
+	db.keyVersion[k]++
+	db.propagate(append([]string{"ZREM", k}, members...)...)
+	return removed
+}
+
+// zsetPop removes the count members with the lowest scores, or the highest
+// with max, and gives them in that order.
+func (db *RedisDB) zsetPop(k string, count int, max bool) []ssElem {
+	s := db.zsetKeys[k]
+	if count > s.card() {
+		count = s.card()
+	}
+	elems := s.byRank(0, count, max)
+	members := make([]string, 0, len(elems))
+	for _, e := range elems {
+		members = append(members, e.member)
+	}
+	db.zsetRem(k, members...)
+	return elems
+}
+
+// zsetScore gives the score of a member, if it's there.
+func (db *RedisDB) zsetScore(k, member string) (float64, bool) {
+	s, ok := db.zsetKeys[k]
+	if !ok {
+		return 0, false
+	}
+	return s.score(member)
+}
+
+// zsetPairs gives score/member pairs, as for ZADD.
+func zsetPairs(elems []ssElem) []string {
+	res := make([]string, 0, 2*len(elems))
+	for _, e := range elems {
+		res = append(res, formatScore(e.score), e.member)
+	}
+	return res
+}
+
+// streamAdd adds an entry to a stream, which is created if needed. The ID
+// has to be above the stream's last ID.
+func (db *RedisDB) streamAdd(k string, id streamID, values []string) {
+	s, ok := db.streamKeys[k]
+	if !ok {
+		s = &streamKey{}
+		db.keys[k] = "stream"
+		db.streamKeys[k] = s
+	}
+	s.entries = append(s.entries, streamEntry{id: id, values: values})
+	s.lastID = id
+	db.keyVersion[k]++
+	db.propagate(append([]string{"XADD", k, id.String()}, values...)...)
+}
+
+// streamSetID sets the last ID of a stream, which is created if needed. This
+// keeps the last ID of streams with deleted entries in the append-only file.
+func (db *RedisDB) streamSetID(k string, id streamID) {
+	s, ok := db.streamKeys[k]
+	if !ok {
+		s = &streamKey{}
+		db.keys[k] = "stream"
+		db.streamKeys[k] = s
+	}
+	s.lastID = id
+	db.keyVersion[k]++
+	db.propagate("XSETID", k, id.String())
+}
+
+// streamSet replaces a whole stream, with its groups.
+func (db *RedisDB) streamSet(k string, s *streamKey) {
+	db.del(k)
+	db.keys[k] = "stream"
+	db.streamKeys[k] = s
+	db.keyVersion[k]++
+	for _, args := range streamCommands(k, s) {
+		db.propagate(args...)
+	}
+}
+
+// streamCommands gives the commands which recreate a stream. Consumers come
+// back with the current time as their last seen time.
+func streamCommands(k string, s *streamKey) [][]string {
+	var res [][]string
+	for _, e := range s.entries {
+		res = append(res, append([]string{"XADD", k, e.id.String()}, e.values...))
+	}
+	res = append(res, []string{"XSETID", k, s.lastID.String()})
+	for _, name := range s.groupNames() {
+		g := s.groups[name]
+		res = append(res, []string{"XGROUP", "CREATE", k, name, g.lastID.String()})
+		for _, c := range g.consumerNames() {
+			res = append(res, []string{"XGROUP", "CREATECONSUMER", k, name, c})
+		}
+		for _, p := range g.pending {
+			res = append(res, xclaimCommand(k, name, p))
+		}
+	}
+	return res
+}
+
+// xclaimCommand is the XCLAIM which sets a pending entry exactly as it is.
+// This is also how Redis replicates XREADGROUP.
+func xclaimCommand(k, group string, p streamPending) []string {
+	return []string{
+		"XCLAIM", k, group, p.consumer, "0", p.id.String(),
+		"TIME", strconv.FormatInt(unixMilli(p.delivered), 10),
+		"RETRYCOUNT", strconv.Itoa(p.count),
+		"FORCE", "JUSTID",
+	}
+}
+
+// streamGroupCreate adds a consumer group to an existing stream.
+func (db *RedisDB) streamGroupCreate(k, group string, lastID streamID) {
+	s := db.streamKeys[k]
+	if s.groups == nil {
+		s.groups = map[string]*streamGroup{}
+	}
+	s.groups[group] = newStreamGroup(lastID)
+	db.keyVersion[k]++
+	db.propagate("XGROUP", "CREATE", k, group, lastID.String())
+}
+
+// streamGroupSetID sets the last delivered ID of a group.
+func (db *RedisDB) streamGroupSetID(k, group string, id streamID) {
+	db.streamKeys[k].groups[group].lastID = id
+	db.keyVersion[k]++
+	db.propagate("XGROUP", "SETID", k, group, id.String())
+}
+
+// streamGroupDestroy removes a consumer group. Returns whether it was there.
+func (db *RedisDB) streamGroupDestroy(k, group string) bool {
+	s, ok := db.streamKeys[k]
+	if !ok || s.groups[group] == nil {
+		return false
+	}
+	delete(s.groups, group)
+	db.keyVersion[k]++
+	db.propagate("XGROUP", "DESTROY", k, group)
+	return true
+}
+
+// streamConsumerCreate adds a consumer to a group. Returns whether it's new.
+func (db *RedisDB) streamConsumerCreate(k, group, consumer string, now time.Time) bool {
+	g := db.streamKeys[k].groups[group]
+	if _, ok := g.consumers[consumer]; ok {
+		return false
+	}
+	g.consumers[consumer] = &streamConsumer{seen: now}
+	db.keyVersion[k]++
+	db.propagate("XGROUP", "CREATECONSUMER", k, group, consumer)
+	return true
+}
+
+// streamConsumerSeen creates a consumer if needed, and sets its last seen
+// time. Seen times alone don't make a database dirty.
+func (db *RedisDB) streamConsumerSeen(k, group, consumer string, now time.Time) {
+	if !db.streamConsumerCreate(k, group, consumer, now) {
+		db.streamKeys[k].groups[group].consumers[consumer].seen = now
+	}
+}
+
+// streamConsumerDelete removes a consumer, and its pending entries. Returns
+// the nr of pending entries it had.
+func (db *RedisDB) streamConsumerDelete(k, group, consumer string) int {
+	g := db.streamKeys[k].groups[group]
+	if _, ok := g.consumers[consumer]; !ok {
+		return 0
+	}
+	var (
+		n    = 0
+		keep = g.pending[:0]
+	)
+	for _, p := range g.pending {
+		if p.consumer == consumer {
+			n++
+			continue
+		}
+		keep = append(keep, p)
+	}
+	g.pending = keep
+	delete(g.consumers, consumer)
+	db.keyVersion[k]++
+	db.propagate("XGROUP", "DELCONSUMER", k, group, consumer)
+	return n
+}
+
+// streamPendingSet adds or replaces an entry in the pending entries list of a
+// group. The consumer is created if needed.
+func (db *RedisDB) streamPendingSet(k, group string, p streamPending) {
+	g := db.streamKeys[k].groups[group]
+	if _, ok := g.consumers[p.consumer]; !ok {
+		g.consumers[p.consumer] = &streamConsumer{seen: p.delivered}
+	}
+	g.setPending(p)
+	db.keyVersion[k]++
+	db.propagate(xclaimCommand(k, group, p)...)
+}
+
+// streamAck removes entries from the pending entries list of a group. Returns
+// the nr of removed entries.
+func (db *RedisDB) streamAck(k, group string, ids ...streamID) int {
+	g := db.streamKeys[k].groups[group]
+	var (
+		n    = 0
+		args = []string{"XACK", k, group}
+	)
+	for _, id := range ids {
+		if g.delPending(id) {
+			n++
+			args = append(args, id.String())
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	db.keyVersion[k]++
+	db.propagate(args...)
+	return n
+}
+
+// streamDel removes entries from a stream. Returns nr of removed entries.
+// Streams stay, even when empty.
+func (db *RedisDB) streamDel(k string, ids ...streamID) int {
+	s, ok := db.streamKeys[k]
+	if !ok {
+		return 0
+	}
+	var (
+		deleted = 0
+		args    = []string{"XDEL", k}
+	)
+	for _, id := range ids {
+		i := s.search(id)
+		if i == len(s.entries) || s.entries[i].id != id {
+			continue
+		}
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+		args = append(args, id.String())
+		deleted++
+	}
+	if deleted == 0 {
+		return 0
+	}
+	db.keyVersion[k]++
+	db.propagate(args...)
+	return deleted
+}
+
+// streamTrim removes entries as set by a MAXLEN or MINID option. Returns nr
+// of removed entries.
+func (db *RedisDB) streamTrim(k string, t streamTrim) int {
+	s, ok := db.streamKeys[k]
+	if !ok {
+		return 0
+	}
+	n := t.trimCount(s)
+	if n == 0 {
+		return 0
+	}
+	s.entries = append([]streamEntry{}, s.entries[n:]...)
+	db.keyVersion[k]++
+	db.propagate("XTRIM", k, "MAXLEN", strconv.Itoa(len(s.entries)))
+	return n
+}
+
+// sortedMembers gives the members with a TTL, sorted.
+func sortedMembers(ttls map[string]time.Time) []string {
+	res := make([]string, 0, len(ttls))
+	for e := range ttls {
+		res = append(res, e)
+	}
+	sort.Strings(res)
+	return res
+}
+
 func reverseSlice(o []string) {
 	for i := range make([]struct{}, len(o)/2) {
 		other := len(o) - 1 - i
 		o[i], o[other] = o[other], o[i]
 	}
 }
+
+// unixMilli is t in milliseconds since the epoch.
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromUnixMilli is the inverse of unixMilli.
+func fromUnixMilli(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
@@ -4,6 +4,7 @@ package rediqueue
 
 import (
 	"errors"
+	"time"
 )
 
 var (
@@ -15,6 +16,11 @@ var (
 	ErrIntValueError = errors.New(msgInvalidInt)
 	// ErrFloatValueError can returned by INCRBYFLOAT
 	ErrFloatValueError = errors.New(msgInvalidFloat)
+	// ErrIncrOverflow is returned when INCR &c. would overflow.
+	ErrIncrOverflow = errors.New(msgIncrOverflow)
+	// ErrIncrNaNOrInf is returned when INCRBYFLOAT would make a NaN or
+	// Infinity.
+	ErrIncrNaNOrInf = errors.New(msgIncrNaNOrInf)
 )
 
 // Select sets the DB id for all direct commands.
@@ -61,6 +67,205 @@ func (db *RedisDB) FlushDB() {
 	db.flush()
 }
 
+// Get returns a string key.
+func (m *RediQueue) Get(k string) (string, error) {
+	return m.DB(m.selectedDB).Get(k)
+}
+
+// Get returns a string key.
+func (db *RedisDB) Get(k string) (string, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return "", ErrKeyNotFound
+	}
+	if db.t(k) != "string" {
+		return "", ErrWrongType
+	}
+	return db.stringKeys[k], nil
+}
+
+// Set sets a string key. Removes any TTL, and overwrites keys of any type.
+func (m *RediQueue) Set(k, v string) error {
+	return m.DB(m.selectedDB).Set(k, v)
+}
+
+// Set sets a string key. Removes any TTL, and overwrites keys of any type.
+func (db *RedisDB) Set(k, v string) error {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	db.stringSet(k, v)
+	return nil
+}
+
+// Incr changes an int string value by delta. Returns the new value.
+func (m *RediQueue) Incr(k string, delta int64) (int64, error) {
+	return m.DB(m.selectedDB).Incr(k, delta)
+}
+
+// Incr changes an int string value by delta. Returns the new value.
+func (db *RedisDB) Incr(k string, delta int64) (int64, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if db.exists(k) && db.t(k) != "string" {
+		return 0, ErrWrongType
+	}
+	return db.stringIncr(k, delta)
+}
+
+// Incrfloat changes a float string value by delta. Returns the new value.
+func (m *RediQueue) Incrfloat(k string, delta float64) (float64, error) {
+	return m.DB(m.selectedDB).Incrfloat(k, delta)
+}
+
+// Incrfloat changes a float string value by delta. Returns the new value.
+func (db *RedisDB) Incrfloat(k string, delta float64) (float64, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if db.exists(k) && db.t(k) != "string" {
+		return 0, ErrWrongType
+	}
+	return db.stringIncrfloat(k, delta)
+}
+
+// Hash returns a copy of the hash k.
+func (m *RediQueue) Hash(k string) (map[string]string, error) {
+	return m.DB(m.selectedDB).Hash(k)
+}
+
+// Hash returns a copy of the hash k.
+func (db *RedisDB) Hash(k string) (map[string]string, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return nil, ErrKeyNotFound
+	}
+	if db.t(k) != "hash" {
+		return nil, ErrWrongType
+	}
+	h := map[string]string{}
+	for f, v := range db.hashKeys[k] {
+		h[f] = v
+	}
+	return h, nil
+}
+
+// HGet returns a hash field, or ErrKeyNotFound if the key or the field isn't
+// there.
+func (m *RediQueue) HGet(k, f string) (string, error) {
+	return m.DB(m.selectedDB).HGet(k, f)
+}
+
+// HGet returns a hash field, or ErrKeyNotFound if the key or the field isn't
+// there.
+func (db *RedisDB) HGet(k, f string) (string, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return "", ErrKeyNotFound
+	}
+	if db.t(k) != "hash" {
+		return "", ErrWrongType
+	}
+	v, ok := db.hashKeys[k][f]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return v, nil
+}
+
+// HSet sets a hash field. Returns whether the field is new.
+func (m *RediQueue) HSet(k, f, v string) (bool, error) {
+	return m.DB(m.selectedDB).HSet(k, f, v)
+}
+
+// HSet sets a hash field. Returns whether the field is new.
+func (db *RedisDB) HSet(k, f, v string) (bool, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if db.exists(k) && db.t(k) != "hash" {
+		return false, ErrWrongType
+	}
+	return db.hashSet(k, f, v) == 1, nil
+}
+
+// HDel removes hash fields. Returns the number of deleted fields.
+func (m *RediQueue) HDel(k string, fields ...string) (int, error) {
+	return m.DB(m.selectedDB).HDel(k, fields...)
+}
+
+// HDel removes hash fields. Returns the number of deleted fields.
+func (db *RedisDB) HDel(k string, fields ...string) (int, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return 0, nil
+	}
+	if db.t(k) != "hash" {
+		return 0, ErrWrongType
+	}
+	return db.hashDel(k, fields...), nil
+}
+
+// HKeys returns the fields of a hash. Sorted.
+func (m *RediQueue) HKeys(k string) ([]string, error) {
+	return m.DB(m.selectedDB).HKeys(k)
+}
+
+// HKeys returns the fields of a hash. Sorted.
+func (db *RedisDB) HKeys(k string) ([]string, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return nil, ErrKeyNotFound
+	}
+	if db.t(k) != "hash" {
+		return nil, ErrWrongType
+	}
+	return db.hashFields(k), nil
+}
+
+// HIncr changes an int hash field by delta. Returns the new value.
+func (m *RediQueue) HIncr(k, f string, delta int64) (int64, error) {
+	return m.DB(m.selectedDB).HIncr(k, f, delta)
+}
+
+// HIncr changes an int hash field by delta. Returns the new value.
+func (db *RedisDB) HIncr(k, f string, delta int64) (int64, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if db.exists(k) && db.t(k) != "hash" {
+		return 0, ErrWrongType
+	}
+	return db.hashIncr(k, f, delta)
+}
+
+// HIncrfloat changes a float hash field by delta. Returns the new value.
+func (m *RediQueue) HIncrfloat(k, f string, delta float64) (float64, error) {
+	return m.DB(m.selectedDB).HIncrfloat(k, f, delta)
+}
+
+// HIncrfloat changes a float hash field by delta. Returns the new value.
+func (db *RedisDB) HIncrfloat(k, f string, delta float64) (float64, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if db.exists(k) && db.t(k) != "hash" {
+		return 0, ErrWrongType
+	}
+	return db.hashIncrfloat(k, f, delta)
+}
+
 // List returns the list k, or an error if it's not there or something else.
 // This is the same as the Redis command `LRANGE 0 -1`, but you can do your own
 // range-ing.
@@ -170,6 +375,44 @@ func (db *RedisDB) SetAdd(k string, elems ...string) (int, error) {
 	return db.setAdd(k, elems...), nil
 }
 
+// SetAddTTL adds keys to a set, which disappear again after ttl. Keys which
+// are there already get the new TTL. Returns the number of new keys.
+func (m *RediQueue) SetAddTTL(k string, ttl time.Duration, elems ...string) (int, error) {
+	return m.DB(m.selectedDB).SetAddTTL(k, ttl, elems...)
+}
+
+// SetAddTTL adds keys to a set, which disappear again after ttl. Keys which
+// are there already get the new TTL. Returns the number of new keys.
+func (db *RedisDB) SetAddTTL(k string, ttl time.Duration, elems ...string) (int, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+	if db.exists(k) && db.t(k) != "set" {
+		return 0, ErrWrongType
+	}
+	return db.setAddTTL(k, db.now().Add(ttl), elems...), nil
+}
+
+// MemberTTL is the time left before a set member expires. It's 0 if the member
+// isn't there, or has no TTL.
+func (m *RediQueue) MemberTTL(k, v string) time.Duration {
+	return m.DB(m.selectedDB).MemberTTL(k, v)
+}
+
+// MemberTTL is the time left before a set member expires. It's 0 if the member
+// isn't there, or has no TTL.
+func (db *RedisDB) MemberTTL(k, v string) time.Duration {
+	db.master.Lock()
+	defer db.master.Unlock()
+	if db.t(k) != "set" {
+		return 0
+	}
+	at, ok := db.memberTTL(k, v)
+	if !ok {
+		return 0
+	}
+	return at.Sub(db.now())
+}
+
 // Members gives all set keys. Sorted.
 func (m *RediQueue) Members(k string) ([]string, error) {
 	return m.DB(m.selectedDB).Members(k)
@@ -206,6 +449,178 @@ func (db *RedisDB) IsMember(k, v string) (bool, error) {
 	return db.setIsMember(k, v), nil
 }
 
+// ZAdd adds a member to a sorted set, or changes its score. Returns whether
+// the member is new.
+func (m *RediQueue) ZAdd(k string, score float64, member string) (bool, error) {
+	return m.DB(m.selectedDB).ZAdd(k, score, member)
+}
+
+// ZAdd adds a member to a sorted set, or changes its score. Returns whether
+// the member is new.
+func (db *RedisDB) ZAdd(k string, score float64, member string) (bool, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if db.exists(k) && db.t(k) != "zset" {
+		return false, ErrWrongType
+	}
+	return db.zsetAdd(k, score, member), nil
+}
+
+// ZRem removes a member from a sorted set. Returns whether it was there.
+func (m *RediQueue) ZRem(k, member string) (bool, error) {
+	return m.DB(m.selectedDB).ZRem(k, member)
+}
+
+// ZRem removes a member from a sorted set. Returns whether it was there.
+func (db *RedisDB) ZRem(k, member string) (bool, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return false, ErrKeyNotFound
+	}
+	if db.t(k) != "zset" {
+		return false, ErrWrongType
+	}
+	return db.zsetRem(k, member) == 1, nil
+}
+
+// ZScore gives the score of a sorted set member.
+func (m *RediQueue) ZScore(k, member string) (float64, error) {
+	return m.DB(m.selectedDB).ZScore(k, member)
+}
+
+// ZScore gives the score of a sorted set member.
+func (db *RedisDB) ZScore(k, member string) (float64, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return 0, ErrKeyNotFound
+	}
+	if db.t(k) != "zset" {
+		return 0, ErrWrongType
+	}
+	score, ok := db.zsetScore(k, member)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	return score, nil
+}
+
+// ZMembers gives the members of a sorted set, lowest score first.
+func (m *RediQueue) ZMembers(k string) ([]string, error) {
+	return m.DB(m.selectedDB).ZMembers(k)
+}
+
+// ZMembers gives the members of a sorted set, lowest score first.
+func (db *RedisDB) ZMembers(k string) ([]string, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return nil, ErrKeyNotFound
+	}
+	if db.t(k) != "zset" {
+		return nil, ErrWrongType
+	}
+	var members []string
+	for _, e := range db.zsetKeys[k].elems() {
+		members = append(members, e.member)
+	}
+	return members, nil
+}
+
+// SortedSet gives a sorted set as a member to score map.
+func (m *RediQueue) SortedSet(k string) (map[string]float64, error) {
+	return m.DB(m.selectedDB).SortedSet(k)
+}
+
+// SortedSet gives a sorted set as a member to score map.
+func (db *RedisDB) SortedSet(k string) (map[string]float64, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return nil, ErrKeyNotFound
+	}
+	if db.t(k) != "zset" {
+		return nil, ErrWrongType
+	}
+	res := map[string]float64{}
+	for _, e := range db.zsetKeys[k].elems() {
+		res[e.member] = e.score
+	}
+	return res, nil
+}
+
+// StreamEntry is an entry in a stream, as given by Stream().
+type StreamEntry struct {
+	ID     string
+	Values []string // field/value pairs
+}
+
+// XAdd adds an entry to a stream, and returns its ID. id is as for XADD: "*",
+// "<ms>-*", or an explicit ID. values are field/value pairs.
+func (m *RediQueue) XAdd(k, id string, values ...string) (string, error) {
+	return m.DB(m.selectedDB).XAdd(k, id, values...)
+}
+
+// XAdd adds an entry to a stream, and returns its ID. id is as for XADD: "*",
+// "<ms>-*", or an explicit ID. values are field/value pairs.
+func (db *RedisDB) XAdd(k, id string, values ...string) (string, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if len(values) == 0 || len(values)%2 != 0 {
+		return "", errors.New(errWrongNumber("xadd"))
+	}
+	if db.exists(k) && db.t(k) != "stream" {
+		return "", ErrWrongType
+	}
+	var last streamID
+	if s, ok := db.streamKeys[k]; ok {
+		last = s.lastID
+	}
+	now := time.Now()
+	if db.now != nil {
+		now = db.now()
+	}
+	sid, msg := nextStreamID(last, id, uint64(unixMilli(now)))
+	if msg != "" {
+		return "", errors.New(msg)
+	}
+	db.streamAdd(k, sid, append([]string{}, values...))
+	return sid.String(), nil
+}
+
+// Stream gives all entries of a stream, oldest first.
+func (m *RediQueue) Stream(k string) ([]StreamEntry, error) {
+	return m.DB(m.selectedDB).Stream(k)
+}
+
+// Stream gives all entries of a stream, oldest first.
+func (db *RedisDB) Stream(k string) ([]StreamEntry, error) {
+	db.master.Lock()
+	defer db.master.Unlock()
+
+	if !db.exists(k) {
+		return nil, ErrKeyNotFound
+	}
+	if db.t(k) != "stream" {
+		return nil, ErrWrongType
+	}
+	var res []StreamEntry
+	for _, e := range db.streamKeys[k].entries {
+		res = append(res, StreamEntry{
+			ID:     e.id.String(),
+			Values: append([]string{}, e.values...),
+		})
+	}
+	return res, nil
+}
+
 // Del deletes a key and any expiration value. Returns whether there was a key.
 func (m *RediQueue) Del(k string) bool {
 	return m.DB(m.selectedDB).Del(k)
@@ -246,6 +661,46 @@ func (db *RedisDB) Exists(k string) bool {
 	return db.exists(k)
 }
 
+// TTL is the time left before a key expires. It's 0 if the key doesn't exist,
+// or has no TTL.
+func (m *RediQueue) TTL(k string) time.Duration {
+	return m.DB(m.selectedDB).TTL(k)
+}
+
+// TTL is the time left before a key expires. It's 0 if the key doesn't exist,
+// or has no TTL.
+func (db *RedisDB) TTL(k string) time.Duration {
+	db.master.Lock()
+	defer db.master.Unlock()
+	at, ok := db.ttl(k)
+	if !ok {
+		return 0
+	}
+	return at.Sub(db.now())
+}
+
+// SetTTL makes a key expire after ttl, counting from SetTime() or now. A ttl
+// of 0 or less removes the TTL.
+func (m *RediQueue) SetTTL(k string, ttl time.Duration) error {
+	return m.DB(m.selectedDB).SetTTL(k, ttl)
+}
+
+// SetTTL makes a key expire after ttl, counting from SetTime() or now. A ttl
+// of 0 or less removes the TTL.
+func (db *RedisDB) SetTTL(k string, ttl time.Duration) error {
+	db.master.Lock()
+	defer db.master.Unlock()
+	if !db.exists(k) {
+		return ErrKeyNotFound
+	}
+	if ttl <= 0 {
+		db.persist(k)
+		return nil
+	}
+	db.setTTL(k, db.now().Add(ttl))
+	return nil
+}
+
 // SRem removes fields from a set. Returns number of deleted fields.
 func (m *RediQueue) SRem(k string, fields ...string) (int, error) {
 	return m.DB(m.selectedDB).SRem(k, fields...)
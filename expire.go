@@ -0,0 +1,66 @@
+package rediqueue
+
+import (
+	"time"
+)
+
+// sweepInterval is how often the sweeper looks for expired keys. Redis does
+// this 10 times a second by default as well.
+const sweepInterval = 100 * time.Millisecond
+
+// FastForward moves the time used for TTLs forward by d, and removes the
+// keys which expired because of that. This makes the clock stand still, as
+// with SetTime(), so TTLs can be tested without sleeping.
+func (m *RediQueue) FastForward(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.now = m.effectiveNow().Add(d)
+	m.expireKeys()
+}
+
+// startSweeper starts removing expired keys every sweepInterval. Keys are
+// also removed when they are looked up; this gets the ones nobody asks for.
+// Needs the lock.
+func (m *RediQueue) startSweeper() {
+	if m.sweepStop != nil {
+		return
+	}
+	m.sweepStop = make(chan struct{})
+	m.every(sweepInterval, m.sweepStop, func(time.Time) {
+		m.expireKeys()
+	})
+}
+
+// stopSweeper stops the sweeper. Needs the lock.
+func (m *RediQueue) stopSweeper() {
+	if m.sweepStop != nil {
+		close(m.sweepStop)
+		m.sweepStop = nil
+	}
+}
+
+// expireKeys removes all expired keys, and wakes up blocked clients if there
+// were any. Needs the lock.
+func (m *RediQueue) expireKeys() {
+	n := 0
+	for _, db := range m.dbs {
+		n += db.expireKeys()
+	}
+	if n > 0 {
+		m.wakeBlocked()
+	}
+}
+
+// expireKeys removes all expired keys and set members. Returns how many.
+func (db *RedisDB) expireKeys() int {
+	n := 0
+	for k := range db.expire {
+		if db.expired(k) && db.checkTTL(k) {
+			n++
+		}
+	}
+	for k := range db.memberNext {
+		n += db.expireMembers(k)
+	}
+	return n
+}
@@ -0,0 +1,60 @@
+package rediqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestFastForward(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.SetTime(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.Push("queue", "one")
+	s.SetAdd("seen", "a")
+	_, err = c.Do("EXPIRE", "queue", 10)
+	ok(t, err)
+	_, err = c.Do("EXPIRE", "seen", 20)
+	ok(t, err)
+
+	s.FastForward(5 * time.Second)
+	v, err := redis.Int(c.Do("TTL", "queue"))
+	ok(t, err)
+	equals(t, 5, v)
+
+	s.FastForward(5 * time.Second)
+	// Gone without a lookup.
+	s.Lock()
+	_, found := s.dbs[0].keys["queue"]
+	s.Unlock()
+	assert(t, !found, "queue still there")
+	equals(t, []string{"seen"}, s.Keys())
+
+	s.FastForward(time.Hour)
+	equals(t, []string{}, s.Keys())
+}
+
+func TestSweeper(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	s.Push("queue", "one")
+	s.Push("forever", "one")
+	_, err = c.Do("PEXPIRE", "queue", 10)
+	ok(t, err)
+
+	time.Sleep(3 * sweepInterval)
+	s.Lock()
+	_, found := s.dbs[0].keys["queue"]
+	s.Unlock()
+	assert(t, !found, "queue not swept")
+	equals(t, []string{"forever"}, s.Keys())
+}
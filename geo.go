@@ -0,0 +1,144 @@
+package rediqueue
+
+// Geo positions, as Redis stores them in sorted sets: the score is a 52-bit
+// geohash, with the latitude bits in the even positions and the longitude
+// bits in the odd ones. Latitudes are limited to what the Web Mercator
+// projection can show.
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	geoStep         = 26 // bits per coordinate
+	geoLatMin       = -85.05112878
+	geoLatMax       = 85.05112878
+	geoLonMin       = -180
+	geoLonMax       = 180
+	geoEarthRadius  = 6372797.560856 // meters, as Redis has it
+	geoHashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// geoEncode gives the geohash of a position, with the given latitude range.
+func geoEncode(lon, lat, latMin, latMax float64) uint64 {
+	latOffset := (lat - latMin) / (latMax - latMin) * (1 << geoStep)
+	lonOffset := (lon - geoLonMin) / (geoLonMax - geoLonMin) * (1 << geoStep)
+	return interleave(uint32(latOffset), uint32(lonOffset))
+}
+
+// geoDecode gives the center of the area of a geohash score.
+func geoDecode(score float64) (float64, float64) {
+	ilat, ilon := deinterleave(uint64(score))
+	latScale := geoLatMax - geoLatMin
+	lonScale := float64(geoLonMax - geoLonMin)
+
+	latMin := geoLatMin + float64(ilat)/(1<<geoStep)*latScale
+	latMax := geoLatMin + float64(ilat+1)/(1<<geoStep)*latScale
+	lonMin := geoLonMin + float64(ilon)/(1<<geoStep)*lonScale
+	lonMax := geoLonMin + float64(ilon+1)/(1<<geoStep)*lonScale
+
+	lon := math.Max(geoLonMin, math.Min(geoLonMax, (lonMin+lonMax)/2))
+	lat := math.Max(geoLatMin, math.Min(geoLatMax, (latMin+latMax)/2))
+	return lon, lat
+}
+
+// geoHashString gives the standard 11 character geohash of a score, as
+// GEOHASH does. It uses the full -90 to 90 latitude range.
+func geoHashString(score float64) string {
+	lon, lat := geoDecode(score)
+	bits := geoEncode(lon, lat, -90, 90)
+	b := make([]byte, 11)
+	for i := range b {
+		idx := 0 // there are only 52 bits, so the last one is always 0
+		if i < 10 {
+			idx = int(bits>>uint(52-(i+1)*5)) & 0x1f
+		}
+		b[i] = geoHashAlphabet[idx]
+	}
+	return string(b)
+}
+
+// interleave puts the bits of x in the even positions, and those of y in
+// the odd ones.
+func interleave(x, y uint32) uint64 {
+	spread := func(v uint32) uint64 {
+		u := uint64(v)
+		u = (u | u<<16) & 0x0000FFFF0000FFFF
+		u = (u | u<<8) & 0x00FF00FF00FF00FF
+		u = (u | u<<4) & 0x0F0F0F0F0F0F0F0F
+		u = (u | u<<2) & 0x3333333333333333
+		u = (u | u<<1) & 0x5555555555555555
+		return u
+	}
+	return spread(x) | spread(y)<<1
+}
+
+// deinterleave is the reverse of interleave.
+func deinterleave(u uint64) (uint32, uint32) {
+	squash := func(u uint64) uint32 {
+		u &= 0x5555555555555555
+		u = (u | u>>1) & 0x3333333333333333
+		u = (u | u>>2) & 0x0F0F0F0F0F0F0F0F
+		u = (u | u>>4) & 0x00FF00FF00FF00FF
+		u = (u | u>>8) & 0x0000FFFF0000FFFF
+		u = (u | u>>16) & 0x00000000FFFFFFFF
+		return uint32(u)
+	}
+	return squash(u), squash(u >> 1)
+}
+
+// geoDistance gives the distance in meters, with the haversine formula.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r, lon1r := lat1*math.Pi/180, lon1*math.Pi/180
+	lat2r, lon2r := lat2*math.Pi/180, lon2*math.Pi/180
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(a))
+}
+
+// geoInBox tells whether a position is in the box of width by height meters
+// around the center. The width is measured at the latitude of the position.
+func geoInBox(lon, lat, centerLon, centerLat, width, height float64) bool {
+	latDist := geoEarthRadius * math.Abs(lat*math.Pi/180-centerLat*math.Pi/180)
+	if latDist > height/2 {
+		return false
+	}
+	return geoDistance(lon, lat, centerLon, lat) <= width/2
+}
+
+// geoValid tells whether GEOADD accepts a position.
+func geoValid(lon, lat float64) bool {
+	return lon >= geoLonMin && lon <= geoLonMax && lat >= geoLatMin && lat <= geoLatMax
+}
+
+// parseGeoUnit gives the number of meters in a unit.
+func parseGeoUnit(u string) (float64, bool) {
+	switch strings.ToLower(u) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	default:
+		return 0, false
+	}
+}
+
+// formatGeoCoord formats a longitude or latitude as Redis does: 17 decimals,
+// without trailing zeros.
+func formatGeoCoord(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// formatGeoDist formats a distance.
+func formatGeoDist(v float64) string {
+	return strconv.FormatFloat(v, 'f', 4, 64)
+}
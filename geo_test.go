@@ -0,0 +1,29 @@
+package rediqueue
+
+import (
+	"testing"
+)
+
+func TestGeohash(t *testing.T) {
+	equals(t, uint64(0x5555555555555555), interleave(0xFFFFFFFF, 0))
+	equals(t, uint64(0xAAAAAAAAAAAAAAAA), interleave(0, 0xFFFFFFFF))
+	x, y := deinterleave(interleave(0x12345678, 0x9abcdef0))
+	equals(t, uint32(0x12345678), x)
+	equals(t, uint32(0x9abcdef0), y)
+
+	score := float64(geoEncode(13.361389, 38.115556, geoLatMin, geoLatMax))
+	equals(t, 3479099956230698.0, score)
+	lon, lat := geoDecode(score)
+	equals(t, "13.36138933897018433", formatGeoCoord(lon))
+	equals(t, "38.11555639549629859", formatGeoCoord(lat))
+	equals(t, "sqc8b49rny0", geoHashString(score))
+
+	// the corners
+	lon, lat = geoDecode(float64(geoEncode(-180, geoLatMin, geoLatMin, geoLatMax)))
+	assert(t, lon > -180 && lon < -179.9999, "lon %f", lon)
+	assert(t, lat > geoLatMin && lat < geoLatMin+0.0001, "lat %f", lat)
+
+	equals(t, "0", formatGeoCoord(0))
+	equals(t, "-1.5", formatGeoCoord(-1.5))
+	equals(t, "166274.1516", formatGeoDist(geoDistance(13.361389338970184, 38.1155563954963, 15.087267458438873, 37.50266842333162)))
+}
@@ -0,0 +1,301 @@
+package rediqueue
+
+// HyperLogLogs, in the same format as Redis, so values can be moved between
+// the two with DUMP/RESTORE or GET/SET:
+//
+//   "HYLL" <encoding> <3 unused bytes> <cached cardinality, 8 bytes LE>
+//   <registers>
+//
+// There are 2^14 registers of 6 bits. The dense encoding packs them all,
+// least significant bit first. The sparse encoding is a run length encoding
+// for mostly empty HyperLogLogs, with these opcodes:
+//
+//   00xxxxxx           ZERO: 1 to 64 empty registers
+//   01xxxxxx yyyyyyyy  XZERO: 1 to 16384 empty registers
+//   1vvvvvxx           VAL: 1 to 4 registers with value 1 to 32
+//
+// The most significant bit of the last cardinality byte is set when the
+// cached value is out of date.
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	hllMagic        = "HYLL"
+	hllHeaderSize   = 16
+	hllDense        = 0
+	hllSparse       = 1
+	hllP            = 14
+	hllQ            = 64 - hllP
+	hllRegisters    = 1 << hllP
+	hllBits         = 6
+	hllDenseSize    = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllSparseMax    = 3000 // as hll-sparse-max-bytes in Redis
+	hllSparseValMax = 32
+	hllAlphaInf     = 0.721347520444481703680 // 1/(2*ln(2))
+)
+
+var (
+	errNotHLL     = errors.New(msgNotHLL)
+	errInvalidHLL = errors.New(msgInvalidHLL)
+)
+
+// hll is a decoded HyperLogLog.
+type hll struct {
+	registers [hllRegisters]uint8
+	dense     bool
+	card      uint64 // cached cardinality
+	cardValid bool
+}
+
+// parseHLL decodes a string value. Gives errNotHLL if it's not a HyperLogLog
+// at all, and errInvalidHLL if it looks like one, but is broken.
+func parseHLL(v string) (*hll, error) {
+	if len(v) < hllHeaderSize || v[:4] != hllMagic {
+		return nil, errNotHLL
+	}
+	h := &hll{}
+	switch v[4] {
+	case hllDense:
+		if len(v) != hllDenseSize {
+			return nil, errNotHLL
+		}
+		h.dense = true
+		regs := v[hllHeaderSize:]
+		for i := range h.registers {
+			b := uint(i * hllBits / 8)
+			fb := uint(i * hllBits & 7)
+			r := uint(regs[b]) >> fb
+			if b+1 < uint(len(regs)) {
+				r |= uint(regs[b+1]) << (8 - fb)
+			}
+			h.registers[i] = uint8(r & 63)
+		}
+	case hllSparse:
+		i := 0
+		for p := hllHeaderSize; p < len(v); p++ {
+			op := v[p]
+			switch {
+			case op&0xC0 == 0x00: // ZERO
+				i += int(op&0x3F) + 1
+			case op&0xC0 == 0x40: // XZERO
+				if p+1 == len(v) {
+					return nil, errInvalidHLL
+				}
+				i += (int(op&0x3F)<<8 | int(v[p+1])) + 1
+				p++
+			default: // VAL
+				n := int(op&0x03) + 1
+				if i+n > hllRegisters {
+					return nil, errInvalidHLL
+				}
+				for ; n > 0; n-- {
+					h.registers[i] = (op>>2)&0x1F + 1
+					i++
+				}
+			}
+			if i > hllRegisters {
+				return nil, errInvalidHLL
+			}
+		}
+		if i != hllRegisters {
+			return nil, errInvalidHLL
+		}
+	default:
+		return nil, errNotHLL
+	}
+	if v[15]&0x80 == 0 {
+		h.cardValid = true
+		for i := 15; i >= 8; i-- {
+			h.card = h.card<<8 | uint64(v[i])
+		}
+	}
+	return h, nil
+}
+
+// String encodes the HyperLogLog. A sparse one becomes dense when it doesn't
+// fit the sparse encoding anymore, as in Redis, but never the other way.
+func (h *hll) String() string {
+	var b []byte
+	if !h.dense {
+		if b = h.encodeSparse(); b == nil {
+			h.dense = true
+		}
+	}
+	if h.dense {
+		b = h.encodeDense()
+	}
+	copy(b, hllMagic)
+	if h.dense {
+		b[4] = hllDense
+	} else {
+		b[4] = hllSparse
+	}
+	if h.cardValid {
+		for i := 8; i < 16; i++ {
+			b[i] = byte(h.card >> (8 * uint(i-8)))
+		}
+	} else {
+		b[15] = 0x80
+	}
+	return string(b)
+}
+
+func (h *hll) encodeDense() []byte {
+	b := make([]byte, hllDenseSize)
+	regs := b[hllHeaderSize:]
+	for i, r := range h.registers {
+		bi := uint(i * hllBits / 8)
+		fb := uint(i * hllBits & 7)
+		regs[bi] |= byte(uint(r) << fb)
+		if bi+1 < uint(len(regs)) {
+			regs[bi+1] |= byte(uint(r) >> (8 - fb))
+		}
+	}
+	return b
+}
+
+// encodeSparse gives nil if the registers don't fit the sparse encoding.
+func (h *hll) encodeSparse() []byte {
+	b := make([]byte, hllHeaderSize, hllHeaderSize+64)
+	for i := 0; i < hllRegisters; {
+		r := h.registers[i]
+		n := 1
+		for i+n < hllRegisters && h.registers[i+n] == r {
+			n++
+		}
+		i += n
+		switch {
+		case r == 0 && n <= 64:
+			b = append(b, byte(n-1))
+		case r == 0:
+			b = append(b, 0x40|byte((n-1)>>8), byte(n-1))
+		case r > hllSparseValMax:
+			return nil
+		default:
+			for ; n > 0; n -= 4 {
+				l := n
+				if l > 4 {
+					l = 4
+				}
+				b = append(b, 0x80|(r-1)<<2|byte(l-1))
+			}
+		}
+		if len(b) > hllHeaderSize+hllSparseMax {
+			return nil
+		}
+	}
+	return b
+}
+
+// add adds an element. Returns whether a register changed.
+func (h *hll) add(e string) bool {
+	hash := murmurHash64A([]byte(e), 0xadc83b19)
+	i := hash & (hllRegisters - 1)
+	hash >>= hllP
+	hash |= 1 << hllQ // so there is always a 1
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	if h.registers[i] >= count {
+		return false
+	}
+	h.registers[i] = count
+	h.cardValid = false
+	return true
+}
+
+// merge sets every register to the maximum of the two. The result is dense if
+// either one is.
+func (h *hll) merge(o *hll) {
+	for i, r := range o.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	h.dense = h.dense || o.dense
+	h.cardValid = false
+}
+
+// count gives the estimated cardinality. This is the estimator from "New
+// cardinality estimation algorithms for HyperLogLog sketches" by Otmar Ertl,
+// which Redis uses as well.
+func (h *hll) count() uint64 {
+	var histo [64]int
+	for _, r := range h.registers {
+		histo[r]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Floor(hllAlphaInf*m*m/z + 0.5))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is MurmurHash2, 64-bit version, as Redis uses it for
+// HyperLogLogs. Blocks are read little endian.
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const (
+		m = 0xc6a4a7935bd1e995
+		r = 47
+	)
+	h := seed ^ uint64(len(data))*m
+	for ; len(data) >= 8; data = data[8:] {
+		k := uint64(data[0]) | uint64(data[1])<<8 | uint64(data[2])<<16 |
+			uint64(data[3])<<24 | uint64(data[4])<<32 | uint64(data[5])<<40 |
+			uint64(data[6])<<48 | uint64(data[7])<<56
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
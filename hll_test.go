@@ -0,0 +1,84 @@
+package rediqueue
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHLLEncoding(t *testing.T) {
+	h := &hll{}
+	for i := 0; i < 100; i++ {
+		h.add(strconv.Itoa(i))
+	}
+	v := h.String()
+	equals(t, byte(hllSparse), v[4])
+
+	p, err := parseHLL(v)
+	ok(t, err)
+	equals(t, h.registers, p.registers)
+	equals(t, false, p.dense)
+	equals(t, false, p.cardValid)
+
+	// A value over 32 doesn't fit the sparse encoding.
+	p.registers[10] = 33
+	v = p.String()
+	equals(t, byte(hllDense), v[4])
+	equals(t, hllDenseSize, len(v))
+	d, err := parseHLL(v)
+	ok(t, err)
+	equals(t, p.registers, d.registers)
+	equals(t, true, d.dense)
+
+	// Nor do too many different registers.
+	h = &hll{}
+	for i := 0; i < 5000; i++ {
+		h.add(strconv.Itoa(i))
+	}
+	equals(t, byte(hllDense), h.String()[4])
+
+	// Dense stays dense.
+	h = &hll{dense: true, card: 0, cardValid: true}
+	v = h.String()
+	equals(t, hllDenseSize, len(v))
+	d, err = parseHLL(v)
+	ok(t, err)
+	equals(t, true, d.dense)
+	equals(t, true, d.cardValid)
+	equals(t, uint64(0), d.count())
+}
+
+func TestParseHLL(t *testing.T) {
+	for _, c := range []struct {
+		v   string
+		err error
+	}{
+		{"", errNotHLL},
+		{"foo", errNotHLL},
+		{"HYLL\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff", errNotHLL},
+		{"HYLL\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff", errNotHLL},
+		{"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f", errInvalidHLL},
+		{"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xfe", errInvalidHLL},
+		{"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff\x00", errInvalidHLL},
+		{"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff", nil},
+	} {
+		_, err := parseHLL(c.v)
+		equals(t, c.err, err)
+	}
+}
+
+func TestHLLAdd(t *testing.T) {
+	// Every element lands in its own register, so the count is exact for
+	// small sets.
+	h := &hll{}
+	for _, e := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		equals(t, true, h.add(e))
+	}
+	equals(t, uint64(7), h.count())
+	equals(t, false, h.add("a"))
+
+	o := &hll{dense: true}
+	o.add("h")
+	h.merge(o)
+	equals(t, uint64(8), h.count())
+	equals(t, true, h.dense)
+}
@@ -0,0 +1,1583 @@
+package rediqueue
+
+// Reading and writing Redis' own RDB files. Only string, hash, list, set,
+// sorted set and stream keys are supported, other types are skipped when
+// reading.
+//
+// See https://github.com/redis/redis/blob/unstable/src/rdb.c for the format.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	rdbMagic   = "REDIS"
+	rdbVersion = 9 // what we write. Reading goes up to rdbMaxVersion.
+
+	rdbMaxVersion = 12
+
+	// Key types.
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZset            = 3
+	rdbTypeHash            = 4
+	rdbTypeZset2           = 5
+	rdbTypeModule          = 6
+	rdbTypeModule2         = 7
+	rdbTypeHashZipmap      = 9
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZsetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeStreamListpack  = 15
+	rdbTypeHashListpack    = 16
+	rdbTypeZsetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeStreamListpack2 = 19
+	rdbTypeSetListpack     = 20
+	rdbTypeStreamListpack3 = 21
+
+	// Opcodes.
+	rdbOpSlotInfo     = 0xF4
+	rdbOpFunction2    = 0xF5
+	rdbOpModuleAux    = 0xF7
+	rdbOpIdle         = 0xF8
+	rdbOpFreq         = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireTimeMs = 0xFC
+	rdbOpExpireTime   = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+
+	// Special string encodings.
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	// quicklist2 node containers.
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+
+	// Entries per ziplist node when writing a quicklist.
+	rdbQuicklistFill = 128
+	// Sets up to this size with only integer members are written as intsets.
+	rdbMaxIntsetEntries = 512
+	// Entries per listpack node when writing a stream.
+	rdbStreamNodeEntries = 100
+
+	// Stream entry flags.
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+var (
+	// ErrBadRDB is returned when an RDB file can't be parsed.
+	ErrBadRDB = errors.New("invalid RDB file")
+	// ErrRDBMemberTTL is returned when an RDB file is saved while set members
+	// have TTLs, which RDB files have no place for.
+	ErrRDBMemberTTL = errors.New("RDB files can't store set member TTLs")
+)
+
+// crc64Jones is the CRC-64 variant Redis uses: the Jones polynomial,
+// reflected, with no initial or final xor. hash/crc64 always inverts.
+var crc64JonesTable = func() *[256]uint64 {
+	var t [256]uint64
+	for i := range t {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ 0x95AC9329AC4BC9B5
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}()
+
+func crc64Jones(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64JonesTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+// rdbWriter keeps a running checksum of everything written.
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (w *rdbWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = crc64Jones(w.crc, b)
+	_, w.err = w.w.Write(b)
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *rdbWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.writeByte(byte(n))
+	case n < 1<<14:
+		w.write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= math.MaxUint32:
+		b := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		w.write(b)
+	default:
+		b := []byte{0x81, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], n)
+		w.write(b)
+	}
+}
+
+func (w *rdbWriter) writeString(s string) {
+	w.writeLen(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+// writeRDB encodes all databases as an RDB file. Needs the lock.
+func writeRDB(dst io.Writer, dbs map[int]*RedisDB) error {
+	for _, db := range dbs {
+		for k := range db.memberExpire {
+			if hasMemberTTLs(db, k) {
+				return ErrRDBMemberTTL
+			}
+		}
+	}
+
+	w := &rdbWriter{w: bufio.NewWriter(dst)}
+	w.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, rdbVersion)))
+	w.writeByte(rdbOpAux)
+	w.writeString("redis-bits")
+	w.writeString(strconv.Itoa(strconv.IntSize))
+
+	for _, id := range sortedDBs(dbs) {
+		db := dbs[id]
+		w.writeByte(rdbOpSelectDB)
+		w.writeLen(uint64(id))
+		w.writeByte(rdbOpResizeDB)
+		w.writeLen(uint64(len(db.keys)))
+		w.writeLen(0)
+		for _, k := range db.allKeys() {
+			if d, ok := db.expire[k]; ok {
+				w.writeByte(rdbOpExpireTimeMs)
+				ms := make([]byte, 8)
+				binary.LittleEndian.PutUint64(ms, uint64(unixMilli(d)))
+				w.write(ms)
+			}
+			writeRDBObject(w, db, k, true)
+		}
+	}
+	w.writeByte(rdbOpEOF)
+	if w.err != nil {
+		return w.err
+	}
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, w.crc)
+	if _, err := w.w.Write(sum); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// writeRDBObject writes the type, the key name (unless withKey is false, as
+// for DUMP), and the value of key k.
+func writeRDBObject(w *rdbWriter, db *RedisDB, k string, withKey bool) {
+	key := func(t byte) {
+		w.writeByte(t)
+		if withKey {
+			w.writeString(k)
+		}
+	}
+	switch db.t(k) {
+	case "string":
+		key(rdbTypeString)
+		w.writeString(db.stringKeys[k])
+	case "hash":
+		key(rdbTypeHash)
+		fields := db.hashFields(k)
+		w.writeLen(uint64(len(fields)))
+		for _, f := range fields {
+			w.writeString(f)
+			w.writeString(db.hashKeys[k][f])
+		}
+	case "list":
+		key(rdbTypeListQuicklist)
+		l := db.listKeys[k]
+		nodes := (len(l) + rdbQuicklistFill - 1) / rdbQuicklistFill
+		w.writeLen(uint64(nodes))
+		for len(l) > 0 {
+			n := rdbQuicklistFill
+			if n > len(l) {
+				n = len(l)
+			}
+			w.writeString(string(encodeZiplist(l[:n])))
+			l = l[n:]
+		}
+	case "set":
+		members := db.setMembers(k)
+		if is, ok := encodeIntset(members); ok {
+			key(rdbTypeSetIntset)
+			w.writeString(string(is))
+			return
+		}
+		key(rdbTypeSet)
+		w.writeLen(uint64(len(members)))
+		for _, m := range members {
+			w.writeString(m)
+		}
+	case "zset":
+		key(rdbTypeZset2)
+		elems := db.zsetKeys[k].elems()
+		w.writeLen(uint64(len(elems)))
+		score := make([]byte, 8)
+		for _, e := range elems {
+			w.writeString(e.member)
+			binary.LittleEndian.PutUint64(score, math.Float64bits(e.score))
+			w.write(score)
+		}
+	case "stream":
+		key(rdbTypeStreamListpack)
+		writeRDBStream(w, db.streamKeys[k])
+	}
+}
+
+// writeRDBStream writes a stream as listpack nodes. Every node starts with a
+// "master entry" with the fields of its first entry, which are left out of
+// later entries with the same fields.
+func writeRDBStream(w *rdbWriter, s *streamKey) {
+	entries := s.entries
+	nodes := (len(entries) + rdbStreamNodeEntries - 1) / rdbStreamNodeEntries
+	w.writeLen(uint64(nodes))
+	for len(entries) > 0 {
+		n := rdbStreamNodeEntries
+		if n > len(entries) {
+			n = len(entries)
+		}
+		master := entries[0]
+		var fields []string
+		for i := 0; i < len(master.values); i += 2 {
+			fields = append(fields, master.values[i])
+		}
+		elems := []string{strconv.Itoa(n), "0", strconv.Itoa(len(fields))}
+		elems = append(elems, fields...)
+		elems = append(elems, "0")
+		for _, e := range entries[:n] {
+			same := len(e.values) == 2*len(fields)
+			for i := 0; same && i < len(fields); i++ {
+				same = e.values[2*i] == fields[i]
+			}
+			flags := 0
+			if same {
+				flags = streamItemSameFields
+			}
+			elems = append(elems,
+				strconv.Itoa(flags),
+				strconv.FormatInt(int64(e.id.ms-master.id.ms), 10),
+				strconv.FormatInt(int64(e.id.seq-master.id.seq), 10),
+			)
+			if same {
+				for i := 1; i < len(e.values); i += 2 {
+					elems = append(elems, e.values[i])
+				}
+				elems = append(elems, strconv.Itoa(len(fields)+3))
+			} else {
+				elems = append(elems, strconv.Itoa(len(e.values)/2))
+				elems = append(elems, e.values...)
+				elems = append(elems, strconv.Itoa(len(e.values)+4))
+			}
+		}
+		w.writeString(string(rdbStreamID(master.id)))
+		w.writeString(string(encodeListpack(elems)))
+		entries = entries[n:]
+	}
+	w.writeLen(uint64(len(s.entries)))
+	w.writeLen(s.lastID.ms)
+	w.writeLen(s.lastID.seq)
+
+	w.writeLen(uint64(len(s.groups)))
+	for _, name := range s.groupNames() {
+		g := s.groups[name]
+		w.writeString(name)
+		w.writeLen(g.lastID.ms)
+		w.writeLen(g.lastID.seq)
+		w.writeLen(uint64(len(g.pending)))
+		for _, p := range g.pending {
+			w.write(rdbStreamID(p.id))
+			w.write(rdbMillis(p.delivered))
+			w.writeLen(uint64(p.count))
+		}
+		w.writeLen(uint64(len(g.consumers)))
+		for _, c := range g.consumerNames() {
+			w.writeString(c)
+			w.write(rdbMillis(g.consumers[c].seen))
+			pending := g.consumerPending(c)
+			w.writeLen(uint64(len(pending)))
+			for _, p := range pending {
+				w.write(rdbStreamID(p.id))
+			}
+		}
+	}
+}
+
+// rdbMillis encodes a time as in RDB files: milliseconds, 8 bytes, little
+// endian.
+func rdbMillis(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(unixMilli(t)))
+	return b
+}
+
+// rdbStreamID encodes a stream ID as in RDB files: 16 bytes, big endian.
+func rdbStreamID(id streamID) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, id.ms)
+	binary.BigEndian.PutUint64(b[8:], id.seq)
+	return b
+}
+
+// hasMemberTTLs tells whether set k has members with a TTL. Those can't be
+// written to RDB files or DUMP payloads.
+func hasMemberTTLs(db *RedisDB, k string) bool {
+	return len(db.memberExpire[k]) > 0
+}
+
+// dumpKey makes a DUMP payload for key k: the value as in an RDB file,
+// followed by the RDB version (2 bytes) and a checksum (8 bytes), both little
+// endian. This is what Redis uses.
+func dumpKey(db *RedisDB, k string) string {
+	var buf bytes.Buffer
+	w := &rdbWriter{w: bufio.NewWriter(&buf)}
+	writeRDBObject(w, db, k, false)
+	version := make([]byte, 2)
+	binary.LittleEndian.PutUint16(version, rdbVersion)
+	w.write(version)
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, w.crc)
+	w.w.Write(sum)
+	w.w.Flush()
+	return buf.String()
+}
+
+// restoreKey decodes a DUMP payload into a new, unlocked, database with a
+// single key k.
+func restoreKey(payload string, k string) (*RedisDB, error) {
+	b := []byte(payload)
+	if len(b) < 11 {
+		return nil, ErrBadRDB
+	}
+	var (
+		body    = b[:len(b)-10]
+		version = binary.LittleEndian.Uint16(b[len(b)-10:])
+		sum     = binary.LittleEndian.Uint64(b[len(b)-8:])
+	)
+	if version > rdbMaxVersion || sum != crc64Jones(0, b[:len(b)-8]) {
+		return nil, ErrBadRDB
+	}
+	r := &rdbReader{r: bufio.NewReader(bytes.NewReader(body))}
+	t, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	db := newRedisDB(0, nil)
+	if err := readRDBValue(r, &db, t, k, false); err != nil {
+		return nil, err
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF || !db.exists(k) {
+		return nil, ErrBadRDB
+	}
+	return &db, nil
+}
+
+// encodeZiplist makes a ziplist with all elements stored as strings.
+func encodeZiplist(elems []string) []byte {
+	var (
+		body    bytes.Buffer
+		prevLen int
+		tail    int
+	)
+	for _, e := range elems {
+		tail = 10 + body.Len()
+		start := body.Len()
+		if prevLen < 254 {
+			body.WriteByte(byte(prevLen))
+		} else {
+			body.WriteByte(254)
+			binary.Write(&body, binary.LittleEndian, uint32(prevLen))
+		}
+		switch n := len(e); {
+		case n < 1<<6:
+			body.WriteByte(byte(n))
+		case n < 1<<14:
+			body.Write([]byte{byte(n>>8) | 0x40, byte(n)})
+		default:
+			body.WriteByte(0x80)
+			binary.Write(&body, binary.BigEndian, uint32(n))
+		}
+		body.WriteString(e)
+		prevLen = body.Len() - start
+	}
+	if len(elems) == 0 {
+		tail = 10
+	}
+	zl := make([]byte, 10, 10+body.Len()+1)
+	binary.LittleEndian.PutUint32(zl[0:], uint32(10+body.Len()+1))
+	binary.LittleEndian.PutUint32(zl[4:], uint32(tail))
+	n := len(elems)
+	if n > math.MaxUint16-1 {
+		n = math.MaxUint16 // "count them yourself"
+	}
+	binary.LittleEndian.PutUint16(zl[8:], uint16(n))
+	zl = append(zl, body.Bytes()...)
+	return append(zl, 0xFF)
+}
+
+// encodeListpack makes a listpack. Elements which are integers in their
+// canonical form are stored as such, as Redis does.
+func encodeListpack(elems []string) []byte {
+	lp := make([]byte, 6)
+	for _, e := range elems {
+		start := len(lp)
+		v, err := strconv.ParseInt(e, 10, 64)
+		switch {
+		case err != nil || strconv.FormatInt(v, 10) != e:
+			switch n := len(e); {
+			case n < 1<<6:
+				lp = append(lp, 0x80|byte(n))
+			case n < 1<<12:
+				lp = append(lp, 0xE0|byte(n>>8), byte(n))
+			default:
+				lp = append(lp, 0xF0, 0, 0, 0, 0)
+				binary.LittleEndian.PutUint32(lp[len(lp)-4:], uint32(n))
+			}
+			lp = append(lp, e...)
+		case v >= 0 && v <= 127:
+			lp = append(lp, byte(v))
+		case v >= -4096 && v <= 4095:
+			u := uint64(v) & (1<<13 - 1)
+			lp = append(lp, 0xC0|byte(u>>8), byte(u))
+		default:
+			enc, size := byte(0xF4), 8
+			switch {
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				enc, size = 0xF1, 2
+			case v >= -1<<23 && v < 1<<23:
+				enc, size = 0xF2, 3
+			case v >= math.MinInt32 && v <= math.MaxInt32:
+				enc, size = 0xF3, 4
+			}
+			lp = append(lp, enc)
+			for i := 0; i < size; i++ {
+				lp = append(lp, byte(uint64(v)>>(8*uint(i))))
+			}
+		}
+		l := len(lp) - start
+		switch size := lpBacklenSize(l); size {
+		case 1:
+			lp = append(lp, byte(l))
+		default:
+			// the most significant 7 bits first, all but the first byte
+			// with the high bit set.
+			for i := size - 1; i >= 0; i-- {
+				b := byte(l>>(7*uint(i))) & 127
+				if i != size-1 {
+					b |= 128
+				}
+				lp = append(lp, b)
+			}
+		}
+	}
+	lp = append(lp, 0xFF)
+	binary.LittleEndian.PutUint32(lp, uint32(len(lp)))
+	n := len(elems)
+	if n > math.MaxUint16-1 {
+		n = math.MaxUint16 // "count them yourself"
+	}
+	binary.LittleEndian.PutUint16(lp[4:], uint16(n))
+	return lp
+}
+
+// lpBacklenSize gives how many bytes a listpack uses to store the length of
+// an entry of l bytes.
+func lpBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// encodeIntset makes an intset if all members are integers in their canonical
+// form, and there are not too many of them.
+func encodeIntset(members []string) ([]byte, bool) {
+	if len(members) == 0 || len(members) > rdbMaxIntsetEntries {
+		return nil, false
+	}
+	var (
+		ints = make([]int64, 0, len(members))
+		size = 2
+	)
+	for _, m := range members {
+		v, err := strconv.ParseInt(m, 10, 64)
+		if err != nil || strconv.FormatInt(v, 10) != m {
+			return nil, false
+		}
+		switch {
+		case v < math.MinInt32 || v > math.MaxInt32:
+			size = 8
+		case (v < math.MinInt16 || v > math.MaxInt16) && size < 4:
+			size = 4
+		}
+		ints = append(ints, v)
+	}
+	// members are sorted as strings, intsets need numerical order.
+	sort.Slice(ints, func(i, j int) bool { return ints[i] < ints[j] })
+
+	b := make([]byte, 8, 8+size*len(ints))
+	binary.LittleEndian.PutUint32(b[0:], uint32(size))
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(ints)))
+	for _, v := range ints {
+		switch size {
+		case 2:
+			b = append(b, byte(v), byte(v>>8))
+		case 4:
+			b = append(b, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(v))
+		case 8:
+			b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(b[len(b)-8:], uint64(v))
+		}
+	}
+	return b, true
+}
+
+// rdbReader keeps a running checksum of everything read, and the offset.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+	n   int64
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	r.n++
+	r.crc = crc64Jones(r.crc, []byte{b})
+	return b, nil
+}
+
+func (r *rdbReader) readFull(n uint64) ([]byte, error) {
+	if n > maxSnapshotString {
+		return nil, ErrBadRDB
+	}
+	b := make([]byte, n)
+	read, err := io.ReadFull(r.r, b)
+	r.n += int64(read)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	r.crc = crc64Jones(r.crc, b)
+	return b, nil
+}
+
+// readLen reads a length. Special encodings (used for strings) are returned
+// with special set.
+func (r *rdbReader) readLen() (n uint64, special bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		b2, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(b2), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			buf, err := r.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := r.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		default:
+			return 0, false, ErrBadRDB
+		}
+	default:
+		return uint64(b & 0x3F), true, nil
+	}
+}
+
+// readLength reads a length which can't be a special encoding.
+func (r *rdbReader) readLength() (uint64, error) {
+	n, special, err := r.readLen()
+	if err == nil && special {
+		err = ErrBadRDB
+	}
+	return n, err
+}
+
+func (r *rdbReader) readString() (string, error) {
+	n, special, err := r.readLen()
+	if err != nil {
+		return "", err
+	}
+	if !special {
+		b, err := r.readFull(n)
+		return string(b), err
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := r.readFull(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case rdbEncInt16:
+		b, err := r.readFull(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case rdbEncInt32:
+		b, err := r.readFull(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case rdbEncLZF:
+		clen, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		if ulen > maxSnapshotString {
+			return "", ErrBadRDB
+		}
+		c, err := r.readFull(clen)
+		if err != nil {
+			return "", err
+		}
+		u, err := lzfDecompress(c, int(ulen))
+		return string(u), err
+	default:
+		return "", ErrBadRDB
+	}
+}
+
+// lzfDecompress decompresses LZF data, which Redis uses for long strings.
+func lzfDecompress(in []byte, ulen int) ([]byte, error) {
+	out := make([]byte, 0, ulen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// literal run
+			ctrl++
+			if i+ctrl > len(in) {
+				return nil, ErrBadRDB
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, ErrBadRDB
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrBadRDB
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, ErrBadRDB
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != ulen {
+		return nil, ErrBadRDB
+	}
+	return out, nil
+}
+
+// readRDB decodes an RDB file. Keys which expired before now are dropped, the
+// others keep their TTL. The returned databases use lock l. Errors are a
+// *CorruptError.
+func readRDB(src io.Reader, l *sync.Mutex, now time.Time) (map[int]*RedisDB, error) {
+	r := &rdbReader{r: bufio.NewReader(src)}
+	dbs, err := r.read(l, now)
+	if err != nil {
+		return nil, &CorruptError{Offset: r.n, Err: err}
+	}
+	return dbs, nil
+}
+
+func (r *rdbReader) read(l *sync.Mutex, now time.Time) (map[int]*RedisDB, error) {
+	magic, err := r.readFull(9)
+	if err != nil {
+		return nil, err
+	}
+	if string(magic[:5]) != rdbMagic {
+		return nil, ErrBadRDB
+	}
+	version, err := strconv.Atoi(string(magic[5:]))
+	if err != nil {
+		return nil, ErrBadRDB
+	}
+	if version < 1 || version > rdbMaxVersion {
+		return nil, fmt.Errorf("unsupported RDB version %d", version)
+	}
+
+	var (
+		dbs      = map[int]*RedisDB{}
+		db       *RedisDB
+		expireAt time.Time
+	)
+	selectDB := func(id int) {
+		if d, ok := dbs[id]; ok {
+			db = d
+			return
+		}
+		d := newRedisDB(id, l)
+		db = &d
+		dbs[id] = db
+	}
+	selectDB(0)
+	for {
+		op, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case rdbOpEOF:
+			for id, d := range dbs {
+				if len(d.keys) == 0 {
+					delete(dbs, id)
+				}
+			}
+			if version < 5 {
+				return dbs, nil
+			}
+			want := r.crc
+			sum := make([]byte, 8)
+			if _, err := io.ReadFull(r.r, sum); err != nil {
+				return nil, noEOF(err)
+			}
+			// a checksum of 0 means checksums were disabled.
+			if got := binary.LittleEndian.Uint64(sum); got != 0 && got != want {
+				return nil, fmt.Errorf("RDB checksum mismatch")
+			}
+			return dbs, nil
+		case rdbOpSelectDB:
+			id, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			selectDB(int(id))
+		case rdbOpResizeDB:
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		case rdbOpAux:
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+		case rdbOpFunction2:
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+		case rdbOpSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLength(); err != nil {
+					return nil, err
+				}
+			}
+		case rdbOpIdle:
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		case rdbOpFreq:
+			if _, err := r.readByte(); err != nil {
+				return nil, err
+			}
+		case rdbOpExpireTime:
+			b, err := r.readFull(4)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+		case rdbOpExpireTimeMs:
+			b, err := r.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = fromUnixMilli(int64(binary.LittleEndian.Uint64(b)))
+		case rdbOpModuleAux, rdbTypeModule, rdbTypeModule2:
+			return nil, fmt.Errorf("RDB modules are not supported")
+		default:
+			k, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			expired := !expireAt.IsZero() && !expireAt.After(now)
+			if err := readRDBValue(r, db, op, k, expired); err != nil {
+				return nil, err
+			}
+			if !expireAt.IsZero() && !expired && db.exists(k) {
+				db.setTTL(k, expireAt)
+			}
+			expireAt = time.Time{}
+		}
+	}
+}
+
+// readRDBValue reads the value of key k, and stores it in db unless skip is
+// set.
+func readRDBValue(r *rdbReader, db *RedisDB, t byte, k string, skip bool) error {
+	var (
+		list, set, hash []string // hash is field/value pairs
+		zset            []ssElem
+		str             *string
+		stream          *streamKey
+	)
+	switch t {
+	case rdbTypeString:
+		v, err := r.readString()
+		if err != nil {
+			return err
+		}
+		str = &v
+	case rdbTypeList, rdbTypeSet, rdbTypeHash:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		if t == rdbTypeHash {
+			n *= 2
+		}
+		var elems []string
+		for ; n > 0; n-- {
+			v, err := r.readString()
+			if err != nil {
+				return err
+			}
+			elems = append(elems, v)
+		}
+		switch t {
+		case rdbTypeList:
+			list = elems
+		case rdbTypeSet:
+			set = elems
+		default:
+			hash = elems
+		}
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		b, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if t == rdbTypeHashZiplist {
+			hash, err = decodeZiplist([]byte(b))
+		} else {
+			hash, err = decodeListpack([]byte(b))
+		}
+		if err != nil {
+			return err
+		}
+		if len(hash)%2 != 0 {
+			return ErrBadRDB
+		}
+	case rdbTypeListZiplist:
+		zl, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if list, err = decodeZiplist([]byte(zl)); err != nil {
+			return err
+		}
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			container := uint64(quicklistNodePacked)
+			if t == rdbTypeListQuicklist2 {
+				if container, err = r.readLength(); err != nil {
+					return err
+				}
+			}
+			node, err := r.readString()
+			if err != nil {
+				return err
+			}
+			var elems []string
+			switch {
+			case container == quicklistNodePlain:
+				elems = []string{node}
+			case t == rdbTypeListQuicklist:
+				elems, err = decodeZiplist([]byte(node))
+			default:
+				elems, err = decodeListpack([]byte(node))
+			}
+			if err != nil {
+				return err
+			}
+			list = append(list, elems...)
+		}
+	case rdbTypeZset, rdbTypeZset2:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			member, err := r.readString()
+			if err != nil {
+				return err
+			}
+			score, err := r.readScore(t == rdbTypeZset2)
+			if err != nil {
+				return err
+			}
+			zset = append(zset, ssElem{member: member, score: score})
+		}
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		b, err := r.readString()
+		if err != nil {
+			return err
+		}
+		var pairs []string
+		if t == rdbTypeZsetZiplist {
+			pairs, err = decodeZiplist([]byte(b))
+		} else {
+			pairs, err = decodeListpack([]byte(b))
+		}
+		if err != nil {
+			return err
+		}
+		if len(pairs)%2 != 0 {
+			return ErrBadRDB
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			score, err := parseScore(pairs[i+1])
+			if err != nil {
+				return ErrBadRDB
+			}
+			zset = append(zset, ssElem{member: pairs[i], score: score})
+		}
+	case rdbTypeSetIntset:
+		is, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if set, err = decodeIntset([]byte(is)); err != nil {
+			return err
+		}
+	case rdbTypeSetListpack:
+		lp, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if set, err = decodeListpack([]byte(lp)); err != nil {
+			return err
+		}
+	case rdbTypeStreamListpack, rdbTypeStreamListpack2, rdbTypeStreamListpack3:
+		var err error
+		if stream, err = r.readStream(t); err != nil {
+			return err
+		}
+	default:
+		if err := skipRDBValue(r, t); err != nil {
+			return err
+		}
+		if !skip {
+			log.Printf("rediqueue: skipping RDB key %q of unsupported type %d", k, t)
+		}
+		return nil
+	}
+	if skip {
+		return nil
+	}
+
+	if db.exists(k) {
+		return fmt.Errorf("%s: duplicate key %q", ErrBadRDB, k)
+	}
+	switch {
+	case str != nil:
+		db.stringSet(k, *str)
+	case len(hash) > 0:
+		db.hashSet(k, hash...)
+	case len(list) > 0:
+		db.listPush(k, list...)
+	case len(set) > 0:
+		db.setAdd(k, set...)
+	case len(zset) > 0:
+		s := newSortedSet()
+		for _, e := range zset {
+			s.set(e.member, e.score)
+		}
+		db.zsetSet(k, s)
+	case stream != nil:
+		db.streamSet(k, stream)
+	}
+	return nil
+}
+
+// readStream reads a stream, with its consumer groups.
+func (r *rdbReader) readStream(t byte) (*streamKey, error) {
+	s := &streamKey{}
+	nodes, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for ; nodes > 0; nodes-- {
+		master, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(master) != 16 {
+			return nil, ErrBadRDB
+		}
+		lp, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := decodeListpack([]byte(lp))
+		if err != nil {
+			return nil, err
+		}
+		entries, err := decodeStreamNode(readRDBStreamID([]byte(master)), elems)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if n := len(s.entries); n > 0 && !s.entries[n-1].id.less(e.id) {
+				return nil, ErrBadRDB
+			}
+			s.entries = append(s.entries, e)
+		}
+	}
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length != uint64(len(s.entries)) {
+		return nil, ErrBadRDB
+	}
+	if s.lastID.ms, err = r.readLength(); err != nil {
+		return nil, err
+	}
+	if s.lastID.seq, err = r.readLength(); err != nil {
+		return nil, err
+	}
+	if n := len(s.entries); n > 0 && s.lastID.less(s.entries[n-1].id) {
+		return nil, ErrBadRDB
+	}
+	if t != rdbTypeStreamListpack {
+		// first ID, max deleted ID, entries added
+		for i := 0; i < 5; i++ {
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	groups, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for ; groups > 0; groups-- {
+		name, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if s.groups[name] != nil {
+			return nil, ErrBadRDB
+		}
+		var lastID streamID
+		if lastID.ms, err = r.readLength(); err != nil {
+			return nil, err
+		}
+		if lastID.seq, err = r.readLength(); err != nil {
+			return nil, err
+		}
+		if t != rdbTypeStreamListpack {
+			// entries read
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		g := newStreamGroup(lastID)
+		pel, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for ; pel > 0; pel-- {
+			b, err := r.readFull(16 + 8)
+			if err != nil {
+				return nil, err
+			}
+			count, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			p := streamPending{
+				id:        readRDBStreamID(b),
+				delivered: fromUnixMilli(int64(binary.LittleEndian.Uint64(b[16:]))),
+				count:     int(count),
+			}
+			if l := len(g.pending); l > 0 && !g.pending[l-1].id.less(p.id) {
+				return nil, ErrBadRDB
+			}
+			g.pending = append(g.pending, p)
+		}
+		consumers, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for ; consumers > 0; consumers-- {
+			c, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := g.consumers[c]; ok {
+				return nil, ErrBadRDB
+			}
+			// seen time, and active time
+			n := 8
+			if t == rdbTypeStreamListpack3 {
+				n = 16
+			}
+			b, err := r.readFull(uint64(n))
+			if err != nil {
+				return nil, err
+			}
+			g.consumers[c] = &streamConsumer{
+				seen: fromUnixMilli(int64(binary.LittleEndian.Uint64(b))),
+			}
+			pel, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			for ; pel > 0; pel-- {
+				b, err := r.readFull(16)
+				if err != nil {
+					return nil, err
+				}
+				p := g.getPending(readRDBStreamID(b))
+				if p == nil || p.consumer != "" {
+					return nil, ErrBadRDB
+				}
+				p.consumer = c
+			}
+		}
+		for _, p := range g.pending {
+			if p.consumer == "" {
+				return nil, ErrBadRDB
+			}
+		}
+		if s.groups == nil {
+			s.groups = map[string]*streamGroup{}
+		}
+		s.groups[name] = g
+	}
+	return s, nil
+}
+
+// readRDBStreamID decodes the first 16 bytes of b. See rdbStreamID().
+func readRDBStreamID(b []byte) streamID {
+	return streamID{
+		ms:  binary.BigEndian.Uint64(b),
+		seq: binary.BigEndian.Uint64(b[8:]),
+	}
+}
+
+// decodeStreamNode gives the entries of a stream listpack node, without the
+// deleted ones. See writeRDBStream().
+func decodeStreamNode(master streamID, elems []string) ([]streamEntry, error) {
+	next := func() (int64, error) {
+		if len(elems) == 0 {
+			return 0, ErrBadRDB
+		}
+		v, err := strconv.ParseInt(elems[0], 10, 64)
+		if err != nil {
+			return 0, ErrBadRDB
+		}
+		elems = elems[1:]
+		return v, nil
+	}
+	strs := func(n int64) ([]string, error) {
+		if n < 0 || n > int64(len(elems)) {
+			return nil, ErrBadRDB
+		}
+		res := elems[:n]
+		elems = elems[n:]
+		return res, nil
+	}
+
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := next()
+	if err != nil {
+		return nil, err
+	}
+	nf, err := next()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := strs(nf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := next(); err != nil { // master entry terminator
+		return nil, err
+	}
+	var res []streamEntry
+	for n := count + deleted; n > 0; n-- {
+		flags, err := next()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		var values []string
+		if flags&streamItemSameFields != 0 {
+			vs, err := strs(nf)
+			if err != nil {
+				return nil, err
+			}
+			for i, f := range fields {
+				values = append(values, f, vs[i])
+			}
+		} else {
+			n, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if values, err = strs(2 * n); err != nil {
+				return nil, err
+			}
+			values = append([]string{}, values...)
+		}
+		if _, err := next(); err != nil { // lp-count
+			return nil, err
+		}
+		if flags&streamItemDeleted != 0 {
+			continue
+		}
+		if len(values) == 0 {
+			return nil, ErrBadRDB
+		}
+		res = append(res, streamEntry{
+			id: streamID{
+				ms:  master.ms + uint64(msDiff),
+				seq: master.seq + uint64(seqDiff),
+			},
+			values: values,
+		})
+	}
+	if len(elems) != 0 {
+		return nil, ErrBadRDB
+	}
+	return res, nil
+}
+
+// skipRDBValue reads past a value of a type we don't support.
+func skipRDBValue(r *rdbReader, t byte) error {
+	switch t {
+	case rdbTypeHashZipmap:
+		_, err := r.readString()
+		return err
+	default:
+		return fmt.Errorf("unsupported RDB type %d", t)
+	}
+}
+
+// readScore reads a sorted set score: a little endian float64 if bin is set,
+// else the old style, a length byte and the score as a string, or 253-255
+// for nan/inf/-inf. NaN is not a valid score.
+func (r *rdbReader) readScore(bin bool) (float64, error) {
+	if bin {
+		b, err := r.readFull(8)
+		if err != nil {
+			return 0, err
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(b))
+		if math.IsNaN(v) {
+			return 0, ErrBadRDB
+		}
+		return v, nil
+	}
+	l, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch l {
+	case 253:
+		return 0, ErrBadRDB
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := r.readFull(uint64(l))
+	if err != nil {
+		return 0, err
+	}
+	v, err := parseScore(string(b))
+	if err != nil {
+		return 0, ErrBadRDB
+	}
+	return v, nil
+}
+
+// decodeZiplist gives all entries of a ziplist.
+func decodeZiplist(zl []byte) ([]string, error) {
+	if len(zl) < 11 {
+		return nil, ErrBadRDB
+	}
+	var (
+		res []string
+		i   = 10
+	)
+	for {
+		if i >= len(zl) {
+			return nil, ErrBadRDB
+		}
+		if zl[i] == 0xFF {
+			return res, nil
+		}
+		// previous entry length
+		if zl[i] == 254 {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(zl) {
+			return nil, ErrBadRDB
+		}
+		enc := zl[i]
+		i++
+		var (
+			strLen = -1
+			intLen int
+		)
+		switch {
+		case enc>>6 == 0:
+			strLen = int(enc & 0x3F)
+		case enc>>6 == 1:
+			if i >= len(zl) {
+				return nil, ErrBadRDB
+			}
+			strLen = int(enc&0x3F)<<8 | int(zl[i])
+			i++
+		case enc == 0x80:
+			if i+4 > len(zl) {
+				return nil, ErrBadRDB
+			}
+			strLen = int(binary.BigEndian.Uint32(zl[i:]))
+			i += 4
+		case enc == 0xC0:
+			intLen = 2
+		case enc == 0xD0:
+			intLen = 4
+		case enc == 0xE0:
+			intLen = 8
+		case enc == 0xF0:
+			intLen = 3
+		case enc == 0xFE:
+			intLen = 1
+		case enc >= 0xF1 && enc <= 0xFD:
+			res = append(res, strconv.Itoa(int(enc&0x0F)-1))
+			continue
+		default:
+			return nil, ErrBadRDB
+		}
+		if strLen >= 0 {
+			if strLen > len(zl)-i {
+				return nil, ErrBadRDB
+			}
+			res = append(res, string(zl[i:i+strLen]))
+			i += strLen
+			continue
+		}
+		if intLen > len(zl)-i {
+			return nil, ErrBadRDB
+		}
+		res = append(res, strconv.FormatInt(leInt(zl[i:i+intLen]), 10))
+		i += intLen
+	}
+}
+
+// decodeListpack gives all entries of a listpack.
+func decodeListpack(lp []byte) ([]string, error) {
+	if len(lp) < 7 {
+		return nil, ErrBadRDB
+	}
+	var (
+		res []string
+		i   = 6
+	)
+	for {
+		if i >= len(lp) {
+			return nil, ErrBadRDB
+		}
+		var (
+			enc    = lp[i]
+			start  = i
+			strLen = -1
+			intLen int
+		)
+		i++
+		switch {
+		case enc == 0xFF:
+			return res, nil
+		case enc>>7 == 0:
+			res = append(res, strconv.Itoa(int(enc)))
+		case enc>>6 == 2:
+			strLen = int(enc & 0x3F)
+		case enc>>5 == 6:
+			if i >= len(lp) {
+				return nil, ErrBadRDB
+			}
+			v := int(enc&0x1F)<<8 | int(lp[i])
+			i++
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			res = append(res, strconv.Itoa(v))
+		case enc>>4 == 0xE:
+			if i >= len(lp) {
+				return nil, ErrBadRDB
+			}
+			strLen = int(enc&0x0F)<<8 | int(lp[i])
+			i++
+		case enc == 0xF0:
+			if i+4 > len(lp) {
+				return nil, ErrBadRDB
+			}
+			strLen = int(binary.LittleEndian.Uint32(lp[i:]))
+			i += 4
+		case enc == 0xF1:
+			intLen = 2
+		case enc == 0xF2:
+			intLen = 3
+		case enc == 0xF3:
+			intLen = 4
+		case enc == 0xF4:
+			intLen = 8
+		default:
+			return nil, ErrBadRDB
+		}
+		switch {
+		case strLen >= 0:
+			if strLen > len(lp)-i {
+				return nil, ErrBadRDB
+			}
+			res = append(res, string(lp[i:i+strLen]))
+			i += strLen
+		case intLen > 0:
+			if intLen > len(lp)-i {
+				return nil, ErrBadRDB
+			}
+			res = append(res, strconv.FormatInt(leInt(lp[i:i+intLen]), 10))
+			i += intLen
+		}
+		i += lpBacklenSize(i - start)
+	}
+}
+
+// decodeIntset gives all members of an intset.
+func decodeIntset(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, ErrBadRDB
+	}
+	size := int(binary.LittleEndian.Uint32(is))
+	n := int(binary.LittleEndian.Uint32(is[4:]))
+	if (size != 2 && size != 4 && size != 8) || len(is)-8 != n*size {
+		return nil, ErrBadRDB
+	}
+	res := make([]string, 0, n)
+	for i := 8; i < len(is); i += size {
+		res = append(res, strconv.FormatInt(leInt(is[i:i+size]), 10))
+	}
+	return res, nil
+}
+
+// leInt decodes a little endian, two's complement, integer of 1 to 8 bytes.
+func leInt(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := uint(64 - 8*len(b))
+	return int64(v<<shift) >> shift
+}
@@ -0,0 +1,332 @@
+package rediqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadRDB(t *testing.T, name string) *RediQueue {
+	f, err := os.Open("testdata/rdb/" + name + ".rdb")
+	ok(t, err)
+	defer f.Close()
+	s := NewRediQueue()
+	dbs, err := readRDB(f, &s.Mutex, time.Now())
+	ok(t, err)
+	s.dbs = dbs
+	return s
+}
+
+func TestRDBFixtures(t *testing.T) {
+	// quicklist with a ziplist node, checksum.
+	s := loadRDB(t, "rdb_v7_list_quicklist")
+	s.CheckList(t, "foo", "bar", "baz", "boo")
+
+	// ziplist with every integer encoding.
+	s = loadRDB(t, "ziplist_with_integers")
+	s.CheckList(t, "ziplist_with_integers",
+		"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12",
+		"-2", "13", "25", "-61", "63", "16380", "-16000", "65535", "-65523",
+		"4194304", "9223372036854775807",
+	)
+
+	// LZF compressed ziplist.
+	s = loadRDB(t, "ziplist_that_compresses_easily")
+	var want []string
+	for _, n := range []int{6, 12, 18, 24, 30, 36} {
+		want = append(want, strings.Repeat("a", n))
+	}
+	s.CheckList(t, "ziplist_compresses_easily", want...)
+
+	// plain list.
+	s = loadRDB(t, "linkedlist")
+	l, err := s.List("force_linkedlist")
+	ok(t, err)
+	equals(t, 1000, len(l))
+
+	// intsets.
+	s = loadRDB(t, "intset_16")
+	s.CheckSet(t, "intset_16", "32764", "32765", "32766")
+	s = loadRDB(t, "intset_32")
+	s.CheckSet(t, "intset_32", "2147418108", "2147418109", "2147418110")
+	s = loadRDB(t, "intset_64")
+	s.CheckSet(t, "intset_64", "9223090557583032316", "9223090557583032317", "9223090557583032318")
+
+	// hashtable set.
+	s = loadRDB(t, "regular_set")
+	s.CheckSet(t, "regular_set", "alpha", "beta", "delta", "gamma", "kappa", "phi")
+
+	// strings, in more than one database, and with TTLs.
+	s = loadRDB(t, "multiple_databases")
+	s.CheckGet(t, "key_in_zeroth_database", "zero")
+	s.Select(2)
+	s.CheckGet(t, "key_in_second_database", "second")
+	s = loadRDB(t, "keys_with_mixed_expiry")
+	s.CheckGet(t, "key01", "this does expire")
+	s.CheckGet(t, "key02", "this does not expire")
+	equals(t, 2, len(s.dbs[0].expire))
+	_, found := s.dbs[0].expire["key02"]
+	assert(t, !found, "key02 has a TTL")
+
+	// ziplist sorted set.
+	s = loadRDB(t, "sorted_set_as_ziplist")
+	z, err := s.SortedSet("sorted_set_as_ziplist")
+	ok(t, err)
+	equals(t, map[string]float64{
+		"8b6ba6718a786daefa69438148361901": 1,
+		"cb7a24bb7528f934b841b34c3a73e0c7": 2.37,
+		"523af537946b79c4f8369ed39ba78605": 3.423,
+	}, z)
+}
+
+// listpack builds a listpack with the given raw entries (without backlen).
+func listpack(entries ...[]byte) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 6))
+	for _, e := range entries {
+		b.Write(e)
+		b.WriteByte(byte(len(e))) // all our entries are < 128 bytes
+	}
+	b.WriteByte(0xFF)
+	lp := b.Bytes()
+	binary.LittleEndian.PutUint32(lp, uint32(len(lp)))
+	binary.LittleEndian.PutUint16(lp[4:], uint16(len(entries)))
+	return lp
+}
+
+func TestRDBListpack(t *testing.T) {
+	// Redis 7 style: quicklist2 with listpack and plain nodes, listpack sets
+	// and hashes.
+	var (
+		buf bytes.Buffer
+		crc uint64
+	)
+	raw := func(b ...byte) { buf.Write(b); crc = crc64Jones(crc, b) }
+	str := func(s string) {
+		if len(s) >= 64 {
+			panic("test string too long")
+		}
+		raw(byte(len(s)))
+		raw([]byte(s)...)
+	}
+
+	raw([]byte("REDIS0011")...)
+	raw(rdbOpAux)
+	str("redis-ver")
+	str("7.2.0")
+	raw(rdbOpSelectDB, 0)
+	raw(rdbOpResizeDB, 4, 0)
+	raw(rdbTypeListQuicklist2)
+	str("queue")
+	raw(2)                   // nodes
+	raw(quicklistNodePacked) // container
+	str(string(listpack(
+		[]byte{0x85, 'h', 'e', 'l', 'l', 'o'}, // 6 bit string
+		[]byte{0x07},                          // 7 bit uint
+		[]byte{0xDF, 0xFF},                    // 13 bit int, -1
+		[]byte{0xF1, 0x30, 0xF8},              // int16, -2000
+		[]byte{0xF3, 0x00, 0x00, 0x00, 0x80},  // int32, min
+	)))
+	raw(quicklistNodePlain)
+	str("a big one")
+	raw(rdbTypeSetListpack)
+	str("seen")
+	str(string(listpack(
+		[]byte{0x83, 'o', 'n', 'e'},
+		[]byte{0x83, 't', 'w', 'o'},
+		[]byte{0x7F}, // 127
+	)))
+	raw(rdbTypeHashListpack)
+	str("job")
+	str(string(listpack(
+		[]byte{0x85, 's', 't', 'a', 't', 'e'},
+		[]byte{0x84, 'd', 'o', 'n', 'e'},
+		[]byte{0x87, 'r', 'e', 't', 'r', 'i', 'e', 's'},
+		[]byte{0x03},
+	)))
+	raw(rdbTypeStreamListpack3)
+	str("events")
+	raw(1)                                                              // nodes
+	str(string([]byte{0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 0})) // master ID, 5-0
+	str(string(listpack(
+		// master entry: 2 entries, 1 deleted, field "n"
+		[]byte{0x02}, []byte{0x01}, []byte{0x01}, []byte{0x81, 'n'}, []byte{0x00},
+		// 5-0, deleted
+		[]byte{0x03}, []byte{0x00}, []byte{0x00}, []byte{0x81, 'a'}, []byte{0x04},
+		// 5-1, same fields
+		[]byte{0x02}, []byte{0x00}, []byte{0x01}, []byte{0x81, 'b'}, []byte{0x04},
+		// 6-0, own fields
+		[]byte{0x00}, []byte{0x01}, []byte{0x00}, []byte{0x02},
+		[]byte{0x81, 'x'}, []byte{0x01}, []byte{0x81, 'y'}, []byte{0x02}, []byte{0x08},
+	)))
+	raw(2)       // length
+	raw(7, 0)    // last ID
+	raw(5, 1)    // first ID
+	raw(5, 0)    // max deleted ID
+	raw(3)       // entries added
+	raw(1)       // groups
+	str("group") // name
+	raw(6, 0)    // last ID
+	raw(2)       // entries read
+	raw(1)       // PEL
+	raw(0, 0, 0, 0, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0)
+	raw(0, 0, 0, 0, 0, 0, 0, 0) // delivery time
+	raw(1)                      // delivery count
+	raw(1)                      // consumers
+	str("alice")
+	raw(0, 0, 0, 0, 0, 0, 0, 0) // seen time
+	raw(0, 0, 0, 0, 0, 0, 0, 0) // active time
+	raw(1)                      // PEL
+	raw(0, 0, 0, 0, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0)
+	raw(rdbOpEOF)
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, crc)
+	buf.Write(sum)
+
+	s := NewRediQueue()
+	dbs, err := readRDB(bytes.NewReader(buf.Bytes()), &s.Mutex, time.Now())
+	ok(t, err)
+	s.dbs = dbs
+	s.CheckList(t, "queue", "hello", "7", "-1", "-2000", "-2147483648", "a big one")
+	s.CheckSet(t, "seen", "one", "two", "127")
+	s.CheckHash(t, "job", map[string]string{"state": "done", "retries": "3"})
+	entries, err := s.Stream("events")
+	ok(t, err)
+	equals(t, []StreamEntry{
+		{ID: "5-1", Values: []string{"n", "b"}},
+		{ID: "6-0", Values: []string{"x", "1", "y", "2"}},
+	}, entries)
+	_, err = s.XAdd("events", "7-0", "n", "c")
+	assert(t, err != nil, "last ID not loaded")
+	g := s.dbs[0].streamKeys["events"].groups["group"]
+	equals(t, streamID{6, 0}, g.lastID)
+	equals(t, []streamPending{{
+		id:        streamID{6, 0},
+		consumer:  "alice",
+		delivered: fromUnixMilli(0),
+		count:     1,
+	}}, g.pending)
+
+	// Break the checksum.
+	b := buf.Bytes()
+	b[len(b)-1] ^= 0xFF
+	_, err = readRDB(bytes.NewReader(b), &s.Mutex, time.Now())
+	assert(t, err != nil, "no checksum error")
+}
+
+func TestRDBRoundtrip(t *testing.T) {
+	equals(t, uint64(0xe9c6d914c4b8d9ca), crc64Jones(0, []byte("123456789")))
+
+	s := NewRediQueue()
+	var long []string
+	for i := 0; i < 300; i++ {
+		long = append(long, strings.Repeat("x", i))
+	}
+	s.Push("long", long...)
+	s.Push("short", "a", "", "c")
+	s.Set("str", "hello")
+	s.Set("emptystr", "")
+	s.HSet("hash", "a", "1")
+	s.HSet("hash", "b", "")
+	s.ZAdd("zset", 0.1, "a")
+	s.ZAdd("zset", math.Inf(1), "b")
+	s.ZAdd("zset", math.Inf(-1), "c")
+	var stream []StreamEntry
+	for i := 0; i < 250; i++ {
+		values := []string{"n", strconv.Itoa(i - 100), "big", strconv.Itoa(i * 100000), "pad", strings.Repeat("y", i*20)}
+		if i%7 == 0 {
+			values = []string{"other", "01"}
+		}
+		id, err := s.XAdd("stream", strconv.Itoa(i*1000)+"-"+strconv.Itoa(i%3+1), values...)
+		ok(t, err)
+		stream = append(stream, StreamEntry{ID: id, Values: values})
+	}
+	s.XAdd("emptystream", "3-0", "a", "b")
+	s.dbs[0].streamDel("emptystream", streamID{3, 0})
+	s.dbs[0].streamSetID("emptystream", streamID{9, 9})
+	s.dbs[0].streamGroupCreate("stream", "g", streamID{2000, 3})
+	s.dbs[0].streamConsumerCreate("stream", "g", "idle", time.Unix(1000, 0))
+	for _, id := range []streamID{{1000, 2}, {2000, 3}} {
+		s.dbs[0].streamPendingSet("stream", "g", streamPending{
+			id:        id,
+			consumer:  "busy",
+			delivered: time.Unix(2000, 0),
+			count:     3,
+		})
+	}
+	s.SetAdd("ints", "1", "-40000", "3")
+	s.SetAdd("bigints", "1", "9223372036854775807")
+	s.SetAdd("notints", "1", "01", "x")
+	s.DB(7).SetAdd("other", "y")
+	var many []string
+	for i := 0; i < 1000; i++ {
+		many = append(many, strconv.Itoa(i))
+	}
+	s.SetAdd("many", many...)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.SetTime(now)
+	ok(t, s.SetTTL("short", time.Minute))
+	s.Push("expired", "x")
+	ok(t, s.SetTTL("expired", time.Second))
+
+	var buf bytes.Buffer
+	ok(t, writeRDB(&buf, s.dbs))
+
+	s2 := NewRediQueue()
+	dbs, err := readRDB(&buf, &s2.Mutex, now.Add(time.Second))
+	ok(t, err)
+	s2.dbs = dbs
+	s2.SetTime(now)
+	s2.setAOF(nil)
+	equals(t, time.Minute, s2.TTL("short"))
+	assert(t, !s2.Exists("expired"), "expired key loaded")
+	s2.CheckList(t, "long", long...)
+	s2.CheckList(t, "short", "a", "", "c")
+	s2.CheckGet(t, "str", "hello")
+	s2.CheckGet(t, "emptystr", "")
+	s2.CheckHash(t, "hash", map[string]string{"a": "1", "b": ""})
+	z, err := s2.SortedSet("zset")
+	ok(t, err)
+	equals(t, map[string]float64{"a": 0.1, "b": math.Inf(1), "c": math.Inf(-1)}, z)
+	entries, err := s2.Stream("stream")
+	ok(t, err)
+	equals(t, stream, entries)
+	entries, err = s2.Stream("emptystream")
+	ok(t, err)
+	equals(t, 0, len(entries))
+	equals(t, streamID{9, 9}, s2.dbs[0].streamKeys["emptystream"].lastID)
+	g := s2.dbs[0].streamKeys["stream"].groups["g"]
+	equals(t, streamID{2000, 3}, g.lastID)
+	equals(t, []string{"busy", "idle"}, g.consumerNames())
+	equals(t, time.Unix(1000, 0), g.consumers["idle"].seen)
+	equals(t, 2, len(g.consumerPending("busy")))
+	equals(t, streamPending{
+		id:        streamID{2000, 3},
+		consumer:  "busy",
+		delivered: time.Unix(2000, 0),
+		count:     3,
+	}, g.pending[1])
+	s2.CheckSet(t, "ints", "1", "-40000", "3")
+	s2.CheckSet(t, "bigints", "1", "9223372036854775807")
+	s2.CheckSet(t, "notints", "1", "01", "x")
+	s2.CheckSet(t, "many", many...)
+	equals(t, []string{"other"}, s2.DB(7).Keys())
+}
+
+func TestRDBLoadSave(t *testing.T) {
+	// Load() recognizes RDB files.
+	s := NewRediQueue()
+	ok(t, s.loadFile("testdata/rdb/regular_set.rdb"))
+	s.CheckSet(t, "regular_set", "alpha", "beta", "delta", "gamma", "kappa", "phi")
+
+	f, err := ParseSnapshotFormat("RDB")
+	ok(t, err)
+	equals(t, SnapshotRDB, f)
+	_, err = ParseSnapshotFormat("foo")
+	assert(t, err != nil, "no error")
+}
@@ -0,0 +1,138 @@
+package rediqueue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// CorruptError is returned when a snapshot, RDB, or append-only file can't be
+// read.
+type CorruptError struct {
+	File   string // empty if not read from a file
+	Offset int64  // where the problem is. For an append-only file everything before it is fine.
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("%s: %v at offset %d", e.File, e.Err, e.Offset)
+}
+
+// Recovery says what to do with damaged files on start.
+type Recovery int
+
+const (
+	// RecoverNone refuses to start. This is the default.
+	RecoverNone Recovery = iota
+	// RecoverTruncate loads the valid part of the append-only file, and cuts
+	// off the rest. A damaged snapshot is still an error.
+	RecoverTruncate
+	// RecoverMoveAside loads the valid part of the append-only file, renames
+	// the damaged file to <name>.corrupt-<unix time>, and writes a new one.
+	// A damaged snapshot is renamed the same way, and not loaded.
+	RecoverMoveAside
+)
+
+// ParseRecovery parses "none", "truncate", or "move".
+func ParseRecovery(s string) (Recovery, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return RecoverNone, nil
+	case "truncate":
+		return RecoverTruncate, nil
+	case "move":
+		return RecoverMoveAside, nil
+	default:
+		return 0, fmt.Errorf("invalid recovery mode: %q", s)
+	}
+}
+
+// SetRecovery sets what Load() and Start() do with damaged files.
+func (m *RediQueue) SetRecovery(r Recovery) {
+	m.Lock()
+	defer m.Unlock()
+	m.recovery = r
+}
+
+// moveAside renames a damaged file out of the way.
+func moveAside(filename string) error {
+	bad := fmt.Sprintf("%s.corrupt-%d", filename, time.Now().Unix())
+	if err := os.Rename(filename, bad); err != nil {
+		return err
+	}
+	log.Printf("rediqueue: moved %s to %s", filename, bad)
+	return nil
+}
+
+// CheckFile validates a snapshot, RDB, or append-only file without using it.
+// key is needed for encrypted snapshots. It returns a short description of
+// the content. If the file is damaged the error is a *CorruptError.
+func CheckFile(filename string, key []byte) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var (
+		r = bufio.NewReader(f)
+		m = NewRediQueue()
+	)
+	m.Lock()
+	defer m.Unlock()
+	if magic, _ := r.Peek(len(snapshotMagic)); string(magic) == snapshotMagic || strings.HasPrefix(string(magic), rdbMagic) {
+		dbs, err := readAnySnapshot(r, nil, time.Time{}, key)
+		if err != nil {
+			err.(*CorruptError).File = filename
+			return "", err
+		}
+		keys := 0
+		for _, db := range dbs {
+			keys += len(db.keys)
+		}
+		kind := "snapshot"
+		if strings.HasPrefix(string(magic), rdbMagic) {
+			kind = "RDB file"
+		}
+		return fmt.Sprintf("%s: %d keys in %d databases", kind, keys, len(dbs)), nil
+	}
+
+	n, err := m.readAOF(r)
+	if err != nil {
+		err.(*CorruptError).File = filename
+		return "", err
+	}
+	return fmt.Sprintf("append-only file: %d commands", n), nil
+}
+
+// readAOF replays an append-only file, and returns the number of commands.
+// Errors are a *CorruptError. Needs the lock.
+func (m *RediQueue) readAOF(src io.Reader) (int, error) {
+	var (
+		r      = bufio.NewReader(src)
+		db     = m.db(0)
+		offset int64
+		count  int
+	)
+	for {
+		args, n, err := readAOFCommand(r)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, &CorruptError{Offset: offset, Err: err}
+		}
+		if db, err = m.applyAOF(db, args); err != nil {
+			return count, &CorruptError{Offset: offset, Err: err}
+		}
+		offset += n
+		count++
+	}
+}
@@ -0,0 +1,162 @@
+package rediqueue
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Damaged files give an error, never a panic.
+func TestCorruptFiles(t *testing.T) {
+	s := NewRediQueue()
+	s.Push("queue", "one", "two", "three")
+	s.SetAdd("ints", "1", "2", "3")
+	s.SetAdd("seen", "a", "b")
+	s.DB(2).Push("other", "x")
+
+	var snap, sealed, rdb, aof bytes.Buffer
+	ok(t, writeSnapshot(&snap, s.dbs, snapshotOptions{}))
+	key := bytes.Repeat([]byte{1}, 16)
+	ok(t, writeSnapshot(&sealed, s.dbs, snapshotOptions{compression: CompressGzip, key: key}))
+	ok(t, writeRDB(&rdb, s.dbs))
+	w := bufio.NewWriter(&aof)
+	writeAOFState(w, s.dbs)
+	ok(t, w.Flush())
+
+	damaged := func(b []byte) [][]byte {
+		var res [][]byte
+		for i := 0; i < len(b); i++ {
+			res = append(res, b[:i])
+			flipped := append([]byte{}, b...)
+			flipped[i] ^= 0xFF
+			res = append(res, flipped)
+		}
+		return res
+	}
+	for _, b := range damaged(snap.Bytes()) {
+		if _, err := readSnapshot(bytes.NewReader(b), nil, nil); err != nil {
+			_ = err.(*CorruptError)
+		}
+	}
+	for _, b := range damaged(sealed.Bytes()) {
+		_, err := readSnapshot(bytes.NewReader(b), nil, key)
+		_ = err.(*CorruptError)
+	}
+	for _, b := range damaged(rdb.Bytes()) {
+		if _, err := readRDB(bytes.NewReader(b), nil, time.Now()); err != nil {
+			_ = err.(*CorruptError)
+		}
+	}
+	for _, b := range damaged(aof.Bytes()) {
+		m := NewRediQueue()
+		if _, err := m.readAOF(bytes.NewReader(b)); err != nil {
+			_ = err.(*CorruptError)
+		}
+	}
+}
+
+func TestAOFRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "appendonly.aof")
+
+	good := append(respCommand("RPUSH", "queue", "a"), respCommand("RPUSH", "queue", "b")...)
+	bad := append(good, respCommand("RPUSH", "queue", "c")[:10]...)
+
+	// Refuse by default.
+	ok(t, ioutil.WriteFile(filename, bad, 0666))
+	s := NewRediQueue()
+	s.SetAppendOnly(filename, FsyncNo)
+	err = s.Start()
+	assert(t, err != nil, "no error")
+	ce, isCorrupt := err.(*CorruptError)
+	assert(t, isCorrupt, "not a CorruptError: %v", err)
+	equals(t, int64(len(good)), ce.Offset)
+	equals(t, filename, ce.File)
+
+	// Truncate
+	s = NewRediQueue()
+	s.SetAppendOnly(filename, FsyncNo)
+	s.SetRecovery(RecoverTruncate)
+	ok(t, s.Start())
+	s.CheckList(t, "queue", "a", "b")
+	s.Push("queue", "d")
+	s.Close()
+	s = NewRediQueue()
+	s.SetAppendOnly(filename, FsyncNo)
+	ok(t, s.Start())
+	s.CheckList(t, "queue", "a", "b", "d")
+	s.Close()
+
+	// Move aside
+	ok(t, ioutil.WriteFile(filename, bad, 0666))
+	s = NewRediQueue()
+	s.SetAppendOnly(filename, FsyncNo)
+	s.SetRecovery(RecoverMoveAside)
+	ok(t, s.Start())
+	s.CheckList(t, "queue", "a", "b")
+	s.Close()
+	files, err := filepath.Glob(filename + ".corrupt-*")
+	ok(t, err)
+	equals(t, 1, len(files))
+	moved, err := ioutil.ReadFile(files[0])
+	ok(t, err)
+	equals(t, bad, moved)
+	_, err = CheckFile(filename, nil)
+	ok(t, err)
+}
+
+func TestSnapshotRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dump.rdb")
+	ok(t, ioutil.WriteFile(filename, []byte(snapshotMagic+"garbage"), 0666))
+
+	s := NewRediQueue()
+	s.SetDir(dir)
+	s.SetRecovery(RecoverTruncate)
+	err = s.Load()
+	_, isCorrupt := err.(*CorruptError)
+	assert(t, isCorrupt, "not a CorruptError: %v", err)
+
+	s.SetRecovery(RecoverMoveAside)
+	ok(t, s.Load())
+	equals(t, 0, len(s.dbs))
+	_, err = os.Stat(filename)
+	assert(t, os.IsNotExist(err), "file not moved")
+}
+
+func TestCheckFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewRediQueue()
+	s.Push("queue", "one")
+	s.DB(2).SetAdd("seen", "a")
+	snap := filepath.Join(dir, "dump.rdb")
+	ok(t, s.saveFile(snap))
+	v, err := CheckFile(snap, nil)
+	ok(t, err)
+	equals(t, "snapshot: 2 keys in 2 databases", v)
+
+	v, err = CheckFile("testdata/rdb/regular_set.rdb", nil)
+	ok(t, err)
+	equals(t, "RDB file: 1 keys in 1 databases", v)
+
+	aof := filepath.Join(dir, "appendonly.aof")
+	ok(t, ioutil.WriteFile(aof, append(respCommand("RPUSH", "q", "a"), "*1\r\n$3\r\nFOO\r\n"...), 0666))
+	_, err = CheckFile(aof, nil)
+	assert(t, err != nil, "no error")
+	assert(t, strings.Contains(err.Error(), "at offset 29"), "wrong error: %v", err)
+
+	_, err = CheckFile(filepath.Join(dir, "nosuch"), nil)
+	assert(t, err != nil, "no error")
+}
@@ -15,10 +15,7 @@
 package rediqueue
 
 import (
-	"encoding/gob"
 	"fmt"
-	"log"
-	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -32,12 +29,22 @@ type setKey map[string]struct{}
 
 // RedisDB holds a single (numbered) Redis database.
 type RedisDB struct {
-	master     *sync.Mutex        // pointer to the lock in RediQueue
-	id         int                // db id
-	keys       map[string]string  // Master map of keys with their type
-	listKeys   map[string]listKey // LPUSH &c. keys
-	setKeys    map[string]setKey  // SADD &c. keys
-	keyVersion map[string]uint    // used to watch values
+	master       *sync.Mutex                     // pointer to the lock in RediQueue
+	id           int                             // db id
+	keys         map[string]string               // Master map of keys with their type
+	stringKeys   map[string]string               // GET/SET &c. keys
+	hashKeys     map[string]hashKey              // HGET/HSET &c. keys
+	listKeys     map[string]listKey              // LPUSH &c. keys
+	setKeys      map[string]setKey               // SADD &c. keys
+	zsetKeys     map[string]*sortedSet           // ZADD &c. keys
+	streamKeys   map[string]*streamKey           // XADD &c. keys
+	expire       map[string]time.Time            // keys with a TTL expire at this time
+	memberExpire map[string]map[string]time.Time // set members with a TTL, by key
+	memberNext   map[string]time.Time            // earliest member TTL per key, or earlier
+	keyVersion   map[string]uint                 // used to watch values
+	now          func() time.Time                // current time for TTLs. Nothing expires if nil.
+	aof          *appendOnly                     // changes are logged here, if set
+	dirty        *int                            // changes are counted here, if set
 }
 
 // RediQueue is a Redis server implementation.
@@ -49,7 +56,39 @@ type RediQueue struct {
 	dbs        map[int]*RedisDB
 	selectedDB int // DB id used in the direct Get(), Set() &c.
 	signal     *sync.Cond
-	now        time.Time // used to make a duration from EXPIREAT. time.Now() if not set.
+	clock      Clock       // see SetClock()
+	now        time.Time   // used for TTLs. The clock's time if not set.
+	aofFile    string      // append-only file, if enabled
+	aofPolicy  FsyncPolicy // fsync policy for aofFile
+	aofLoaded  bool        // aofFile has been replayed
+	aof        *appendOnly // the open aofFile, while running
+
+	aofRewritePct int   // auto-aof-rewrite-percentage
+	aofRewriteMin int64 // auto-aof-rewrite-min-size
+
+	snapshotFormat      SnapshotFormat // what Save() writes
+	snapshotCompression Compression    // how Save() compresses
+	snapshotKey         []byte         // encrypts snapshots, if set
+
+	recovery   Recovery // what to do with damaged files
+	dir        string   // data directory. Working directory if empty.
+	dbFilename string   // snapshot file in dir
+
+	dirty     int           // changes since the last save
+	lastSave  time.Time     // last successful save
+	saveRules []SaveRule    // when to BGSAVE
+	saving    bool          // BGSAVE running
+	saveErr   error         // result of the last BGSAVE
+	saveTry   time.Time     // start of the last BGSAVE
+	saveStop  chan struct{} // stops the save rule checker
+	sweepStop chan struct{} // stops the expired key sweeper
+
+	blocked   []*blockedClient // clients in blocking(), oldest first
+	changeGen uint64           // bumped by wakeBlocked()
+
+	shutdown    bool          // shutting down, blocked clients give up
+	done        chan struct{} // closed when the server stops
+	shutdownErr error         // result of Shutdown()
 }
 
 type txCmd func(*server.Peer, *connCtx)
@@ -72,7 +111,12 @@ type connCtx struct {
 // NewRediQueue makes a new, non-started, RediQueue object.
 func NewRediQueue() *RediQueue {
 	m := RediQueue{
-		dbs: map[int]*RedisDB{},
+		dbs:           map[int]*RedisDB{},
+		aofRewritePct: 100,
+		aofRewriteMin: 64 << 20,
+		dbFilename:    "dump.rdb",
+		clock:         realClock{},
+		lastSave:      time.Now(),
 	}
 	m.signal = sync.NewCond(&m)
 	return &m
@@ -80,81 +124,57 @@ func NewRediQueue() *RediQueue {
 
 func newRedisDB(id int, l *sync.Mutex) RedisDB {
 	return RedisDB{
-		id:         id,
-		master:     l,
-		keys:       map[string]string{},
-		listKeys:   map[string]listKey{},
-		setKeys:    map[string]setKey{},
-		keyVersion: map[string]uint{},
+		id:           id,
+		master:       l,
+		keys:         map[string]string{},
+		stringKeys:   map[string]string{},
+		hashKeys:     map[string]hashKey{},
+		listKeys:     map[string]listKey{},
+		setKeys:      map[string]setKey{},
+		zsetKeys:     map[string]*sortedSet{},
+		streamKeys:   map[string]*streamKey{},
+		expire:       map[string]time.Time{},
+		memberExpire: map[string]map[string]time.Time{},
+		memberNext:   map[string]time.Time{},
+		keyVersion:   map[string]uint{},
 	}
 }
 
 // Run creates and Start()s a RediQueue.
-func Run(bgsave bool) (*RediQueue, error) {
-
+func Run() (*RediQueue, error) {
 	m := NewRediQueue()
 	return m, m.Start()
 }
 
+// RunAddr creates a RediQueue and RunAddr()s it.
 func RunAddr(addr string, saveDuration int) (*RediQueue, error) {
-
 	m := NewRediQueue()
-	m.Load()
-
-	if saveDuration > 0 {
-
-		go func() {
-
-			for {
-				select {
-				case <-time.After(time.Duration(saveDuration) * time.Minute):
-					log.Println("rediqueue save...")
-					m.Save()
-				}
-			}
-		}()
-	}
-
-	return m, m.StartAddr(addr)
+	return m, m.RunAddr(addr, saveDuration)
 }
 
-func (m *RediQueue) Load() {
-
-	dump, err := os.OpenFile("./dump.rdb", os.O_RDONLY, 0666)
-
-	if err != nil {
-
-		if os.IsNotExist(err) {
-			return
-		}
-
-		panic("Error load... " + err.Error())
+// RunAddr loads the snapshot file and the append-only file (if enabled), and
+// starts the server on addr. With saveDuration > 0 the snapshot is written
+// every saveDuration minutes, if anything changed. See also SetSaveRules().
+func (m *RediQueue) RunAddr(addr string, saveDuration int) error {
+	if err := m.Load(); err != nil {
+		return err
 	}
 
-	defer dump.Close()
-
-	gob.NewDecoder(dump).Decode(&m.dbs)
-}
-
-func (m *RediQueue) Save() {
-
-	m.Lock()
-	defer m.Unlock()
-
-	dump, err := os.OpenFile("./dump.rdb", os.O_WRONLY|os.O_CREATE, 0666)
-
-	if err != nil {
-		panic("Error bgsave... " + err.Error())
+	if saveDuration > 0 {
+		m.Lock()
+		m.saveRules = append(m.saveRules, SaveRule{Seconds: saveDuration * 60, Changes: 1})
+		m.Unlock()
 	}
 
-	defer dump.Close()
-
-	gob.NewEncoder(dump).Encode(m.dbs)
+	return m.StartAddr(addr)
 }
 
 // Start starts a server. It listens on a random port on localhost. See also
 // Addr().
 func (m *RediQueue) Start() error {
+	if err := m.startPersistence(); err != nil {
+		return err
+	}
 
 	s, err := server.NewServer(fmt.Sprintf("127.0.0.1:%d", m.port))
 
@@ -168,6 +188,9 @@ func (m *RediQueue) Start() error {
 // StartAddr runs rediqueue with a given addr. Examples: "127.0.0.1:6379",
 // ":6379", or "127.0.0.1:0"
 func (m *RediQueue) StartAddr(addr string) error {
+	if err := m.startPersistence(); err != nil {
+		return err
+	}
 	s, err := server.NewServer(addr)
 	if err != nil {
 		return err
@@ -175,6 +198,17 @@ func (m *RediQueue) StartAddr(addr string) error {
 	return m.start(s)
 }
 
+// startPersistence checks the data directory and opens the append-only file.
+func (m *RediQueue) startPersistence() error {
+	m.Lock()
+	err := m.checkDir()
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+	return m.startAOF()
+}
+
 func (m *RediQueue) start(s *server.Server) error {
 
 	m.Lock()
@@ -182,14 +216,26 @@ func (m *RediQueue) start(s *server.Server) error {
 
 	m.srv = s
 	m.port = s.Addr().Port
+	m.shutdown = false
+	m.done = make(chan struct{})
+	m.shutdownErr = nil
 
 	commandsConnection(m)
 	commandsGeneric(m)
 	commandsServer(m)
 	commandsList(m)
 	commandsSet(m)
+	commandsString(m)
+	commandsHash(m)
+	commandsSortedSet(m)
+	commandsStream(m)
+	commandsHLL(m)
+	commandsGeo(m)
 	commandsTransaction(m)
 
+	m.startSaver()
+	m.startSweeper()
+
 	return nil
 }
 
@@ -208,6 +254,77 @@ func (m *RediQueue) Close() {
 	}
 	m.srv.Close()
 	m.srv = nil
+	m.stopSaver()
+	m.stopSweeper()
+	m.stopAOF()
+	close(m.done)
+}
+
+// ShutdownMode says whether Shutdown() saves the snapshot file.
+type ShutdownMode int
+
+const (
+	// ShutdownDefault saves if there are save rules. See SetSaveRules().
+	ShutdownDefault ShutdownMode = iota
+	// ShutdownSave always saves.
+	ShutdownSave
+	// ShutdownNoSave never saves.
+	ShutdownNoSave
+)
+
+// Shutdown stops the server gracefully: no new connections are accepted,
+// clients blocked in BLPOP &c. get a nil reply, and running commands are
+// finished. Then the snapshot is saved (depending on mode), and the
+// append-only file is flushed and closed. The server is stopped even if that
+// fails; the error is returned, and by Wait().
+func (m *RediQueue) Shutdown(mode ShutdownMode) error {
+	m.Lock()
+	srv := m.srv
+	if srv == nil || m.shutdown {
+		m.Unlock()
+		return m.Wait()
+	}
+	m.shutdown = true
+	m.signal.Broadcast()
+	m.Unlock()
+
+	srv.Drain()
+
+	m.Lock()
+	defer m.Unlock()
+	var err error
+	if mode == ShutdownSave || (mode == ShutdownDefault && len(m.saveRules) > 0) {
+		for m.saving {
+			m.signal.Wait()
+		}
+		if e := m.save(); e != nil {
+			err = fmt.Errorf("save: %v", e)
+		}
+	}
+	if e := m.stopAOF(); e != nil && err == nil {
+		err = fmt.Errorf("append-only file: %v", e)
+	}
+	m.srv = nil
+	m.stopSaver()
+	m.stopSweeper()
+	m.shutdownErr = err
+	close(m.done)
+	return err
+}
+
+// Wait blocks until the server is stopped by Close(), Shutdown(), or the
+// SHUTDOWN command. It returns the error from Shutdown(), if any.
+func (m *RediQueue) Wait() error {
+	m.Lock()
+	done := m.done
+	m.Unlock()
+	if done == nil {
+		return nil
+	}
+	<-done
+	m.Lock()
+	defer m.Unlock()
+	return m.shutdownErr
 }
 
 // RequireAuth makes every connection need to AUTH first. Disable again by
@@ -231,10 +348,22 @@ func (m *RediQueue) db(i int) *RedisDB {
 		return db
 	}
 	db := newRedisDB(i, &m.Mutex) // the DB has our lock.
+	db.aof = m.aof
+	db.dirty = &m.dirty
+	db.now = m.effectiveNow
 	m.dbs[i] = &db
 	return &db
 }
 
+// effectiveNow is the time set with SetTime(), or the clock's time. Needs the
+// lock.
+func (m *RediQueue) effectiveNow() time.Time {
+	if m.now.IsZero() {
+		return m.clock.Now()
+	}
+	return m.now
+}
+
 // Addr returns '127.0.0.1:12345'. Can be given to a Dial(). See also Host()
 // and Port(), which return the same things.
 func (m *RediQueue) Addr() string {
@@ -301,6 +430,12 @@ func (m *RediQueue) Dump() string {
 		r += fmt.Sprintf("- %s\n", k)
 		t := db.t(k)
 		switch t {
+		case "string":
+			r += fmt.Sprintf("%s%s\n", indent, v(db.stringKeys[k]))
+		case "hash":
+			for _, f := range db.hashFields(k) {
+				r += fmt.Sprintf("%s%s: %s\n", indent, f, v(db.hashKeys[k][f]))
+			}
 		case "list":
 			for _, lk := range db.listKeys[k] {
 				r += fmt.Sprintf("%s%s\n", indent, v(lk))
@@ -309,6 +444,17 @@ func (m *RediQueue) Dump() string {
 			for _, mk := range db.setMembers(k) {
 				r += fmt.Sprintf("%s%s\n", indent, v(mk))
 			}
+		case "zset":
+			for _, e := range db.zsetKeys[k].elems() {
+				r += fmt.Sprintf("%s%s: %s\n", indent, formatFloat(e.score), v(e.member))
+			}
+		case "stream":
+			for _, e := range db.streamKeys[k].entries {
+				r += fmt.Sprintf("%s%s\n", indent, e.id)
+				for i := 0; i+1 < len(e.values); i += 2 {
+					r += fmt.Sprintf("%s%s%s: %s\n", indent, indent, e.values[i], v(e.values[i+1]))
+				}
+			}
 		default:
 			r += fmt.Sprintf("%s(a %s, fixme!)\n", indent, t)
 		}
@@ -316,8 +462,8 @@ func (m *RediQueue) Dump() string {
 	return r
 }
 
-// SetTime sets the time against which EXPIREAT values are compared. EXPIREAT
-// will use time.Now() if this is not set.
+// SetTime sets the time against which TTLs are compared, and from which EXPIRE
+// counts. The clock's time is used if this is not set, see SetClock().
 func (m *RediQueue) SetTime(t time.Time) {
 	m.Lock()
 	defer m.Unlock()
@@ -1,35 +1,166 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/chinahdkj/rediqueue"
 )
 
+// keyEnv has the snapshot key, if there is no -keyfile.
+const keyEnv = "REDIQUEUE_SNAPSHOT_KEY"
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(check(os.Args[2:]))
+	}
+
+	var (
+		dir         = flag.String("dir", ".", "data directory for the snapshot and the append-only file")
+		dbFilename  = flag.String("dbfilename", "dump.rdb", "snapshot file name in the data directory")
+		appendOnly  = flag.String("appendonly", "", "append-only file, relative to -dir. Disabled if empty")
+		appendFsync = flag.String("appendfsync", "everysec", "fsync policy for the append-only file: always, everysec, or no")
+		rewritePct  = flag.Int("auto-aof-rewrite-percentage", 100, "rewrite the append-only file after it grew this much. 0 disables")
+		rewriteMin  = flag.Int64("auto-aof-rewrite-min-size", 64<<20, "minimum size in bytes for an automatic rewrite")
+		format      = flag.String("format", "native", "snapshot file format: native, or rdb to write files redis-server can load")
+		save        = flag.String("save", "3600 1 300 100 60 10000", "save rules as <seconds> <changes> pairs. Disabled if empty")
+		compress    = flag.String("compress", "none", "snapshot compression: none, gzip, or flate")
+		keyFile     = flag.String("keyfile", "", "file with a key (hex or base64) to encrypt snapshots. Default is $"+keyEnv)
+		recovery    = flag.String("recover", "none", "damaged files on start: none to refuse, truncate to cut off a damaged append-only file, or move to rename damaged files")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [addr]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check [-keyfile file] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	addr := ":6300"
 
-	if len(os.Args) > 1 {
-		addr = os.Args[1]
+	if flag.NArg() > 0 {
+		addr = flag.Arg(0)
+	}
+
+	policy, err := rediqueue.ParseFsyncPolicy(*appendFsync)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	snapshotFormat, err := rediqueue.ParseSnapshotFormat(*format)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	saveRules, err := rediqueue.ParseSaveRules(*save)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	recoveryMode, err := rediqueue.ParseRecovery(*recovery)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	compression, err := rediqueue.ParseCompression(*compress)
+
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	m, err := rediqueue.RunAddr(addr, 10)
+	key, err := snapshotKey(*keyFile)
 
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+
+	m := rediqueue.NewRediQueue()
+	m.SetRecovery(recoveryMode)
+	m.SetDir(*dir)
+	m.SetDBFilename(*dbFilename)
+	m.SetSnapshotFormat(snapshotFormat)
+	m.SetSnapshotCompression(compression)
+
+	if err := m.SetSnapshotKey(key); err != nil {
+		log.Fatal(err)
+	}
+
+	m.SetAppendOnly(*appendOnly, policy)
+	m.SetAutoAOFRewrite(*rewritePct, *rewriteMin)
+	m.SetSaveRules(saveRules...)
+
+	if err := m.RunAddr(addr, 0); err != nil {
+		log.Fatal(err)
 	}
 
 	fmt.Println("rediqueue at " + addr)
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-c
+		log.Printf("rediqueue: %v, shutting down...", sig)
+		m.Shutdown(rediqueue.ShutdownSave)
+	}()
+
+	// Also returns after a SHUTDOWN command.
+	if err := m.Wait(); err != nil {
+		log.Printf("rediqueue: shutdown failed: %v", err)
+		os.Exit(1)
+	}
+
+	log.Println("rediqueue: shut down")
+}
 
-	log.Println("rediqueue on exiting...")
+// snapshotKey reads the key from filename, or from the environment. nil if
+// there is none.
+func snapshotKey(filename string) ([]byte, error) {
+	if filename != "" {
+		return rediqueue.ReadSnapshotKeyFile(filename)
+	}
+	if k := os.Getenv(keyEnv); k != "" {
+		return rediqueue.ParseSnapshotKey(k)
+	}
+	return nil, nil
+}
 
-	m.Save()
+// check validates snapshot and append-only files. Returns the exit status.
+func check(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	keyFile := fs.String("keyfile", "", "file with the key for encrypted snapshots. Default is $"+keyEnv)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s check [flags] file...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	files := fs.Args()
+	if len(files) == 0 {
+		fs.Usage()
+		return 2
+	}
+	key, err := snapshotKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	status := 0
+	for _, f := range files {
+		desc, err := rediqueue.CheckFile(f, key)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: ok, %s\n", f, desc)
+	}
+	return status
 }
@@ -97,6 +97,22 @@ func TestDumpList(t *testing.T) {
 	}
 }
 
+func TestDumpStream(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	s.XAdd("planets", "1-0", "name", "earth", "moons", "1")
+	s.XAdd("planets", "2-0", "name", "mars")
+	if have, want := s.Dump(), `- planets
+   1-0
+      name: "earth"
+      moons: "1"
+   2-0
+      name: "mars"
+`; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+}
+
 func TestDumpSet(t *testing.T) {
 	s, err := Run()
 	ok(t, err)
@@ -11,27 +11,95 @@ import (
 )
 
 const (
-	msgWrongType         = "WRONGTYPE Operation against a key holding the wrong kind of value"
-	msgInvalidInt        = "ERR value is not an integer or out of range"
-	msgInvalidFloat      = "ERR value is not a valid float"
-	msgInvalidMinMax     = "ERR min or max is not a float"
-	msgInvalidRangeItem  = "ERR min or max not valid string range item"
-	msgInvalidTimeout    = "ERR timeout is not an integer or out of range"
-	msgSyntaxError       = "ERR syntax error"
-	msgKeyNotFound       = "ERR no such key"
-	msgOutOfRange        = "ERR index out of range"
-	msgInvalidCursor     = "ERR invalid cursor"
-	msgXXandNX           = "ERR XX and NX options at the same time are not compatible"
-	msgNegTimeout        = "ERR timeout is negative"
-	msgInvalidSETime     = "ERR invalid expire time in set"
-	msgInvalidSETEXTime  = "ERR invalid expire time in setex"
-	msgInvalidPSETEXTime = "ERR invalid expire time in psetex"
+	msgWrongType           = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	msgInvalidInt          = "ERR value is not an integer or out of range"
+	msgInvalidFloat        = "ERR value is not a valid float"
+	msgInvalidMinMax       = "ERR min or max is not a float"
+	msgInvalidRangeItem    = "ERR min or max not valid string range item"
+	msgInvalidTimeout      = "ERR timeout is not an integer or out of range"
+	msgSyntaxError         = "ERR syntax error"
+	msgKeyNotFound         = "ERR no such key"
+	msgOutOfRange          = "ERR index out of range"
+	msgInvalidCursor       = "ERR invalid cursor"
+	msgXXandNX             = "ERR XX and NX options at the same time are not compatible"
+	msgNegTimeout          = "ERR timeout is negative"
+	msgInvalidSETime       = "ERR invalid expire time in set"
+	msgInvalidSETEXTime    = "ERR invalid expire time in setex"
+	msgInvalidPSETEXTime   = "ERR invalid expire time in psetex"
+	msgIncrOverflow        = "ERR increment or decrement would overflow"
+	msgIncrNaNOrInf        = "ERR increment would produce NaN or Infinity"
+	msgOffsetOutOfRange    = "ERR offset is out of range"
+	msgHashNotInt          = "ERR hash value is not an integer"
+	msgHashNotFloat        = "ERR hash value is not a float"
+	msgGTLTandNX           = "ERR GT, LT, and/or NX options at the same time are not compatible"
+	msgSingleElementPair   = "ERR INCR option supports a single increment-element pair"
+	msgScoreNaN            = "ERR resulting score is not a number (NaN)"
+	msgWeightNotFloat      = "ERR weight value is not a float"
+	msgMustBePositive      = "ERR value is out of range, must be positive"
+	msgInvalidStreamID     = "ERR Invalid stream ID specified as stream command argument"
+	msgStreamIDTooSmall    = "ERR The ID specified in XADD is equal or smaller than the target stream top item"
+	msgStreamIDZero        = "ERR The ID specified in XADD must be greater than 0-0"
+	msgStreamExhausted     = "ERR The stream has exhausted the last possible ID, unable to add more items"
+	msgStreamMaxlenNeg     = "ERR The MAXLEN argument must be >= 0."
+	msgStreamLimitNeg      = "ERR The LIMIT argument must be >= 0."
+	msgStreamLimitExact    = "ERR syntax error, LIMIT cannot be used without the special ~ option"
+	msgInvalidStartID      = "ERR invalid start ID for the interval"
+	msgStreamSetIDTooSmall = "ERR The ID specified in XSETID is smaller than the target stream top item"
+	msgInvalidEndID        = "ERR invalid end ID for the interval"
+	msgXgroupKeyNotFound   = "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."
+	msgXgroupBusy          = "BUSYGROUP Consumer Group name already exists"
+	msgXreadgroupDollar    = "ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set."
+	msgXreadGT             = "ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option."
+	msgXclaimMinIdle       = "ERR Invalid min-idle-time argument for XCLAIM"
+	msgCountPositive       = "ERR COUNT must be > 0"
+	msgDumpMemberTTL       = "ERR DUMP payloads can't store set member TTLs"
+	msgNotHLL              = "WRONGTYPE Key is not a valid HyperLogLog string value."
+	msgInvalidHLL          = "INVALIDOBJ Corrupted HLL object detected"
+	msgBitOffset           = "ERR bit offset is not an integer or out of range"
+	msgBitValue            = "ERR bit is not an integer or out of range"
+	msgBitposBit           = "ERR The bit argument must be 1 or 0."
+	msgBitopNot            = "ERR BITOP NOT must be called with a single source key."
+	msgBitfieldType        = "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+	msgBitfieldOverflow    = "ERR Invalid OVERFLOW type specified"
+	msgBitfieldRO          = "ERR BITFIELD_RO only supports the GET subcommand"
+	msgGeoUnit             = "ERR unsupported unit provided. please use M, KM, FT, MI"
+	msgGeoRadiusNeg        = "ERR radius cannot be negative"
+	msgGeoBoxNeg           = "ERR height or width cannot be negative"
+	msgGeoAny              = "ERR the ANY argument requires COUNT argument"
+	msgGeoMember           = "ERR could not decode requested zset member"
+	msgGeoFrom             = "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH"
+	msgGeoBy               = "ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH"
+	msgRankZero            = "ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"
+	msgCountNegative       = "ERR COUNT can't be negative"
+	msgMaxlenNegative      = "ERR MAXLEN can't be negative"
+	msgNumkeys             = "ERR numkeys should be greater than 0"
+	msgCountZero           = "ERR count should be greater than 0"
 )
 
 func errWrongNumber(cmd string) string {
 	return fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
 }
 
+func errInvalidExpire(cmd string) string {
+	return fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(cmd))
+}
+
+func errNoGroup(key, group string) string {
+	return fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+}
+
+func errNoGroupForKey(key, group string) string {
+	return fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)
+}
+
+func errInvalidLonLat(lon, lat float64) string {
+	return fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", lon, lat)
+}
+
+func errGeoStore(what string) string {
+	return fmt.Sprintf("ERR %s is not compatible with WITHDIST, WITHHASH and WITHCOORD options", what)
+}
+
 // withTx wraps the non-argument-checking part of command handling code in
 // transaction logic.
 func withTx(
@@ -48,15 +116,57 @@ func withTx(
 	m.Lock()
 	cb(c, ctx)
 	// done, wake up anyone who waits on anything.
-	m.signal.Broadcast()
+	m.wakeBlocked()
 	m.Unlock()
 }
 
+// blockedClient is a client waiting in blocking().
+type blockedClient struct {
+	tried uint64 // changeGen+1 of the last try
+}
+
+// wakeBlocked tells blocked clients something changed. They retry in the order
+// they blocked, so the client which waits longest gets the first go at a new
+// element, as in Redis. Needs the lock.
+func (m *RediQueue) wakeBlocked() {
+	m.changeGen++
+	m.signal.Broadcast()
+}
+
+// turn tells whether b should retry now: it hasn't tried since the last change,
+// and all clients which blocked before it have.
+func (m *RediQueue) turn(b *blockedClient) bool {
+	if b.tried > m.changeGen {
+		return false
+	}
+	for _, o := range m.blocked {
+		if o == b {
+			return true
+		}
+		if o.tried <= m.changeGen {
+			return false
+		}
+	}
+	return true
+}
+
+// unblock removes b, and lets the clients behind it have their turn.
+func (m *RediQueue) unblock(b *blockedClient) {
+	for i, o := range m.blocked {
+		if o == b {
+			m.blocked = append(m.blocked[:i], m.blocked[i+1:]...)
+			break
+		}
+	}
+	m.signal.Broadcast()
+}
+
 // blockCmd is executed returns whether it is done
 type blockCmd func(*server.Peer, *connCtx) bool
 
 // blocking keeps trying a command until the callback returns true. Calls
-// onTimeout after the timeout (or when we call this in a transaction).
+// onTimeout after the timeout (or when we call this in a transaction). Blocked
+// clients retry in the order they blocked, see wakeBlocked().
 func blocking(
 	m *RediQueue,
 	c *server.Peer,
@@ -66,7 +176,6 @@ func blocking(
 ) {
 	var (
 		ctx = getCtx(c)
-		dl  *time.Timer
 		dlc <-chan time.Time
 	)
 	if inTx(ctx) {
@@ -78,17 +187,29 @@ func blocking(
 		c.WriteInline("QUEUED")
 		return
 	}
-	if timeout != 0 {
-		dl = time.NewTimer(timeout)
-		defer dl.Stop()
-		dlc = dl.C
-	}
 
 	m.Lock()
 	defer m.Unlock()
+	if timeout != 0 {
+		dl := m.clock.NewTimer(timeout)
+		defer dl.Stop()
+		dlc = dl.C()
+	}
+	b := &blockedClient{}
+	m.blocked = append(m.blocked, b)
+	defer m.unblock(b)
 	for {
-		done := cb(c, ctx)
-		if done {
+		if m.turn(b) {
+			b.tried = m.changeGen + 1
+			if cb(c, ctx) {
+				// it popped or pushed something
+				m.changeGen++
+				return
+			}
+			m.signal.Broadcast() // next in line
+		}
+		if m.shutdown {
+			onTimeout(c)
 			return
 		}
 		// there is no cond.WaitTimeout(), so hence the the goroutine to wait
@@ -142,6 +263,20 @@ func formatFloat(v float64) string {
 	return sv
 }
 
+// expireAt gives the time n units of d after base. It's false when that
+// doesn't fit in a time.Duration, or in nanoseconds since the epoch.
+func expireAt(base time.Time, n int64, d time.Duration) (time.Time, bool) {
+	if n > math.MaxInt64/int64(d) || n < math.MinInt64/int64(d) {
+		return time.Time{}, false
+	}
+	ttl := time.Duration(n) * d
+	b := base.UnixNano()
+	if (ttl > 0 && b > math.MaxInt64-int64(ttl)) || (ttl < 0 && b < math.MinInt64-int64(ttl)) {
+		return time.Time{}, false
+	}
+	return base.Add(ttl), true
+}
+
 // redisRange gives Go offsets for something l long with start/end in
 // Redis semantics. Both start and end can be negative.
 // Used for string range and list range things.
@@ -168,10 +303,10 @@ func redisRange(l, start, end int, stringSymantics bool) (int, int) {
 			}
 		}
 	}
-	end++ // end argument is inclusive in Redis.
-	if end > l {
-		end = l
+	if end > l-1 {
+		end = l - 1 // also stops end++ from overflowing
 	}
+	end++ // end argument is inclusive in Redis.
 
 	if end < start {
 		return 0, 0
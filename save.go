@@ -0,0 +1,224 @@
+package rediqueue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrSaveInProgress is returned by BGSave when a background save is
+	// already running.
+	ErrSaveInProgress = errors.New("ERR Background save already in progress")
+)
+
+// saveRetry is how long we wait after a failed background save before the
+// save rules can start another one.
+const saveRetry = 5 * time.Second
+
+// SetDir sets the directory for the snapshot file and the append-only file.
+// The default is the working directory. It's checked to be writable when the
+// server starts.
+func (m *RediQueue) SetDir(dir string) {
+	m.Lock()
+	defer m.Unlock()
+	m.dir = dir
+}
+
+// SetDBFilename sets the name of the snapshot file in the data directory. The
+// default is "dump.rdb".
+func (m *RediQueue) SetDBFilename(name string) {
+	m.Lock()
+	defer m.Unlock()
+	m.dbFilename = name
+}
+
+// path gives the location of a file in the data directory. Absolute names are
+// used as-is. Needs the lock.
+func (m *RediQueue) path(name string) string {
+	if m.dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(m.dir, name)
+}
+
+// checkDir verifies that the data directory is usable. Needs the lock.
+func (m *RediQueue) checkDir() error {
+	if err := checkDBFilename(m.dbFilename); err != nil {
+		return err
+	}
+	if m.dir == "" {
+		return nil
+	}
+	return checkDir(m.dir)
+}
+
+// checkDir verifies that dir is a directory we can create files in.
+func checkDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("data directory: %v", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("data directory: %s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".rediqueue-check-")
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkDBFilename verifies the snapshot file name isn't a path.
+func checkDBFilename(name string) error {
+	if name == "" || filepath.Base(name) != name {
+		return fmt.Errorf("invalid dbfilename %q: must be a file name, not a path", name)
+	}
+	return nil
+}
+
+// SaveRule triggers a background save when at least Changes changes were
+// made, and the last save was at least Seconds seconds ago. This is the
+// `save <seconds> <changes>` config from redis.conf.
+type SaveRule struct {
+	Seconds int
+	Changes int
+}
+
+// ParseSaveRules parses rules in the redis.conf format: "3600 1 300 100".
+// An empty string gives no rules.
+func ParseSaveRules(s string) ([]SaveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rules: %q", s)
+	}
+	var rules []SaveRule
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid save rules: %q", s)
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save rules: %q", s)
+		}
+		rules = append(rules, SaveRule{Seconds: seconds, Changes: changes})
+	}
+	return rules, nil
+}
+
+// SetSaveRules replaces the rules which trigger a background save. No rules
+// (the default) disables automatic saves.
+func (m *RediQueue) SetSaveRules(rules ...SaveRule) {
+	m.Lock()
+	defer m.Unlock()
+	m.saveRules = rules
+}
+
+// LastSave returns the time of the last successful save.
+func (m *RediQueue) LastSave() time.Time {
+	m.Lock()
+	defer m.Unlock()
+	return m.lastSave
+}
+
+// Dirty returns the number of changes since the last save.
+func (m *RediQueue) Dirty() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.dirty
+}
+
+// BGSave starts writing the snapshot file in the background. Errors from the
+// background save are logged.
+func (m *RediQueue) BGSave() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.saving {
+		return ErrSaveInProgress
+	}
+	m.bgsave()
+	return nil
+}
+
+// save writes the snapshot file. Needs the lock.
+func (m *RediQueue) save() error {
+	if err := m.saveFile(m.path(m.dbFilename)); err != nil {
+		return err
+	}
+	m.dirty = 0
+	m.lastSave = m.clock.Now()
+	return nil
+}
+
+// bgsave copies all databases, and writes them in a goroutine, so the lock
+// isn't held while encoding. Needs the lock, and m.saving must be false.
+func (m *RediQueue) bgsave() {
+	var (
+		filename = m.path(m.dbFilename)
+		opts     = m.snapshotOptions()
+		dirty    = m.dirty
+		dbs      = m.copyDBs()
+	)
+	m.saving = true
+	m.saveTry = m.clock.Now()
+	go func() {
+		err := writeSnapshotFile(filename, opts, dbs)
+
+		m.Lock()
+		defer m.Unlock()
+		m.saving = false
+		m.saveErr = err
+		if err != nil {
+			log.Printf("rediqueue background save: %v", err)
+		} else {
+			m.dirty -= dirty
+			m.lastSave = m.saveTry
+		}
+		m.signal.Broadcast()
+	}()
+}
+
+// needsSave checks the save rules. Needs the lock.
+func (m *RediQueue) needsSave(now time.Time) bool {
+	if m.saving || m.dirty == 0 {
+		return false
+	}
+	if m.saveErr != nil && now.Sub(m.saveTry) < saveRetry {
+		return false
+	}
+	for _, r := range m.saveRules {
+		if m.dirty >= r.Changes && now.Sub(m.lastSave) >= time.Duration(r.Seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// startSaver starts checking the save rules every second. Needs the lock.
+func (m *RediQueue) startSaver() {
+	if m.saveStop != nil {
+		return
+	}
+	m.saveStop = make(chan struct{})
+	m.every(time.Second, m.saveStop, func(now time.Time) {
+		if m.needsSave(now) {
+			m.bgsave()
+		}
+	})
+}
+
+// stopSaver stops the save rule checker. Needs the lock.
+func (m *RediQueue) stopSaver() {
+	if m.saveStop != nil {
+		close(m.saveStop)
+		m.saveStop = nil
+	}
+}
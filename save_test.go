@@ -0,0 +1,186 @@
+package rediqueue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func waitBGSave(s *RediQueue) {
+	s.Lock()
+	defer s.Unlock()
+	for s.saving {
+		s.signal.Wait()
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewRediQueue()
+	s.SetDir(dir)
+	ok(t, s.Start())
+	defer s.Close()
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+
+	_, err = c.Do("RPUSH", "queue", "a", "b")
+	ok(t, err)
+	_, err = c.Do("SADD", "seen", "a")
+	ok(t, err)
+	equals(t, 3, s.Dirty()) // every pushed element counts
+
+	before := s.LastSave()
+	v, err := redis.String(c.Do("SAVE"))
+	ok(t, err)
+	equals(t, "OK", v)
+	equals(t, 0, s.Dirty())
+	last, err := redis.Int(c.Do("LASTSAVE"))
+	ok(t, err)
+	equals(t, int(s.LastSave().Unix()), last)
+	assert(t, !s.LastSave().Before(before), "LASTSAVE didn't move")
+
+	s2 := NewRediQueue()
+	s2.SetDir(dir)
+	ok(t, s2.Load())
+	s2.CheckList(t, "queue", "a", "b")
+
+	_, err = c.Do("LPOP", "queue")
+	ok(t, err)
+	v, err = redis.String(c.Do("BGSAVE"))
+	ok(t, err)
+	equals(t, "Background saving started", v)
+	waitBGSave(s)
+	equals(t, 0, s.Dirty())
+	ok(t, s2.Load())
+	s2.CheckList(t, "queue", "b")
+
+	// Errors
+	_, err = c.Do("SAVE", "foo")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("BGSAVE", "foo")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("LASTSAVE", "foo")
+	assert(t, err != nil, "no error")
+	s.Lock()
+	s.saving = true
+	s.Unlock()
+	_, err = c.Do("BGSAVE")
+	assert(t, err != nil, "no error")
+	equals(t, ErrSaveInProgress, s.BGSave())
+	s.Lock()
+	s.saving = false
+	s.Unlock()
+}
+
+func TestSaveRules(t *testing.T) {
+	rules, err := ParseSaveRules("3600 1 300 100")
+	ok(t, err)
+	equals(t, []SaveRule{{3600, 1}, {300, 100}}, rules)
+	rules, err = ParseSaveRules("")
+	ok(t, err)
+	equals(t, 0, len(rules))
+	for _, r := range []string{"3600", "foo 1", "0 1", "60 -1"} {
+		_, err := ParseSaveRules(r)
+		assert(t, err != nil, "no error for %q", r)
+	}
+
+	s := NewRediQueue()
+	s.SetSaveRules(SaveRule{Seconds: 60, Changes: 2})
+	now := s.LastSave()
+	s.Push("queue", "a")
+	assert(t, !s.needsSave(now.Add(time.Hour)), "saves with too few changes")
+	s.Push("queue", "b")
+	assert(t, !s.needsSave(now.Add(time.Second)), "saves too soon")
+	assert(t, s.needsSave(now.Add(time.Minute)), "doesn't save")
+
+	// Changes made during a BGSAVE still count.
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	s.SetDir(dir)
+	s.SetDBFilename("queue.rdb")
+	ok(t, s.BGSave())
+	s.Push("queue", "c")
+	waitBGSave(s)
+	equals(t, 1, s.Dirty())
+	_, err = os.Stat(filepath.Join(dir, "queue.rdb"))
+	ok(t, err)
+	s2 := NewRediQueue()
+	s2.SetDir(dir)
+	s2.SetDBFilename("queue.rdb")
+	ok(t, s2.Load())
+	s2.CheckList(t, "queue", "a", "b")
+}
+
+func TestDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	// Not there
+	s := NewRediQueue()
+	s.SetDir(filepath.Join(dir, "nosuch"))
+	assert(t, s.Start() != nil, "no error")
+
+	// Not a directory
+	file := filepath.Join(dir, "file")
+	ok(t, ioutil.WriteFile(file, nil, 0666))
+	s.SetDir(file)
+	assert(t, s.Start() != nil, "no error")
+
+	// Not a file name
+	s.SetDir(dir)
+	s.SetDBFilename("../dump.rdb")
+	assert(t, s.Start() != nil, "no error")
+
+	// The append-only file lives in the data directory as well.
+	s.SetDBFilename("dump.rdb")
+	s.SetAppendOnly("appendonly.aof", FsyncNo)
+	ok(t, s.Start())
+	defer s.Close()
+	_, err = os.Stat(filepath.Join(dir, "appendonly.aof"))
+	ok(t, err)
+
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+	v, err := redis.Strings(c.Do("CONFIG", "GET", "d*"))
+	ok(t, err)
+	equals(t, []string{"dbfilename", "dump.rdb", "dir", dir}, v)
+
+	other := filepath.Join(dir, "other")
+	ok(t, os.Mkdir(other, 0777))
+	_, err = c.Do("CONFIG", "SET", "dir", other)
+	ok(t, err)
+	_, err = c.Do("CONFIG", "SET", "dbfilename", "other.rdb")
+	ok(t, err)
+	v, err = redis.Strings(c.Do("CONFIG", "GET", "dir", "dbfilename", "dir"))
+	ok(t, err)
+	equals(t, []string{"dir", other, "dbfilename", "other.rdb"}, v)
+	_, err = c.Do("SAVE")
+	ok(t, err)
+	_, err = os.Stat(filepath.Join(other, "other.rdb"))
+	ok(t, err)
+
+	// Errors
+	_, err = c.Do("CONFIG", "SET", "dir", filepath.Join(dir, "nosuch"))
+	assert(t, err != nil, "no error")
+	_, err = c.Do("CONFIG", "SET", "dbfilename", "a/b")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("CONFIG", "SET", "nosuch", "a")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("CONFIG", "SET", "dir")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("CONFIG", "GET")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("CONFIG", "NOSUCH")
+	assert(t, err != nil, "no error")
+	_, err = c.Do("CONFIG")
+	assert(t, err != nil, "no error")
+}
@@ -19,18 +19,19 @@ type Cmd func(c *Peer, cmd string, args []string)
 type Server struct {
 	l         net.Listener
 	cmds      map[string]Cmd
-	peers     map[net.Conn]struct{}
+	peers     map[net.Conn]bool // value is whether a command is running
 	mu        sync.Mutex
 	wg        sync.WaitGroup
 	infoConns int
 	infoCmds  int
+	draining  bool
 }
 
 // NewServer makes a server listening on addr. Close with .Close().
 func NewServer(addr string) (*Server, error) {
 	s := Server{
 		cmds:  map[string]Cmd{},
-		peers: map[net.Conn]struct{}{},
+		peers: map[net.Conn]bool{},
 	}
 
 	l, err := net.Listen("tcp", addr)
@@ -65,7 +66,11 @@ func (s *Server) serve(l net.Listener) {
 			defer conn.Close()
 
 			s.mu.Lock()
-			s.peers[conn] = struct{}{}
+			if s.draining {
+				s.mu.Unlock()
+				return
+			}
+			s.peers[conn] = false
 			s.infoConns++
 			s.mu.Unlock()
 
@@ -103,6 +108,37 @@ func (s *Server) Close() {
 	s.wg.Wait()
 }
 
+// Drain stops accepting connections, and closes every connection once its
+// current command is done. Idle connections are closed right away. It waits
+// until all connections are closed.
+func (s *Server) Drain() {
+	s.mu.Lock()
+	s.draining = true
+	if s.l != nil {
+		s.l.Close()
+	}
+	s.l = nil
+	for c, busy := range s.peers {
+		if !busy {
+			c.Close()
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// setBusy marks a connection as running a command, or as idle. Returns false
+// if the connection should be closed because the server is draining.
+func (s *Server) setBusy(c net.Conn, busy bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.peers[c] = busy
+	return true
+}
+
 // Register a command. It can't have been registered before. Safe to call on a
 // running server.
 func (s *Server) Register(cmd string, f Cmd) error {
@@ -132,10 +168,18 @@ func (s *Server) servePeer(c net.Conn) {
 			return
 		}
 
+		if !s.setBusy(c, true) {
+			return
+		}
+
 		s.dispatch(cl, args)
 
 		cl.w.Flush()
 
+		if !s.setBusy(c, false) {
+			return
+		}
+
 		if cl.closed {
 			c.Close()
 			return
@@ -228,6 +272,11 @@ func (c *Peer) WriteNull() {
 	fmt.Fprintf(c.w, "$-1\r\n")
 }
 
+// WriteNullArray writes a redis Null array
+func (c *Peer) WriteNullArray() {
+	fmt.Fprintf(c.w, "*-1\r\n")
+}
+
 // WriteLen starts an array with the given length
 func (c *Peer) WriteLen(n int) {
 	fmt.Fprintf(c.w, "*%d\r\n", n)
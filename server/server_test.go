@@ -2,6 +2,8 @@ package server
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"reflect"
 	"strconv"
 	"strings"
@@ -157,3 +159,60 @@ func Test(t *testing.T) {
 		}
 	}
 }
+
+func TestDrain(t *testing.T) {
+	s, err := NewServer(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	s.Register("SLOW", func(c *Peer, cmd string, args []string) {
+		close(started)
+		<-release
+		c.WriteInline("DONE")
+	})
+
+	busy, err := redis.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Addr().String()
+
+	res := make(chan string, 1)
+	go func() {
+		v, _ := redis.String(busy.Do("SLOW"))
+		res <- v
+	}()
+	<-started
+
+	drained := make(chan struct{})
+	go func() {
+		s.Drain()
+		close(drained)
+	}()
+
+	// The idle connection is closed right away, the busy one gets its reply.
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection still open: %v", err)
+	}
+	if _, err := redis.Dial("tcp", addr); err == nil {
+		t.Fatal("still accepting connections")
+	}
+	close(release)
+	if have, want := <-res, "DONE"; have != want {
+		t.Errorf("have: %s, want: %s", have, want)
+	}
+	<-drained
+	if _, err := busy.Do("SLOW"); err == nil {
+		t.Fatal("busy connection still open")
+	}
+}
@@ -0,0 +1,967 @@
+package rediqueue
+
+// On-disk snapshot format.
+//
+// A snapshot is:
+//
+//   "RDQSNAP" <version byte> <flags byte>
+//   for every non-empty database:
+//     opDB <db id>
+//     opList <nr of keys> (<key> <nr of elements> <element>...)...
+//     opSet <nr of keys> (<key> <nr of members> <member>...)...
+//     opString <nr of keys> (<key> <value>)...
+//     opHash <nr of keys> (<key> <nr of fields> (<field> <value>)...)...
+//     opZset <nr of keys> (<key> <nr of members> (<member> <score>)...)...
+//     opStream <nr of keys> (<key> <last ID> <nr of entries> (<ID> <nr of values> <value>...)...)...
+//     opStreamGroup <nr of keys> (<key> <nr of groups> (<group> <last ID>
+//       <nr of consumers> (<consumer> <seen time>)...
+//       <nr of pending> (<ID> <consumer> <delivery time> <delivery count>)...)...)...
+//     opExpire <nr of keys> (<key> <unix time in milliseconds>)...
+//     opMemberExpire <nr of keys> (<key> <nr of members> (<member> <unix time in milliseconds>)...)...
+//   opEOF
+//   <crc64 (ECMA) of everything above, 8 bytes big endian>
+//
+// All numbers are uvarints, all strings are a uvarint length followed by the
+// raw bytes. Scores are strings which parse back to the exact float, stream
+// IDs are two numbers, stream values are field/value pairs, and times are unix
+// time in milliseconds. The flags say whether everything after them is
+// compressed or encrypted, see transform.go. Version 1 files have no flags
+// byte, versions before 3 have no opExpire, before 4 no opMemberExpire,
+// before 5 no opString, before 6 no opHash, before 7 no opZset, before 8 no
+// opStream, and before 9 no opStreamGroup.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotMagic   = "RDQSNAP"
+	snapshotVersion = 9
+
+	opDB     = 0xFE
+	opEOF    = 0xFF
+	opList   = 0x01
+	opSet    = 0x02
+	opExpire = 0x03
+	opString = 0x05
+	opHash   = 0x06
+	opZset   = 0x07
+	opStream = 0x08
+
+	opStreamGroup = 0x09
+
+	opMemberExpire = 0x04
+
+	// maxSnapshotString guards against allocating silly amounts of memory on
+	// a corrupted length.
+	maxSnapshotString = 512 << 20
+)
+
+var (
+	// ErrBadSnapshot is returned when a snapshot can't be parsed.
+	ErrBadSnapshot = errors.New("invalid snapshot")
+	// ErrSnapshotChecksum is returned when a snapshot has the wrong checksum.
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+	crcTable = crc64.MakeTable(crc64.ECMA)
+)
+
+// SnapshotFormat is the file format Save() uses.
+type SnapshotFormat int
+
+const (
+	// SnapshotNative is our own format. This is the default.
+	SnapshotNative SnapshotFormat = iota
+	// SnapshotRDB is the Redis RDB format, which redis-server can load.
+	// String, hash, list, set, sorted set, and stream keys are stored, with
+	// their TTLs. Set member TTLs are not: saving fails with ErrRDBMemberTTL
+	// while there are any.
+	SnapshotRDB
+)
+
+// ParseSnapshotFormat parses "native" or "rdb".
+func ParseSnapshotFormat(s string) (SnapshotFormat, error) {
+	switch strings.ToLower(s) {
+	case "native":
+		return SnapshotNative, nil
+	case "rdb":
+		return SnapshotRDB, nil
+	default:
+		return 0, fmt.Errorf("invalid snapshot format: %q", s)
+	}
+}
+
+// SetSnapshotFormat sets the file format Save() writes. Load() reads both.
+func (m *RediQueue) SetSnapshotFormat(f SnapshotFormat) {
+	m.Lock()
+	defer m.Unlock()
+	m.snapshotFormat = f
+}
+
+// Load replaces all databases with the content of the snapshot file, which
+// can be one of ours, or an RDB file written by Redis. A missing file is not
+// an error.
+func (m *RediQueue) Load() error {
+	m.Lock()
+	filename := m.path(m.dbFilename)
+	m.Unlock()
+	return m.loadFile(filename)
+}
+
+// Save writes all databases to the snapshot file. The file is written to a
+// temporary file first, and then renamed over the old one. A running BGSAVE
+// is waited for.
+func (m *RediQueue) Save() error {
+	m.Lock()
+	defer m.Unlock()
+	for m.saving {
+		m.signal.Wait()
+	}
+	return m.save()
+}
+
+func (m *RediQueue) loadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	m.Lock()
+	defer m.Unlock()
+	dbs, err := readAnySnapshot(bufio.NewReader(f), &m.Mutex, m.effectiveNow(), m.snapshotKey)
+	if err != nil {
+		ce, ok := err.(*CorruptError)
+		if !ok {
+			return err
+		}
+		ce.File = filename
+		if m.recovery != RecoverMoveAside {
+			return err
+		}
+		log.Printf("rediqueue: %v. Not loaded", err)
+		f.Close()
+		return moveAside(filename)
+	}
+	m.dbs = dbs
+	m.setAOF(m.aof)
+	m.dirty = 0
+	m.lastSave = m.clock.Now()
+	return nil
+}
+
+// SnapshotTo writes all databases to w, in the format Load() reads,
+// compressed and encrypted as configured. The data is copied with the lock
+// held, and encoded without it, so w can be slow.
+func (m *RediQueue) SnapshotTo(w io.Writer) error {
+	m.Lock()
+	dbs := m.copyDBs()
+	opts := m.snapshotOptions()
+	m.Unlock()
+	return writeSnapshot(w, dbs, opts)
+}
+
+// RestoreFrom replaces all databases with a snapshot read from r. Both our
+// own format and RDB files are accepted. Nothing changes if r can't be read
+// completely.
+func (m *RediQueue) RestoreFrom(r io.Reader) error {
+	m.Lock()
+	now, key := m.effectiveNow(), m.snapshotKey
+	m.Unlock()
+	dbs, err := readAnySnapshot(bufio.NewReader(r), nil, now, key)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.flushAll()
+	for _, id := range sortedDBs(dbs) {
+		m.db(id).copyFrom(dbs[id])
+	}
+	m.wakeBlocked()
+	return nil
+}
+
+// copyDBs makes a copy of all databases. Needs the lock.
+func (m *RediQueue) copyDBs() map[int]*RedisDB {
+	dbs := map[int]*RedisDB{}
+	for id, db := range m.dbs {
+		dbs[id] = db.copy()
+	}
+	return dbs
+}
+
+// readAnySnapshot decodes either an RDB file or one of our snapshots. The
+// returned databases use lock l. now is used for RDB expire times. key
+// decrypts encrypted snapshots.
+func readAnySnapshot(r *bufio.Reader, l *sync.Mutex, now time.Time, key []byte) (map[int]*RedisDB, error) {
+	if magic, _ := r.Peek(len(rdbMagic)); string(magic) == rdbMagic {
+		return readRDB(r, l, now)
+	}
+	return readSnapshot(r, l, key)
+}
+
+// saveFile writes a snapshot atomically. Needs the lock.
+func (m *RediQueue) saveFile(filename string) error {
+	return writeSnapshotFile(filename, m.snapshotOptions(), m.dbs)
+}
+
+// writeSnapshotFile writes a snapshot atomically. dbs must be locked, or be
+// copies.
+func writeSnapshotFile(filename string, opts snapshotOptions, dbs map[int]*RedisDB) error {
+	if opts.format == SnapshotRDB && opts.flags() != 0 {
+		return errors.New("RDB snapshots can't be compressed or encrypted")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+
+	write := func(w io.Writer, dbs map[int]*RedisDB) error {
+		return writeSnapshot(w, dbs, opts)
+	}
+	if opts.format == SnapshotRDB {
+		write = writeRDB
+	}
+	if err := write(tmp, dbs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// snapshotWriter keeps a running checksum of everything written.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash64
+	err error
+}
+
+func (w *snapshotWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc.Write(b)
+	_, w.err = w.w.Write(b)
+}
+
+func (w *snapshotWriter) writeByte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *snapshotWriter) writeUint(n uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.write(buf[:binary.PutUvarint(buf, n)])
+}
+
+func (w *snapshotWriter) writeString(s string) {
+	w.writeUint(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+func (w *snapshotWriter) writeStreamID(id streamID) {
+	w.writeUint(id.ms)
+	w.writeUint(id.seq)
+}
+
+// writeSnapshot encodes all databases, with the compression and encryption
+// from opts. Needs the lock.
+func writeSnapshot(dst io.Writer, dbs map[int]*RedisDB, opts snapshotOptions) error {
+	header := append([]byte(snapshotMagic), snapshotVersion, opts.flags())
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	tw, header, err := transformWriter(dst, header, opts)
+	if err != nil {
+		return err
+	}
+	w := &snapshotWriter{
+		w:   bufio.NewWriter(tw),
+		crc: crc64.New(crcTable),
+	}
+	w.crc.Write(header)
+
+	for _, id := range sortedDBs(dbs) {
+		db := dbs[id]
+		w.writeByte(opDB)
+		w.writeUint(uint64(id))
+
+		w.writeByte(opList)
+		lists := db.typedKeys("list")
+		w.writeUint(uint64(len(lists)))
+		for _, k := range lists {
+			l := db.listKeys[k]
+			w.writeString(k)
+			w.writeUint(uint64(len(l)))
+			for _, el := range l {
+				w.writeString(el)
+			}
+		}
+
+		w.writeByte(opSet)
+		sets := db.typedKeys("set")
+		w.writeUint(uint64(len(sets)))
+		for _, k := range sets {
+			members := db.setMembers(k)
+			w.writeString(k)
+			w.writeUint(uint64(len(members)))
+			for _, el := range members {
+				w.writeString(el)
+			}
+		}
+
+		w.writeByte(opString)
+		strs := db.typedKeys("string")
+		w.writeUint(uint64(len(strs)))
+		for _, k := range strs {
+			w.writeString(k)
+			w.writeString(db.stringKeys[k])
+		}
+
+		w.writeByte(opHash)
+		hashes := db.typedKeys("hash")
+		w.writeUint(uint64(len(hashes)))
+		for _, k := range hashes {
+			fields := db.hashFields(k)
+			w.writeString(k)
+			w.writeUint(uint64(len(fields)))
+			for _, f := range fields {
+				w.writeString(f)
+				w.writeString(db.hashKeys[k][f])
+			}
+		}
+
+		w.writeByte(opZset)
+		zsets := db.typedKeys("zset")
+		w.writeUint(uint64(len(zsets)))
+		for _, k := range zsets {
+			elems := db.zsetKeys[k].elems()
+			w.writeString(k)
+			w.writeUint(uint64(len(elems)))
+			for _, e := range elems {
+				w.writeString(e.member)
+				w.writeString(formatScore(e.score))
+			}
+		}
+
+		w.writeByte(opStream)
+		streams := db.typedKeys("stream")
+		w.writeUint(uint64(len(streams)))
+		for _, k := range streams {
+			s := db.streamKeys[k]
+			w.writeString(k)
+			w.writeStreamID(s.lastID)
+			w.writeUint(uint64(len(s.entries)))
+			for _, e := range s.entries {
+				w.writeStreamID(e.id)
+				w.writeUint(uint64(len(e.values)))
+				for _, v := range e.values {
+					w.writeString(v)
+				}
+			}
+		}
+
+		w.writeByte(opStreamGroup)
+		var withGroups []string
+		for _, k := range streams {
+			if len(db.streamKeys[k].groups) > 0 {
+				withGroups = append(withGroups, k)
+			}
+		}
+		w.writeUint(uint64(len(withGroups)))
+		for _, k := range withGroups {
+			s := db.streamKeys[k]
+			w.writeString(k)
+			w.writeUint(uint64(len(s.groups)))
+			for _, name := range s.groupNames() {
+				g := s.groups[name]
+				w.writeString(name)
+				w.writeStreamID(g.lastID)
+				w.writeUint(uint64(len(g.consumers)))
+				for _, c := range g.consumerNames() {
+					w.writeString(c)
+					w.writeUint(uint64(unixMilli(g.consumers[c].seen)))
+				}
+				w.writeUint(uint64(len(g.pending)))
+				for _, p := range g.pending {
+					w.writeStreamID(p.id)
+					w.writeString(p.consumer)
+					w.writeUint(uint64(unixMilli(p.delivered)))
+					w.writeUint(uint64(p.count))
+				}
+			}
+		}
+
+		w.writeByte(opExpire)
+		var ttls []string
+		for _, k := range db.allKeys() {
+			if _, ok := db.expire[k]; ok {
+				ttls = append(ttls, k)
+			}
+		}
+		w.writeUint(uint64(len(ttls)))
+		for _, k := range ttls {
+			w.writeString(k)
+			w.writeUint(uint64(unixMilli(db.expire[k])))
+		}
+
+		w.writeByte(opMemberExpire)
+		var withTTL []string
+		for _, k := range sets {
+			if len(db.memberExpire[k]) > 0 {
+				withTTL = append(withTTL, k)
+			}
+		}
+		w.writeUint(uint64(len(withTTL)))
+		for _, k := range withTTL {
+			members := sortedMembers(db.memberExpire[k])
+			w.writeString(k)
+			w.writeUint(uint64(len(members)))
+			for _, e := range members {
+				w.writeString(e)
+				w.writeUint(uint64(unixMilli(db.memberExpire[k][e])))
+			}
+		}
+	}
+	w.writeByte(opEOF)
+	if w.err != nil {
+		return w.err
+	}
+	sum := make([]byte, 8)
+	binary.BigEndian.PutUint64(sum, w.crc.Sum64())
+	if _, err := w.w.Write(sum); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// snapshotReader keeps a running checksum of everything read, and the offset.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash64
+	n   int64
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	r.n++
+	r.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (r *snapshotReader) readFull(n uint64) ([]byte, error) {
+	if n > uint64(maxSnapshotString) {
+		return nil, ErrBadSnapshot
+	}
+	b := make([]byte, n)
+	read, err := io.ReadFull(r.r, b)
+	r.n += int64(read)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	r.crc.Write(b)
+	return b, nil
+}
+
+func (r *snapshotReader) readUint() (uint64, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		return 0, ErrBadSnapshot
+	}
+	return n, nil
+}
+
+func (r *snapshotReader) readString() (string, error) {
+	n, err := r.readUint()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.readFull(n)
+	return string(b), err
+}
+
+// noEOF turns an EOF into an unexpected one. A snapshot always ends with a
+// checksum, so running out of data is never fine.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readSnapshot decodes a snapshot. The returned databases use lock l. key is
+// needed for encrypted snapshots. Errors are a *CorruptError; for compressed
+// or encrypted snapshots the offset is in the decoded data.
+func readSnapshot(src io.Reader, l *sync.Mutex, key []byte) (map[int]*RedisDB, error) {
+	r := &snapshotReader{
+		r:   bufio.NewReader(src),
+		crc: crc64.New(crcTable),
+	}
+	dbs, err := r.read(l, key)
+	if err != nil {
+		return nil, &CorruptError{Offset: r.n, Err: err}
+	}
+	return dbs, nil
+}
+
+func (r *snapshotReader) read(l *sync.Mutex, key []byte) (map[int]*RedisDB, error) {
+	magic, err := r.readFull(uint64(len(snapshotMagic)))
+	if err != nil {
+		return nil, err
+	}
+	if string(magic) != snapshotMagic {
+		return nil, ErrBadSnapshot
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version < 1 || version > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	transformed := false
+	if version >= 2 {
+		flags, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if flags != 0 {
+			header := append(magic, version, flags)
+			in, full, err := transformReader(r.r, header, flags, key)
+			if err != nil {
+				return nil, err
+			}
+			r.crc.Write(full[len(header):])
+			r.r = bufio.NewReader(in)
+			transformed = true
+		}
+	}
+
+	var (
+		dbs = map[int]*RedisDB{}
+		db  *RedisDB
+	)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opEOF:
+			want := r.crc.Sum64()
+			sum := make([]byte, 8)
+			if _, err := io.ReadFull(r.r, sum); err != nil {
+				return nil, noEOF(err)
+			}
+			if binary.BigEndian.Uint64(sum) != want {
+				return nil, ErrSnapshotChecksum
+			}
+			if transformed {
+				if err := drain(r.r); err != nil {
+					return nil, err
+				}
+			}
+			return dbs, nil
+		case opDB:
+			id, err := r.readUint()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := dbs[int(id)]; ok {
+				return nil, ErrBadSnapshot
+			}
+			d := newRedisDB(int(id), l)
+			db = &d
+			dbs[int(id)] = db
+		case opList, opSet, opHash, opZset:
+			if db == nil {
+				return nil, ErrBadSnapshot
+			}
+			if err := readSnapshotKeys(r, db, op); err != nil {
+				return nil, err
+			}
+		case opString:
+			if db == nil {
+				return nil, ErrBadSnapshot
+			}
+			if err := readSnapshotStrings(r, db); err != nil {
+				return nil, err
+			}
+		case opStream:
+			if db == nil {
+				return nil, ErrBadSnapshot
+			}
+			if err := readSnapshotStreams(r, db); err != nil {
+				return nil, err
+			}
+		case opStreamGroup:
+			if db == nil {
+				return nil, ErrBadSnapshot
+			}
+			if err := readSnapshotStreamGroups(r, db); err != nil {
+				return nil, err
+			}
+		case opExpire:
+			if db == nil {
+				return nil, ErrBadSnapshot
+			}
+			if err := readSnapshotTTLs(r, db); err != nil {
+				return nil, err
+			}
+		case opMemberExpire:
+			if db == nil {
+				return nil, ErrBadSnapshot
+			}
+			if err := readSnapshotMemberTTLs(r, db); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrBadSnapshot
+		}
+	}
+}
+
+// readSnapshotKeys reads an opList, opSet, opHash, or opZset section. Hashes
+// and sorted sets have two strings per field or member.
+func readSnapshotKeys(r *snapshotReader, db *RedisDB, op byte) error {
+	n, err := r.readUint()
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		k, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if db.exists(k) {
+			return ErrBadSnapshot
+		}
+		elems, err := r.readUint()
+		if err != nil {
+			return err
+		}
+		if elems == 0 {
+			return ErrBadSnapshot
+		}
+		if op == opHash || op == opZset {
+			elems *= 2
+		}
+		vs := make([]string, 0, minUint(elems, 1024))
+		for ; elems > 0; elems-- {
+			v, err := r.readString()
+			if err != nil {
+				return err
+			}
+			vs = append(vs, v)
+		}
+		switch op {
+		case opList:
+			db.listPush(k, vs...)
+		case opSet:
+			db.setAdd(k, vs...)
+		case opHash:
+			db.hashSet(k, vs...)
+		case opZset:
+			for i := 0; i < len(vs); i += 2 {
+				score, err := parseScore(vs[i+1])
+				if err != nil {
+					return ErrBadSnapshot
+				}
+				db.zsetAdd(k, score, vs[i])
+			}
+		}
+	}
+	return nil
+}
+
+// readSnapshotStrings reads an opString section.
+func readSnapshotStrings(r *snapshotReader, db *RedisDB) error {
+	n, err := r.readUint()
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		k, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if db.exists(k) {
+			return ErrBadSnapshot
+		}
+		v, err := r.readString()
+		if err != nil {
+			return err
+		}
+		db.stringSet(k, v)
+	}
+	return nil
+}
+
+// readSnapshotStreams reads an opStream section.
+func readSnapshotStreams(r *snapshotReader, db *RedisDB) error {
+	n, err := r.readUint()
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		k, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if db.exists(k) {
+			return ErrBadSnapshot
+		}
+		s := &streamKey{}
+		if s.lastID, err = r.readStreamID(); err != nil {
+			return err
+		}
+		entries, err := r.readUint()
+		if err != nil {
+			return err
+		}
+		for ; entries > 0; entries-- {
+			id, err := r.readStreamID()
+			if err != nil {
+				return err
+			}
+			if n := len(s.entries); (n > 0 && !s.entries[n-1].id.less(id)) || s.lastID.less(id) {
+				return ErrBadSnapshot
+			}
+			nv, err := r.readUint()
+			if err != nil {
+				return err
+			}
+			if nv == 0 || nv%2 != 0 {
+				return ErrBadSnapshot
+			}
+			values := make([]string, 0, minUint(nv, 1024))
+			for ; nv > 0; nv-- {
+				v, err := r.readString()
+				if err != nil {
+					return err
+				}
+				values = append(values, v)
+			}
+			s.entries = append(s.entries, streamEntry{id: id, values: values})
+		}
+		db.streamSet(k, s)
+	}
+	return nil
+}
+
+// readSnapshotStreamGroups reads an opStreamGroup section. The streams have
+// to be there already.
+func readSnapshotStreamGroups(r *snapshotReader, db *RedisDB) error {
+	n, err := r.readUint()
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		k, err := r.readString()
+		if err != nil {
+			return err
+		}
+		s, ok := db.streamKeys[k]
+		if !ok {
+			return ErrBadSnapshot
+		}
+		groups, err := r.readUint()
+		if err != nil {
+			return err
+		}
+		for ; groups > 0; groups-- {
+			name, err := r.readString()
+			if err != nil {
+				return err
+			}
+			if s.groups[name] != nil {
+				return ErrBadSnapshot
+			}
+			lastID, err := r.readStreamID()
+			if err != nil {
+				return err
+			}
+			db.streamGroupCreate(k, name, lastID)
+			g := s.groups[name]
+
+			consumers, err := r.readUint()
+			if err != nil {
+				return err
+			}
+			for ; consumers > 0; consumers-- {
+				c, err := r.readString()
+				if err != nil {
+					return err
+				}
+				ms, err := r.readUint()
+				if err != nil {
+					return err
+				}
+				if !db.streamConsumerCreate(k, name, c, fromUnixMilli(int64(ms))) {
+					return ErrBadSnapshot
+				}
+			}
+
+			pending, err := r.readUint()
+			if err != nil {
+				return err
+			}
+			for ; pending > 0; pending-- {
+				id, err := r.readStreamID()
+				if err != nil {
+					return err
+				}
+				if l := len(g.pending); l > 0 && !g.pending[l-1].id.less(id) {
+					return ErrBadSnapshot
+				}
+				c, err := r.readString()
+				if err != nil {
+					return err
+				}
+				if _, ok := g.consumers[c]; !ok {
+					return ErrBadSnapshot
+				}
+				ms, err := r.readUint()
+				if err != nil {
+					return err
+				}
+				count, err := r.readUint()
+				if err != nil {
+					return err
+				}
+				db.streamPendingSet(k, name, streamPending{
+					id:        id,
+					consumer:  c,
+					delivered: fromUnixMilli(int64(ms)),
+					count:     int(count),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+func (r *snapshotReader) readStreamID() (streamID, error) {
+	ms, err := r.readUint()
+	if err != nil {
+		return streamID{}, err
+	}
+	seq, err := r.readUint()
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{ms, seq}, nil
+}
+
+// readSnapshotTTLs reads an opExpire section. The keys have to be there
+// already.
+func readSnapshotTTLs(r *snapshotReader, db *RedisDB) error {
+	n, err := r.readUint()
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		k, err := r.readString()
+		if err != nil {
+			return err
+		}
+		ms, err := r.readUint()
+		if err != nil {
+			return err
+		}
+		if !db.exists(k) {
+			return ErrBadSnapshot
+		}
+		db.setTTL(k, fromUnixMilli(int64(ms)))
+	}
+	return nil
+}
+
+// readSnapshotMemberTTLs reads an opMemberExpire section. The sets and their
+// members have to be there already.
+func readSnapshotMemberTTLs(r *snapshotReader, db *RedisDB) error {
+	n, err := r.readUint()
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		k, err := r.readString()
+		if err != nil {
+			return err
+		}
+		members, err := r.readUint()
+		if err != nil {
+			return err
+		}
+		for ; members > 0; members-- {
+			e, err := r.readString()
+			if err != nil {
+				return err
+			}
+			ms, err := r.readUint()
+			if err != nil {
+				return err
+			}
+			if !db.setIsMember(k, e) {
+				return ErrBadSnapshot
+			}
+			db.setAddTTL(k, fromUnixMilli(int64(ms)), e)
+		}
+	}
+	return nil
+}
+
+func minUint(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// sortedDBs gives the ids of all non-empty databases, sorted.
+func sortedDBs(dbs map[int]*RedisDB) []int {
+	ids := make([]int, 0, len(dbs))
+	for id, db := range dbs {
+		if len(db.keys) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,214 @@
+package rediqueue
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestSnapshot(t *testing.T) {
+	s := NewRediQueue()
+	s.Push("queue", "one", "two", "three")
+	s.SetAdd("seen", "a", "b")
+	s.Set("name", "value")
+	s.HSet("job", "state", "new")
+	s.ZAdd("ranked", 1.5, "a")
+	s.ZAdd("ranked", -2, "b")
+	s.XAdd("events", "1-1", "state", "new", "id", "7")
+	s.XAdd("events", "2-0", "state", "done")
+	s.dbs[0].streamSetID("events", streamID{5, 0})
+	seen := time.Unix(1000, 0)
+	s.dbs[0].streamGroupCreate("events", "workers", streamID{1, 1})
+	s.dbs[0].streamConsumerCreate("events", "workers", "idle", seen)
+	s.dbs[0].streamPendingSet("events", "workers", streamPending{
+		id:        streamID{1, 1},
+		consumer:  "busy",
+		delivered: seen.Add(time.Second),
+		count:     2,
+	})
+	s.DB(3).Push("other", "x")
+	s.DB(5) // empty, not stored
+
+	var buf bytes.Buffer
+	ok(t, writeSnapshot(&buf, s.dbs, snapshotOptions{}))
+
+	s2 := NewRediQueue()
+	dbs, err := readSnapshot(bytes.NewReader(buf.Bytes()), &s2.Mutex, nil)
+	ok(t, err)
+	s2.dbs = dbs
+	equals(t, 2, len(dbs))
+	s2.CheckList(t, "queue", "one", "two", "three")
+	s2.CheckSet(t, "seen", "a", "b")
+	s2.CheckGet(t, "name", "value")
+	s2.CheckHash(t, "job", map[string]string{"state": "new"})
+	z, err := s2.SortedSet("ranked")
+	ok(t, err)
+	equals(t, map[string]float64{"a": 1.5, "b": -2}, z)
+	entries, err := s2.Stream("events")
+	ok(t, err)
+	equals(t, []StreamEntry{
+		{ID: "1-1", Values: []string{"state", "new", "id", "7"}},
+		{ID: "2-0", Values: []string{"state", "done"}},
+	}, entries)
+	equals(t, streamID{5, 0}, s2.dbs[0].streamKeys["events"].lastID)
+	g := s2.dbs[0].streamKeys["events"].groups["workers"]
+	equals(t, streamID{1, 1}, g.lastID)
+	equals(t, []string{"busy", "idle"}, g.consumerNames())
+	equals(t, seen, g.consumers["idle"].seen)
+	equals(t, []streamPending{{
+		id:        streamID{1, 1},
+		consumer:  "busy",
+		delivered: seen.Add(time.Second),
+		count:     2,
+	}}, g.pending)
+	l, err := s2.DB(3).List("other")
+	ok(t, err)
+	equals(t, []string{"x"}, l)
+
+	// Corrupted data
+	{
+		b := append([]byte{}, buf.Bytes()...)
+		b[len(snapshotMagic)+5] ^= 0xFF
+		_, err := readSnapshot(bytes.NewReader(b), &s2.Mutex, nil)
+		assert(t, err != nil, "no error")
+	}
+
+	// Wrong checksum
+	{
+		b := append([]byte{}, buf.Bytes()...)
+		b[len(b)-1] ^= 0xFF
+		_, err := readSnapshot(bytes.NewReader(b), &s2.Mutex, nil)
+		equals(t, ErrSnapshotChecksum, err.(*CorruptError).Err)
+	}
+
+	// Truncated
+	{
+		b := buf.Bytes()[:buf.Len()-3]
+		_, err := readSnapshot(bytes.NewReader(b), &s2.Mutex, nil)
+		equals(t, io.ErrUnexpectedEOF, err.(*CorruptError).Err)
+	}
+
+	// Not a snapshot
+	{
+		_, err := readSnapshot(bytes.NewReader([]byte("hello world")), &s2.Mutex, nil)
+		equals(t, &CorruptError{Offset: 7, Err: ErrBadSnapshot}, err)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dump.rdb")
+
+	s := NewRediQueue()
+	// Missing file is fine.
+	ok(t, s.loadFile(filename))
+
+	s.Push("queue", "one", "two")
+	ok(t, s.saveFile(filename))
+
+	// Overwriting a longer file must not leave garbage behind.
+	s.Pop("queue")
+	ok(t, s.saveFile(filename))
+
+	s2 := NewRediQueue()
+	ok(t, s2.loadFile(filename))
+	s2.CheckList(t, "queue", "one")
+
+	files, err := ioutil.ReadDir(dir)
+	ok(t, err)
+	equals(t, 1, len(files))
+
+	ok(t, ioutil.WriteFile(filename, []byte("garbage"), 0666))
+	assert(t, s2.loadFile(filename) != nil, "no error")
+	s2.CheckList(t, "queue", "one")
+}
+
+func TestSnapshotTo(t *testing.T) {
+	s := NewRediQueue()
+	s.Push("queue", "one", "two")
+	s.DB(2).SetAdd("seen", "a")
+
+	var buf bytes.Buffer
+	ok(t, s.SnapshotTo(&buf))
+	backup := buf.Bytes()
+
+	s.Pop("queue")
+	s.Push("new", "x")
+	ok(t, s.RestoreFrom(bytes.NewReader(backup)))
+	s.CheckList(t, "queue", "one", "two")
+	equals(t, []string{"queue"}, s.DB(0).Keys())
+	members, err := s.DB(2).Members("seen")
+	ok(t, err)
+	equals(t, []string{"a"}, members)
+
+	// Broken input changes nothing.
+	s.Push("new", "x")
+	assert(t, s.RestoreFrom(bytes.NewReader(backup[:len(backup)-2])) != nil, "no error")
+	s.CheckList(t, "new", "x")
+
+	// RDB files work too.
+	f, err := os.Open("testdata/rdb/regular_set.rdb")
+	ok(t, err)
+	defer f.Close()
+	ok(t, s.RestoreFrom(f))
+	equals(t, []string{"regular_set"}, s.DB(0).Keys())
+}
+
+func TestRestoreFromBlocked(t *testing.T) {
+	s, err := Run()
+	ok(t, err)
+	defer s.Close()
+	s.Push("queue", "job")
+	var buf bytes.Buffer
+	ok(t, s.SnapshotTo(&buf))
+	s.FlushAll()
+
+	c, err := redis.Dial("tcp", s.Addr())
+	ok(t, err)
+	got := goStrings(t, c, "BLPOP", "queue", 2)
+	for {
+		s.Lock()
+		n := len(s.blocked)
+		s.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Restoring wakes up the blocked client, well before its timeout.
+	ok(t, s.RestoreFrom(&buf))
+	start := time.Now()
+	equals(t, []string{"queue", "job"}, <-got)
+	assert(t, time.Since(start) < time.Second, "BLPOP took too long")
+}
+
+func TestSnapshotTTL(t *testing.T) {
+	s := NewRediQueue()
+	s.SetTime(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.Push("queue", "one")
+	s.Push("forever", "one")
+	ok(t, s.SetTTL("queue", time.Minute))
+
+	var buf bytes.Buffer
+	ok(t, s.SnapshotTo(&buf))
+	s.FlushAll()
+	ok(t, s.RestoreFrom(&buf))
+	equals(t, time.Minute, s.TTL("queue"))
+	equals(t, time.Duration(0), s.TTL("forever"))
+
+	// Keys which expired in the meantime are gone.
+	buf.Reset()
+	ok(t, s.SnapshotTo(&buf))
+	s.SetTime(time.Date(2020, 1, 1, 12, 1, 0, 0, time.UTC))
+	ok(t, s.RestoreFrom(&buf))
+	equals(t, []string{"forever"}, s.Keys())
+}
@@ -0,0 +1,376 @@
+package rediqueue
+
+// The ordered structure behind sorted set keys: a skip list ordered by score,
+// then by member, which knows how many nodes every link skips, so ranks are
+// found without walking the whole list. This is what Redis does in t_zset.c.
+
+import (
+	"math/rand"
+	"strconv"
+)
+
+const (
+	ssMaxLevel = 32
+	ssP        = 0.25 // chance a node is on the next level as well
+)
+
+// ssElem is a sorted set member with its score.
+type ssElem struct {
+	member string
+	score  float64
+}
+
+// less is the sorted set order.
+func (e ssElem) less(o ssElem) bool {
+	if e.score != o.score {
+		return e.score < o.score
+	}
+	return e.member < o.member
+}
+
+type ssNode struct {
+	ssElem
+	prev *ssNode // nil for the first node
+	next []ssLink
+}
+
+type ssLink struct {
+	node *ssNode
+	span int // nr of nodes this link moves ahead
+}
+
+// sortedSet is a sorted set. Not safe for concurrent use.
+type sortedSet struct {
+	scores map[string]float64
+	head   *ssNode // not a member
+	tail   *ssNode
+	level  int
+	length int
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{
+		scores: map[string]float64{},
+		head:   &ssNode{next: make([]ssLink, ssMaxLevel)},
+		level:  1,
+	}
+}
+
+func ssRandomLevel() int {
+	l := 1
+	for l < ssMaxLevel && rand.Float64() < ssP {
+		l++
+	}
+	return l
+}
+
+// card gives the number of members.
+func (s *sortedSet) card() int {
+	return s.length
+}
+
+// score gives the score of a member.
+func (s *sortedSet) score(member string) (float64, bool) {
+	v, ok := s.scores[member]
+	return v, ok
+}
+
+// set adds a member, or changes its score. Returns whether it's new.
+func (s *sortedSet) set(member string, score float64) bool {
+	old, ok := s.scores[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		s.delete(ssElem{member: member, score: old})
+	}
+	s.insert(ssElem{member: member, score: score})
+	return !ok
+}
+
+// remove removes a member. Returns whether it was there.
+func (s *sortedSet) remove(member string) bool {
+	score, ok := s.scores[member]
+	if !ok {
+		return false
+	}
+	s.delete(ssElem{member: member, score: score})
+	return true
+}
+
+// insert adds an element which isn't there yet.
+func (s *sortedSet) insert(e ssElem) {
+	var (
+		update [ssMaxLevel]*ssNode
+		rank   [ssMaxLevel]int // rank of update[i]
+	)
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		if i < s.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.next[i].node != nil && x.next[i].node.less(e) {
+			rank[i] += x.next[i].span
+			x = x.next[i].node
+		}
+		update[i] = x
+	}
+	level := ssRandomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+			update[i].next[i].span = s.length
+		}
+		s.level = level
+	}
+	n := &ssNode{ssElem: e, next: make([]ssLink, level)}
+	for i := 0; i < level; i++ {
+		n.next[i].node = update[i].next[i].node
+		update[i].next[i].node = n
+		n.next[i].span = update[i].next[i].span - (rank[0] - rank[i])
+		update[i].next[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < s.level; i++ {
+		update[i].next[i].span++
+	}
+	if update[0] != s.head {
+		n.prev = update[0]
+	}
+	if n.next[0].node != nil {
+		n.next[0].node.prev = n
+	} else {
+		s.tail = n
+	}
+	s.length++
+	s.scores[e.member] = e.score
+}
+
+// delete removes an element which is there.
+func (s *sortedSet) delete(e ssElem) {
+	var update [ssMaxLevel]*ssNode
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && x.next[i].node.less(e) {
+			x = x.next[i].node
+		}
+		update[i] = x
+	}
+	x = x.next[0].node
+	for i := 0; i < s.level; i++ {
+		if update[i].next[i].node == x {
+			update[i].next[i].span += x.next[i].span - 1
+			update[i].next[i].node = x.next[i].node
+		} else {
+			update[i].next[i].span--
+		}
+	}
+	if x.next[0].node != nil {
+		x.next[0].node.prev = x.prev
+	} else {
+		s.tail = x.prev
+	}
+	for s.level > 1 && s.head.next[s.level-1].node == nil {
+		s.level--
+	}
+	s.length--
+	delete(s.scores, e.member)
+}
+
+// rank gives the 0-based rank of a member, or -1.
+func (s *sortedSet) rank(member string) int {
+	score, ok := s.scores[member]
+	if !ok {
+		return -1
+	}
+	e := ssElem{member: member, score: score}
+	r := 0
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && !e.less(x.next[i].node.ssElem) {
+			r += x.next[i].span
+			x = x.next[i].node
+		}
+		if x.member == member && x != s.head {
+			return r - 1
+		}
+	}
+	return -1
+}
+
+// at gives the node with 0-based rank r, or nil.
+func (s *sortedSet) at(r int) *ssNode {
+	if r < 0 || r >= s.length {
+		return nil
+	}
+	x := s.head
+	traversed := 0
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && traversed+x.next[i].span <= r+1 {
+			traversed += x.next[i].span
+			x = x.next[i].node
+		}
+		if traversed == r+1 {
+			return x
+		}
+	}
+	return nil
+}
+
+// first gives the first node for which below() is false, or nil. below()
+// has to be true for the nodes before it, and false after.
+func (s *sortedSet) first(below func(ssElem) bool) *ssNode {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && below(x.next[i].node.ssElem) {
+			x = x.next[i].node
+		}
+	}
+	return x.next[0].node
+}
+
+// last gives the last node for which within() is true, or nil. within() has
+// to be true for the nodes before it, and false after.
+func (s *sortedSet) last(within func(ssElem) bool) *ssNode {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && within(x.next[i].node.ssElem) {
+			x = x.next[i].node
+		}
+	}
+	if x == s.head {
+		return nil
+	}
+	return x
+}
+
+// elems gives all elements, in order.
+func (s *sortedSet) elems() []ssElem {
+	res := make([]ssElem, 0, s.length)
+	for n := s.head.next[0].node; n != nil; n = n.next[0].node {
+		res = append(res, n.ssElem)
+	}
+	return res
+}
+
+// byRank gives the elements with rank start up to (not including) end, as
+// from redisRange(). With reverse the ranks count from the highest score.
+func (s *sortedSet) byRank(start, end int, reverse bool) []ssElem {
+	if start >= end {
+		return nil
+	}
+	res := make([]ssElem, 0, end-start)
+	if reverse {
+		for n := s.at(s.length - 1 - start); n != nil && len(res) < end-start; n = n.prev {
+			res = append(res, n.ssElem)
+		}
+		return res
+	}
+	for n := s.at(start); n != nil && len(res) < end-start; n = n.next[0].node {
+		res = append(res, n.ssElem)
+	}
+	return res
+}
+
+// rangeBound is the min or max of a ZRANGEBYSCORE or ZRANGEBYLEX.
+type rangeBound interface {
+	// below tells whether e comes before the range, for a min.
+	below(e ssElem) bool
+	// within tells whether e doesn't come after the range, for a max.
+	within(e ssElem) bool
+}
+
+// between gives the elements from min to max, skipping offset, and at most
+// count of them. A negative count is no limit. With reverse it starts at max.
+func (s *sortedSet) between(min, max rangeBound, reverse bool, offset, count int) []ssElem {
+	var res []ssElem
+	if reverse {
+		for n := s.last(max.within); n != nil && !min.below(n.ssElem) && count != 0; n = n.prev {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			res = append(res, n.ssElem)
+			count--
+		}
+		return res
+	}
+	for n := s.first(min.below); n != nil && max.within(n.ssElem) && count != 0; n = n.next[0].node {
+		if offset > 0 {
+			offset--
+			continue
+		}
+		res = append(res, n.ssElem)
+		count--
+	}
+	return res
+}
+
+// count gives the number of elements from min to max.
+func (s *sortedSet) count(min, max rangeBound) int {
+	first, last := s.first(min.below), s.last(max.within)
+	if first == nil || last == nil {
+		return 0
+	}
+	n := s.rank(last.member) - s.rank(first.member) + 1
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// copy makes a deep copy.
+func (s *sortedSet) copy() *sortedSet {
+	c := newSortedSet()
+	for _, e := range s.elems() {
+		c.insert(e)
+	}
+	return c
+}
+
+// scoreBound is a ZRANGEBYSCORE &c. min or max.
+type scoreBound struct {
+	v    float64
+	excl bool
+}
+
+func (b scoreBound) below(e ssElem) bool {
+	return e.score < b.v || (b.excl && e.score == b.v)
+}
+
+func (b scoreBound) within(e ssElem) bool {
+	return e.score < b.v || (!b.excl && e.score == b.v)
+}
+
+// lexBound is a ZRANGEBYLEX &c. min or max. Only useful when all scores are
+// the same.
+type lexBound struct {
+	v    string
+	excl bool
+	inf  int // -1 for "-", 1 for "+"
+}
+
+func (b lexBound) below(e ssElem) bool {
+	switch b.inf {
+	case -1:
+		return false
+	case 1:
+		return true
+	}
+	return e.member < b.v || (b.excl && e.member == b.v)
+}
+
+func (b lexBound) within(e ssElem) bool {
+	switch b.inf {
+	case -1:
+		return false
+	case 1:
+		return true
+	}
+	return e.member < b.v || (!b.excl && e.member == b.v)
+}
+
+// formatScore formats a score so it parses back to the exact same value. For
+// the append-only file and snapshots; clients get formatFloat().
+func formatScore(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,78 @@
+package rediqueue
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSortedSet(t *testing.T) {
+	s := newSortedSet()
+	equals(t, true, s.set("b", 2))
+	equals(t, true, s.set("a", 2))
+	equals(t, true, s.set("c", 1))
+	equals(t, false, s.set("c", 3))
+	equals(t, []ssElem{{"a", 2}, {"b", 2}, {"c", 3}}, s.elems())
+	equals(t, 0, s.rank("a"))
+	equals(t, 2, s.rank("c"))
+	equals(t, -1, s.rank("nosuch"))
+	equals(t, "b", s.at(1).member)
+	equals(t, (*ssNode)(nil), s.at(3))
+
+	equals(t, []ssElem{{"c", 3}, {"b", 2}}, s.byRank(0, 2, true))
+	equals(t, []ssElem{{"b", 2}, {"c", 3}}, s.byRank(1, 3, false))
+
+	min, max := scoreBound{v: 2, excl: true}, scoreBound{v: 3}
+	equals(t, []ssElem{{"c", 3}}, s.between(min, max, false, 0, -1))
+	equals(t, 1, s.count(min, max))
+	min.excl = false
+	equals(t, []ssElem{{"c", 3}, {"b", 2}, {"a", 2}}, s.between(min, max, true, 0, -1))
+	equals(t, []ssElem{{"b", 2}}, s.between(min, max, true, 1, 1))
+	equals(t, 3, s.count(min, max))
+
+	equals(t, true, s.remove("b"))
+	equals(t, false, s.remove("b"))
+	equals(t, []ssElem{{"a", 2}, {"c", 3}}, s.elems())
+	equals(t, 2, s.card())
+}
+
+// Compare against a plain sorted slice, with enough members for a few levels.
+func TestSortedSetRandom(t *testing.T) {
+	var (
+		s    = newSortedSet()
+		want = map[string]float64{}
+		r    = rand.New(rand.NewSource(42))
+	)
+	for i := 0; i < 5000; i++ {
+		member := strconv.Itoa(r.Intn(500))
+		if r.Intn(3) == 0 {
+			_, was := want[member]
+			equals(t, was, s.remove(member))
+			delete(want, member)
+			continue
+		}
+		score := float64(r.Intn(100))
+		s.set(member, score)
+		want[member] = score
+	}
+
+	var sorted []ssElem
+	for m, sc := range want {
+		sorted = append(sorted, ssElem{member: m, score: sc})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].less(sorted[j]) })
+	equals(t, sorted, s.elems())
+	equals(t, len(sorted), s.card())
+	for i, e := range sorted {
+		equals(t, i, s.rank(e.member))
+		equals(t, e, s.at(i).ssElem)
+	}
+	// Walk back via prev.
+	i := len(sorted) - 1
+	for n := s.tail; n != nil; n = n.prev {
+		equals(t, sorted[i], n.ssElem)
+		i--
+	}
+	equals(t, -1, i)
+}
@@ -0,0 +1,393 @@
+package rediqueue
+
+// Stream keys: entries ordered by their <ms>-<seq> ID, plus the last ID
+// handed out, which stays when the entries are trimmed or deleted, so IDs
+// are never reused. Consumer groups keep track of what they delivered to
+// which consumer, until it's acknowledged.
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamID is the ID of a stream entry.
+type streamID struct {
+	ms, seq uint64
+}
+
+var (
+	errInvalidStreamID = errors.New(msgInvalidStreamID)
+	maxStreamID        = streamID{math.MaxUint64, math.MaxUint64}
+)
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(o streamID) bool {
+	if id.ms != o.ms {
+		return id.ms < o.ms
+	}
+	return id.seq < o.seq
+}
+
+// next gives the ID right after id. False if id is the last possible one.
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	default:
+		return id, false
+	}
+}
+
+// prev gives the ID right before id. False if id is 0-0.
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	default:
+		return id, false
+	}
+}
+
+// parseStreamID parses "<ms>-<seq>", or "<ms>", which gets seq as its
+// sequence number.
+func parseStreamID(s string, seq uint64) (streamID, error) {
+	ms := s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		ms = s[:i]
+		v, err := strconv.ParseUint(s[i+1:], 10, 64)
+		if err != nil {
+			return streamID{}, errInvalidStreamID
+		}
+		seq = v
+	}
+	v, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	return streamID{v, seq}, nil
+}
+
+// nextStreamID gives the ID for a new entry from an XADD ID argument: "*",
+// "<ms>-*", or an explicit ID, which has to be above last. now is in
+// milliseconds since the epoch, for "*".
+func nextStreamID(last streamID, arg string, now uint64) (streamID, string) {
+	if arg == "*" {
+		if now > last.ms {
+			return streamID{now, 0}, ""
+		}
+		id, ok := last.next()
+		if !ok {
+			return id, msgStreamExhausted
+		}
+		return id, ""
+	}
+	if strings.HasSuffix(arg, "-*") {
+		ms, err := strconv.ParseUint(arg[:len(arg)-2], 10, 64)
+		if err != nil {
+			return streamID{}, msgInvalidStreamID
+		}
+		switch {
+		case ms < last.ms:
+			return streamID{}, msgStreamIDTooSmall
+		case ms == last.ms:
+			if last.seq == math.MaxUint64 {
+				return streamID{}, msgStreamIDTooSmall
+			}
+			return streamID{ms, last.seq + 1}, ""
+		default:
+			return streamID{ms, 0}, ""
+		}
+	}
+	id, err := parseStreamID(arg, 0)
+	if err != nil {
+		return id, msgInvalidStreamID
+	}
+	if id == (streamID{}) {
+		return id, msgStreamIDZero
+	}
+	if !last.less(id) {
+		return id, msgStreamIDTooSmall
+	}
+	return id, ""
+}
+
+// streamEntry is a stream entry, with its field/value pairs.
+type streamEntry struct {
+	id     streamID
+	values []string
+}
+
+// streamKey is a stream. Not safe for concurrent use.
+type streamKey struct {
+	entries []streamEntry // ordered by ID
+	lastID  streamID      // the highest ID ever added
+	groups  map[string]*streamGroup
+}
+
+// streamGroup is a consumer group.
+type streamGroup struct {
+	lastID    streamID        // the last entry delivered to the group
+	pending   []streamPending // delivered, but not acknowledged. Ordered by ID.
+	consumers map[string]*streamConsumer
+}
+
+// streamPending is an entry in the pending entries list of a group. The entry
+// itself might be deleted from the stream by now.
+type streamPending struct {
+	id        streamID
+	consumer  string
+	delivered time.Time // last delivery
+	count     int       // nr of deliveries
+}
+
+// streamConsumer is a consumer in a group. Its pending entries are the ones
+// in the group's list with its name.
+type streamConsumer struct {
+	seen time.Time // last time it read or claimed anything
+}
+
+func newStreamGroup(lastID streamID) *streamGroup {
+	return &streamGroup{
+		lastID:    lastID,
+		consumers: map[string]*streamConsumer{},
+	}
+}
+
+// searchPending gives the index of the first pending entry with an ID not
+// below id.
+func (g *streamGroup) searchPending(id streamID) int {
+	return sort.Search(len(g.pending), func(i int) bool {
+		return !g.pending[i].id.less(id)
+	})
+}
+
+// getPending gives the pending entry with the given ID, or nil.
+func (g *streamGroup) getPending(id streamID) *streamPending {
+	i := g.searchPending(id)
+	if i < len(g.pending) && g.pending[i].id == id {
+		return &g.pending[i]
+	}
+	return nil
+}
+
+// setPending adds or replaces a pending entry.
+func (g *streamGroup) setPending(p streamPending) {
+	i := g.searchPending(p.id)
+	if i < len(g.pending) && g.pending[i].id == p.id {
+		g.pending[i] = p
+		return
+	}
+	g.pending = append(g.pending, streamPending{})
+	copy(g.pending[i+1:], g.pending[i:])
+	g.pending[i] = p
+}
+
+// delPending removes a pending entry. Returns whether it was there.
+func (g *streamGroup) delPending(id streamID) bool {
+	i := g.searchPending(id)
+	if i == len(g.pending) || g.pending[i].id != id {
+		return false
+	}
+	g.pending = append(g.pending[:i], g.pending[i+1:]...)
+	return true
+}
+
+// consumerPending gives the pending entries of a consumer.
+func (g *streamGroup) consumerPending(consumer string) []streamPending {
+	var res []streamPending
+	for _, p := range g.pending {
+		if p.consumer == consumer {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// groupNames gives the names of all groups, sorted.
+func (s *streamKey) groupNames() []string {
+	res := make([]string, 0, len(s.groups))
+	for g := range s.groups {
+		res = append(res, g)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// consumerNames gives the names of all consumers, sorted.
+func (g *streamGroup) consumerNames() []string {
+	res := make([]string, 0, len(g.consumers))
+	for c := range g.consumers {
+		res = append(res, c)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// search gives the index of the first entry with an ID not below id.
+func (s *streamKey) search(id streamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.less(id)
+	})
+}
+
+// get gives the entry with the given ID, if it's there.
+func (s *streamKey) get(id streamID) (streamEntry, bool) {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].id == id {
+		return s.entries[i], true
+	}
+	return streamEntry{}, false
+}
+
+// between gives the entries from start to end, both included, and at most
+// count of them. A negative count is no limit. With reverse it starts at
+// end.
+func (s *streamKey) between(start, end streamID, reverse bool, count int) []streamEntry {
+	if end.less(start) {
+		return nil
+	}
+	from, to := s.search(start), s.search(end)
+	if to < len(s.entries) && s.entries[to].id == end {
+		to++
+	}
+	var res []streamEntry
+	if reverse {
+		for i := to - 1; i >= from && count != 0; i-- {
+			res = append(res, s.entries[i])
+			count--
+		}
+		return res
+	}
+	for i := from; i < to && count != 0; i++ {
+		res = append(res, s.entries[i])
+		count--
+	}
+	return res
+}
+
+// after gives the entries with an ID above id, at most count of them. A
+// negative count is no limit.
+func (s *streamKey) after(id streamID, count int) []streamEntry {
+	next, ok := id.next()
+	if !ok {
+		return nil
+	}
+	return s.between(next, maxStreamID, false, count)
+}
+
+// copy makes a deep copy.
+func (s *streamKey) copy() *streamKey {
+	c := &streamKey{
+		entries: make([]streamEntry, len(s.entries)),
+		lastID:  s.lastID,
+	}
+	for i, e := range s.entries {
+		c.entries[i] = streamEntry{
+			id:     e.id,
+			values: append([]string{}, e.values...),
+		}
+	}
+	for name, g := range s.groups {
+		cg := newStreamGroup(g.lastID)
+		cg.pending = append([]streamPending{}, g.pending...)
+		for cname, cons := range g.consumers {
+			cc := *cons
+			cg.consumers[cname] = &cc
+		}
+		if c.groups == nil {
+			c.groups = map[string]*streamGroup{}
+		}
+		c.groups[name] = cg
+	}
+	return c
+}
+
+// streamTrim is a parsed MAXLEN or MINID option, as for XADD and XTRIM.
+type streamTrim struct {
+	maxLen int      // -1 if not set
+	minID  streamID // used if maxLen is -1
+}
+
+// trimCount gives how many entries, from the start, the option removes.
+func (t streamTrim) trimCount(s *streamKey) int {
+	if t.maxLen >= 0 {
+		if len(s.entries) <= t.maxLen {
+			return 0
+		}
+		return len(s.entries) - t.maxLen
+	}
+	return s.search(t.minID)
+}
+
+// parseStreamTrim parses "MAXLEN|MINID [=|~] threshold [LIMIT count]" at the
+// start of args. Gives the nr of arguments used. Since we always trim
+// exactly, "~" and LIMIT make no difference.
+func parseStreamTrim(args []string) (streamTrim, int, string) {
+	var (
+		t      = streamTrim{maxLen: -1}
+		used   = 1
+		approx = false
+	)
+	if len(args) < 2 {
+		return t, 0, msgSyntaxError
+	}
+	switch args[1] {
+	case "=":
+		used++
+	case "~":
+		approx = true
+		used++
+	}
+	if len(args) <= used {
+		return t, 0, msgSyntaxError
+	}
+	threshold := args[used]
+	used++
+	switch strings.ToUpper(args[0]) {
+	case "MAXLEN":
+		n, err := strconv.Atoi(threshold)
+		if err != nil {
+			return t, 0, msgInvalidInt
+		}
+		if n < 0 {
+			return t, 0, msgStreamMaxlenNeg
+		}
+		t.maxLen = n
+	case "MINID":
+		id, err := parseStreamID(threshold, 0)
+		if err != nil {
+			return t, 0, msgInvalidStreamID
+		}
+		t.minID = id
+	default:
+		return t, 0, msgSyntaxError
+	}
+	if len(args) > used && strings.ToUpper(args[used]) == "LIMIT" {
+		if len(args) <= used+1 {
+			return t, 0, msgSyntaxError
+		}
+		n, err := strconv.Atoi(args[used+1])
+		if err != nil {
+			return t, 0, msgInvalidInt
+		}
+		if n < 0 {
+			return t, 0, msgStreamLimitNeg
+		}
+		if !approx {
+			return t, 0, msgStreamLimitExact
+		}
+		used += 2
+	}
+	return t, used, ""
+}
@@ -0,0 +1,109 @@
+package rediqueue
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNextStreamID(t *testing.T) {
+	last := streamID{10, 5}
+	for _, c := range []struct {
+		arg  string
+		want streamID
+		msg  string
+	}{
+		{"*", streamID{20, 0}, ""},
+		{"10-*", streamID{10, 6}, ""},
+		{"11-*", streamID{11, 0}, ""},
+		{"9-*", streamID{}, msgStreamIDTooSmall},
+		{"10-6", streamID{10, 6}, ""},
+		{"11", streamID{11, 0}, ""},
+		{"10-5", streamID{10, 5}, msgStreamIDTooSmall},
+		{"10", streamID{10, 0}, msgStreamIDTooSmall},
+		{"foo", streamID{}, msgInvalidStreamID},
+		{"1-foo", streamID{}, msgInvalidStreamID},
+		{"foo-*", streamID{}, msgInvalidStreamID},
+	} {
+		id, msg := nextStreamID(last, c.arg, 20)
+		equals(t, c.msg, msg)
+		if msg == "" {
+			equals(t, c.want, id)
+		}
+	}
+
+	// the clock is behind
+	id, msg := nextStreamID(last, "*", 5)
+	equals(t, "", msg)
+	equals(t, streamID{10, 6}, id)
+
+	_, msg = nextStreamID(streamID{}, "0-0", 5)
+	equals(t, msgStreamIDZero, msg)
+	_, msg = nextStreamID(maxStreamID, "*", 5)
+	equals(t, msgStreamExhausted, msg)
+	_, msg = nextStreamID(streamID{3, math.MaxUint64}, "3-*", 5)
+	equals(t, msgStreamIDTooSmall, msg)
+}
+
+func TestStreamKey(t *testing.T) {
+	s := &streamKey{}
+	for _, id := range []streamID{{1, 0}, {1, 1}, {2, 0}, {3, 0}} {
+		s.entries = append(s.entries, streamEntry{id: id})
+		s.lastID = id
+	}
+	ids := func(es []streamEntry) []streamID {
+		var res []streamID
+		for _, e := range es {
+			res = append(res, e.id)
+		}
+		return res
+	}
+
+	equals(t, []streamID{{1, 1}, {2, 0}}, ids(s.between(streamID{1, 1}, streamID{2, 5}, false, -1)))
+	equals(t, []streamID{{2, 0}, {1, 1}}, ids(s.between(streamID{1, 1}, streamID{2, 5}, true, -1)))
+	equals(t, []streamID{{3, 0}}, ids(s.between(streamID{}, maxStreamID, true, 1)))
+	equals(t, []streamID(nil), ids(s.between(streamID{3, 0}, streamID{1, 0}, false, -1)))
+	equals(t, []streamID{{2, 0}, {3, 0}}, ids(s.after(streamID{1, 1}, -1)))
+	equals(t, []streamID(nil), ids(s.after(maxStreamID, -1)))
+
+	_, found := s.get(streamID{1, 1})
+	equals(t, true, found)
+	_, found = s.get(streamID{1, 2})
+	equals(t, false, found)
+
+	equals(t, 2, streamTrim{maxLen: 2}.trimCount(s))
+	equals(t, 0, streamTrim{maxLen: 5}.trimCount(s))
+	equals(t, 2, streamTrim{maxLen: -1, minID: streamID{1, 2}}.trimCount(s))
+
+	c := s.copy()
+	c.entries[0].id = streamID{0, 1}
+	equals(t, streamID{1, 0}, s.entries[0].id)
+}
+
+func TestParseStreamTrim(t *testing.T) {
+	tr, used, msg := parseStreamTrim([]string{"MAXLEN", "~", "10", "LIMIT", "5", "*"})
+	equals(t, "", msg)
+	equals(t, 5, used)
+	equals(t, streamTrim{maxLen: 10}, tr)
+
+	tr, used, msg = parseStreamTrim([]string{"minid", "4-1", "*"})
+	equals(t, "", msg)
+	equals(t, 2, used)
+	equals(t, streamTrim{maxLen: -1, minID: streamID{4, 1}}, tr)
+
+	for _, c := range []struct {
+		args []string
+		msg  string
+	}{
+		{[]string{"MAXLEN"}, msgSyntaxError},
+		{[]string{"MAXLEN", "="}, msgSyntaxError},
+		{[]string{"MAXLEN", "foo"}, msgInvalidInt},
+		{[]string{"MAXLEN", "-1"}, msgStreamMaxlenNeg},
+		{[]string{"MINID", "foo"}, msgInvalidStreamID},
+		{[]string{"MAXLEN", "1", "LIMIT"}, msgSyntaxError},
+		{[]string{"MAXLEN", "~", "1", "LIMIT", "-1"}, msgStreamLimitNeg},
+		{[]string{"MAXLEN", "1", "LIMIT", "1"}, msgStreamLimitExact},
+	} {
+		_, _, msg := parseStreamTrim(c.args)
+		equals(t, c.msg, msg)
+	}
+}
@@ -0,0 +1,364 @@
+package rediqueue
+
+// Snapshot compression and encryption.
+//
+// The flags byte in the snapshot header says which transforms are applied
+// to everything after the header: the low 4 bits are the Compression, and
+// flagEncrypted means the (compressed) data is encrypted:
+//
+//   <salt, 32 bytes>
+//   (<chunk length, 4 bytes big endian> <AES-256-GCM sealed chunk>)...
+//
+// The AES key is HMAC-SHA256(key, salt), so every file has its own key and
+// the nonce can simply be the chunk number. The additional data of every
+// chunk is the header, and a byte which is 1 for the last chunk, so chunks
+// can't be reordered or cut off.
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	flagCompression = 0x0F
+	flagEncrypted   = 0x10
+
+	saltSize  = 32
+	sealChunk = 64 << 10
+
+	// minSnapshotKey is the shortest key SetSnapshotKey() accepts.
+	minSnapshotKey = 16
+)
+
+var (
+	// ErrSnapshotEncrypted is returned when loading an encrypted snapshot
+	// without a key.
+	ErrSnapshotEncrypted = errors.New("snapshot is encrypted, and no key is set")
+	// ErrSnapshotDecrypt is returned when an encrypted snapshot can't be
+	// decrypted: the key is wrong, or the file has been changed.
+	ErrSnapshotDecrypt = errors.New("snapshot decryption failed: wrong key or damaged file")
+)
+
+// Compression is how snapshots are compressed.
+type Compression int
+
+const (
+	// CompressNone doesn't compress. This is the default.
+	CompressNone Compression = iota
+	// CompressGzip uses gzip.
+	CompressGzip
+	// CompressFlate uses raw deflate.
+	CompressFlate
+)
+
+// ParseCompression parses "none", "gzip", or "flate".
+func ParseCompression(s string) (Compression, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return CompressNone, nil
+	case "gzip":
+		return CompressGzip, nil
+	case "flate":
+		return CompressFlate, nil
+	default:
+		return 0, fmt.Errorf("invalid compression: %q", s)
+	}
+}
+
+// SetSnapshotCompression sets how Save() and SnapshotTo() compress
+// snapshots. Load() reads all variants.
+func (m *RediQueue) SetSnapshotCompression(c Compression) {
+	m.Lock()
+	defer m.Unlock()
+	m.snapshotCompression = c
+}
+
+// SetSnapshotKey sets the key to encrypt snapshots written by Save() and
+// SnapshotTo(), and to decrypt them on load. It needs to be at least 16
+// bytes; see ParseSnapshotKey(). A nil key disables encryption.
+func (m *RediQueue) SetSnapshotKey(key []byte) error {
+	if key != nil && len(key) < minSnapshotKey {
+		return fmt.Errorf("snapshot key too short: need at least %d bytes", minSnapshotKey)
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.snapshotKey = key
+	return nil
+}
+
+// ParseSnapshotKey decodes a key given as hex or base64, as in a key file or
+// an environment variable.
+func ParseSnapshotKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, errors.New("snapshot key is neither hex nor base64")
+		}
+	}
+	if len(key) < minSnapshotKey {
+		return nil, fmt.Errorf("snapshot key too short: need at least %d bytes", minSnapshotKey)
+	}
+	return key, nil
+}
+
+// ReadSnapshotKeyFile reads a key file, with the key in hex or base64.
+func ReadSnapshotKeyFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSnapshotKey(string(b))
+}
+
+// snapshotOptions is how a snapshot is written.
+type snapshotOptions struct {
+	format      SnapshotFormat
+	compression Compression
+	key         []byte // encrypt if set
+}
+
+// snapshotOptions gives the current options. Needs the lock.
+func (m *RediQueue) snapshotOptions() snapshotOptions {
+	return snapshotOptions{
+		format:      m.snapshotFormat,
+		compression: m.snapshotCompression,
+		key:         m.snapshotKey,
+	}
+}
+
+func (o snapshotOptions) flags() byte {
+	f := byte(o.compression) & flagCompression
+	if o.key != nil {
+		f |= flagEncrypted
+	}
+	return f
+}
+
+// transformWriter compresses and encrypts everything written to dst after
+// header, which has been written already.
+func transformWriter(dst io.Writer, header []byte, o snapshotOptions) (io.WriteCloser, []byte, error) {
+	var (
+		w       io.Writer = dst
+		closers []io.Closer
+	)
+	if o.key != nil {
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, nil, err
+		}
+		if _, err := dst.Write(salt); err != nil {
+			return nil, nil, err
+		}
+		header = append(append([]byte{}, header...), salt...)
+		aead, err := snapshotAEAD(o.key, salt)
+		if err != nil {
+			return nil, nil, err
+		}
+		sw := &sealWriter{w: dst, aead: aead, header: header}
+		w = sw
+		closers = append(closers, sw)
+	}
+	switch o.compression {
+	case CompressNone:
+	case CompressGzip:
+		zw := gzip.NewWriter(w)
+		w = zw
+		closers = append(closers, zw)
+	case CompressFlate:
+		zw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		w = zw
+		closers = append(closers, zw)
+	default:
+		return nil, nil, fmt.Errorf("invalid compression %d", o.compression)
+	}
+	return &chainWriter{Writer: w, closers: closers}, header, nil
+}
+
+// transformReader undoes transformWriter. r is positioned right after the
+// flags byte.
+func transformReader(r io.Reader, header []byte, flags byte, key []byte) (io.Reader, []byte, error) {
+	if flags&^(flagCompression|flagEncrypted) != 0 {
+		return nil, nil, fmt.Errorf("unsupported snapshot flags %#x", flags)
+	}
+	if flags&flagEncrypted != 0 {
+		if key == nil {
+			return nil, nil, ErrSnapshotEncrypted
+		}
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(r, salt); err != nil {
+			return nil, nil, noEOF(err)
+		}
+		header = append(append([]byte{}, header...), salt...)
+		aead, err := snapshotAEAD(key, salt)
+		if err != nil {
+			return nil, nil, err
+		}
+		r = &openReader{r: r, aead: aead, header: header}
+	}
+	switch Compression(flags & flagCompression) {
+	case CompressNone:
+	case CompressGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, noEOF(err)
+		}
+		r = zr
+	case CompressFlate:
+		r = flate.NewReader(r)
+	default:
+		return nil, nil, fmt.Errorf("unsupported snapshot compression %d", flags&flagCompression)
+	}
+	return r, header, nil
+}
+
+// chainWriter closes a stack of writers, innermost last.
+type chainWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (c *chainWriter) Close() error {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		if err := c.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func snapshotAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+func chunkAD(header []byte, last bool) []byte {
+	ad := append([]byte{}, header...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// sealWriter encrypts in chunks of sealChunk bytes.
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	n      uint64
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	// Keep at least one byte back, the last chunk is written by Close().
+	for len(s.buf) > sealChunk {
+		if err := s.seal(s.buf[:sealChunk], false); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[sealChunk:]
+	}
+	return len(p), nil
+}
+
+func (s *sealWriter) Close() error {
+	return s.seal(s.buf, true)
+}
+
+func (s *sealWriter) seal(p []byte, last bool) error {
+	ct := s.aead.Seal(nil, chunkNonce(s.aead, s.n), p, chunkAD(s.header, last))
+	s.n++
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(len(ct)))
+	if _, err := s.w.Write(l); err != nil {
+		return err
+	}
+	_, err := s.w.Write(ct)
+	return err
+}
+
+// openReader decrypts what sealWriter wrote.
+type openReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	n      uint64
+	last   bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.last {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openReader) open() error {
+	l := make([]byte, 4)
+	if _, err := io.ReadFull(o.r, l); err != nil {
+		return noEOF(err)
+	}
+	size := binary.BigEndian.Uint32(l)
+	if size > sealChunk+uint32(o.aead.Overhead()) {
+		return ErrSnapshotDecrypt
+	}
+	ct := make([]byte, size)
+	if _, err := io.ReadFull(o.r, ct); err != nil {
+		return noEOF(err)
+	}
+	nonce := chunkNonce(o.aead, o.n)
+	for _, last := range []bool{false, true} {
+		if pt, err := o.aead.Open(nil, nonce, ct, chunkAD(o.header, last)); err == nil {
+			o.buf = pt
+			o.last = last
+			o.n++
+			return nil
+		}
+	}
+	return ErrSnapshotDecrypt
+}
+
+// drain reads what's left after the end of a snapshot, which has to be
+// nothing. This makes the decompressor and decryption check their trailers.
+func drain(r io.Reader) error {
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return noEOF(err)
+	}
+	if n != 0 {
+		return ErrBadSnapshot
+	}
+	return nil
+}
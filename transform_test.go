@@ -0,0 +1,144 @@
+package rediqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotTransforms(t *testing.T) {
+	s := NewRediQueue()
+	var jobs []string
+	for i := 0; i < 1000; i++ {
+		jobs = append(jobs, strings.Repeat("payload ", 20)) // > 1 chunk
+	}
+	s.Push("queue", jobs...)
+	s.SetAdd("seen", "a", "b")
+
+	key := bytes.Repeat([]byte{42}, 32)
+	for _, c := range []Compression{CompressNone, CompressGzip, CompressFlate} {
+		for _, k := range [][]byte{nil, key} {
+			var buf bytes.Buffer
+			ok(t, writeSnapshot(&buf, s.dbs, snapshotOptions{compression: c, key: k}))
+			equals(t, byte(c), buf.Bytes()[len(snapshotMagic)+1]&flagCompression)
+			if c != CompressNone || k != nil {
+				assert(t, !bytes.Contains(buf.Bytes(), []byte("payload")), "plain text in %d/%v", c, k != nil)
+			}
+
+			s2 := NewRediQueue()
+			dbs, err := readSnapshot(bytes.NewReader(buf.Bytes()), &s2.Mutex, k)
+			ok(t, err)
+			s2.dbs = dbs
+			s2.CheckList(t, "queue", jobs...)
+			s2.CheckSet(t, "seen", "a", "b")
+		}
+	}
+
+	var buf bytes.Buffer
+	ok(t, writeSnapshot(&buf, s.dbs, snapshotOptions{compression: CompressGzip, key: key}))
+	b := buf.Bytes()
+
+	// No key
+	_, err := readSnapshot(bytes.NewReader(b), nil, nil)
+	equals(t, ErrSnapshotEncrypted, err.(*CorruptError).Err)
+
+	// Wrong key
+	_, err = readSnapshot(bytes.NewReader(b), nil, bytes.Repeat([]byte{1}, 32))
+	equals(t, ErrSnapshotDecrypt, err.(*CorruptError).Err)
+
+	// Changed header
+	{
+		b := append([]byte{}, b...)
+		b[len(snapshotMagic)+2] ^= 0xFF // in the salt
+		_, err = readSnapshot(bytes.NewReader(b), nil, key)
+		equals(t, ErrSnapshotDecrypt, err.(*CorruptError).Err)
+	}
+
+	// Without the last chunk
+	{
+		var plain bytes.Buffer
+		ok(t, writeSnapshot(&plain, s.dbs, snapshotOptions{key: key}))
+		p := plain.Bytes()
+		first := len(snapshotMagic) + 2 + saltSize
+		size := binary.BigEndian.Uint32(p[first:])
+		_, err = readSnapshot(bytes.NewReader(p[:first+4+int(size)]), nil, key)
+		assert(t, err != nil, "no error")
+	}
+}
+
+func TestSnapshotVersion1(t *testing.T) {
+	s := NewRediQueue()
+	s.Push("queue", "one")
+	var buf bytes.Buffer
+	ok(t, writeSnapshot(&buf, s.dbs, snapshotOptions{}))
+
+	// Same thing, without the flags byte.
+	b := buf.Bytes()
+	v1 := append([]byte(snapshotMagic), 1)
+	v1 = append(v1, b[len(snapshotMagic)+2:len(b)-8]...)
+	sum := make([]byte, 8)
+	binary.BigEndian.PutUint64(sum, crc64.Checksum(v1, crcTable))
+	v1 = append(v1, sum...)
+
+	s2 := NewRediQueue()
+	dbs, err := readSnapshot(bytes.NewReader(v1), &s2.Mutex, nil)
+	ok(t, err)
+	s2.dbs = dbs
+	s2.CheckList(t, "queue", "one")
+}
+
+func TestSnapshotKey(t *testing.T) {
+	k, err := ParseSnapshotKey("000102030405060708090a0b0c0d0e0f\n")
+	ok(t, err)
+	equals(t, 16, len(k))
+	k, err = ParseSnapshotKey("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=")
+	ok(t, err)
+	equals(t, 32, len(k))
+	_, err = ParseSnapshotKey("0001")
+	assert(t, err != nil, "no error")
+	_, err = ParseSnapshotKey("not a key!")
+	assert(t, err != nil, "no error")
+
+	c, err := ParseCompression("GZIP")
+	ok(t, err)
+	equals(t, CompressGzip, c)
+	_, err = ParseCompression("zip")
+	assert(t, err != nil, "no error")
+
+	dir, err := ioutil.TempDir("", "rediqueue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	ok(t, ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f"), 0600))
+	key, err := ReadSnapshotKeyFile(keyFile)
+	ok(t, err)
+
+	s := NewRediQueue()
+	s.SetDir(dir)
+	assert(t, s.SetSnapshotKey([]byte("short")) != nil, "no error")
+	ok(t, s.SetSnapshotKey(key))
+	s.SetSnapshotCompression(CompressFlate)
+	s.Push("queue", "secret")
+	ok(t, s.Save())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dump.rdb"))
+	ok(t, err)
+	assert(t, !bytes.Contains(b, []byte("secret")), "plain text")
+
+	s2 := NewRediQueue()
+	s2.SetDir(dir)
+	assert(t, s2.Load() != nil, "no error")
+	ok(t, s2.SetSnapshotKey(key))
+	ok(t, s2.Load())
+	s2.CheckList(t, "queue", "secret")
+	_, err = CheckFile(filepath.Join(dir, "dump.rdb"), key)
+	ok(t, err)
+
+	// RDB files are plain.
+	s.SetSnapshotFormat(SnapshotRDB)
+	assert(t, s.Save() != nil, "no error")
+}